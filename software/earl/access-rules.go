@@ -0,0 +1,81 @@
+// Per-level, per-target access rules, e.g. for a workshop regular users may
+// only use in the afternoon. Targets and levels without a rule get the
+// usual access of the level. Rules only take away access: hours of a rule
+// apply on top of those of the level.
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Access of one level to one target.
+type AccessRule struct {
+	Allowed bool
+	// If set, the hours of access to this target, in addition to the
+	// usual limits of the level, e.g. of guests to their targets. Only
+	// used if Allowed.
+	Hours *HourWindow
+}
+
+type AccessMatrix map[Level]map[Target]AccessRule
+
+// The rule for the level at the target, if any.
+func (m AccessMatrix) Rule(level Level, target Target) (AccessRule, bool) {
+	rule, found := m[level][target]
+	return rule, found
+}
+
+func (m AccessMatrix) validate() error {
+	for level, targets := range m {
+		if !isValidLevel(string(level)) {
+			return fmt.Errorf("Unknown level '%s' in access rules", level)
+		}
+		for target, rule := range targets {
+			if rule.Allowed && rule.Hours != nil {
+				what := string(level) + " at " + string(target)
+				if err := validateHours(what, rule.Hours.From, rule.Hours.To); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Parse rules such as "user:workshop=deny,fulltimeuser:workshop=12-20".
+// A rule is "allow", "deny" or hours.
+func ParseAccessMatrix(spec string) (AccessMatrix, error) {
+	result := make(AccessMatrix)
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(entry, "=")
+		cell := strings.Split(parts[0], ":")
+		if len(parts) != 2 || len(cell) != 2 {
+			return nil, fmt.Errorf("Expected <level>:<target>=<rule>, got '%s'", entry)
+		}
+		level := Level(strings.TrimSpace(cell[0]))
+		target := Target(strings.TrimSpace(cell[1]))
+		var rule AccessRule
+		switch value := strings.TrimSpace(parts[1]); value {
+		case "allow":
+			rule.Allowed = true
+		case "deny":
+			rule.Allowed = false
+		default:
+			window, err := ParseHourWindow(value)
+			if err != nil {
+				return nil, err
+			}
+			rule.Allowed = true
+			rule.Hours = &window
+		}
+		if result[level] == nil {
+			result[level] = make(map[Target]AccessRule)
+		}
+		result[level][target] = rule
+	}
+	if err := result.validate(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
@@ -22,10 +22,14 @@ type AccessHandler struct {
 	t Terminal // Our terminal we can do operations on
 
 	// Current state
-	currentCode        string    // PIN typed so far on keypad
-	lastKeypressTime   time.Time // Last touch of key to reset
-	currentRFID        string    // Current RFID we received
-	nextRFIDActionTime time.Time // Time we have seen the current RFID
+	keypad             *CodeAccumulator // PIN typed so far on keypad
+	currentRFID        string           // Current RFID we received
+	nextRFIDActionTime time.Time        // Time we have seen the current RFID
+
+	// First factor at a target that needs card and PIN.
+	pendingAuth       string // Token from BeginAuth(), empty if none
+	pendingAuthFactor AuthFactor
+	pendingAuthSince  time.Time
 
 	colorShown   bool
 	colorOffTime time.Time
@@ -39,7 +43,8 @@ const (
 func NewAccessHandler(backends *Backends) *AccessHandler {
 	return &AccessHandler{
 		backends: backends,
-		clock:    RealClock{}}
+		clock:    RealClock{},
+		keypad:   NewCodeAccumulator(kKeypadTimeout)}
 }
 
 func (h *AccessHandler) Init(t Terminal) {
@@ -48,26 +53,20 @@ func (h *AccessHandler) Init(t Terminal) {
 func (h *AccessHandler) HandleShutdown() {}
 
 func (h *AccessHandler) HandleKeypress(b byte) {
-	h.lastKeypressTime = h.clock.Now()
-	switch b {
-	case '#':
-		if h.currentCode != "" {
-			h.checkAccess(h.currentCode, "keypad")
-			h.currentCode = ""
-		} else {
-			// As long as we don't have a 4x4 keypad, we
-			// use the single '#' to be the doorbell.
-			h.backends.appEventBus.Post(&AppEvent{
-				Ev:     AppDoorbellTriggerEvent,
-				Target: Target(h.t.GetTerminalName()),
-				Source: h.t.GetTerminalName(),
-				Msg:    "doorbell",
-			})
-		}
-	case '*':
-		h.currentCode = "" // reset
-	default:
-		h.currentCode += string(b)
+	switch event, code := h.keypad.HandleKey(b, h.clock.Now()); event {
+	case CodeSubmitted:
+		h.checkAccess(code, "keypad")
+	case CodeEmptySubmit:
+		// As long as we don't have a 4x4 keypad, we
+		// use the single '#' to be the doorbell.
+		h.backends.appEventBus.Post(&AppEvent{
+			Ev:     AppDoorbellTriggerEvent,
+			Target: Target(h.t.GetTerminalName()),
+			Source: h.t.GetTerminalName(),
+			Msg:    "doorbell",
+		})
+	case CodeMalformed:
+		h.t.BuzzSpeaker("L", 500)
 	}
 }
 
@@ -100,8 +99,13 @@ func (h *AccessHandler) HandleAppEvent(event *AppEvent) {
 func (h *AccessHandler) HandleTick() {
 	now := h.clock.Now()
 	// Keypad got a partial code, but never finished with '#'
-	if now.Sub(h.lastKeypressTime) > kKeypadTimeout && h.currentCode != "" {
-		h.currentCode = ""
+	if event, _ := h.keypad.HandleTick(now); event == CodeMalformed {
+		h.t.BuzzSpeaker("L", 500) // indicate timeout
+	}
+	// The authenticator might allow longer, but someone who doesn't
+	// finish within the keypad timeout starts over.
+	if h.pendingAuth != "" && now.Sub(h.pendingAuthSince) > kKeypadTimeout {
+		h.pendingAuth = ""
 		h.t.BuzzSpeaker("L", 500) // indicate timeout
 	}
 	if h.colorShown && now.After(h.colorOffTime) {
@@ -118,6 +122,29 @@ func scrubLogValue(in string) string {
 	return hex.EncodeToString(hashgen.Sum(nil))[0:6]
 }
 
+// If set, access decisions are logged with a hint of the code.
+var logCodeHints = true
+
+func SetCodeHints(on bool) {
+	logCodeHints = on
+}
+
+// A short hint of the code for logs and events, so that a card that failed
+// at one reader can be recognized at another or in the audit log, without
+// revealing it. Unlike scrubLogValue(), it is peppered like the stored
+// codes, so that short PINs can't be recovered by trying all of them. "-"
+// with hints turned off.
+func codeHint(code string) string {
+	return authCodePepper.hint(code)
+}
+
+func (p codePepper) hint(code string) string {
+	if !logCodeHints {
+		return "-"
+	}
+	return p.hash(code)[0:6]
+}
+
 func (h *AccessHandler) setColorForTime(color string, duration time.Duration) {
 	h.t.ShowColor(color)
 	h.colorShown = true
@@ -127,22 +154,57 @@ func (h *AccessHandler) setColorForTime(color string, duration time.Duration) {
 func (h *AccessHandler) checkAccess(code string, fyi_origin string) {
 	// Don't bother with too short codes. In particular, don't buzz
 	// or flash lights to not to seem overly interactive.
-	if !hasMinimalCodeRequirements(code) {
+	if !hasMinimalCodeRequirements(code, h.backends.authenticator.MinCodeLength()) {
 		return
 	}
 	target := Target(h.t.GetTerminalName())
-	user := h.backends.authenticator.FindUser(code)
-	auth_result, msg := h.backends.authenticator.AuthUser(code, target)
-	if user != nil && auth_result == AuthOk {
+	var user *User
+	var auth_result AuthResult
+	var msg string
+	two_factor, ok := h.backends.authenticator.(TwoFactorAuthenticator)
+	if ok && two_factor.NeedsTwoFactor(target) {
+		user = h.backends.authenticator.FindUser(code)
+		factor := FactorPIN
+		if fyi_origin == "RFID" {
+			factor = FactorCard
+		}
+		if h.pendingAuth == "" || h.pendingAuthFactor == factor {
+			// First factor (again); wait for the other one.
+			token, begin_msg := two_factor.BeginAuth(code, factor, target)
+			h.pendingAuth, h.pendingAuthFactor = token, factor
+			h.pendingAuthSince = h.clock.Now()
+			if token != "" {
+				h.t.BuzzSpeaker("H", 100)
+				return
+			}
+			auth_result, msg = AuthFail, begin_msg
+		} else {
+			auth_result, _, msg = two_factor.CompleteAuth(h.pendingAuth, code, factor)
+			h.pendingAuth = ""
+		}
+	} else {
+		auth_result, user, msg = h.backends.authenticator.AuthUserDetailed(code, target)
+		if user == nil {
+			// Denied; still good to know whose code it was.
+			user = h.backends.authenticator.FindUser(code)
+		}
+	}
+	if auth_result == AuthOk {
 		h.t.BuzzSpeaker("H", 500)
-		// Be sparse, don't log user, but keep track of level.
+		// Be sparse, don't log user, but keep track of level. Without
+		// a user, e.g. for a master code or a door open to all, the
+		// message tells why.
+		what := msg
+		if user != nil {
+			what = string(user.UserLevel)
+		}
 		log.Printf("%s: granted. %s Type=%s",
-			target, fyi_origin, user.UserLevel)
+			target, fyi_origin, what)
 		h.backends.appEventBus.Post(&AppEvent{
 			Ev:     AppOpenRequest,
 			Target: target,
 			Source: h.t.GetTerminalName(),
-			Msg:    "Opening for " + string(user.UserLevel),
+			Msg:    "Opening for " + what,
 		})
 		// Note, this will automatically trigger the green LED as
 		// we subsequently receive the AppOpenRequest ourselves.
@@ -155,8 +217,8 @@ func (h *AccessHandler) checkAccess(code string, fyi_origin string) {
 		// to create a reverse table), but can see patterns when the
 		// same thing happens multiple times.
 		log.Printf("%s: denied. %s | %s (%s)",
-			target, msg, fyi_origin, scrubLogValue(code))
-		if auth_result == AuthFail {
+			target, logUserMessage(msg, user), fyi_origin, codeHint(code))
+		if auth_result == AuthFail || user == nil {
 			h.setColorForTime("R", 500*time.Millisecond)
 		} else {
 			// Show blue (='nighttime') for authentication that is
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -32,6 +34,35 @@ func (a *MockAuthenticator) AuthUser(code string, target Target) (AuthResult, st
 	return result, "MockAuthenticator says: some failure occured"
 }
 
+func (a *MockAuthenticator) AuthUserWithReason(code string, target Target) (AuthResult, AuthReason, string) {
+	result, msg := a.AuthUser(code, target)
+	switch result {
+	case AuthOk:
+		return result, AccessGranted, msg
+	case AuthExpired:
+		return result, AccessDeniedExpired, msg
+	case AuthOkButOutsideTime:
+		return result, AccessDeniedOutsideHours, msg
+	}
+	return result, AccessDeniedUnknownCode, msg
+}
+
+func (a *MockAuthenticator) AuthUserDetailed(code string, target Target) (AuthResult, *User, string) {
+	result, msg := a.AuthUser(code, target)
+	if result != AuthOk {
+		return result, nil, msg
+	}
+	return result, a.FindUser(code), msg
+}
+
+func (a *MockAuthenticator) MinCodeLength() int {
+	return DefaultMinCodeLength
+}
+
+func (a *MockAuthenticator) ValidityRemaining(code string) (time.Duration, bool) {
+	return UnlimitedValidity, true
+}
+
 func (a *MockAuthenticator) AddNewUser(authentication_user string, user User) (bool, string) {
 	return false, ""
 }
@@ -269,5 +300,93 @@ func TestRFIDDebounce(t *testing.T) {
 	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
 }
 
+// Grants if the first factor was allowed and the second is the other type.
+type MockTwoFactorAuthenticator struct {
+	*MockAuthenticator
+	firstFactor AuthFactor
+}
+
+func (a *MockTwoFactorAuthenticator) NeedsTwoFactor(target Target) bool {
+	return true
+}
+
+func (a *MockTwoFactorAuthenticator) BeginAuth(code string, factor AuthFactor, target Target) (string, string) {
+	if result, _ := a.AuthUser(code, target); result != AuthOk {
+		return "", "User does not exist"
+	}
+	a.firstFactor = factor
+	return "token", ""
+}
+
+func (a *MockTwoFactorAuthenticator) CompleteAuth(token string, code string, factor AuthFactor) (AuthResult, AuthReason, string) {
+	if token != "token" || factor == a.firstFactor {
+		return AuthFail, AccessDeniedSecondFactor, "Needs card and PIN."
+	}
+	return a.AuthUserWithReason(code, Target("mock"))
+}
+
+func TestTwoFactorAccess(t *testing.T) {
+	testFixture := NewTestFixture(t)
+	testFixture.mockbackends.authenticator = &MockTwoFactorAuthenticator{
+		MockAuthenticator: testFixture.mockauth}
+	testFixture.mockauth.allow[ACKey{"rfid-123", Target("mock")}] = AuthOk
+	testFixture.mockauth.allow[ACKey{"123456", Target("mock")}] = AuthOk
+
+	// Card alone isn't enough.
+	testFixture.handlerUnderTest.HandleRFID("rfid-123")
+	testFixture.mockterm.expectBuzz(Buzz{"H", 100})
+	testFixture.ExpectNoMoreEvents()
+
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.mockterm.expectBuzz(Buzz{"H", 500})
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+
+	// Starts over after a timeout.
+	mockClock := &MockClock{}
+	testFixture.handlerUnderTest.clock = mockClock
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.mockterm.expectBuzz(Buzz{"H", 100})
+	mockClock.now = mockClock.now.Add(60 * time.Second)
+	testFixture.handlerUnderTest.HandleTick()
+	testFixture.mockterm.expectBuzz(Buzz{"L", 500})
+	PressKeys(testFixture.handlerUnderTest, "123456#")
+	testFixture.mockterm.expectBuzz(Buzz{"H", 100})
+	testFixture.ExpectNoMoreEvents()
+}
+
+// Granted without a user, e.g. for master codes or at doors open to all.
+func TestGrantedWithoutUser(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "handler-master")
+	masterFile, _ := ioutil.TempFile("", "handler-master-codes")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(masterFile.Name())
+	}
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 03:00") // A Friday.
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	defer auth.Close()
+	ioutil.WriteFile(masterFile.Name(), []byte("tech "+hashAuthCode("lift123")+" mock\n"), 0644)
+	ExpectTrue(t, auth.SetMasterCodes(masterFile.Name()) == nil, "Master codes")
+
+	testFixture := NewTestFixture(t)
+	testFixture.mockbackends.authenticator = auth
+	testFixture.handlerUnderTest.HandleRFID("lift123")
+	testFixture.FlushAllAppEvents()
+	testFixture.mockterm.expectBuzz(Buzz{"H", 500})
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+
+	schedules, _ := ParseOpenSchedules("mock=fri 0-24")
+	auth.SetOpenSchedules(schedules)
+	testFixture.FlushAllAppEvents()
+	testFixture.handlerUnderTest.HandleRFID("stranger123")
+	testFixture.FlushAllAppEvents()
+	testFixture.mockterm.expectBuzz(Buzz{"H", 500})
+	testFixture.ExpectEvent(AppOpenRequest, Target("mock"))
+	testFixture.ExpectNoMoreEvents()
+}
+
 // test ideas:
 //  - too short code: don't buzz
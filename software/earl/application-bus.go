@@ -26,16 +26,32 @@ type AppEventType string
 
 const (
 	// Entrance handling events.
-	AppDoorbellTriggerEvent = AppEventType("trigger-bell") // Doorbell triggered for target
-	AppDoorSensorEvent      = AppEventType("door-sensor")  // Target door opened/closed
-	AppOpenRequest          = AppEventType("open")         // Request to open door for target.
-	AppHushBellRequest      = AppEventType("hush-bell")    // Request to snooze bell until given timeout
+	AppDoorbellTriggerEvent = AppEventType("trigger-bell")    // Doorbell triggered for target
+	AppDoorSensorEvent      = AppEventType("door-sensor")     // Target door opened/closed
+	AppOpenRequest          = AppEventType("open")            // Request to open door for target.
+	AppHushBellRequest      = AppEventType("hush-bell")       // Request to snooze bell until given timeout
+	AppHoldOpenRequest      = AppEventType("hold-open")       // Target held open until given timeout
+	AppSpaceStatus          = AppEventType("space-status")    // Space opened (Value=1) until Timeout or closed (Value=0)
+	AppLockdown             = AppEventType("lockdown")        // Lockdown on (Value=1) or lifted (Value=0)
+	AppDuressAlarm          = AppEventType("duress")          // Silent alarm: duress code used at Target
+	AppUsageAlert           = AppEventType("usage-alert")     // User got in Value times today
+	AppMasterOverride       = AppEventType("master-override") // Alarm: master code used at Target
+	AppTargetMode           = AppEventType("target-mode")     // Target open to all (Value=1) or needs a badge (Value=0)
+	AppClockSkew            = AppEventType("clock-skew")      // Clock suspect (Value=1) or right again (Value=0)
 
 	// User management events.
 	AppUserAdded        = AppEventType("user-added")
 	AppUserUpdated      = AppEventType("user-updated")
 	AppUserDeleted      = AppEventType("user-deleted")
 	AppUserFileReloaded = AppEventType("user-file-reloaded")
+	AppUserCountAlert   = AppEventType("user-count-alert")        // Suspicious user count after reload
+	AppUserReloadFailed = AppEventType("user-file-reload-failed") // Value: failures in a row
+	AppCodeAdded        = AppEventType("code-added")              // Audit log only; posted as user-updated
+	AppCodeRemoved      = AppEventType("code-removed")            // Audit log only; posted as user-updated
+	AppUserPromoted     = AppEventType("user-promoted")           // Audit log only; posted as user-updated
+	AppUserElevated     = AppEventType("user-elevated")           // Audit log only
+	AppElevationEnded   = AppEventType("elevation-ended")         // Audit log only
+	AppCodeRevoked      = AppEventType("code-revoked")            // Audit log only
 
 	// terminal/lifetime handling
 	AppEarlStarted        = AppEventType("earl-started")
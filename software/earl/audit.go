@@ -0,0 +1,106 @@
+// Append-only audit log of access decisions and user changes, so that
+// questions like "who got denied at the gate last night" can be answered.
+//
+// One line per entry; each line is written with a single write to a file
+// opened for appending, so concurrent entries never interleave. Codes are
+// never logged in plain, only as scrubbed hint.
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuditLogger struct {
+	lock     sync.Mutex
+	filename string
+	file     *os.File
+}
+
+func NewAuditLogger(filename string) (*AuditLogger, error) {
+	logger := &AuditLogger{filename: filename}
+	if err := logger.Reopen(); err != nil {
+		return nil, err
+	}
+	return logger, nil
+}
+
+// Re-open the file, e.g. after it has been rotated away by logrotate.
+func (l *AuditLogger) Reopen() error {
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = f
+	return nil
+}
+
+func (l *AuditLogger) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// Log an access decision.
+func (l *AuditLogger) LogAccess(event AuthEvent) {
+	decision := "denied"
+	if event.Result == AuthOk {
+		decision = "granted"
+	}
+	entry := fmt.Sprintf("access target=%s result=%s reason=%s user=%q code=%s",
+		event.Target, decision, event.Reason, event.UserName, event.CodeHint)
+	if event.Duress {
+		entry += " duress"
+	}
+	if event.Check {
+		entry += " check"
+	}
+	l.write(event.Timestamp, entry)
+}
+
+// Log a change of a user, e.g. "user-added", done by the given member.
+func (l *AuditLogger) LogUserChange(timestamp time.Time, change AppEventType,
+	by string, user *User) {
+	l.write(timestamp, fmt.Sprintf("%s by=%q user=%q level=%s codes=%d",
+		change, by, user.Name, user.UserLevel, len(user.Codes)))
+}
+
+// Log codes revoked by the given member; what is the code hint or user.
+func (l *AuditLogger) LogRevocation(timestamp time.Time, by string, what string, codes int) {
+	l.write(timestamp, fmt.Sprintf("%s by=%q what=%q codes=%d",
+		AppCodeRevoked, by, what, codes))
+}
+
+// Log the space opening or closing, by the given member or by itself.
+func (l *AuditLogger) LogSpaceStatus(timestamp time.Time, open bool, by string, msg string) {
+	l.write(timestamp, fmt.Sprintf("%s open=%t by=%q msg=%q",
+		AppSpaceStatus, open, by, msg))
+}
+
+// Log a temporary elevation of a user to the given level, or its end.
+func (l *AuditLogger) LogElevation(timestamp time.Time, change AppEventType,
+	by string, userName string, level Level, until time.Time) {
+	l.write(timestamp, fmt.Sprintf("%s by=%q user=%q level=%s until=%s",
+		change, by, userName, level, until.Format("2006-01-02 15:04")))
+}
+
+func (l *AuditLogger) write(timestamp time.Time, entry string) {
+	line := timestamp.Format("2006-01-02 15:04:05 -0700") + " " + entry + "\n"
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file != nil {
+		l.file.Write([]byte(line))
+	}
+}
@@ -0,0 +1,76 @@
+// Live feed of access decisions, e.g. for a dashboard or an audit log.
+//
+// Unlike the ApplicationBus, publishing never blocks: access decisions must
+// not wait for a slow or absent consumer. If a subscriber's buffer is full,
+// the event is dropped for that subscriber and counted.
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const authEventBufferSize = 64
+
+type AuthEvent struct {
+	Timestamp time.Time
+	Target    Target
+	Result    AuthResult
+	Reason    AuthReason
+	UserName  string // Empty for unknown codes.
+	CodeHint  string // See codeHint(); to recognize repeated attempts.
+	Duress    bool   // A duress code was used; see User.DuressCodes.
+	Check     bool   // Only asked if the code would get in; see ReadOnly().
+}
+
+// The event without what tells who it was, for users who want to stay
+// anonymous: only their level, and no code hint that would link their
+// entries.
+func (e AuthEvent) anonymized(level Level) AuthEvent {
+	e.UserName = "anonymous " + string(level)
+	e.CodeHint = ""
+	return e
+}
+
+type authEventFeed struct {
+	lock        sync.Mutex
+	subscribers []chan AuthEvent
+	dropped     int64
+}
+
+func (f *authEventFeed) subscribe() <-chan AuthEvent {
+	channel := make(chan AuthEvent, authEventBufferSize)
+	f.lock.Lock()
+	f.subscribers = append(f.subscribers, channel)
+	f.lock.Unlock()
+	return channel
+}
+
+func (f *authEventFeed) unsubscribe(channel <-chan AuthEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for i, subscriber := range f.subscribers {
+		if subscriber == channel {
+			f.subscribers = append(f.subscribers[:i], f.subscribers[i+1:]...)
+			close(subscriber)
+			return
+		}
+	}
+}
+
+func (f *authEventFeed) publish(event AuthEvent) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, subscriber := range f.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			atomic.AddInt64(&f.dropped, 1)
+		}
+	}
+}
+
+func (f *authEventFeed) droppedCount() int64 {
+	return atomic.LoadInt64(&f.dropped)
+}
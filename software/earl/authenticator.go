@@ -9,20 +9,27 @@
 //
 package main
 
-// TODO
-// - We need the concept of an 'open space'. If the space is open (e.g.
-//   two members state that they are there), then regular users should come
-//   in independent of time.
 import (
+	"context"
 	"crypto/md5"
-	"encoding/csv"
+	"crypto/subtle"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
 )
 
 type AuthResult int
@@ -36,6 +43,80 @@ const (
 	HolidayHiatusEnd     = 1483747200 // 2017-01-07 UTC
 )
 
+// Why access was granted or denied. Finer grained than the AuthResult, e.g.
+// for terminals to show their own messages or to count denials.
+type AuthReason int
+
+const (
+	AccessDeniedOther        = AuthReason(iota) // e.g. unknown level
+	AccessGranted                               // AuthOk
+	AccessDeniedUnknownCode                     // No user with that code
+	AccessDeniedExpired                         // Not yet or no longer valid
+	AccessDeniedOutsideHours                    // Not at this time of day
+	AccessDeniedHiatus                          // User on hiatus
+	AccessDeniedTooShort                        // Code doesn't even qualify
+	AccessDeniedNoTarget                        // No target and no default
+	AccessDeniedLockedOut                       // Too many failures at target
+	AccessDeniedUsedUp                          // Single-use code already used
+	AccessDeniedLockdown                        // Only members during lockdown
+	AccessDeniedDisabled                        // Suspended by an operator
+	AccessDeniedSecondFactor                    // Target needs card and PIN
+	AccessDeniedRevoked                         // On the deny-list
+	AccessGrantedMaster                         // AuthOk with a master code
+	AccessDeniedTimeout                         // Lookup took too long
+	AccessDeniedPassback                        // Entered again without exit
+	AccessDeniedCapacity                        // Maximum occupancy reached
+	AccessGrantedOpen                           // AuthOk: target open to all
+	AccessDeniedTestOnly                        // Canary of the self-test
+	AccessDeniedClockSkew                       // Clock suspect: members only
+)
+
+func (r AuthReason) String() string {
+	switch r {
+	case AccessGranted:
+		return "granted"
+	case AccessDeniedUnknownCode:
+		return "unknown-code"
+	case AccessDeniedExpired:
+		return "expired"
+	case AccessDeniedOutsideHours:
+		return "outside-hours"
+	case AccessDeniedHiatus:
+		return "hiatus"
+	case AccessDeniedTooShort:
+		return "too-short"
+	case AccessDeniedNoTarget:
+		return "no-target"
+	case AccessDeniedLockedOut:
+		return "locked-out"
+	case AccessDeniedUsedUp:
+		return "used-up"
+	case AccessDeniedLockdown:
+		return "lockdown"
+	case AccessDeniedDisabled:
+		return "disabled"
+	case AccessDeniedSecondFactor:
+		return "second-factor"
+	case AccessDeniedRevoked:
+		return "revoked"
+	case AccessGrantedMaster:
+		return "master-override"
+	case AccessDeniedTimeout:
+		return "timeout"
+	case AccessDeniedPassback:
+		return "passback"
+	case AccessDeniedCapacity:
+		return "capacity"
+	case AccessGrantedOpen:
+		return "open-to-all"
+	case AccessDeniedTestOnly:
+		return "test-only"
+	case AccessDeniedClockSkew:
+		return "clock-skew"
+	}
+	return "other"
+}
+
 // Modify a user pointer. Returns 'true' if the changes should be written back.
 type ModifyFun func(user *User) bool
 
@@ -48,6 +129,21 @@ type Authenticator interface {
 	// to access "target" ?
 	AuthUser(code string, target Target) (AuthResult, string)
 
+	// Like AuthUser(), but also tells the reason for the result.
+	AuthUserWithReason(code string, target Target) (AuthResult, AuthReason, string)
+
+	// Like AuthUser(), but also returns a copy of the user if granted,
+	// e.g. to greet them by name. nil if denied.
+	AuthUserDetailed(code string, target Target) (AuthResult, *User, string)
+
+	// Minimum number of characters for a code to be considered at all.
+	MinCodeLength() int
+
+	// How long the code is still valid, e.g. to warn users about expiring
+	// access. UnlimitedValidity if it doesn't expire. Returns false if
+	// there is no user for the code.
+	ValidityRemaining(code string) (time.Duration, bool)
+
 	// Given a valid authentication code of some member (PIN or RFID), add
 	/// the new user object. Updates the file.
 	AddNewUser(authentication_code string, user User) (bool, string)
@@ -64,43 +160,365 @@ type Authenticator interface {
 }
 
 type FileBasedAuthenticator struct {
-	userFilename  string
-	fileTimestamp time.Time  // modification timestamp.
-	fileLock      sync.Mutex // File writing
+	store         UserStore
+	fileTimestamp time.Time    // Version of the store when last read or written.
+	fileLock      sync.RWMutex // Store reading and writing
+
+	// If non-nil, we're notified about changes of the user file
+	// instead of checking its timestamp on each access.
+	watcher     *fsnotify.Watcher
+	watcherDone chan bool
+
+	// If set, the user file is checked periodically by the scheduler
+	// instead of on each access. See StartPeriodicReload().
+	periodicReload bool
+
+	// Runs all our periodic jobs, such as reloads and checks of door
+	// modes and the clock; started with the first. Stopped by Close().
+	scheduler *Scheduler
+
+	// Otherwise, we check on access, but not more often than every
+	// statInterval (0: always). Protected by fileLock; lastStat, in
+	// UnixNano, is atomic, so that lookups don't queue up for it.
+	statInterval time.Duration
+	lastStat     int64
 
 	// List of users and various indexes needed to look-up. Never use
 	// directly, use the ...UserSyncronized() methods.
 	// For modifications, we employ an optimistic concurrency control:
 	// on change operations we determine if we are still in the same
 	// revision when we looked up the item to change.
-	userLock   sync.Mutex       // Mutex to protect following data structures
+	userLock   sync.RWMutex     // Mutex to protect following data structures
 	userList   []*User          // Sequence of users
 	user2index map[*User]int    // user-pointer to index in userList
 	code2user  map[string]*User // access-code to user
 	revision   int              // counter for optimistic locking.
 
+	// If set, we also accept codes with salted hashes, and with
+	// upgradeCodes update md5-hashed codes on use. The salted codes
+	// can't be looked up by hash; tag2codes narrows down which to verify.
+	tag2codes    map[string][]string // Also protected by userLock.
+	codeHasher   *CodeHasher
+	upgradeCodes bool
+
 	eventBus *ApplicationBus
-	clock    Clock // Our source of time. Useful for simulated clock in tests
+	clock    Clock  // Our source of time. Useful for simulated clock in tests
+	logger   Logger // Where our log lines go.
+
+	// Target to use if AuthUser() is called with an empty target. Empty
+	// means: no default, so a missing target is an error.
+	defaultTarget Target
+
+	// Number of users read in the last successful load. If a reload
+	// drops more than the configured number or percent of users, we
+	// alert, as this might be a truncated or badly merged file.
+	loadedUserCount      int
+	reloadDropAlertCount int // 0: disabled
+	reloadDropAlertPct   int // 0: disabled
+
+	// Number of users by level (not expired ones) in the last load. If
+	// below the configured minimum after a reload, we alert and in
+	// strict mode keep the previous data.
+	loadedLevelCounts map[Level]int
+	levelMinimums     map[Level]int
+	strictMinimums    bool
+
+	// Why the last reload has not been used; nil if it has been. Along
+	// with the counts of failed reloads, protected by fileLock.
+	lastReloadError    error
+	failedReloads      int
+	failedReloadsInRow int
+
+	// What was left out of the users in use; protected by fileLock.
+	loadReport LoadReport
+
+	// A reload without any users replacing a non-empty set is rejected,
+	// unless allowed: more likely a file briefly truncated while saved
+	// than a deliberate change. emptyVersion is the version we last
+	// rejected for that, storeMissing tells if the store vanished.
+	allowEmptyReload bool
+	emptyVersion     time.Time
+	storeMissing     bool
+
+	// Where the hours of access windows are meant, usually where the
+	// space is. nil: as the clock says, i.e. time.Local for RealClock.
+	location *time.Location
+
+	// Daytime windows for regular and fulltime users, possibly
+	// different per weekday.
+	accessHours      AccessHours
+	userSchedule     WeeklySchedule
+	fulltimeSchedule WeeklySchedule
+
+	// Subscribers to the live feed of AuthUser() decisions.
+	authEvents authEventFeed
+
+	// If set, access decisions and user changes are recorded here.
+	auditLog *AuditLogger
+
+	// If set, told about access decisions and reloads.
+	metrics Metrics
+
+	// Unknown codes per target, to lock out after too many.
+	failures *failureTracker
+
+	// Recently seen unknown codes, to cheaply reject replayed guesses.
+	unknownCodes *negativeCache
+
+	// Targets that need card and PIN, and the pending authentications.
+	twoFactor *twoFactorTracker
+
+	// Targets open to all at scheduled times, see doormodes.go. Changes
+	// are announced by a job of the scheduler, once there are schedules.
+	doorModes       *doorModeTracker
+	doorModeLock    sync.Mutex
+	doorModeTicking bool
+
+	// Checks if our clock is way off, see clockskew.go.
+	clockSkew *clockSkewChecker
+
+	// Rules for levels at particular targets, overriding the usual
+	// access of the level. Empty: usual access everywhere.
+	accessRules AccessMatrix
+
+	// Users granted access within this time before they expire are told
+	// to renew. 0: off.
+	expiryWarning time.Duration
+
+	// Users getting in less than this before their hours end count as
+	// allowed to be present until this after, see presence.go. 0: off.
+	graceSwipe time.Duration
+
+	// Codes shorter than this, in characters, are rejected right away
+	// and can't be given to new users.
+	minCodeLength int
+
+	// What users on hiatus are told, see SetHiatusMessage().
+	hiatusMessage *template.Template
+
+	// New users valid for longer than this, or without limit, need two
+	// sponsors, see AddNewUserWithSponsors(). 0: off.
+	coSponsorAfter time.Duration
+
+	// Users of level promoteFrom valid for longer than promoteAfter get
+	// promoteTo with their next access. 0: off.
+	promoteAfter time.Duration
+	promoteFrom  Level
+	promoteTo    Level
+
+	// If set, each AuthUser() decision is sent as signed receipt to
+	// the receiptSink. Off by default.
+	receiptKey  []byte
+	receiptSink ReceiptSink
+
+	// In a security incident, only members get in. In memory only, so a
+	// restart clears it.
+	lockdownLock sync.Mutex
+	lockdown     bool
+
+	// When and where users got access. In memory only.
+	activity *activityTracker
+
+	// Users temporarily at another level. In memory only.
+	elevations *elevationTracker
+
+	// Who is in the space, with entry and exit readers. In memory only.
+	presence *presenceTracker
+
+	// Codes revoked for good, checked before looking up the user.
+	revoked *denyList
+
+	// Override codes for maintenance, opening their targets no matter
+	// what. Set before serving; see SetMasterCodes().
+	masterCodes masterCodes
+
+	// Codes are hashed with it, see codePepper. Set when created.
+	pepper codePepper
+
+	// Days only members get in, see holidays.go. nil: none. Read again
+	// with reloadIfChanged().
+	holidays *holidayCalendar
+
+	// Where notable additions and decisions are notified. nil: nowhere.
+	notifications *notifyQueue
+
+	// Targets that are held open, e.g. during an event.
+	holdOpenLock sync.Mutex
+	holdOpen     map[Target]holdOpenState
+
+	// If a member opened the space, regular users get in at any time.
+	// Closes automatically after spaceOpenTimeout, so that nobody
+	// has to remember.
+	spaceOpenLock    sync.Mutex
+	spaceOpenUntil   time.Time // zero: closed
+	spaceOpenedBy    string
+	spaceOpenTimeout time.Duration
+
+	// With that many members present, the space opens by itself, and
+	// closes when the last of them leaves. 0: off. Closing it by hand
+	// holds that off until all members are gone.
+	autoOpenMembers    int
+	autoOpened         bool
+	autoOpenSuppressed bool
+}
+
+// Default time after which an open space closes by itself.
+const defaultSpaceOpenTimeout = 4 * time.Hour
+
+type holdOpenState struct {
+	until  time.Time
+	setBy  string // Name of member who requested it
+	setAt  time.Time
+	reason string
 }
 
+// Authenticator with users stored in the given CSV file, their codes hashed
+// with the pepper; empty for the one of SetAuthCodePepper(), by default the
+// DefaultAuthCodePepper. Returns nil if the users can't be loaded.
 func NewFileBasedAuthenticator(userFilename string,
-	bus *ApplicationBus) *FileBasedAuthenticator {
-	a := &FileBasedAuthenticator{
-		userFilename: userFilename,
-		userList:     make([]*User, 0, 10),
-		user2index:   make(map[*User]int),
-		code2user:    make(map[string]*User),
-		revision:     0,
-		eventBus:     bus,
-		clock:        RealClock{},
+	bus *ApplicationBus, pepper string) *FileBasedAuthenticator {
+	return NewFileBasedAuthenticatorWithClock(userFilename, bus, pepper, RealClock{})
+}
+
+// Like NewFileBasedAuthenticator(), but taking the time from the given clock,
+// e.g. a MockClock to simulate days, DST transitions or year boundaries.
+func NewFileBasedAuthenticatorWithClock(userFilename string,
+	bus *ApplicationBus, pepper string, clock Clock) *FileBasedAuthenticator {
+	store := NewCSVUserStore(userFilename)
+	a, err := loadFileBasedAuthenticator(store, bus, nil, pepper, clock)
+	if err != nil {
+		StdLogger{}.Printf("%v", err)
+		return nil
 	}
+	return a
+}
 
-	if !a.readDatabase() {
+// Authenticator with users kept in the given store. Returns nil if the
+// users can't be loaded.
+func NewFileBasedAuthenticatorWithStore(store UserStore,
+	bus *ApplicationBus) *FileBasedAuthenticator {
+	a, err := LoadFileBasedAuthenticator(store, bus, nil, "")
+	if err != nil {
+		StdLogger{}.Printf("%v", err)
 		return nil
 	}
 	return a
 }
 
+// Like NewFileBasedAuthenticatorWithStore(), but tells why the users can't
+// be loaded. The error wraps the underlying one, so e.g.
+// errors.Is(err, os.ErrNotExist) tells a missing file from other problems.
+// All log lines, from loading on, go to the logger; nil for the standard
+// logger. The pepper is as with NewFileBasedAuthenticator().
+func LoadFileBasedAuthenticator(store UserStore, bus *ApplicationBus,
+	logger Logger, pepper string) (*FileBasedAuthenticator, error) {
+	return loadFileBasedAuthenticator(store, bus, logger, pepper, RealClock{})
+}
+
+// The clock is already needed while loading, e.g. to count valid users.
+func loadFileBasedAuthenticator(store UserStore, bus *ApplicationBus,
+	logger Logger, pepper string, clock Clock) (*FileBasedAuthenticator, error) {
+	if logger == nil {
+		logger = StdLogger{}
+	}
+	codes := authCodePepper
+	if pepper != "" {
+		codes = codePepper(pepper)
+	}
+	a := &FileBasedAuthenticator{
+		store:      store,
+		userList:   make([]*User, 0, 10),
+		user2index: make(map[*User]int),
+		code2user:  make(map[string]*User),
+		tag2codes:  make(map[string][]string),
+		revision:   0,
+		eventBus:   bus,
+		clock:      clock,
+		logger:     logger,
+		pepper:     codes,
+		holdOpen:   make(map[Target]holdOpenState),
+		activity:   newActivityTracker(clock.Now()),
+		elevations: newElevationTracker(),
+		revoked:    newDenyList(),
+		presence:   newPresenceTracker(),
+		failures:   newFailureTracker(),
+
+		unknownCodes:  newNegativeCache(),
+		twoFactor:     newTwoFactorTracker(),
+		doorModes:     newDoorModeTracker(),
+		clockSkew:     newClockSkewChecker(),
+		scheduler:     NewScheduler(clock),
+		minCodeLength: DefaultMinCodeLength,
+		hiatusMessage: defaultHiatusMessage,
+	}
+	a.SetAccessHours(AccessHours{}) // defaults
+	a.spaceOpenTimeout = defaultSpaceOpenTimeout
+
+	if err := a.readDatabase(); err != nil {
+		return nil, fmt.Errorf("Could not read users from %v: %w", store, err)
+	}
+	return a, nil
+}
+
+// Returns an error if we are not in a state to do our job: the users can't
+// be read, there are none, the last reload failed, there are fewer users of
+// some level than the minimums, or the clock is not set (e.g. Raspberry Pi
+// without network after boot) or suspect. For supervisors to restart us
+// instead of silently denying everyone.
+func (a *FileBasedAuthenticator) HealthCheck() error {
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	if csvStore, ok := a.store.(*CSVUserStore); ok {
+		f, err := os.Open(csvStore.Filename())
+		if err != nil {
+			return err
+		}
+		f.Close()
+	} else if versioned, ok := a.store.(VersionedUserStore); ok {
+		if _, err := versioned.Version(); err != nil {
+			return err
+		}
+	}
+	if a.lastReloadError != nil {
+		return a.lastReloadError
+	}
+	a.userLock.RLock()
+	users := len(a.user2index)
+	a.userLock.RUnlock()
+	if users == 0 {
+		return fmt.Errorf("No users loaded from %v", a.store)
+	}
+	// With strict minimums, the reload was rejected and reported above.
+	var short []string
+	for level, minimum := range a.levelMinimums {
+		if count := a.loadedLevelCounts[level]; count < minimum {
+			short = append(short, fmt.Sprintf("%d valid '%s' users, expected at least %d",
+				count, level, minimum))
+		}
+	}
+	if len(short) > 0 {
+		sort.Strings(short)
+		return fmt.Errorf("Only %s in %v", strings.Join(short, ", "), a.store)
+	}
+	if a.clock.Now().Year() < 2015 {
+		return fmt.Errorf("Clock not set: %v", a.clock.Now())
+	}
+	if why := a.clockSkew.suspectWhy(); why != "" {
+		return fmt.Errorf("Clock suspect: %s", why)
+	}
+	return nil
+}
+
+// Records and users left out when loading the users in use, e.g. to show
+// to whoever maintains the user file.
+func (a *FileBasedAuthenticator) LastLoadReport() LoadReport {
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	report := a.loadReport
+	report.lines, report.files = nil, nil
+	return report
+}
+
 func (a *FileBasedAuthenticator) FindUser(plain_code string) *User {
 	user := a.findUserSynchronized(plain_code, nil)
 	if user == nil {
@@ -110,159 +528,2293 @@ func (a *FileBasedAuthenticator) FindUser(plain_code string) *User {
 	return &retval
 }
 
+// Like FindUser(), also telling whether the code is a card or a PIN, as
+// far as known.
+func (a *FileBasedAuthenticator) FindUserWithCodeType(plain_code string) (*User, AuthFactor) {
+	user := a.findUserSynchronized(plain_code, nil)
+	if user == nil {
+		return nil, FactorUnknown
+	}
+	codeType := FactorUnknown
+	if stored := a.storedCode(user.Codes, plain_code); stored != "" {
+		for i, code := range user.Codes {
+			if code == stored {
+				codeType = user.CodeType(i)
+			}
+		}
+	}
+	retval := *user
+	return &retval, codeType
+}
+
 // Iterate through users. The users are a copy, you can't modify them.
 func (a *FileBasedAuthenticator) IterateUsers(callback func(user User)) {
-	for _, user := range a.userList {
-		callback(*user)
+	a.userLock.RLock()
+	users := make([]*User, len(a.userList))
+	copy(users, a.userList)
+	a.userLock.RUnlock()
+	for _, user := range users {
+		if user != nil { // deleted users leave a hole
+			callback(*user)
+		}
 	}
 }
 
-// Check if access for a given code is granted to a given Target
-func (a *FileBasedAuthenticator) AuthUser(code string, target Target) (AuthResult, string) {
-	if !hasMinimalCodeRequirements(code) {
-		return AuthFail, "Auth failed: too short code."
+// All users currently known, e.g. for administrative tools. The users are
+// deep copies, so they can be modified without affecting us.
+func (a *FileBasedAuthenticator) ListUsers() []User {
+	a.reloadIfChanged()
+	a.userLock.RLock()
+	defer a.userLock.RUnlock()
+	result := make([]User, 0, len(a.user2index))
+	for _, user := range a.userList {
+		if user != nil { // deleted users leave a hole
+			result = append(result, user.deepCopy())
+		}
 	}
+	return result
+}
+
+// Remaining validity of codes that don't expire.
+const UnlimitedValidity = time.Duration(math.MaxInt64)
+
+func (a *FileBasedAuthenticator) ValidityRemaining(code string) (time.Duration, bool) {
 	user := a.findUserSynchronized(code, nil)
 	if user == nil {
-		return AuthFail, "No user for code"
+		return 0, false
 	}
-	// In case of Hiatus users, be a bit more specific with logging: this
-	// might be someone stolen a token of some person on leave or attempt
-	// of a blocked user to get access.
-	if user.UserLevel == LevelHiatus {
-		return AuthFail, fmt.Sprintf("User on hiatus '%s <%s>'", user.Name, user.ContactInfo)
+	now := a.clock.Now()
+	expires := user.ExpiryDate(now)
+	if expires.IsZero() {
+		return UnlimitedValidity, true
 	}
-	if !user.InValidityPeriod(a.clock.Now()) {
-		return AuthExpired, "Code not valid yet/expired"
+	if !expires.After(now) {
+		return 0, true
 	}
-	return a.userHasAccess(user, target)
+	return expires.Sub(now), true
 }
 
-func (a *FileBasedAuthenticator) AddNewUser(authentication_code string, user User) (bool, string) {
-	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
-		return false, auth_msg
+// Users whose name contains the query, ignoring case. Meant for operators
+// who only know a name, so no code material is handed out: codes and
+// sponsors, which are hashed codes as well, are left empty. The issue dates
+// still tell how many codes the user has.
+func (a *FileBasedAuthenticator) FindUsersByName(query string) []User {
+	query = strings.ToLower(query)
+	var result []User
+	for _, user := range a.ListUsers() {
+		if !strings.Contains(strings.ToLower(user.Name), query) {
+			continue
+		}
+		user.stripCodes()
+		result = append(result, user)
 	}
+	return result
+}
 
-	// We remember the sponsor who added the user.
-	user.Sponsors = []string{hashAuthCode(authentication_code)}
-	// If no valid from date is given, then this is creation time.
-	if user.ValidFrom.IsZero() {
-		user.ValidFrom = a.clock.Now()
+// Name of the placeholder FindSponsors() returns for sponsors that are
+// not among the users anymore.
+const UnknownSponsorName = "<unknown sponsor>"
+
+// Who vouched for the user with the given name: the users whose (hashed)
+// codes are in its Sponsors, without code material as in FindUsersByName().
+// Sponsors that left, or whose code changed or was salted since, show
+// up as UnknownSponsorName. nil if there is no such user.
+func (a *FileBasedAuthenticator) FindSponsors(userName string) []User {
+	a.reloadIfChanged()
+	a.userLock.RLock()
+	defer a.userLock.RUnlock()
+	for _, user := range a.userList {
+		if user == nil || user.Name != userName {
+			continue
+		}
+		result := []User{}
+		for _, hashed := range user.Sponsors {
+			if hashed == "" {
+				continue // root of it all.
+			}
+			sponsor := a.code2user[hashed]
+			if sponsor == nil {
+				result = append(result, User{Name: UnknownSponsorName})
+				continue
+			}
+			found := sponsor.deepCopy()
+			found.stripCodes()
+			result = append(result, found)
+		}
+		return result
 	}
-	// Are the codes used unique ?
-	if !a.addUserSynchronized(&user) {
-		return false, "Duplicate codes while adding user"
+	return nil
+}
+
+// Lock a target for cooldown after maxFailures unknown codes within window,
+// to make trying codes at a reader impractical. While locked, no code is
+// accepted at that target. A successful access resets the count.
+// maxFailures of 0 disables, which is the default.
+func (a *FileBasedAuthenticator) SetFailureLockout(maxFailures int,
+	window time.Duration, cooldown time.Duration) {
+	a.failures.configure(maxFailures, window, cooldown)
+}
+
+// Remember up to size recently seen unknown codes, so that repeating them
+// is cheap to reject. Any change of the users invalidates them.
+// 0, the default, disables.
+func (a *FileBasedAuthenticator) SetNegativeCacheSize(size int) {
+	a.unknownCodes.configure(size)
+}
+
+// Accept codes hashed with the salted, slow hasher besides the classic md5
+// ones. With upgrade, md5-hashed codes are replaced with salted ones when
+// used; they are written with the next change of the users.
+func (a *FileBasedAuthenticator) SetCodeHasher(hasher *CodeHasher, upgrade bool) {
+	a.codeHasher = hasher
+	a.upgradeCodes = upgrade && hasher != nil
+	a.unknownCodes.clear() // Might be known now.
+}
+
+// Record all access decisions and user changes in the given audit log.
+// nil disables.
+func (a *FileBasedAuthenticator) SetAuditLogger(logger *AuditLogger) {
+	a.auditLog = logger
+}
+
+// Notify additions of users and notable access decisions, see notifier.go.
+// Set before serving; nil to stop notifying.
+func (a *FileBasedAuthenticator) SetNotifier(notifier Notifier) {
+	a.notifications.close()
+	a.notifications = nil
+	if notifier != nil {
+		a.notifications = newNotifyQueue(notifier, a.logger)
 	}
+}
 
-	a.postUserEvent(AppUserAdded, &user)
+// Number of notifications dropped as the notifier couldn't keep up.
+func (a *FileBasedAuthenticator) DroppedNotifications() int {
+	return a.notifications.droppedCount()
+}
 
-	return a.appendDatabaseSingleEntry(&user)
+// Count access decisions and reloads, e.g. with PrometheusMetrics. Tells the
+// number of users loaded so far right away.
+func (a *FileBasedAuthenticator) SetMetrics(metrics Metrics) {
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	a.metrics = metrics
+	metrics.UsersLoaded(a.loadedUserCount)
 }
 
-func (a *FileBasedAuthenticator) UpdateUser(authentication_code string,
-	user_code string, updater_fun ModifyFun) (bool, string) {
-	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelModify); !auth_ok {
-		return false, auth_msg
+// Set the target to be used when AuthUser() is called without one. Useful
+// for simple single-door setups. Set to empty Target to disable.
+func (a *FileBasedAuthenticator) SetDefaultTarget(target Target) {
+	a.defaultTarget = target
+}
+
+// Alert if a reload of the user file results in more than "maxDrop" users
+// fewer than before, or more than "maxDropPercent" percent fewer.
+// A value of 0 disables the respective check.
+func (a *FileBasedAuthenticator) SetReloadDropAlert(maxDrop int, maxDropPercent int) {
+	a.reloadDropAlertCount = maxDrop
+	a.reloadDropAlertPct = maxDropPercent
+}
+
+// Set minimum number of valid users per level we expect after each reload;
+// e.g. we always should have some members, otherwise nobody can add users.
+// If "strict", a reload violating this is rejected and the previous
+// user data is kept.
+func (a *FileBasedAuthenticator) SetLevelMinimums(minimums map[Level]int, strict bool) {
+	a.levelMinimums = minimums
+	a.strictMinimums = strict
+}
+
+// Accept reloads of the user file that have no users at all. Off by
+// default: we rather keep the previous users than lock everyone out.
+func (a *FileBasedAuthenticator) SetAllowEmptyReload(allow bool) {
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	a.allowEmptyReload = allow
+}
+
+// Configure the daytime windows for regular and fulltime users. Windows left
+// at zero get the default hours. Returns an error and leaves the current
+// configuration alone if the hours don't make sense.
+// This replaces a schedule set with SetFulltimeSchedule().
+func (a *FileBasedAuthenticator) SetAccessHours(hours AccessHours) error {
+	hours, err := hours.withDefaults()
+	if err != nil {
+		return err
 	}
+	a.accessHours = hours
+	a.userSchedule = hours.UserSchedule()
+	a.fulltimeSchedule = hours.FulltimeSchedule()
+	return nil
+}
 
-	var previous_revision int
-	orig_user := a.findUserSynchronized(user_code, &previous_revision)
-	modification_copy := *orig_user
-	// Call back the caller asking for modification of this user record. We
-	// hand out a copy to mess with. If updater_fun() decides to not modify
-	// or discard the modification, it can return false and we abort.
-	if !updater_fun(&modification_copy) {
-		return false, "Upate abort."
+// Set rules for access of levels at particular targets, e.g. to deny
+// regular users the workshop. Cells without rule keep the usual access of
+// the level.
+func (a *FileBasedAuthenticator) SetAccessRules(rules AccessMatrix) error {
+	if err := rules.validate(); err != nil {
+		return err
 	}
+	a.accessRules = rules
+	return nil
+}
 
-	// Alright, some modification has been done. Update, but make sure to
-	// only do that if nothing has changed in the meantime.
-	if !a.replaceUserSynchronized(previous_revision, orig_user, &modification_copy) {
-		return false, "Changed while editing."
+// Set the access schedule for fulltime users.
+func (a *FileBasedAuthenticator) SetFulltimeSchedule(schedule WeeklySchedule) {
+	a.fulltimeSchedule = schedule
+}
+
+// Enable signed receipts: each access decision is signed with the given key,
+// and handed to the sink. A nil sink disables receipts.
+func (a *FileBasedAuthenticator) EnableReceipts(key []byte, sink ReceiptSink) {
+	a.receiptKey = key
+	a.receiptSink = sink
+}
+
+// Check if access for a given code is granted to a given Target
+func (a *FileBasedAuthenticator) AuthUser(code string, target Target) (AuthResult, string) {
+	return a.AuthUserCtx(context.Background(), code, target)
+}
+
+// Like AuthUser(), but denies with "auth timed out" if looking up the user
+// takes longer than the context allows, e.g. with a store that needs to
+// be reloaded from a slow database.
+func (a *FileBasedAuthenticator) AuthUserCtx(ctx context.Context, code string, target Target) (AuthResult, string) {
+	result, _, msg := a.authAndRecord(ctx, code, target, "")
+	return result, msg
+}
+
+func (a *FileBasedAuthenticator) AuthUserWithReason(code string, target Target) (AuthResult, AuthReason, string) {
+	return a.authAndRecord(context.Background(), code, target, "")
+}
+
+// Master codes are not users, so they are granted without one.
+func (a *FileBasedAuthenticator) AuthUserDetailed(code string, target Target) (AuthResult, *User, string) {
+	user, result, _, msg := a.authAndRecordUser(context.Background(), code, target, "", false)
+	if result != AuthOk || user == nil {
+		return result, nil, msg
 	}
+	granted := user.deepCopy()
+	return result, &granted, msg
+}
 
-	a.postUserEvent(AppUserUpdated, &modification_copy)
+// Decide and record the decision. If first_factor is set, code is the second
+// factor and needs to be of the user with that identity().
+func (a *FileBasedAuthenticator) authAndRecord(ctx context.Context, code string, target Target,
+	first_factor string) (AuthResult, AuthReason, string) {
+	_, result, reason, msg := a.authAndRecordUser(ctx, code, target, first_factor, false)
+	return result, reason, msg
+}
+
+// As authAndRecord(), also returning the user found for the code, if any.
+// A check only asks whether the code would get in: it is recorded and
+// counts towards the lockout like any decision, but nobody entered, so
+// single-use codes stay unused and there is no receipt.
+func (a *FileBasedAuthenticator) authAndRecordUser(ctx context.Context, code string, target Target,
+	first_factor string, check bool) (*User, AuthResult, AuthReason, string) {
+	if target == "" {
+		target = a.defaultTarget
+	}
+	now := a.clock.Now()
+	a.expireElevations(now)
+	a.updateDoorModes(now)
+	defer a.updateAutoOpen(now)
+	var user *User
+	var result AuthResult
+	var reason AuthReason
+	var msg string
+	duress := false
+	master := ""
+	// Lockout and revoked codes before anything that grants without
+	// looking at the user. Members aren't locked out by the guesses of
+	// others, so while locked, we look at the code.
+	locked, until := a.failures.lockedUntil(string(target), now)
+	if locked && !a.isMemberCode(code) {
+		result, reason = AuthFail, AccessDeniedLockedOut
+		msg = fmt.Sprintf("Too many failed attempts; temporarily locked until %s, try later.",
+			until.Format("15:04:05"))
+	} else if a.revoked.contains(a.pepper.hash(code)) {
+		result, reason, msg = AuthFail, AccessDeniedRevoked, "revoked."
+	} else if master = a.masterCodes.find(a.pepper, code, target); master != "" {
+		result, reason, msg = AuthOk, AccessGrantedMaster, "Master override."
+		a.raiseMasterOverride(master, target)
+		a.notifyAccess(now, target, reason, master,
+			fmt.Sprintf("Master code '%s' used at %s.", master, target))
+	} else if a.TargetMode(target) == DoorOpenToAll {
+		// The door is latched open; no need to look at the code.
+		result, reason, msg = AuthOk, AccessGrantedOpen, "Open to all."
+	} else {
+		user, result, reason, msg = a.authUser(ctx, code, target, first_factor, check)
+		if user != nil && a.isDuressCode(user, code) {
+			duress = true
+			a.raiseDuressAlarm(user, target)
+		}
+		switch reason {
+		case AccessGranted:
+			if !locked { // A member doesn't lift it for the others.
+				a.failures.recordSuccess(string(target))
+			}
+		case AccessDeniedUnknownCode:
+			if a.failures.recordFailure(string(target), now) {
+				a.logger.Printf("%s: too many unknown codes; locking.", target)
+				a.notifyAccess(now, target, AccessDeniedLockedOut, "",
+					fmt.Sprintf("%s locked after too many unknown codes.", target))
+			}
+		case AccessDeniedHiatus:
+			a.notifyAccess(now, target, reason, user.Name,
+				fmt.Sprintf("'%s' on hiatus tried to get in at %s.", user.Name, target))
+		}
+	}
+	if a.receiptSink != nil && !check {
+		a.receiptSink(NewSignedReceipt(a.receiptKey, now,
+			target, a.pepper.hash(code), result))
+	}
+	event := AuthEvent{
+		Timestamp: now,
+		Target:    target,
+		Result:    result,
+		Reason:    reason,
+		CodeHint:  a.pepper.hint(code),
+		Duress:    duress,
+		Check:     check,
+	}
+	if master != "" {
+		event.UserName = master
+	}
+	if user != nil {
+		event.UserName = user.Name
+		if result == AuthOk && !check {
+			a.recordEntry(user, target, now)
+			a.presence.record(user.identity(), user.UserLevel == LevelMember, target,
+				now, a.graceUntil(user, target, now))
+			a.promoteIfDue(user, code, now)
+		}
+		if user.Anonymous && !a.alwaysNamed(event) {
+			event = event.anonymized(user.UserLevel)
+		}
+	}
+	a.authEvents.publish(event)
+	if a.auditLog != nil {
+		a.auditLog.LogAccess(event)
+	}
+	if a.metrics != nil {
+		a.metrics.AuthDecision(target, result, reason)
+		a.metrics.AuthDuration(a.clock.Now().Sub(now))
+	}
+	return user, result, reason, msg
+}
 
-	return a.writeDatabase()
+// If the code is of a member, who still gets in while the target is locked
+// after failed attempts.
+func (a *FileBasedAuthenticator) isMemberCode(code string) bool {
+	user := a.findUserSynchronized(code, nil)
+	return user != nil && user.UserLevel == LevelMember
 }
 
-func (a *FileBasedAuthenticator) DeleteUser(
-	authentication_code string, user_code string) (bool, string) {
-	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
-		return false, auth_msg
+// Decisions that name the user even if they'd rather stay anonymous: a
+// duress code, a revoked code or a user on hiatus, who might be someone
+// with a stolen badge, and anything during lockdown.
+func (a *FileBasedAuthenticator) alwaysNamed(event AuthEvent) bool {
+	return event.Duress || event.Reason == AccessDeniedRevoked ||
+		event.Reason == AccessDeniedHiatus || a.IsLockdown()
+}
+
+// Returns the user found for the code, or nil, along with the decision.
+// With dry_run, nothing is changed, e.g. single-use codes stay unused.
+func (a *FileBasedAuthenticator) authUser(ctx context.Context, code string, target Target,
+	first_factor string, dry_run bool) (*User, AuthResult, AuthReason, string) {
+	if target == "" {
+		return nil, AuthFail, AccessDeniedNoTarget, "No target given and no default target configured."
+	}
+	if !hasMinimalCodeRequirements(code, a.minCodeLength) {
+		return nil, AuthFail, AccessDeniedTooShort, "Auth failed: too short code."
+	}
+	if a.revoked.contains(a.pepper.hash(code)) {
+		return nil, AuthFail, AccessDeniedRevoked, "revoked."
+	}
+	user, err := a.findUserCtx(ctx, code)
+	if err != nil {
+		return nil, AuthFail, AccessDeniedTimeout, "auth timed out"
+	}
+	if user == nil {
+		return nil, AuthFail, AccessDeniedUnknownCode, "No user for code"
+	}
+	if a.revoked.containsSalted(user.indexedCodes()) {
+		// Salted codes are only on the list as stored with the user.
+		return user, AuthFail, AccessDeniedRevoked, "revoked."
+	}
+	if user.TestOnly {
+		return user, AuthFail, AccessDeniedTestOnly, "Test-only code."
+	}
+	if a.upgradeCodes && !dry_run {
+		a.upgradeCode(user, code)
+	}
+	if user.SingleUse && !user.UsedAt.IsZero() {
+		return user, AuthFail, AccessDeniedUsedUp, "Code already used."
+	}
+	result, reason, msg := a.authKnownUser(user, target)
+	if a.clockSkew.membersOnly() {
+		result, reason, msg = clockFailSafe(user, result, reason, msg)
+	}
+	if result == AuthOk && a.twoFactor.required(target) {
+		if first_factor == "" {
+			result, reason, msg = AuthFail, AccessDeniedSecondFactor, "Needs card and PIN."
+		} else if user.identity() != first_factor {
+			result, reason, msg = AuthFail, AccessDeniedSecondFactor, "Card and PIN of different users."
+		}
+	}
+	if result == AuthOk && a.presence.passbackDenied(user.identity(), target, a.clock.Now()) {
+		result, reason, msg = AuthFail, AccessDeniedPassback, "Already in; exit first."
+	}
+	if result == AuthOk && user.UserLevel != LevelMember &&
+		a.presence.atCapacity(user.identity(), target, a.clock.Now()) {
+		result, reason, msg = AuthFail, AccessDeniedCapacity, "at capacity"
+	}
+	if result == AuthOk && user.SingleUse && !dry_run {
+		if ok, used_msg := a.consumeSingleUse(code); !ok {
+			result, reason, msg = AuthFail, AccessDeniedUsedUp, used_msg
+		}
+	}
+	if result != AuthOk && user.DenyMessage != "" {
+		// Some users get a personal note when they can't get in.
+		msg = msg + ": " + user.DenyMessage
+	}
+	if result == AuthOk && a.expiryWarning > 0 {
+		now := a.clock.Now()
+		expires := user.ExpiryDate(now)
+		if !expires.IsZero() && expires.Sub(now) <= a.expiryWarning {
+			msg = "Granted, renew soon: expires " + expires.Format("2006-01-02") + "."
+		}
+	}
+	return user, result, reason, msg
+}
+
+func (a *FileBasedAuthenticator) recordEntry(user *User, target Target, now time.Time) {
+	entries, alert := a.activity.record(user.identity(), target, a.localTime(now))
+	if !alert {
+		return
+	}
+	msg := fmt.Sprintf("'%s' got in %d times today", user.Name, entries)
+	a.logger.Printf("%s", a.pepper.logUserMessage(msg, user))
+	a.eventBus.Post(&AppEvent{
+		Ev:     AppUsageAlert,
+		Target: target,
+		Source: "authenticator",
+		Msg:    msg,
+		Value:  entries,
+	})
+}
+
+// Promote users after their probation, e.g. regular users to fulltime
+// users after 30 days, with their first access after that. Neither level
+// can be hiatus; disabled users are never promoted. 0 to turn off.
+func (a *FileBasedAuthenticator) SetProbation(from Level, to Level, after time.Duration) error {
+	if after > 0 {
+		if !isValidLevel(string(from)) || !isValidLevel(string(to)) || from == to {
+			return fmt.Errorf("Invalid promotion from '%s' to '%s'", from, to)
+		}
+		if from == LevelHiatus || to == LevelHiatus {
+			return errors.New("Users on hiatus are not promoted")
+		}
+	}
+	a.promoteAfter, a.promoteFrom, a.promoteTo = after, from, to
+	return nil
+}
+
+func (a *FileBasedAuthenticator) promoteIfDue(user *User, code string, now time.Time) {
+	if a.promoteAfter <= 0 || !a.dueForPromotion(user, now) {
+		return
+	}
+	var promoted *User // Unless changed meanwhile.
+	ok, msg := a.modifyUser(code, func(user *User) bool {
+		if !a.dueForPromotion(user, now) {
+			return false
+		}
+		user.UserLevel = a.promoteTo
+		promoted = user
+		return true
+	})
+	if promoted == nil {
+		return
+	}
+	if !ok {
+		a.logger.Printf("Could not promote '%s': %s", a.pepper.logName(promoted.Name), msg)
+		return // Next access tries again.
+	}
+	a.logger.Printf("Promoted '%s' to %s after probation.", a.pepper.logName(promoted.Name), a.promoteTo)
+	if a.auditLog != nil {
+		a.auditLog.LogUserChange(now, AppUserPromoted, "", promoted)
+	}
+}
+
+func (a *FileBasedAuthenticator) dueForPromotion(user *User, now time.Time) bool {
+	return user.UserLevel == a.promoteFrom && !user.Disabled &&
+		!user.ValidFrom.IsZero() && now.Sub(user.ValidFrom) >= a.promoteAfter
+}
+
+// Post an AppUsageAlert when a user gets access more often than this on
+// a day, e.g. a shared or cloned card. 0, the default, disables.
+func (a *FileBasedAuthenticator) SetMaxDailyEntries(max int) {
+	a.activity.setMaxDailyEntries(max)
+}
+
+// How often users got in through which target since we started.
+func (a *FileBasedAuthenticator) UsageStats() UsageStats {
+	return a.activity.stats(a.ListUsers())
+}
+
+// When a user with the given name last got access. Returns false if not
+// since we started, which is a restart as this is only kept in memory.
+func (a *FileBasedAuthenticator) LastSeen(userName string) (time.Time, bool) {
+	var result time.Time
+	found := false
+	for _, user := range a.ListUsers() {
+		if user.Name != userName {
+			continue
+		}
+		if seen, ok := a.lastSeenOf(&user); ok && seen.After(result) {
+			result, found = seen, true
+		}
+	}
+	return result, found
+}
+
+// Users that didn't get access for the given time, e.g. candidates for
+// hiatus. Users never seen only count once we have been tracking for that
+// long. Without code material, see FindUsersByName().
+func (a *FileBasedAuthenticator) InactiveSince(d time.Duration) []User {
+	cutoff := a.clock.Now().Add(-d)
+	tracked_long_enough := !a.activity.since.After(cutoff)
+	var result []User
+	for _, user := range a.ListUsers() {
+		if len(user.indexedCodes()) == 0 {
+			continue // Can't get in anyway.
+		}
+		seen, ok := a.lastSeenOf(&user)
+		if (ok && seen.Before(cutoff)) || (!ok && tracked_long_enough) {
+			user.stripCodes()
+			result = append(result, user)
+		}
+	}
+	return result
+}
+
+func (a *FileBasedAuthenticator) lastSeenOf(user *User) (time.Time, bool) {
+	if len(user.indexedCodes()) == 0 {
+		return time.Time{}, false
+	}
+	return a.activity.lastSeen(user.identity())
+}
+
+// Track who is in the space, see presence.go: access at one of the entry
+// targets marks users present until they get access at one of the exit
+// targets, or for idleTimeout if not 0.
+func (a *FileBasedAuthenticator) SetPresenceTargets(entry []Target, exit []Target, idleTimeout time.Duration) {
+	a.presence.configure(entry, exit, idleTimeout)
+}
+
+// Deny entry at the targets to users that entered less than window ago
+// and didn't exit since, see presence.go. Needs entry and exit targets
+// with SetPresenceTargets().
+func (a *FileBasedAuthenticator) SetAntiPassback(targets []Target, window time.Duration) error {
+	if len(targets) > 0 && window <= 0 {
+		return errors.New("Anti-passback needs a window")
+	}
+	a.presence.configurePassback(targets, window)
+	return nil
+}
+
+// Let only members in at entry targets while that many users are present,
+// e.g. the maximum occupancy posted at the door. 0: no limit.
+func (a *FileBasedAuthenticator) SetMaxOccupancy(max int) {
+	a.presence.setMaxOccupancy(max)
+}
+
+// Users that get in less than grace before their hours end count as
+// allowed to be present until grace after the end, see presence.go. Only
+// for reporting who is present; it doesn't let anyone in. 0, the default,
+// disables.
+func (a *FileBasedAuthenticator) SetGraceSwipe(grace time.Duration) {
+	a.graceSwipe = grace
+}
+
+// Until when a user getting in now at the target counts as allowed to be
+// present, if that is a late entry with grace. Zero otherwise.
+func (a *FileBasedAuthenticator) graceUntil(user *User, target Target, now time.Time) time.Time {
+	if a.graceSwipe <= 0 {
+		return time.Time{}
+	}
+	ends, limited := a.accessEndsAt(user, target, now)
+	if !limited || ends.Sub(now) > a.graceSwipe {
+		return time.Time{}
+	}
+	return ends.Add(a.graceSwipe)
+}
+
+// When the access of the user at the target that includes now ends, if it
+// is limited by hours at all: the end of the hours of their level or the
+// access rule, or of their recurring schedule, whichever comes first.
+func (a *FileBasedAuthenticator) accessEndsAt(user *User, target Target, now time.Time) (time.Time, bool) {
+	now = a.localTime(now)
+	var ends time.Time
+	endOfWindow := func(window HourWindow) {
+		if !window.Contains(now.Hour()) {
+			return
+		}
+		end := time.Date(now.Year(), now.Month(), now.Day(), window.To, 0, 0, 0, now.Location())
+		if ends.IsZero() || end.Before(ends) {
+			ends = end
+		}
+	}
+	if user.UserLevel == LevelUser || user.UserLevel == LevelFulltimeUser {
+		endOfWindow(a.AccessWindowAt(user, now))
+	}
+	if rule, found := a.accessRules.Rule(user.UserLevel, target); found && rule.Hours != nil {
+		endOfWindow(*rule.Hours)
+	}
+	if end, found := user.Schedule.EndOf(now); found && (ends.IsZero() || end.Before(ends)) {
+		ends = end
+	}
+	return ends, !ends.IsZero()
+}
+
+// The users present that are not allowed to be by now: they wouldn't get
+// in where they entered, and are not within the grace of a late entry.
+// Without their codes.
+func (a *FileBasedAuthenticator) presentUnauthorized(now time.Time) []User {
+	present := a.presence.entriesAt(now)
+	var result []User
+	if len(present) == 0 {
+		return result
+	}
+	for _, user := range a.ListUsers() {
+		if len(user.indexedCodes()) == 0 {
+			continue
+		}
+		entry, found := present[user.identity()]
+		if !found || now.Before(entry.graceUntil) {
+			continue
+		}
+		if decision, _, _ := a.authKnownUser(&user, entry.target); decision == AuthOk {
+			continue
+		}
+		user.stripCodes()
+		result = append(result, user)
+	}
+	return result
+}
+
+// The users present that would be denied if they swiped now where they
+// entered, e.g. still in after closing, without their codes. Users within
+// the grace of a late entry are not listed, see SetGraceSwipe(). Only
+// members can ask.
+func (a *FileBasedAuthenticator) UnauthorizedPresent(memberCode string) ([]User, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return nil, auth_msg
+	}
+	return a.presentUnauthorized(a.clock.Now()), ""
+}
+
+// Number of users present, see SetPresenceTargets().
+func (a *FileBasedAuthenticator) Occupancy() int {
+	return a.presence.occupancy(a.clock.Now())
+}
+
+// The users in the space, without their codes.
+func (a *FileBasedAuthenticator) WhoIsPresent() []User {
+	present := a.presence.presentAt(a.clock.Now())
+	var result []User
+	if len(present) == 0 {
+		return result
+	}
+	for _, user := range a.ListUsers() {
+		if len(user.indexedCodes()) > 0 && present[user.identity()] {
+			user.stripCodes()
+			result = append(result, user)
+		}
+	}
+	return result
+}
+
+func (a *FileBasedAuthenticator) IsPresent(userName string) bool {
+	for _, user := range a.WhoIsPresent() {
+		if user.Name == userName {
+			return true
+		}
+	}
+	return false
+}
+
+// Nobody is present anymore, e.g. after the last one locked up.
+func (a *FileBasedAuthenticator) ClearPresence() {
+	a.presence.clear()
+	a.logger.Printf("Presence cleared.")
+	a.updateAutoOpen(a.clock.Now())
+}
+
+// Open the space once that many members are present at the same time, see
+// SetPresenceTargets(), and close it when the last of them leaves. 0: off.
+func (a *FileBasedAuthenticator) SetAutoOpen(members int) {
+	a.spaceOpenLock.Lock()
+	defer a.spaceOpenLock.Unlock()
+	a.autoOpenMembers = members
+}
+
+// Default of members that need to be present for SetAutoOpen(): two
+// members stating that they are there.
+const DefaultAutoOpenMembers = 2
+
+func (a *FileBasedAuthenticator) updateAutoOpen(now time.Time) {
+	members := a.presence.membersAt(now)
+	a.spaceOpenLock.Lock()
+	if a.autoOpenMembers <= 0 {
+		a.spaceOpenLock.Unlock()
+		return
+	}
+	var msg string
+	value := 0
+	switch {
+	case members == 0:
+		a.autoOpenSuppressed = false
+		if a.autoOpened {
+			a.autoOpened = false
+			a.spaceOpenUntil = time.Time{}
+			msg = "Space closed: last member left"
+		}
+	case a.autoOpened:
+		// Still open as long as members are around.
+		a.spaceOpenUntil = now.Add(a.spaceOpenTimeout)
+	case members >= a.autoOpenMembers && !a.autoOpenSuppressed &&
+		(a.spaceOpenUntil.IsZero() || !now.Before(a.spaceOpenUntil)):
+		a.autoOpened = true
+		a.spaceOpenUntil = now.Add(a.spaceOpenTimeout)
+		a.spaceOpenedBy = "presence"
+		msg = fmt.Sprintf("Space opened: %d members present", members)
+		value = 1
+	}
+	until := a.spaceOpenUntil
+	a.spaceOpenLock.Unlock()
+	if msg == "" {
+		return
+	}
+	a.logger.Printf("%s", msg)
+	if a.auditLog != nil {
+		a.auditLog.LogSpaceStatus(now, value == 1, "", msg)
+	}
+	event := &AppEvent{
+		Ev:     AppSpaceStatus,
+		Source: "authenticator",
+		Msg:    msg,
+		Value:  value,
+	}
+	if value == 1 {
+		event.Timeout = until
+	}
+	a.eventBus.Post(event)
+}
+
+// Require card and PIN for the given targets, e.g. a server room, see
+// BeginAuth(). The second factor has to follow within timeout.
+func (a *FileBasedAuthenticator) SetTwoFactorTargets(targets []Target, timeout time.Duration) {
+	a.twoFactor.configure(targets, timeout)
+}
+
+func (a *FileBasedAuthenticator) NeedsTwoFactor(target Target) bool {
+	if target == "" {
+		target = a.defaultTarget
+	}
+	return a.twoFactor.required(target)
+}
+
+// First factor for a target that needs two. Only checks that the target
+// isn't locked and the code long enough; the decision is made by
+// CompleteAuth(), so that nothing is told before the second factor: codes
+// that are unknown or not of the factor get a token as well, that never
+// completes.
+func (a *FileBasedAuthenticator) BeginAuth(code string, factor AuthFactor, target Target) (string, string) {
+	if target == "" {
+		target = a.defaultTarget
+	}
+	now := a.clock.Now()
+	if locked, _ := a.failures.lockedUntil(string(target), now); locked && !a.isMemberCode(code) {
+		return "", "Too many failed attempts; try later."
+	}
+	if !hasMinimalCodeRequirements(code, a.minCodeLength) {
+		return "", "Auth failed: too short code."
+	}
+	identity, stored := unknownIdentity, ""
+	if user := a.findUserSynchronized(code, nil); user == nil {
+		if a.failures.recordFailure(string(target), now) {
+			a.logger.Printf("%s: too many unknown codes; locking.", target)
+		}
+	} else {
+		if a.isDuressCode(user, code) {
+			a.raiseDuressAlarm(user, target)
+		}
+		if factor_code, is_factor := a.factorCode(user, code, factor); is_factor {
+			identity, stored = user.identity(), factor_code
+		}
+	}
+	token := a.twoFactor.begin(identity, stored, factor, target, now)
+	if token == "" {
+		return "", "Too many pending authentications."
+	}
+	return token, ""
+}
+
+// Second factor: grants if the code is of the other factor, of the same
+// user, and that user has access to the target. Both codes need to be
+// known as of their factor, see User.CodeTypes.
+func (a *FileBasedAuthenticator) CompleteAuth(token string, code string, factor AuthFactor) (AuthResult, AuthReason, string) {
+	pending := a.twoFactor.take(token, a.clock.Now())
+	if pending == nil {
+		return AuthFail, AccessDeniedSecondFactor, "No pending authentication or it expired."
+	}
+	if pending.factor == factor {
+		return AuthFail, AccessDeniedSecondFactor, "Needs card and PIN."
+	}
+	if a.codeMatches(pending.code, code) {
+		return AuthFail, AccessDeniedSecondFactor, "Same code twice; needs card and PIN."
+	}
+	if user := a.findUserSynchronized(code, nil); user != nil {
+		// Of another user, authUser() tells.
+		if _, is_factor := a.factorCode(user, code, factor); !is_factor &&
+			user.identity() == pending.identity {
+			return AuthFail, AccessDeniedSecondFactor,
+				fmt.Sprintf("Code is not known as %s.", factor)
+		}
+	}
+	return a.authAndRecord(context.Background(), code, pending.target, pending.identity)
+}
+
+// Subscribe to the live feed of access decisions. Never blocks access
+// decisions: if the channel is full, events are dropped and counted in
+// DroppedAuthEvents().
+func (a *FileBasedAuthenticator) Events() <-chan AuthEvent {
+	return a.authEvents.subscribe()
+}
+
+// Stop sending events to a channel returned by Events(), and close it.
+func (a *FileBasedAuthenticator) StopEvents(channel <-chan AuthEvent) {
+	a.authEvents.unsubscribe(channel)
+}
+
+// Number of events dropped as a subscriber didn't keep up.
+func (a *FileBasedAuthenticator) DroppedAuthEvents() int64 {
+	return a.authEvents.droppedCount()
+}
+
+func (a *FileBasedAuthenticator) authKnownUser(user *User, target Target) (AuthResult, AuthReason, string) {
+	if user.Disabled {
+		return AuthFail, AccessDeniedDisabled, "account disabled"
+	}
+	if user.UserLevel != LevelMember && a.IsLockdown() {
+		return AuthFail, AccessDeniedLockdown, "space in lockdown."
+	}
+	// In case of Hiatus users, be a bit more specific with logging: this
+	// might be someone stolen a token of some person on leave or attempt
+	// of a blocked user to get access.
+	if user.UserLevel == LevelHiatus {
+		return AuthFail, AccessDeniedHiatus, hiatusMessage(a.hiatusMessage, user, target)
+	}
+	if !user.InValidityPeriod(a.clock.Now()) {
+		return AuthExpired, AccessDeniedExpired, "Code not valid yet/expired"
+	}
+	if user.Schedule != nil && !user.Schedule.Contains(a.localTime(a.clock.Now())) {
+		return AuthOkButOutsideTime, AccessDeniedOutsideHours,
+			"Outside of your scheduled times (" + user.Schedule.String() + ")"
+	}
+	if level, elevated := a.elevations.level(user.identity(), a.clock.Now()); elevated {
+		effective := *user
+		effective.UserLevel = level
+		user = &effective
+	}
+	result, msg := a.userHasAccess(user, target)
+	switch result {
+	case AuthOk:
+		return result, AccessGranted, msg
+	case AuthOkButOutsideTime:
+		return result, AccessDeniedOutsideHours, msg
+	}
+	return result, AccessDeniedOther, msg
+}
+
+// Let the user with the given name get in like a user of the given level
+// until the given time, e.g. for hosting an event. Replaces an earlier
+// elevation of the user. Needs a member; in memory only.
+func (a *FileBasedAuthenticator) ElevateUser(authentication_code string,
+	userName string, toLevel Level, until time.Time) (bool, string) {
+	member, auth_msg := a.verifiedMember(authentication_code, CanLevelAdminister)
+	if member == nil {
+		return false, auth_msg
+	}
+	if !isValidLevel(string(toLevel)) || toLevel == LevelHiatus {
+		return false, fmt.Sprintf("Can't elevate to '%s'.", toLevel)
+	}
+	now := a.clock.Now()
+	if !until.After(now) {
+		return false, "Elevation needs to end in the future."
+	}
+	user, msg := a.findUserByNameSynchronized(userName, nil)
+	if user == nil {
+		return false, msg
+	}
+	if len(user.indexedCodes()) == 0 {
+		return false, "User has no codes."
+	}
+	if user.UserLevel == LevelHiatus || user.Disabled {
+		return false, "User on hiatus or disabled."
+	}
+	a.elevations.set(user.identity(), elevation{
+		name: user.Name, level: toLevel, until: until, by: member.Name})
+	a.logger.Printf("'%s' elevated '%s' to %s until %s", a.pepper.logName(member.Name),
+		a.pepper.logName(user.Name), toLevel, until.Format("2006-01-02 15:04"))
+	if a.auditLog != nil {
+		a.auditLog.LogElevation(now, AppUserElevated, member.Name, user.Name, toLevel, until)
+	}
+	return true, ""
+}
+
+// Elevations are over once their time is; the audit log gets their end
+// at that time, even if we only notice with the next access.
+func (a *FileBasedAuthenticator) expireElevations(now time.Time) {
+	for _, e := range a.elevations.expire(now) {
+		a.logger.Printf("Elevation of '%s' to %s ended", a.pepper.logName(e.name), e.level)
+		if a.auditLog != nil {
+			a.auditLog.LogElevation(e.until, AppElevationEnded, e.by, e.name, e.level, e.until)
+		}
+	}
+}
+
+// Keep revoked codes in the file, reading the ones in it. Without it, they
+// are only kept in memory.
+func (a *FileBasedAuthenticator) SetDenyList(filename string) error {
+	list, err := loadDenyList(filename)
+	if err != nil {
+		return err
+	}
+	a.revoked = list
+	return nil
+}
+
+// Revoke the code for good, e.g. of a badge reported stolen. Members only.
+// Takes effect right away, whether or not a user has the code.
+func (a *FileBasedAuthenticator) RevokeCode(authentication_code string, code string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAdminister); !auth_ok {
+		return false, auth_msg
+	}
+	if code == "" {
+		return false, "No code to revoke."
+	}
+	return a.revoke(authentication_code, a.pepper.hint(code), a.pepper.hint(code), []string{a.pepper.hash(code)})
+}
+
+// Revoke all codes of the user, including the duress codes. The user stays
+// in the users file, but none of the codes gets in anymore.
+func (a *FileBasedAuthenticator) RevokeUserCodes(authentication_code string, userName string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAdminister); !auth_ok {
+		return false, auth_msg
+	}
+	user, msg := a.findUserByNameSynchronized(userName, nil)
+	if user == nil {
+		return false, msg
+	}
+	codes := user.indexedCodes()
+	if len(codes) == 0 {
+		return false, "User has no codes."
+	}
+	return a.revoke(authentication_code, fmt.Sprintf("user %q", user.Name),
+		fmt.Sprintf("user %q", a.pepper.logName(user.Name)), codes)
+}
+
+// What is revoked is described as in the audit log and, redacted, in the
+// general log.
+func (a *FileBasedAuthenticator) revoke(authentication_code string, what string, logWhat string,
+	hashes []string) (bool, string) {
+	by := ""
+	if member := a.findUserSynchronized(authentication_code, nil); member != nil {
+		by = member.Name
+	}
+	now := a.clock.Now()
+	err := a.revoked.add(fmt.Sprintf("%s by %q at %s", what, by, now.Format(time.RFC3339)), hashes)
+	a.logger.Printf("'%s' revoked %s (%d codes)", a.pepper.logName(by), logWhat, len(hashes))
+	if a.auditLog != nil {
+		a.auditLog.LogRevocation(now, by, what, len(hashes))
+	}
+	if err != nil {
+		a.logger.Printf("Could not write deny-list: %v", err)
+		return false, "Revoked until restart, but could not write deny-list: " + err.Error()
+	}
+	return true, ""
+}
+
+func (a *FileBasedAuthenticator) AddNewUser(authentication_code string, user User) (bool, string) {
+	return a.AddNewUserWithSponsors([]string{authentication_code}, user)
+}
+
+// Like AddNewUser(), but with the codes of several sponsoring members, all
+// of which are recorded. With SetCoSponsorAfter(), long-term users need
+// two different sponsors.
+func (a *FileBasedAuthenticator) AddNewUserWithSponsors(authentication_codes []string, user User) (bool, string) {
+	return a.addNewUser(authentication_codes, user, false)
+}
+
+// Check if AddNewUserWithSponsors() would succeed, with the same checks
+// and messages, but without adding the user. E.g. for a UI to tell before
+// the user is written.
+func (a *FileBasedAuthenticator) ValidateNewUser(authentication_codes []string, user User) (bool, string) {
+	return a.addNewUser(authentication_codes, user, true)
+}
+
+func (a *FileBasedAuthenticator) addNewUser(authentication_codes []string, user User, dry_run bool) (bool, string) {
+	if msg := a.prepareNewUser(authentication_codes, &user); msg != "" {
+		return false, msg
+	}
+	if dry_run {
+		code, owner := a.codeOwnerSynchronized(&user)
+		if owner != nil {
+			return false, "Duplicate codes while adding user: " +
+				duplicateCodeMessage(&user, code, owner)
+		}
+		return true, ""
+	}
+	// Are the codes used unique ?
+	if code, owner := a.addUserSynchronized(&user); owner != nil {
+		return false, "Duplicate codes while adding user: " +
+			duplicateCodeMessage(&user, code, owner)
+	}
+
+	if ok, msg := a.appendUser(&user); !ok {
+		a.removeUserSynchronized(&user)
+		return false, "Could not write new user: " + msg
+	}
+
+	a.auditUserChange(AppUserAdded, authentication_codes[0], &user)
+	a.postUserEvent(AppUserAdded, &user)
+	a.notifyUserAdded(authentication_codes[0], &user)
+	return true, ""
+}
+
+func (a *FileBasedAuthenticator) notifyUserAdded(member_code string, user *User) {
+	if a.notifications == nil {
+		return
+	}
+	event := NotifyEvent{
+		Timestamp: a.clock.Now(),
+		Kind:      NotifyUserAdded,
+		UserName:  user.Name,
+	}
+	if member := a.findUserSynchronized(member_code, nil); member != nil {
+		event.By = member.Name
+	}
+	if user.UserLevel == LevelGuest {
+		event.Kind = NotifyGuestAdded
+		event.Msg = fmt.Sprintf("'%s' added guest '%s' until %s.", event.By,
+			user.Name, user.ValidTo.Format("2006-01-02 15:04"))
+	} else {
+		event.Msg = fmt.Sprintf("'%s' added '%s' as %s.", event.By, user.Name, user.UserLevel)
+	}
+	a.notifications.send(event)
+}
+
+// Check that the sponsors may add the user and fill in what we record when
+// adding. Returns why not, empty if ok. Uniqueness of the codes is up to
+// the caller.
+func (a *FileBasedAuthenticator) prepareNewUser(authentication_codes []string, user *User) string {
+	if len(authentication_codes) == 0 {
+		return "No sponsor for new user."
+	}
+	for i, code := range authentication_codes {
+		if auth_ok, auth_msg := a.verifyOpAllowed(code, CanLevelAddDelete); !auth_ok {
+			return auth_msg
+		}
+		for _, other := range authentication_codes[:i] {
+			if a.isSameUser(code, other) {
+				return "Sponsors need to be different members."
+			}
+		}
+	}
+
+	if msg := checkNewUserCodes(user.Codes); msg != "" {
+		return msg
+	}
+	for _, code := range user.DuressCodes {
+		if !isHashedCode(code) {
+			return "Duress code of new user is not hashed"
+		}
+	}
+
+	// We remember the sponsors who added the user.
+	user.Sponsors = make([]string, len(authentication_codes))
+	for i, code := range authentication_codes {
+		user.Sponsors[i] = a.pepper.hash(code)
+	}
+	// If no valid from date is given, then this is creation time.
+	if user.ValidFrom.IsZero() {
+		user.ValidFrom = a.clock.Now()
+	}
+	if len(authentication_codes) < 2 && a.needsCoSponsor(user) {
+		return "Long-term user needs a second sponsor."
+	}
+	user.stampCodeIssueDates(nil, a.clock.Now())
+	return ""
+}
+
+// Add a batch of users, e.g. after a membership drive, with the same checks
+// as AddNewUser(), also against codes used twice within the batch, but
+// writing the store only once. Returns how many users were added and why
+// the others were not. If atomic, a single failing user fails all.
+func (a *FileBasedAuthenticator) ImportUsers(authentication_code string, users []User,
+	atomic bool) (int, []string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
+		return 0, []string{auth_msg}
+	}
+	var failures []string
+	var batch []*User
+	batchCodes := make(map[string]*User)
+	for i := range users {
+		user := users[i]
+		fail := func(msg string) {
+			failures = append(failures, fmt.Sprintf("User %d '%s': %s", i+1, user.Name, msg))
+		}
+		if msg := a.prepareNewUser([]string{authentication_code}, &user); msg != "" {
+			fail(msg)
+			continue
+		}
+		if code, owner := a.codeOwnerSynchronized(&user); owner != nil {
+			fail(duplicateCodeMessage(&user, code, owner))
+			continue
+		}
+		var batchOwner *User
+		for _, code := range user.indexedCodes() {
+			if batchOwner = batchCodes[code]; batchOwner != nil {
+				fail(duplicateCodeMessage(&user, code, batchOwner) + " (in this import)")
+				break
+			}
+		}
+		if batchOwner != nil {
+			continue
+		}
+		for _, code := range user.indexedCodes() {
+			batchCodes[code] = &user
+		}
+		batch = append(batch, &user)
+	}
+	if len(batch) == 0 || (atomic && len(failures) > 0) {
+		return 0, failures
+	}
+
+	// Someone might have added codes since we checked.
+	var added []*User
+	for _, user := range batch {
+		if code, owner := a.addUserSynchronized(user); owner != nil {
+			failures = append(failures, fmt.Sprintf("User '%s': %s", user.Name,
+				duplicateCodeMessage(user, code, owner)))
+			if atomic {
+				for _, user := range added {
+					a.removeUserSynchronized(user)
+				}
+				return 0, failures
+			}
+			continue
+		}
+		added = append(added, user)
+	}
+	if ok, msg := a.writeAllUsers(); !ok {
+		for _, user := range added {
+			a.removeUserSynchronized(user)
+		}
+		return 0, append(failures, "Could not write new users: "+msg)
+	}
+	for _, user := range added {
+		a.auditUserChange(AppUserAdded, authentication_code, user)
+		a.postUserEvent(AppUserAdded, user)
+	}
+	return len(added), failures
+}
+
+// Whether both codes belong to the same user, e.g. their RFID and PIN.
+func (a *FileBasedAuthenticator) isSameUser(code string, other_code string) bool {
+	user := a.findUserSynchronized(code, nil)
+	other := a.findUserSynchronized(other_code, nil)
+	return user != nil && other != nil && user.identity() == other.identity()
+}
+
+// New users that will be valid longer than coSponsorAfter, or without
+// limit, need a second sponsor.
+func (a *FileBasedAuthenticator) needsCoSponsor(user *User) bool {
+	if a.coSponsorAfter <= 0 {
+		return false
+	}
+	now := a.clock.Now()
+	expires := user.ExpiryDate(now)
+	return expires.IsZero() || expires.Sub(now) > a.coSponsorAfter
+}
+
+// Add a guest with the given code and name, that has access to the target
+// for validFor from now on. Needs the same authorization as AddNewUser().
+func (a *FileBasedAuthenticator) AddGuest(authentication_code string,
+	guest_code string, name string, validFor time.Duration, target Target) (bool, string) {
+	if validFor <= 0 {
+		return false, "Guest pass needs a validity."
+	}
+	if target == "" {
+		return false, "Guest pass needs a target."
+	}
+	now := a.clock.Now()
+	guest := User{
+		Name:      name,
+		UserLevel: LevelGuest,
+		ValidFrom: now,
+		ValidTo:   now.Add(validFor),
+		Targets:   []Target{target},
+	}
+	if err := guest.setAuthCode(guest_code, a.minCodeLength, a.pepper); err != nil {
+		return false, "Guest code " + err.Error() + "."
+	}
+	return a.AddNewUser(authentication_code, guest)
+}
+
+// Forget guests whose pass has expired, so that they don't accumulate.
+// They are gone from the store as well with the next full write.
+func (a *FileBasedAuthenticator) dropExpiredGuestsRequiresLock(now time.Time) {
+	dropped := 0
+	for _, user := range a.userList {
+		if user != nil && user.UserLevel == LevelGuest &&
+			!user.ValidTo.IsZero() && !user.ValidTo.After(now) {
+			a.deleteUserRequiresLock(user)
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		a.logger.Printf("Dropped %d expired guest passes.", dropped)
+	}
+}
+
+func (a *FileBasedAuthenticator) UpdateUser(authentication_code string,
+	user_code string, updater_fun ModifyFun) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelModify); !auth_ok {
+		return false, auth_msg
+	}
+	var updated *User
+	ok, msg := a.modifyUser(user_code, func(user *User) bool {
+		if !updater_fun(user) {
+			return false
+		}
+		updated = user
+		return true
+	})
+	if ok {
+		a.auditUserChange(AppUserUpdated, authentication_code, updated)
+	}
+	return ok, msg
+}
+
+func (a *FileBasedAuthenticator) auditUserChange(change AppEventType,
+	member_code string, user *User) {
+	if a.auditLog == nil {
+		return
+	}
+	by := ""
+	if member := a.findUserSynchronized(member_code, nil); member != nil {
+		by = member.Name
+	}
+	a.auditLog.LogUserChange(a.clock.Now(), change, by, user)
+}
+
+// Modify user found by user_code. Caller has to make sure the operation
+// is allowed.
+func (a *FileBasedAuthenticator) modifyUser(user_code string, updater_fun ModifyFun) (bool, string) {
+	var previous_revision int
+	orig_user := a.findUserSynchronized(user_code, &previous_revision)
+	if orig_user == nil {
+		return false, "No user for code"
+	}
+	return a.modifyFoundUser(orig_user, previous_revision, updater_fun)
+}
+
+// Like modifyUser(), for a user looked up at previous_revision.
+func (a *FileBasedAuthenticator) modifyFoundUser(orig_user *User,
+	previous_revision int, updater_fun ModifyFun) (bool, string) {
+	modification_copy := *orig_user
+	// Call back the caller asking for modification of this user record. We
+	// hand out a copy to mess with. If updater_fun() decides to not modify
+	// or discard the modification, it can return false and we abort.
+	if !updater_fun(&modification_copy) {
+		return false, "Upate abort."
+	}
+	modification_copy.stampCodeIssueDates(orig_user, a.clock.Now())
+
+	// Alright, some modification has been done. Update, but make sure to
+	// only do that if nothing has changed in the meantime.
+	if ok, msg := a.replaceUserSynchronized(previous_revision, orig_user, &modification_copy); !ok {
+		return false, msg
+	}
+
+	// Keep memory and disk in sync: if we can't write, don't keep it.
+	if ok, msg := a.writeAllUsers(); !ok {
+		a.restoreUserSynchronized(&modification_copy, orig_user)
+		return false, "Could not write update: " + msg
+	}
+
+	a.postUserEvent(AppUserUpdated, &modification_copy)
+	return true, ""
+}
+
+// Mark a single-use code as used, and write that, so that not even a reload
+// brings it back. Returns false if it has been used already or if we can't
+// record that; better to deny than to let the code work more than once.
+func (a *FileBasedAuthenticator) consumeSingleUse(code string) (bool, string) {
+	for attempt := 0; attempt < 3; attempt++ {
+		already_used := false
+		ok, msg := a.modifyUser(code, func(user *User) bool {
+			if !user.UsedAt.IsZero() {
+				already_used = true
+				return false
+			}
+			user.UsedAt = a.clock.Now()
+			return true
+		})
+		switch {
+		case ok:
+			return true, ""
+		case already_used:
+			return false, "Code already used."
+		case msg != "Changed while editing.":
+			return false, "Could not record use of single-use code: " + msg
+		}
+		// Someone else changed the users meanwhile; maybe the same
+		// code swiped twice. Look again.
+	}
+	return false, "Could not record use of single-use code."
+}
+
+// Keep the target unlocked until the given time, e.g. during an event, so
+// that no swipe is needed. An "until" in the past ends a hold-open early.
+// Not during a lockdown, which ends all hold-opens.
+func (a *FileBasedAuthenticator) HoldTargetOpen(memberCode string, target Target,
+	until time.Time, reason string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return false, auth_msg
+	}
+	if until.After(a.clock.Now()) && a.IsLockdown() {
+		return false, "Not during a lockdown."
+	}
+	member := a.findUserSynchronized(memberCode, nil)
+	now := a.clock.Now()
+	a.holdOpenLock.Lock()
+	if until.After(now) {
+		a.holdOpen[target] = holdOpenState{
+			until:  until,
+			setBy:  member.Name,
+			setAt:  now,
+			reason: reason,
+		}
+	} else {
+		delete(a.holdOpen, target)
+	}
+	a.holdOpenLock.Unlock()
+
+	msg := fmt.Sprintf("%s held open until %s by '%s': %s", target,
+		until.Format("2006-01-02 15:04"), member.Name, reason)
+	a.logger.Printf("%s", a.pepper.logUserMessage(msg, member))
+	a.eventBus.Post(&AppEvent{
+		Ev:      AppHoldOpenRequest,
+		Target:  target,
+		Source:  "authenticator",
+		Msg:     msg,
+		Timeout: until,
+	})
+	return true, ""
+}
+
+// Returns true if the target is currently held open. Never during a
+// lockdown.
+func (a *FileBasedAuthenticator) IsTargetHeldOpen(target Target) bool {
+	if a.IsLockdown() {
+		return false
+	}
+	a.holdOpenLock.Lock()
+	defer a.holdOpenLock.Unlock()
+	state, found := a.holdOpen[target]
+	if !found {
+		return false
+	}
+	if !a.clock.Now().Before(state.until) {
+		a.logger.Printf("%s: hold-open by '%s' since %s expired", target,
+			a.pepper.logName(state.setBy), state.setAt.Format("2006-01-02 15:04"))
+		delete(a.holdOpen, target)
+		return false
+	}
+	return true
+}
+
+// Open the targets to all during the windows of their schedule, see
+// doormodes.go; other targets always need a badge. Replaces earlier
+// schedules. Changes of the mode are checked every minute and with each
+// access, and posted as AppTargetMode events.
+func (a *FileBasedAuthenticator) SetOpenSchedules(schedules map[Target]RecurringSchedule) {
+	a.doorModes.configure(schedules)
+	a.doorModeLock.Lock()
+	if !a.doorModeTicking && len(schedules) > 0 {
+		a.every(doorModeTick, func() { a.updateDoorModes(a.clock.Now()) })
+		a.doorModeTicking = true
+	}
+	a.doorModeLock.Unlock()
+	a.updateDoorModes(a.clock.Now())
+}
+
+// Whether the target is currently open to all or needs a badge. During a
+// lockdown, all targets need a badge.
+func (a *FileBasedAuthenticator) TargetMode(target Target) DoorMode {
+	if a.IsLockdown() {
+		return DoorBadgeRequired
+	}
+	return a.doorModes.mode(target, a.localTime(a.clock.Now()))
+}
+
+func (a *FileBasedAuthenticator) updateDoorModes(now time.Time) {
+	for _, change := range a.doorModes.changes(a.localTime(now), a.IsLockdown()) {
+		msg := fmt.Sprintf("%s needs a badge again", change.target)
+		if change.mode == DoorOpenToAll {
+			msg = fmt.Sprintf("%s open to all (%s)", change.target, change.schedule)
+		}
+		a.logger.Printf("%s", msg)
+		a.eventBus.Post(&AppEvent{
+			Ev:     AppTargetMode,
+			Target: change.target,
+			Source: "authenticator",
+			Msg:    msg,
+			Value:  int(change.mode),
+		})
+	}
+}
+
+// Check every few minutes if our clock is more than threshold behind the
+// last change of the users file, or off the time of the source if not
+// nil. While it is, a warning is logged with each check, and with
+// failSafe, only members get in. A threshold of 0 disables the check.
+func (a *FileBasedAuthenticator) SetClockSkewCheck(threshold time.Duration,
+	source TimeSource, failSafe bool) {
+	c := a.clockSkew
+	c.lock.Lock()
+	c.threshold, c.source, c.failSafe = threshold, source, failSafe
+	if !c.ticking && threshold > 0 {
+		a.every(clockSkewInterval, func() { a.CheckClock() })
+		c.ticking = true
+	}
+	c.lock.Unlock()
+	a.CheckClock()
+}
+
+// Compare our clock now, see SetClockSkewCheck(). Returns false if it is
+// suspect.
+func (a *FileBasedAuthenticator) CheckClock() bool {
+	now := a.clock.Now()
+	a.fileLock.Lock()
+	fileVersion := a.fileTimestamp
+	a.fileLock.Unlock()
+	why := a.clockSkew.check(now, fileVersion)
+	changed := a.clockSkew.setSuspect(why)
+	if why == "" {
+		if changed {
+			a.logger.Printf("Clock looks right again.")
+			a.eventBus.Post(&AppEvent{
+				Ev:     AppClockSkew,
+				Source: "authenticator",
+				Msg:    "Clock looks right again",
+				Value:  0,
+			})
+		}
+		return true
+	}
+	msg := "WARNING: clock suspect, " + why
+	if a.clockSkew.membersOnly() {
+		msg += "; only members get in until it is fixed"
+	}
+	a.logger.Printf("%s", msg)
+	if changed {
+		a.eventBus.Post(&AppEvent{
+			Ev:     AppClockSkew,
+			Source: "authenticator",
+			Msg:    msg,
+			Value:  1,
+		})
+	}
+	return false
+}
+
+// Grant access with a "renew soon" message to users that expire within
+// the given time. Doesn't change the decision. 0, the default, disables.
+func (a *FileBasedAuthenticator) SetExpiryWarning(warning time.Duration) {
+	a.expiryWarning = warning
+}
+
+// Require two different sponsoring members for new users that are valid
+// for longer than the given time, or without limit. Anonymous cards, which
+// expire soon, still only need one. 0, the default, disables.
+func (a *FileBasedAuthenticator) SetCoSponsorAfter(after time.Duration) {
+	a.coSponsorAfter = after
+}
+
+// Set the minimum length of codes in characters (not bytes). Applies to
+// codes given to new users as well as to authentication; existing users
+// with shorter codes are locked out when raising it.
+func (a *FileBasedAuthenticator) SetMinCodeLength(length int) error {
+	if length < 1 {
+		return fmt.Errorf("Minimum code length needs to be positive, got %d", length)
+	}
+	a.minCodeLength = length
+	return nil
+}
+
+// Set the template of what users on hiatus are told when trying to get
+// in, see hiatusmessage.go for the fields. Their contact info only shows if
+// the template asks for it.
+func (a *FileBasedAuthenticator) SetHiatusMessage(text string) error {
+	tmpl, err := parseHiatusMessage(text)
+	if err != nil {
+		return fmt.Errorf("Hiatus message: %v", err)
+	}
+	a.hiatusMessage = tmpl
+	return nil
+}
+
+func (a *FileBasedAuthenticator) MinCodeLength() int {
+	return a.minCodeLength
+}
+
+// Set the time after which an open space closes by itself if not given in
+// OpenSpace().
+func (a *FileBasedAuthenticator) SetSpaceOpenTimeout(timeout time.Duration) {
+	a.spaceOpenLock.Lock()
+	defer a.spaceOpenLock.Unlock()
+	a.spaceOpenTimeout = timeout
+}
+
+// Open the space to regular users independent of their time of day. A
+// member responsible for the space does that when they are around. The
+// space closes automatically after the given timeout, or if that is zero,
+// the configured default.
+func (a *FileBasedAuthenticator) OpenSpace(memberCode string, timeout time.Duration) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return false, auth_msg
+	}
+	member := a.findUserSynchronized(memberCode, nil)
+	a.spaceOpenLock.Lock()
+	if timeout <= 0 {
+		timeout = a.spaceOpenTimeout
+	}
+	until := a.clock.Now().Add(timeout)
+	a.spaceOpenUntil = until
+	a.spaceOpenedBy = member.Name
+	a.autoOpened = false // Stays open until then, members or not.
+	a.spaceOpenLock.Unlock()
+
+	msg := fmt.Sprintf("Space opened by '%s' until %s", member.Name,
+		until.Format("2006-01-02 15:04"))
+	a.logger.Printf("%s", a.pepper.logUserMessage(msg, member))
+	if a.auditLog != nil {
+		a.auditLog.LogSpaceStatus(a.clock.Now(), true, member.Name, msg)
+	}
+	a.eventBus.Post(&AppEvent{
+		Ev:      AppSpaceStatus,
+		Source:  "authenticator",
+		Msg:     msg,
+		Value:   1,
+		Timeout: until,
+	})
+	return true, ""
+}
+
+// Deny everyone but members at all targets, e.g. in a security incident,
+// or lift that again. Takes effect with the next access decision; targets
+// held open are closed right away. Not persisted: a restart lifts it.
+func (a *FileBasedAuthenticator) SetLockdown(memberCode string, on bool) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return false, auth_msg
+	}
+	member := a.findUserSynchronized(memberCode, nil)
+	a.lockdownLock.Lock()
+	a.lockdown = on
+	a.lockdownLock.Unlock()
+	defer a.updateDoorModes(a.clock.Now()) // After the lockdown event.
+
+	msg := fmt.Sprintf("Lockdown lifted by '%s'", member.Name)
+	value := 0
+	if on {
+		msg = fmt.Sprintf("Lockdown by '%s': members only", member.Name)
+		value = 1
+	}
+	a.logger.Printf("%s", a.pepper.logUserMessage(msg, member))
+	a.eventBus.Post(&AppEvent{
+		Ev:     AppLockdown,
+		Source: "authenticator",
+		Msg:    msg,
+		Value:  value,
+	})
+	if on {
+		a.endHoldOpens("lockdown")
+	}
+	return true, ""
+}
+
+// End all hold-opens right away, so that no door stays latched. Posted
+// like a hold-open that expires now.
+func (a *FileBasedAuthenticator) endHoldOpens(why string) {
+	now := a.clock.Now()
+	a.holdOpenLock.Lock()
+	held := make([]Target, 0, len(a.holdOpen))
+	for target := range a.holdOpen {
+		held = append(held, target)
+	}
+	a.holdOpen = make(map[Target]holdOpenState)
+	a.holdOpenLock.Unlock()
+	sort.Slice(held, func(i, j int) bool { return held[i] < held[j] })
+	for _, target := range held {
+		msg := fmt.Sprintf("%s no longer held open: %s", target, why)
+		a.logger.Printf("%s", msg)
+		a.eventBus.Post(&AppEvent{
+			Ev:      AppHoldOpenRequest,
+			Target:  target,
+			Source:  "authenticator",
+			Msg:     msg,
+			Timeout: now,
+		})
+	}
+}
+
+func (a *FileBasedAuthenticator) IsLockdown() bool {
+	a.lockdownLock.Lock()
+	defer a.lockdownLock.Unlock()
+	return a.lockdown
+}
+
+// Close the space again; regular users are back to their usual hours.
+func (a *FileBasedAuthenticator) CloseSpace(memberCode string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return false, auth_msg
+	}
+	member := a.findUserSynchronized(memberCode, nil)
+	a.spaceOpenLock.Lock()
+	a.spaceOpenUntil = time.Time{}
+	if a.autoOpened {
+		a.autoOpened = false
+		a.autoOpenSuppressed = true
+	}
+	a.spaceOpenLock.Unlock()
+
+	msg := fmt.Sprintf("Space closed by '%s'", member.Name)
+	if a.auditLog != nil {
+		a.auditLog.LogSpaceStatus(a.clock.Now(), false, member.Name, msg)
+	}
+	a.logger.Printf("%s", a.pepper.logUserMessage(msg, member))
+	a.eventBus.Post(&AppEvent{
+		Ev:     AppSpaceStatus,
+		Source: "authenticator",
+		Msg:    msg,
+		Value:  0,
+	})
+	return true, ""
+}
+
+// Returns true if the space is currently open to regular users.
+func (a *FileBasedAuthenticator) IsSpaceOpen() bool {
+	a.updateAutoOpen(a.clock.Now()) // Members may have timed out.
+	a.spaceOpenLock.Lock()
+	defer a.spaceOpenLock.Unlock()
+	if a.spaceOpenUntil.IsZero() {
+		return false
+	}
+	if !a.clock.Now().Before(a.spaceOpenUntil) {
+		a.logger.Printf("Space opened by '%s' closed automatically at %s",
+			a.pepper.logName(a.spaceOpenedBy), a.spaceOpenUntil.Format("2006-01-02 15:04"))
+		a.spaceOpenUntil = time.Time{}
+		a.autoOpened = false
+		return false
+	}
+	return true
+}
+
+// Return all users whose badge needs to be printed: they never had one,
+// or their name or level changed since it was printed. Only users with
+// contact info are considered; anonymous temporary cards don't get badges.
+func (a *FileBasedAuthenticator) UsersNeedingBadges(memberCode string) ([]User, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return nil, auth_msg
+	}
+	var result []User
+	a.IterateUsers(func(user User) {
+		if user.HasContactInfo() && user.NeedsBadgePrint() {
+			result = append(result, user)
+		}
+	})
+	return result, ""
+}
+
+// Remember that the badge for the user with "targetCode" has been printed
+// with the current information.
+func (a *FileBasedAuthenticator) MarkBadgePrinted(memberCode string, targetCode string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return false, auth_msg
+	}
+	now := a.clock.Now()
+	return a.modifyUser(targetCode, func(user *User) bool {
+		user.MarkBadgePrinted(now)
+		return true
+	})
+}
+
+func (a *FileBasedAuthenticator) DeleteUser(
+	authentication_code string, user_code string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
+		return false, auth_msg
+	}
+
+	revoker := a.findUserSynchronized(authentication_code, nil)
+	var revision int
+	user := a.findUserSynchronized(user_code, &revision)
+	if user == nil {
+		return false, "No user for code"
+	}
+	user_index, msg := a.deleteUserSynchronized(revision, user)
+	if user_index < 0 {
+		return false, msg
+	}
+
+	// Only forget about the user if we could persist that.
+	if ok, msg := a.writeAllUsers(); !ok {
+		a.reinsertUserSynchronized(user, user_index)
+		return false, "Could not write deletion: " + msg
+	}
+
+	a.logger.Printf("Audit: '%s' deleted user '%s' (level %s, %d code(s))",
+		a.pepper.logName(revoker.Name), a.pepper.logName(user.Name), user.UserLevel, len(user.Codes))
+	if a.auditLog != nil {
+		a.auditLog.LogUserChange(a.clock.Now(), AppUserDeleted, revoker.Name, user)
+	}
+	a.postUserEvent(AppUserDeleted, user)
+	return true, ""
+}
+
+// Give the user with the given name another code, e.g. a replacement for a
+// lost card. The code must not be used by anyone yet.
+func (a *FileBasedAuthenticator) AddCodeToUser(authentication_code string,
+	userName string, newCode string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
+		return false, auth_msg
+	}
+	if err := checkCodeStrength(newCode, a.minCodeLength); err != nil {
+		return false, "New code " + err.Error() + "."
+	}
+	// Also finds codes stored salted, which the index check when
+	// replacing the user can't.
+	if owner := a.findUserSynchronized(newCode, nil); owner != nil {
+		return false, fmt.Sprintf("Code already used by '%s'.", owner.Name)
+	}
+	var revision int
+	user, msg := a.findUserByNameSynchronized(userName, &revision)
+	if user == nil {
+		return false, msg
+	}
+	hashed := a.pepper.hash(newCode)
+	var updated *User
+	ok, msg := a.modifyFoundUser(user, revision, func(user *User) bool {
+		user.Codes = append(append([]string(nil), user.Codes...), hashed)
+		updated = user
+		return true
+	})
+	if !ok {
+		return false, msg
+	}
+	a.logger.Printf("Audit: code added to '%s', now %d code(s)",
+		a.pepper.logName(userName), len(updated.Codes))
+	a.auditUserChange(AppCodeAdded, authentication_code, updated)
+	return true, ""
+}
+
+// Revoke a single code of the user with the given name, e.g. of a lost
+// card. Users can't lose their last code this way; use DeleteUser() or
+// BulkRevokeCodesBefore() for that.
+func (a *FileBasedAuthenticator) RemoveCodeFromUser(authentication_code string,
+	userName string, code string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAddDelete); !auth_ok {
+		return false, auth_msg
+	}
+	var revision int
+	user := a.findUserSynchronized(code, &revision)
+	if user == nil || user.Name != userName {
+		return false, "User has no such code."
+	}
+	stored := a.storedCode(user.Codes, code)
+	if stored == "" {
+		return false, "User has no such code." // e.g. a duress code.
+	}
+	if len(user.Codes) < 2 {
+		return false, "Can't remove the last code of a user."
+	}
+	var updated *User
+	ok, msg := a.modifyFoundUser(user, revision, func(user *User) bool {
+		var remaining []string
+		for _, existing := range user.Codes {
+			if existing != stored {
+				remaining = append(remaining, existing)
+			}
+		}
+		user.Codes = remaining
+		updated = user
+		return true
+	})
+	if !ok {
+		return false, msg
+	}
+	a.logger.Printf("Audit: code removed from '%s', now %d code(s)",
+		a.pepper.logName(userName), len(updated.Codes))
+	a.auditUserChange(AppCodeRemoved, authentication_code, updated)
+	return true, ""
+}
+
+// Which of the stored codes the plain code is, or empty if none.
+func (a *FileBasedAuthenticator) storedCode(codes []string, plain_code string) string {
+	legacy := a.pepper.hash(plain_code)
+	for _, stored := range codes {
+		if stored == legacy {
+			return stored
+		}
+		if isSaltedCode(stored) && a.codeHasher != nil &&
+			a.codeHasher.Verify(plain_code, stored) {
+			return stored
+		}
+	}
+	return ""
+}
+
+// The user with exactly that name. Returns nil and why if there is none, or
+// more than one.
+func (a *FileBasedAuthenticator) findUserByNameSynchronized(name string, rev *int) (*User, string) {
+	a.reloadIfChanged()
+	a.userLock.RLock()
+	defer a.userLock.RUnlock()
+	var result *User
+	for _, user := range a.userList {
+		if user == nil || user.Name != name {
+			continue
+		}
+		if result != nil {
+			return nil, "Several users with that name."
+		}
+		result = user
+	}
+	if result == nil {
+		return nil, "No user with that name."
+	}
+	if rev != nil {
+		*rev = a.revision
+	}
+	return result, ""
+}
+
+// Revoke all codes that have been issued before the given time, e.g. after a
+// batch of cards or a reader got compromised. Users left without codes stay
+// in the database, but NeedsCodeReissue(). Codes with unknown issue date
+// (issued before we kept track) are left alone; so are duress codes, which
+// have no issue date: set them again with SetDuressCode() if needed.
+// Returns the number of revoked codes. If the users can't be written,
+// nothing is revoked.
+func (a *FileBasedAuthenticator) BulkRevokeCodesBefore(memberCode string,
+	issuedBefore time.Time) (revoked int, err error) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return 0, errors.New(auth_msg)
+	}
+	member := a.findUserSynchronized(memberCode, nil)
+
+	var originals, changed []*User
+	a.userLock.Lock()
+	a.revision++
+	for index, user := range a.userList {
+		if user == nil {
+			continue
+		}
+		modified := *user
+		modified.Codes = nil
+		modified.CodeIssueDates = nil
+		modified.CodeTypes = nil
+		for i, code := range user.Codes {
+			issued := user.CodeIssueDate(i)
+			if !issued.IsZero() && issued.Before(issuedBefore) {
+				continue // revoke.
+			}
+			modified.Codes = append(modified.Codes, code)
+			modified.CodeIssueDates = append(modified.CodeIssueDates, issued)
+			if user.CodeTypes != nil {
+				modified.CodeTypes = append(modified.CodeTypes, user.CodeType(i))
+			}
+		}
+		if len(modified.Codes) == len(user.Codes) {
+			continue // Nothing to do for this one.
+		}
+		revoked += len(user.Codes) - len(modified.Codes)
+		a.deleteUserRequiresLock(user)
+		a.addUserAtPosRequiresLock(&modified, index)
+		originals = append(originals, user)
+		changed = append(changed, &modified)
+	}
+	a.userLock.Unlock()
+
+	if len(changed) == 0 {
+		return 0, nil
+	}
+	// Keep memory and disk in sync: if we can't write, don't keep it.
+	if ok, msg := a.writeAllUsers(); !ok {
+		for i, user := range changed {
+			a.restoreUserSynchronized(user, originals[i])
+		}
+		return 0, errors.New("Could not write bulk revoke: " + msg)
+	}
+
+	needReissue := 0
+	for _, user := range changed {
+		if user.NeedsCodeReissue() {
+			needReissue++
+		}
+		a.logger.Printf("Bulk revoke: '%s' now has %d code(s)", a.pepper.logName(user.Name), len(user.Codes))
+		a.postUserEvent(AppUserUpdated, user)
+	}
+	a.logger.Printf("Bulk revoke by '%s' of codes issued before %s: "+
+		"%d codes revoked, %d users need new codes",
+		a.pepper.logName(member.Name), issuedBefore.Format("2006-01-02 15:04"),
+		revoked, needReissue)
+	if a.auditLog != nil {
+		a.auditLog.LogRevocation(a.clock.Now(), member.Name,
+			"codes issued before "+issuedBefore.Format("2006-01-02 15:04"), revoked)
+	}
+	return revoked, nil
+}
+
+// Given a test function for the user level, test if operation is allowed
+func (a *FileBasedAuthenticator) verifyOpAllowed(auth_code string, isOpAllowed func(Level) bool) (bool, string) {
+	authMember, msg := a.verifiedMember(auth_code, isOpAllowed)
+	return authMember != nil, msg
+}
+
+// Like verifyOpAllowed(), but returns the member allowed, or nil and why
+// not. Looking them up again later might find nobody, e.g. after a reload.
+func (a *FileBasedAuthenticator) verifiedMember(auth_code string, isOpAllowed func(Level) bool) (*User, string) {
+	authMember := a.findUserSynchronized(auth_code, nil)
+	if authMember == nil {
+		return nil, "Couldn't find member with authentication code."
+	}
+	if !isOpAllowed(authMember.UserLevel) {
+		return nil, "User not authorized."
+	}
+	if authMember.Disabled {
+		return nil, "Auth-Member disabled."
+	}
+	if !authMember.InValidityPeriod(a.clock.Now()) {
+		return nil, "Auth-Member expired."
+	}
+	return authMember, ""
+}
+
+// Find user; this returns the raw pointer to the User and you really only
+// should modify while holdling a lock.
+// If you want to use the returned object to call a modification operation:
+// If revision is non-nil, fills in the current revision.
+func (a *FileBasedAuthenticator) findUserSynchronized(plain_code string, rev *int) *User {
+	a.reloadIfChanged()
+	hashed := a.pepper.hash(plain_code)
+	a.userLock.RLock()
+	revision := a.revision
+	if a.unknownCodes.contains(hashed, revision) {
+		a.userLock.RUnlock()
+		if rev != nil {
+			*rev = revision
+		}
+		return nil
+	}
+	user, _ := a.code2user[hashed]
+	var candidates []string
+	if user == nil && a.codeHasher != nil {
+		candidates = a.tag2codes[a.codeHasher.Tag(plain_code)]
+	}
+	a.userLock.RUnlock()
+
+	// Salted codes are slow to verify; don't hold the lock meanwhile.
+	for _, stored := range candidates {
+		if a.codeHasher.Verify(plain_code, stored) {
+			a.userLock.RLock()
+			user = a.code2user[stored]
+			revision = a.revision
+			a.userLock.RUnlock()
+			break
+		}
+	}
+	if user == nil {
+		a.unknownCodes.add(hashed, revision)
+	}
+	if rev != nil {
+		*rev = revision
+	}
+	return user
+}
+
+// Like findUserSynchronized(), but gives up once the context is done. The
+// lookup itself goes on in the background, so that a reload it started
+// still finishes and the next lookup is fast again.
+func (a *FileBasedAuthenticator) findUserCtx(ctx context.Context, plain_code string) (*User, error) {
+	if ctx.Done() == nil {
+		return a.findUserSynchronized(plain_code, nil), nil // Can't be cancelled.
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	found := make(chan *User, 1)
+	go func() {
+		found <- a.findUserSynchronized(plain_code, nil)
+	}()
+	select {
+	case user := <-found:
+		return user, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Replace the md5-hashed plain_code of the user with a salted hash. This
+// only changes the users in memory; it is written with the next change.
+func (a *FileBasedAuthenticator) upgradeCode(user *User, plain_code string) {
+	legacy := a.pepper.hash(plain_code)
+	a.userLock.RLock()
+	revision := a.revision
+	found := a.code2user[legacy] == user
+	a.userLock.RUnlock()
+	if !found {
+		return // Already salted.
+	}
+	salted, err := a.codeHasher.Hash(plain_code)
+	if err != nil {
+		a.logger.Printf("Can't hash code: %v", err)
+		return
+	}
+	upgraded := *user
+	upgraded.Codes = replacedCode(user.Codes, legacy, salted)
+	upgraded.DuressCodes = replacedCode(user.DuressCodes, legacy, salted)
+	if ok, _ := a.replaceUserSynchronized(revision, user, &upgraded); ok {
+		a.logger.Printf("Upgraded code of '%s' to salted hash.", a.pepper.logName(user.Name))
+	}
+}
+
+// Copy of the codes with "from" replaced by "to".
+func replacedCode(codes []string, from string, to string) []string {
+	result := make([]string, len(codes))
+	for i, code := range codes {
+		if code == from {
+			code = to
+		}
+		result[i] = code
+	}
+	return result
+}
+
+// Returns true if the plain code is one of the duress codes of the user.
+// Checks all of them, whichever code was used, so that it takes the same
+// time for regular codes.
+func (a *FileBasedAuthenticator) isDuressCode(user *User, plain_code string) bool {
+	duress := false
+	for _, stored := range user.DuressCodes {
+		if a.codeMatches(stored, plain_code) {
+			duress = true
+		}
+	}
+	return duress
+}
+
+// If the stored code, legacy hash or salted, is the plain code.
+func (a *FileBasedAuthenticator) codeMatches(stored string, plain_code string) bool {
+	if isSaltedCode(stored) {
+		return a.codeHasher != nil && a.codeHasher.Verify(plain_code, stored)
+	}
+	return subtle.ConstantTimeCompare([]byte(stored), []byte(a.pepper.hash(plain_code))) == 1
+}
+
+// The stored form of the user's code that the plain code is, and whether
+// that code is of the given factor; see User.CodeTypes. Duress codes are
+// of any factor, so that someone forced to open the door isn't given away
+// by a denial. Empty if the code is not the user's.
+func (a *FileBasedAuthenticator) factorCode(user *User, plain_code string,
+	factor AuthFactor) (string, bool) {
+	for i, stored := range user.Codes {
+		if a.codeMatches(stored, plain_code) {
+			return stored, user.CodeType(i) == factor
+		}
+	}
+	for _, stored := range user.DuressCodes {
+		if a.codeMatches(stored, plain_code) {
+			return stored, true
+		}
+	}
+	return "", false
+}
+
+// Someone is forced to let someone in. Tell whoever can help, but nothing
+// at the door: the decision and its message are as for the regular code.
+func (a *FileBasedAuthenticator) raiseDuressAlarm(user *User, target Target) {
+	msg := fmt.Sprintf("DURESS: code of '%s' used at %s", user.Name, target)
+	a.logger.Printf("%s", a.pepper.logUserMessage(msg, user))
+	a.eventBus.Post(&AppEvent{
+		Ev:     AppDuressAlarm,
+		Target: target,
+		Source: "authenticator",
+		Msg:    msg,
+	})
+}
+
+// Read the master codes from the file, see mastercodes.go. Their use is
+// granted at their targets without any further checks, but raises an
+// alarm each time.
+func (a *FileBasedAuthenticator) SetMasterCodes(filename string) error {
+	codes, err := loadMasterCodes(filename)
+	if err != nil {
+		return err
 	}
+	a.masterCodes = codes
+	return nil
+}
 
-	var revision int
-	user := a.findUserSynchronized(user_code, &revision)
-	if !a.deleteUserSynchronized(revision, user) {
-		return false, "Delete failed"
+// Read the days the space is closed or open from the file, see
+// holidays.go. Changes of the file are picked up like those of the users.
+func (a *FileBasedAuthenticator) SetHolidayCalendar(filename string) error {
+	calendar, err := loadHolidayCalendar(filename)
+	if err != nil {
+		return err
 	}
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	a.holidays = calendar
+	return nil
+}
 
-	a.postUserEvent(AppUserDeleted, user)
+func (a *FileBasedAuthenticator) notifyAccess(now time.Time, target Target,
+	reason AuthReason, userName string, msg string) {
+	a.notifications.send(NotifyEvent{
+		Timestamp: now,
+		Kind:      NotifyAccess,
+		Target:    target,
+		Reason:    reason.String(),
+		UserName:  userName,
+		Msg:       msg,
+	})
+}
 
-	return a.writeDatabase()
+func (a *FileBasedAuthenticator) raiseMasterOverride(name string, target Target) {
+	msg := fmt.Sprintf("MASTER OVERRIDE: '%s' used at %s", name, target)
+	a.logger.Printf("%s", msg)
+	a.eventBus.Post(&AppEvent{
+		Ev:     AppMasterOverride,
+		Target: target,
+		Source: "authenticator",
+		Msg:    msg,
+	})
 }
 
-// Given a test function for the user level, test if operation is allowed
-func (a *FileBasedAuthenticator) verifyOpAllowed(auth_code string, isOpAllowed func(Level) bool) (bool, string) {
-	authMember := a.findUserSynchronized(auth_code, nil)
-	if authMember == nil {
-		return false, "Couldn't find member with authentication code."
+// Set the duress code of the member with the given code: a code that opens
+// like the regular one, but raises a silent alarm.
+func (a *FileBasedAuthenticator) SetDuressCode(member_code string, duress_code string) (bool, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(member_code, CanLevelAdminister); !auth_ok {
+		return false, auth_msg
 	}
-	if !isOpAllowed(authMember.UserLevel) {
-		return false, "User not authorized."
+	var invalid error
+	ok, msg := a.UpdateUser(member_code, member_code, func(user *User) bool {
+		invalid = user.setDuressCode(duress_code, a.minCodeLength, a.pepper)
+		return invalid == nil
+	})
+	if invalid != nil {
+		return false, "Duress code " + invalid.Error() + "."
 	}
-	if !authMember.InValidityPeriod(a.clock.Now()) {
-		return false, "Auth-Member expired."
+	return ok, msg
+}
+
+// Add user.
+// Makes sure the data structure is synchronized.
+// Returns a nil owner if added, otherwise the (hashed) code of the user that
+// is already used and by whom. Either all codes of the user are added or
+// none.
+func (a *FileBasedAuthenticator) addUserSynchronized(user *User) (code string, owner *User) {
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	a.revision++
+	code, owner = a.codeOwnerRequiresLock(user)
+	if !a.addUserAtPosRequiresLock(user, -1) {
+		return code, owner
 	}
-	return true, ""
+	return "", nil
 }
 
-// Find user; this returns the raw pointer to the User and you really only
-// should modify while holdling a lock.
-// If you want to use the returned object to call a modification operation:
-// If revision is non-nil, fills in the current revision.
-func (a *FileBasedAuthenticator) findUserSynchronized(plain_code string, rev *int) *User {
-	a.reloadIfChanged()
+func (a *FileBasedAuthenticator) codeOwnerSynchronized(user *User) (string, *User) {
+	a.userLock.RLock()
+	defer a.userLock.RUnlock()
+	return a.codeOwnerRequiresLock(user)
+}
+
+// Returns the former position of the user or -1 and reason if not possible.
+func (a *FileBasedAuthenticator) deleteUserSynchronized(expected_revision int, user *User) (int, string) {
 	a.userLock.Lock()
 	defer a.userLock.Unlock()
-	user, _ := a.code2user[hashAuthCode(plain_code)]
-	if rev != nil {
-		*rev = a.revision
+	if a.revision != expected_revision {
+		return -1, "Changed while deleting."
 	}
-	return user
+	a.revision++
+	user_index := a.deleteUserRequiresLock(user)
+	if user_index < 0 {
+		return -1, "User not in database anymore."
+	}
+	return user_index, ""
 }
 
-// Add user.
-// Makes sure the data structure is synchronized.
-func (a *FileBasedAuthenticator) addUserSynchronized(user *User) bool {
+// Undo an addUserSynchronized().
+func (a *FileBasedAuthenticator) removeUserSynchronized(user *User) {
 	a.userLock.Lock()
 	defer a.userLock.Unlock()
 	a.revision++
-	return a.addUserAtPosRequiresLock(user, -1)
+	a.deleteUserRequiresLock(user)
 }
 
-func (a *FileBasedAuthenticator) deleteUserSynchronized(expected_revision int, user *User) bool {
+// Undo a deleteUserSynchronized().
+func (a *FileBasedAuthenticator) reinsertUserSynchronized(user *User, user_index int) {
 	a.userLock.Lock()
 	defer a.userLock.Unlock()
-	if a.revision != expected_revision {
-		return false
-	}
 	a.revision++
-	user_index := a.deleteUserRequiresLock(user)
-	return user_index >= 0
+	a.addUserAtPosRequiresLock(user, user_index)
 }
 
 // Replace user if the revision of the system is still the same as expected.
-func (a *FileBasedAuthenticator) replaceUserSynchronized(expected_revision int, old_user *User, new_user *User) bool {
+// Returns false and reason if not possible.
+func (a *FileBasedAuthenticator) replaceUserSynchronized(expected_revision int, old_user *User, new_user *User) (bool, string) {
 	a.userLock.Lock()
 	defer a.userLock.Unlock()
 	if a.revision != expected_revision {
-		return false
+		return false, "Changed while editing."
+	}
+	// Check codes before we touch anything, so that we don't end up
+	// with the old user removed but the new one not added.
+	for _, code := range new_user.indexedCodes() {
+		if owner := a.code2user[code]; owner != nil && owner != old_user {
+			return false, duplicateCodeMessage(new_user, code, owner)
+		}
 	}
 	a.revision++
 	user_index := a.deleteUserRequiresLock(old_user)
-	return a.addUserAtPosRequiresLock(new_user, user_index)
+	a.addUserAtPosRequiresLock(new_user, user_index)
+	return true, ""
+}
+
+// Undo a replaceUserSynchronized(), e.g. if we couldn't write the change to
+// disk.
+func (a *FileBasedAuthenticator) restoreUserSynchronized(new_user *User, old_user *User) {
+	a.userLock.Lock()
+	defer a.userLock.Unlock()
+	a.revision++
+	user_index := a.deleteUserRequiresLock(new_user)
+	a.addUserAtPosRequiresLock(old_user, user_index)
 }
 
 // Add a user at particular position. -1 for append.
@@ -271,11 +2823,9 @@ func (a *FileBasedAuthenticator) addUserAtPosRequiresLock(user *User, at_index i
 	// ASSERT: a.userLock already locked.
 	// First verify that there is no code in there that is already used by
 	// someone else.
-	for _, code := range user.Codes {
-		if a.code2user[code] != nil {
-			log.Printf("Ignoring multiple used code '%s'", code)
-			return false // Existing user with that code
-		}
+	if code, owner := a.codeOwnerRequiresLock(user); owner != nil {
+		a.logger.Printf("Ignoring multiple used code '%s'", code)
+		return false // Existing user with that code
 	}
 	// Then ok to add.
 	if at_index < 0 {
@@ -289,12 +2839,45 @@ func (a *FileBasedAuthenticator) addUserAtPosRequiresLock(user *User, at_index i
 		a.userList[at_index] = user
 		a.user2index[user] = at_index
 	}
-	for _, code := range user.Codes {
+	for _, code := range user.indexedCodes() {
 		a.code2user[code] = user
+		if tag := saltedCodeTagOf(code); tag != "" {
+			a.tag2codes[tag] = append(a.tag2codes[tag], code)
+		}
 	}
 	return true
 }
 
+// Which of the user's codes is already used by whom, for the member adding
+// or changing the user to sort out. The code only as hint, like in the
+// logs, i.e. the start of the stored hash; we only have the hash anyway.
+func duplicateCodeMessage(user *User, code string, owner *User) string {
+	which := "Code"
+	for i, candidate := range user.Codes {
+		if candidate == code {
+			which = fmt.Sprintf("Code %d", i+1)
+		}
+	}
+	for i, candidate := range user.DuressCodes {
+		if candidate == code {
+			which = fmt.Sprintf("Duress code %d", i+1)
+		}
+	}
+	return fmt.Sprintf("%s (hint %s) already used by '%s'.",
+		which, code[0:6], owner.Name)
+}
+
+// The first of the user's codes that someone is already using, and who.
+func (a *FileBasedAuthenticator) codeOwnerRequiresLock(user *User) (string, *User) {
+	// ASSERT: a.userLock already locked.
+	for _, code := range user.indexedCodes() {
+		if owner := a.code2user[code]; owner != nil {
+			return code, owner
+		}
+	}
+	return "", nil
+}
+
 // Delete user and return index where it was.
 func (a *FileBasedAuthenticator) deleteUserRequiresLock(user *User) int {
 	// ASSERT: a.userLock already locked.
@@ -305,161 +2888,497 @@ func (a *FileBasedAuthenticator) deleteUserRequiresLock(user *User) int {
 
 	a.userList[pos] = nil
 	delete(a.user2index, user)
-	for _, code := range user.Codes {
+	for _, code := range user.indexedCodes() {
 		delete(a.code2user, code)
+		if tag := saltedCodeTagOf(code); tag != "" {
+			a.tag2codes[tag] = removeString(a.tag2codes[tag], code)
+		}
 	}
 	return pos
 }
 
-//
-// Read the user CSV file
-//
-// It is name, level, code[,code...]
-func (a *FileBasedAuthenticator) readDatabase() bool {
-	if a.userFilename == "" {
-		log.Println("RFID-user file not provided")
-		return false
+// Returns a new list without the given element.
+func removeString(list []string, remove string) []string {
+	var result []string
+	for _, element := range list {
+		if element != remove {
+			result = append(result, element)
+		}
+	}
+	return result
+}
+
+// Read all users from the store.
+func (a *FileBasedAuthenticator) readDatabase() error {
+	// Version before loading, so that changes while we load
+	// make us reload.
+	if versioned, ok := a.store.(VersionedUserStore); ok {
+		a.fileTimestamp, _ = versioned.Version()
 	}
-	f, err := os.Open(a.userFilename)
+	a.logger.Printf("Reading %v", a.store)
+	users, err := a.store.Load()
 	if err != nil {
-		log.Println("Could not read RFID user-file", err)
-		return false
+		return err
+	}
+	var report LoadReport
+	if reporting, ok := a.store.(ReportingUserStore); ok {
+		report = reporting.LastLoadReport()
+	}
+	for _, skipped := range report.Skipped {
+		a.logger.Printf("Skipped record in %v, %v", a.store, &skipped)
+	}
+	for _, conflict := range report.Conflicts {
+		logged := conflict
+		logged.Kept, logged.Dropped = a.pepper.logName(logged.Kept), a.pepper.logName(logged.Dropped)
+		a.logger.Printf("Level conflict in %v: %v", a.store, logged)
 	}
-
-	fileinfo, _ := os.Stat(a.userFilename)
-	a.fileTimestamp = fileinfo.ModTime()
-
-	reader := csv.NewReader(f)
-	reader.FieldsPerRecord = -1 //variable length fields
 
 	counts := make(map[Level]int)
 	expired_counts := make(map[Level]int)
 	total := 0
-	log.Printf("Reading %s", a.userFilename)
-	for {
-		user, done := NewUserFromCSV(reader)
-		if done {
-			break
-		}
-		if user == nil {
-			continue // e.g. due to comment or short line
+	for _, user := range users {
+		if _, owner := a.addUserSynchronized(user); owner != nil {
+			duplicate := DuplicateCode{
+				User:      user.Name,
+				File:      report.fileOf(user),
+				Line:      report.lineOf(user),
+				Owner:     owner.Name,
+				OwnerFile: report.fileOf(owner),
+				OwnerLine: report.lineOf(owner),
+			}
+			logged := duplicate
+			logged.User, logged.Owner = a.pepper.logName(logged.User), a.pepper.logName(logged.Owner)
+			a.logger.Printf("Skipped user in %v: %v", a.store, logged)
+			report.Duplicates = append(report.Duplicates, duplicate)
+			continue
 		}
-		a.addUserSynchronized(user)
 		total++
 		counts[user.UserLevel]++
 		if !user.InValidityPeriod(a.clock.Now()) {
 			expired_counts[user.UserLevel]++
 		}
+		if !user.HasContactInfo() && user.ValidFrom.IsZero() {
+			a.logger.Printf("No start-date for temp code of '%s'; expired.",
+				a.pepper.logName(user.Name))
+		}
 	}
-	log.Printf("Read %d users from %s", total, a.userFilename)
+	a.loadedUserCount = total
+	a.loadedLevelCounts = make(map[Level]int)
 	for level, count := range counts {
-		log.Printf("%14s %4d (%3d good, %3d expired)", level, count, count-expired_counts[level], expired_counts[level])
+		a.loadedLevelCounts[level] = count - expired_counts[level]
 	}
-	return true
+	a.loadReport = report
+	a.logger.Printf("Read %d users from %v", total, a.store)
+	for level, count := range counts {
+		a.logger.Printf("%14s %4d (%3d good, %3d expired)", level, count, count-expired_counts[level], expired_counts[level])
+	}
+	return nil
 }
 
 // For now, we sometimes need to modify the file manually, e.g. to add contact
 // info. This allows to automatically reload it.
+// If we're watching the file or reload periodically, that takes care of it
+// instead.
+// The holiday calendar is always checked here, as it isn't watched.
+// Lookups only share the fileLock to find out; it is taken exclusively
+// if there is something to reload.
 func (a *FileBasedAuthenticator) reloadIfChanged() {
+	a.fileLock.RLock()
+	watched := a.watcher != nil || a.periodicReload
+	interval := a.statInterval
+	holidays := a.holidays
+	a.fileLock.RUnlock()
+	if watched && holidays == nil {
+		return
+	}
+	now := a.clock.Now().UnixNano()
+	last := atomic.LoadInt64(&a.lastStat)
+	// If the clock went backwards, better check.
+	if elapsed := time.Duration(now - last); elapsed >= 0 && elapsed < interval {
+		return
+	}
+	if !atomic.CompareAndSwapInt64(&a.lastStat, last, now) {
+		return // Someone else is checking right now.
+	}
+	if holidays != nil {
+		if reloaded, err := holidays.reloadIfChanged(); err != nil {
+			a.logger.Printf("Holiday calendar not reloaded, keeping the days we have: %v", err)
+		} else if reloaded {
+			a.logger.Printf("Reloaded holiday calendar %s", holidays.filename)
+		}
+	}
+	if watched || !a.storeChanged() {
+		return
+	}
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	a.reloadRequiresLock(false) // Checks again; someone might have been faster.
+}
+
+// If reloadRequiresLock() would have anything to do, i.e. the version of
+// the store differs from the one we have, or it went missing or came back.
+func (a *FileBasedAuthenticator) storeChanged() bool {
+	versioned, ok := a.store.(VersionedUserStore)
+	if !ok {
+		return false
+	}
+	version, err := versioned.Version()
+	a.fileLock.RLock()
+	defer a.fileLock.RUnlock()
+	if err != nil || a.storeMissing {
+		return (err != nil) != a.storeMissing
+	}
+	return version != a.fileTimestamp
+}
+
+// Sensible interval for SetStatInterval() on busy doors.
+const DefaultStatInterval = time.Second
+
+// Check the user file for changes on access at most every "interval", so
+// that rapid swipes don't each stat the file. Changes are noticed with the
+// first access after the interval. 0, the default, checks on each access.
+func (a *FileBasedAuthenticator) SetStatInterval(interval time.Duration) {
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	a.statInterval = interval
+}
+
+// Start watching the user file for changes with fsnotify instead of
+// checking its timestamp on every lookup. We watch the directory, as
+// atomic writes replace the file with a new one by renaming.
+// If this returns an error, we just keep checking the timestamp.
+// Only possible for users stored in a CSVUserStore.
+func (a *FileBasedAuthenticator) StartWatching() error {
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	if a.watcher != nil {
+		return nil // Already watching
+	}
+	csvStore, ok := a.store.(*CSVUserStore)
+	if !ok {
+		return errors.New("Can only watch user files")
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	if err = watcher.Add(filepath.Dir(csvStore.Filename())); err != nil {
+		watcher.Close()
+		return err
+	}
+	a.watcher = watcher
+	a.watcherDone = make(chan bool)
+	go a.watchUserFile(watcher, csvStore.Filename(), a.watcherDone)
+
+	// Changes before we started watching.
+	a.reloadRequiresLock(false)
+	return nil
+}
+
+// Stop watching the user file and go back to checking the timestamp.
+func (a *FileBasedAuthenticator) StopWatching() {
+	a.fileLock.Lock()
+	watcher, done := a.watcher, a.watcherDone
+	a.watcher, a.watcherDone = nil, nil
+	a.fileLock.Unlock()
+	if watcher == nil {
+		return
+	}
+	watcher.Close()
+	<-done
+}
+
+// Check for changes of the users every "interval" in the background instead
+// of on each access, e.g. where fsnotify doesn't work, like on network
+// mounts. Starting it again while running has no effect. Stop with Close().
+func (a *FileBasedAuthenticator) StartPeriodicReload(interval time.Duration) {
 	a.fileLock.Lock()
 	defer a.fileLock.Unlock()
-	fileinfo, err := os.Stat(a.userFilename)
+	if a.periodicReload {
+		return
+	}
+	a.every(interval, func() {
+		a.fileLock.Lock()
+		if a.periodicReload { // Not closed meanwhile.
+			a.reloadRequiresLock(false)
+		}
+		a.fileLock.Unlock()
+	})
+	a.periodicReload = true
+}
+
+// How often the scheduler looks for due jobs; fine enough for all of them.
+const schedulerTick = time.Second
+
+// Run the job on the scheduler every interval, until Close().
+func (a *FileBasedAuthenticator) every(interval time.Duration, job func()) {
+	var run func()
+	run = func() {
+		job()
+		a.scheduler.After(interval, run)
+	}
+	a.scheduler.After(interval, run)
+	a.scheduler.Start(schedulerTick)
+}
+
+// Stop background activity: the jobs of the scheduler, such as periodic
+// reloads, and watching the user file. Safe to call if nothing was
+// started, and multiple times.
+func (a *FileBasedAuthenticator) Close() {
+	a.StopWatching()
+	a.fileLock.Lock()
+	a.periodicReload = false
+	a.fileLock.Unlock()
+	a.scheduler.Close()
+	a.notifications.close()
+}
+
+func (a *FileBasedAuthenticator) watchUserFile(watcher *fsnotify.Watcher,
+	filename string, done chan bool) {
+	defer close(done)
+	watched := filepath.Clean(filename)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Clean(event.Name) != watched ||
+				!event.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+				continue
+			}
+			a.fileLock.Lock()
+			// A write to the file itself might not change the
+			// timestamp on filesystems with coarse mtime, so
+			// always reload. New files replacing ours are
+			// checked by timestamp, so that we don't re-read
+			// what writeAllUsers() just wrote.
+			a.reloadRequiresLock(event.Has(fsnotify.Write))
+			a.fileLock.Unlock()
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			// We might have missed events.
+			a.logger.Printf("Watching %s: %v", filename, err)
+			a.fileLock.Lock()
+			a.reloadRequiresLock(false)
+			a.fileLock.Unlock()
+		}
+	}
+}
+
+// Reload the users if the version of the store changed or if forced.
+// Requires the fileLock to be held.
+func (a *FileBasedAuthenticator) reloadRequiresLock(force bool) {
+	versioned, ok := a.store.(VersionedUserStore)
+	if !ok {
+		return // Nobody else changes it.
+	}
+	version, err := versioned.Version()
 	if err != nil {
-		return // well, ok then.
+		// E.g. in the middle of a save. Keep what we have; tell once.
+		if !a.storeMissing {
+			a.storeMissing = true
+			a.rejectReload(fmt.Errorf("Can't check %v: %v", a.store, err))
+		}
+		return
+	}
+	if a.storeMissing {
+		a.storeMissing = false
+		a.logger.Printf("%v is back.", a.store)
+		if version == a.fileTimestamp {
+			// Unchanged, so what we have is current.
+			a.lastReloadError = nil
+			a.failedReloadsInRow = 0
+		}
 	}
-	if a.fileTimestamp == fileinfo.ModTime() {
+	if !force && a.fileTimestamp == version {
 		return // nothing to do.
 	}
-	msg := fmt.Sprintf("Refreshing changed %s (%s -> %s)\n",
-		a.userFilename,
+	msg := fmt.Sprintf("Refreshing changed %v (%s -> %s)\n",
+		a.store,
 		a.fileTimestamp.Format("2006-01-02 15:04:05"),
-		fileinfo.ModTime().Format("2006-01-02 15:04:05"))
-	log.Println(msg)
+		version.Format("2006-01-02 15:04:05"))
+	if version != a.emptyVersion { // Not again while retrying.
+		a.logger.Printf("%s", msg)
+	}
 
 	// For now, we are doing it simple: just create
 	// a new authenticator and steal the result.
 	// If we allow to modify users in-memory, we need to make
 	// sure that we don't replace contents while that is happening.
-	newAuth := NewFileBasedAuthenticator(a.userFilename, a.eventBus)
-	if newAuth == nil {
+	started := a.clock.Now()
+	newAuth, err := loadFileBasedAuthenticator(a.store, a.eventBus, a.logger, string(a.pepper), a.clock)
+	if a.metrics != nil {
+		a.metrics.ReloadDuration(a.clock.Now().Sub(started))
+	}
+	if err != nil {
+		// Don't attempt again until the file changes.
+		a.fileTimestamp = version
+		a.rejectReload(fmt.Errorf("Reload rejected: %v", err))
+		return
+	}
+	a.userLock.RLock()
+	haveUsers := len(a.user2index) > 0
+	a.userLock.RUnlock()
+	if len(newAuth.user2index) == 0 && haveUsers && !a.allowEmptyReload {
+		// Don't remember the version: with coarse timestamps, the
+		// complete file might have the same; check again next time.
+		if version != a.emptyVersion {
+			a.emptyVersion = version
+			a.rejectReload(fmt.Errorf("Reload of %v rejected: no users", a.store))
+		}
+		return
+	}
+	a.emptyVersion = time.Time{}
+	if !a.checkLevelMinimums(newAuth.loadedLevelCounts) && a.strictMinimums {
+		a.fileTimestamp = newAuth.fileTimestamp
+		a.rejectReload(fmt.Errorf("Reload of %v rejected: "+
+			"too few users of some level", a.store))
 		return
 	}
+	a.lastReloadError = nil
+	a.failedReloadsInRow = 0
 	a.userLock.Lock()
 	defer a.userLock.Unlock()
 	// Steal all the fields :)
+	a.revision++ // Pending modifications refer to the old users.
 	a.fileTimestamp = newAuth.fileTimestamp
 	a.userList = newAuth.userList
 	a.user2index = newAuth.user2index
 	a.code2user = newAuth.code2user
+	a.tag2codes = newAuth.tag2codes
+	a.loadReport = newAuth.loadReport
+	a.dropExpiredGuestsRequiresLock(a.clock.Now())
 	a.eventBus.Post(&AppEvent{
 		Ev:     AppUserFileReloaded,
 		Source: "authenticator",
 		Msg:    msg,
 	})
+	a.checkUserCountDrop(a.loadedUserCount, newAuth.loadedUserCount)
+	a.loadedUserCount = newAuth.loadedUserCount
+	a.loadedLevelCounts = newAuth.loadedLevelCounts
+	if a.metrics != nil {
+		a.metrics.Reload(nil)
+		a.metrics.UsersLoaded(a.loadedUserCount)
+	}
 }
 
-// Full dump of database.
-func (a *FileBasedAuthenticator) writeDatabase() (bool, string) {
-	// First, dump out the database to a temporary file and
-	// make sure it succeeds.
-	tmpFilename := a.userFilename + ".tmp"
-	if ok, msg := a.writeTempCSV(tmpFilename); !ok {
-		return false, msg
+// Keep the previous users, but make sure someone notices: the maintainer
+// who just edited the file wants to see why, and if it keeps failing,
+// we get louder.
+// Requires the fileLock to be held.
+func (a *FileBasedAuthenticator) rejectReload(err error) {
+	a.lastReloadError = err
+	a.failedReloads++
+	a.failedReloadsInRow++
+	msg := err.Error() + ". Keeping previous data."
+	if a.failedReloadsInRow >= 3 {
+		msg = fmt.Sprintf("ALERT: %d reloads failed in a row. %s",
+			a.failedReloadsInRow, msg)
+	}
+	a.logger.Printf("%s", msg)
+	if a.metrics != nil {
+		a.metrics.Reload(err)
 	}
+	a.eventBus.Post(&AppEvent{
+		Ev:     AppUserReloadFailed,
+		Source: "authenticator",
+		Msg:    msg,
+		Value:  a.failedReloadsInRow,
+	})
+}
 
-	// Alright, good. Atomic rename.
+// Number of reloads that have been rejected, e.g. because of a broken
+// user file.
+func (a *FileBasedAuthenticator) FailedReloads() int {
 	a.fileLock.Lock()
 	defer a.fileLock.Unlock()
-	os.Rename(tmpFilename, a.userFilename)
-
-	fileinfo, _ := os.Stat(a.userFilename)
-	a.fileTimestamp = fileinfo.ModTime()
+	return a.failedReloads
+}
 
-	return true, ""
+// Check that the counts of users per level satisfy the configured
+// minimums. Alerts and returns false if not.
+func (a *FileBasedAuthenticator) checkLevelMinimums(counts map[Level]int) bool {
+	ok := true
+	for level, minimum := range a.levelMinimums {
+		if counts[level] >= minimum {
+			continue
+		}
+		msg := fmt.Sprintf("Only %d valid '%s' users in %v; expected at least %d",
+			counts[level], level, a.store, minimum)
+		a.logger.Printf("%s", msg)
+		a.eventBus.Post(&AppEvent{
+			Ev:     AppUserCountAlert,
+			Source: "authenticator",
+			Msg:    msg,
+			Value:  counts[level],
+		})
+		ok = false
+	}
+	return ok
 }
 
-// Like write database, but just append a single user. In that case, a file
-// append is sufficient.
-func (a *FileBasedAuthenticator) appendDatabaseSingleEntry(user *User) (bool, string) {
-	// Just append the user to the file which is sufficient for AddNewUser()
-	a.fileLock.Lock()
-	defer a.fileLock.Unlock()
-	f, err := os.OpenFile(a.userFilename, os.O_WRONLY|os.O_APPEND, 0644)
-	if err != nil {
-		return false, err.Error()
+// Compare user count of previous load with the current and alert if
+// we lost more than allowed.
+func (a *FileBasedAuthenticator) checkUserCountDrop(before int, after int) {
+	a.logger.Printf("User count after reload: %d -> %d", before, after)
+	drop := before - after
+	if drop <= 0 {
+		return
+	}
+	exceeded := (a.reloadDropAlertCount > 0 && drop > a.reloadDropAlertCount) ||
+		(a.reloadDropAlertPct > 0 && 100*drop > a.reloadDropAlertPct*before)
+	if !exceeded {
+		return
 	}
-	defer f.Close()
-	writer := csv.NewWriter(f)
-	user.WriteCSV(writer)
-	writer.Flush()
+	msg := fmt.Sprintf("User count dropped from %d to %d after reload of %v. "+
+		"Truncated file?", before, after, a.store)
+	a.logger.Printf("%s", msg)
+	a.eventBus.Post(&AppEvent{
+		Ev:     AppUserCountAlert,
+		Source: "authenticator",
+		Msg:    msg,
+		Value:  after,
+	})
+}
 
-	fileinfo, _ := os.Stat(a.userFilename)
-	a.fileTimestamp = fileinfo.ModTime()
+// Full dump of database: replace all users in the store. On any error, the
+// stored users are left untouched.
+func (a *FileBasedAuthenticator) writeAllUsers() (bool, string) {
+	return a.writeStore(func() error {
+		// Users in the list are never modified, only replaced, so
+		// a copy of the list is a consistent snapshot.
+		a.userLock.RLock()
+		users := make([]*User, len(a.userList))
+		copy(users, a.userList)
+		a.userLock.RUnlock()
+		return a.store.ReplaceAll(users)
+	})
+}
 
-	return true, ""
+// Add a single user to the store.
+func (a *FileBasedAuthenticator) appendUser(user *User) (bool, string) {
+	return a.writeStore(func() error {
+		return a.store.Append(user)
+	})
 }
 
-// Write content of the 'user database' to temp CSV file.
-func (a *FileBasedAuthenticator) writeTempCSV(filename string) (bool, string) {
-	os.Remove(filename)
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
-	if err != nil {
+func (a *FileBasedAuthenticator) writeStore(write func() error) (bool, string) {
+	// Hold the file lock all the way through, so that reloadIfChanged()
+	// doesn't see our change before we've recorded the new version.
+	a.fileLock.Lock()
+	defer a.fileLock.Unlock()
+	if err := write(); err != nil {
 		return false, err.Error()
 	}
-	defer f.Close()
-	writer := csv.NewWriter(f)
-	for _, user := range a.userList {
-		if user != nil {
-			user.WriteCSV(writer)
+	if versioned, ok := a.store.(VersionedUserStore); ok {
+		if version, err := versioned.Version(); err == nil {
+			a.fileTimestamp = version
 		}
 	}
-	writer.Flush()
-	/* writer.Error() does not exist in older go versions :(
-	if writer.Error() != nil {
-		log.Println(writer.Error())
-		return false, writer.Error()
-	}
-	*/
 	return true, ""
 }
 
@@ -475,31 +3394,186 @@ func (a *FileBasedAuthenticator) writeTempCSV(filename string) (bool, string) {
 // So we merely protect against accidentally revealing a PIN or card-ID and
 // their lengths while browsing the file. A weak MD5 is more than enough for
 // this use-case.
+//
+// Hashed with the process-wide pepper, see SetAuthCodePepper(); an
+// authenticator hashes with its own, see codePepper.
 func hashAuthCode(plain string) string {
+	return authCodePepper.hash(plain)
+}
+
+// The pepper that has been used with all existing user files. Kept as
+// default, so that these continue to work.
+const DefaultAuthCodePepper = "MakeThisALittleBitLongerToChewOnEarlFoo"
+
+// Secret mixed into code hashes, code hints and log pseudonyms. Each
+// authenticator keeps the one it was created with, so that several of them
+// don't get in each other's way.
+type codePepper string
+
+func (p codePepper) hash(plain string) string {
 	hashgen := md5.New()
-	io.WriteString(hashgen, "MakeThisALittleBitLongerToChewOnEarlFoo"+plain)
+	io.WriteString(hashgen, string(p)+normalizeAuthCode(plain))
 	return hex.EncodeToString(hashgen.Sum(nil))
 }
 
+// For users created outside an authenticator, e.g. in the UI, and for
+// authenticators created without a pepper of their own.
+var authCodePepper codePepper = DefaultAuthCodePepper
+
+// Set the process-wide pepper for hashAuthCode(). Each space should have
+// its own for new deployments. Needs to be set at startup, before anything
+// runs, as it is not synchronized; authenticators created before keep the
+// previous one. Changing the pepper invalidates all codes in an existing
+// file. Since we only store hashes, they can't be re-hashed; users need to
+// be given their codes again.
+func SetAuthCodePepper(pepper string) error {
+	if pepper == "" {
+		return errors.New("Empty pepper")
+	}
+	authCodePepper = codePepper(pepper)
+	return nil
+}
+
+// If set, codes that look like hex card IDs are uppercased before
+// hashing, see normalizeAuthCode().
+var uppercaseHexCodes = false
+
+// Readers differ in how they deliver the same card: some append whitespace
+// or a "\r", some report hex IDs in lowercase. So that a card always hashes
+// the same, codes are normalized wherever they are hashed or measured.
+func normalizeAuthCode(code string) string {
+	code = strings.TrimSpace(code)
+	if uppercaseHexCodes && isHexString(code) {
+		code = strings.ToUpper(code)
+	}
+	return code
+}
+
+func isHexString(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789abcdefABCDEF") == ""
+}
+
+// Uppercase codes consisting only of hex digits, for readers that report
+// card IDs in varying case. PINs with only digits are not affected, but
+// keypads with letters are, so it is off by default. Like the pepper, this
+// needs to be decided before codes are hashed: existing hashes of lowercase
+// IDs won't match anymore.
+func SetUppercaseHexCodes(uppercase bool) {
+	uppercaseHexCodes = uppercase
+}
+
+// 32Bit Mifare are 8 characters hex, this is more to impose a minimum
+// 'strength' of a pin.
+const DefaultMinCodeLength = 5
+
 // Verify that code is long enough (and possibly other syntactical things, such
 // as not all the same digits and such)
-func hasMinimalCodeRequirements(code string) bool {
-	// 32Bit Mifare are 8 characters hex, this is more to impose a minimum
-	// 'strength' of a pin.
-	return len(code) >= 5
+// Length is counted in characters (runes), not bytes, so that a code
+// typed with multibyte characters is not considered longer than it is.
+func hasMinimalCodeRequirements(code string, minLength int) bool {
+	return utf8.RuneCountInString(normalizeAuthCode(code)) >= minLength
+}
+
+// Stricter than hasMinimalCodeRequirements(), for new codes. Existing codes
+// that don't satisfy this still work.
+func checkCodeStrength(code string, minLength int) error {
+	if !hasMinimalCodeRequirements(code, minLength) {
+		return fmt.Errorf("too short, needs at least %d characters", minLength)
+	}
+	code = normalizeAuthCode(code)
+	first, _ := utf8.DecodeRuneInString(code)
+	if strings.Count(code, string(first)) == utf8.RuneCountInString(code) {
+		return errors.New("all the same character")
+	}
+	return nil
+}
+
+// Check that codes of a user to be added are what SetAuthCode() creates.
+// Returns an empty string if ok, otherwise which code is bad and why.
+func checkNewUserCodes(codes []string) string {
+	if len(codes) == 0 {
+		return "New user has no code (too short or weak?)"
+	}
+	for i, code := range codes {
+		if !isHashedCode(code) {
+			return fmt.Sprintf("Code %d of new user is not hashed", i+1)
+		}
+	}
+	return ""
+}
+
+func isHashedCode(code string) bool {
+	if isSaltedCode(code) {
+		return true
+	}
+	_, err := hex.DecodeString(code)
+	return err == nil && len(code) == 2*md5.Size
+}
+
+// The hours the user may open doors at the given day. Personal hours of
+// the user apply every day instead of the schedule of their level.
+func (a *FileBasedAuthenticator) AccessWindowAt(user *User, now time.Time) HourWindow {
+	return a.accessWindowOn(user, a.localTime(now).Weekday())
+}
+
+// The hours the user may open doors on the given day of the week.
+func (a *FileBasedAuthenticator) accessWindowOn(user *User, day time.Weekday) HourWindow {
+	if user.Hours != nil && hasPersonalHours(user.UserLevel) {
+		return *user.Hours
+	}
+	switch user.UserLevel {
+	case LevelUser:
+		return a.userSchedule[day]
+	case LevelFulltimeUser:
+		return a.fulltimeSchedule[day]
+	}
+	from, to := user.AccessHours()
+	return HourWindow{from, to}
+}
+
+// Evaluate access hours and weekdays in the given location instead of the
+// one of the clock, e.g. the space's if the server runs in UTC. Wall clock
+// hours, so DST transitions shift the windows as members expect.
+func (a *FileBasedAuthenticator) SetLocation(location *time.Location) {
+	a.location = location
+}
+
+// The time as it is on the wall clock of the space.
+func (a *FileBasedAuthenticator) localTime(t time.Time) time.Time {
+	if a.location == nil {
+		return t
+	}
+	return t.In(a.location)
 }
 
 func (a *FileBasedAuthenticator) userHasAccess(user *User, target Target) (AuthResult, string) {
-	// TODO: we need a concept of an 'open' space, i.e. a responsible user
-	// opens the space to be accessible by the public, so that other users
-	// can come in even outside 'their' times. Right now only dummy - never
-	// open.
-	space_open_to_public := false
-
-	hour_from, hour_to := user.AccessHours()
-	current_hour := a.clock.Now().Hour()
-	isday := space_open_to_public ||
-		(current_hour >= hour_from && current_hour < hour_to)
+	// If a responsible member opened the space, other users can come
+	// in even outside 'their' times.
+	space_open_to_public := a.IsSpaceOpen()
+
+	now := a.localTime(a.clock.Now())
+	if user.UserLevel != LevelMember && a.holidays.closed(now) {
+		// Even if a member opened the space: it's closed for the day.
+		return AuthOkButOutsideTime, "space closed (holiday)."
+	}
+	rule, has_rule := a.accessRules.Rule(user.UserLevel, target)
+	if has_rule && !rule.Allowed {
+		return AuthFail, fmt.Sprintf("No access to %s for %s", target, user.UserLevel)
+	}
+	result, msg := a.levelHasAccess(user, target, now, space_open_to_public)
+	// Hours of a rule limit those of the level further.
+	if result == AuthOk && has_rule && rule.Hours != nil &&
+		!space_open_to_public && !rule.Hours.Contains(now.Hour()) {
+		return AuthOkButOutsideTime,
+			fmt.Sprintf("%s outside %s at %s", user.UserLevel, *rule.Hours, target)
+	}
+	return result, msg
+}
+
+// The usual access of the level at the target, at the local time now.
+func (a *FileBasedAuthenticator) levelHasAccess(user *User, target Target, now time.Time,
+	space_open_to_public bool) (AuthResult, string) {
+	current_hour := now.Hour()
 	switch user.UserLevel {
 	case LevelMember:
 		return AuthOk, "" // Members always have access.
@@ -508,25 +3582,42 @@ func (a *FileBasedAuthenticator) userHasAccess(user *User, target Target) (AuthR
 		return AuthOk, ""
 
 	case LevelFulltimeUser:
-		if !isday {
+		// Fulltime users can have different hours depending on weekday,
+		// or their own.
+		window := a.AccessWindowAt(user, now)
+		if !space_open_to_public && !window.Contains(current_hour) {
+			if window.IsClosed() {
+				return AuthOkButOutsideTime,
+					"Fulltime user: closed on " + now.Weekday().String()
+			}
 			return AuthOkButOutsideTime,
-				fmt.Sprintf("Fulltime user outside %d:00..%d:00",
-					hour_from, hour_to)
+				fmt.Sprintf("Fulltime user outside %s", window)
 		}
 		return AuthOk, ""
 
 	case LevelUser:
-		if !isday {
+		window := a.AccessWindowAt(user, now)
+		if !space_open_to_public && !window.Contains(current_hour) {
+			if window.IsClosed() {
+				return AuthOkButOutsideTime,
+					"Regular user: closed on " + now.Weekday().String()
+			}
 			return AuthOkButOutsideTime,
-				fmt.Sprintf("Regular user outside %d:00..%d:00",
-					hour_from, hour_to)
+				fmt.Sprintf("Regular user outside %s", window)
 		}
 		now := a.clock.Now().Unix()
-		if now >= HolidayHiatusBegin && now <= HolidayHiatusEnd {
+		if !space_open_to_public && now >= HolidayHiatusBegin && now <= HolidayHiatusEnd {
 			return AuthOkButOutsideTime, "Regular user during holiday hiatus period"
 		}
 		return AuthOk, ""
 
+	case LevelGuest:
+		// Only where the pass is for; time is limited by its validity.
+		if !user.HasTarget(target) {
+			return AuthFail, fmt.Sprintf("Guest pass not valid for %s", target)
+		}
+		return AuthOk, ""
+
 	case LevelHiatus:
 		return AuthFail, "On Hiatus"
 	}
@@ -1,11 +1,20 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"encoding/csv"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"testing"
 	"time"
@@ -72,9 +81,7 @@ func CreateSimpleFileAuth(authFile *os.File, clock Clock) Authenticator {
 	rootUser.WriteCSV(writer)
 	writer.Flush()
 	authFile.Close()
-	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
-	auth.clock = clock
-	return auth
+	return NewFileBasedAuthenticatorWithClock(authFile.Name(), NewApplicationBus(), "", clock)
 }
 
 func TestAddUser(t *testing.T) {
@@ -110,6 +117,13 @@ func TestAddUser(t *testing.T) {
 	// Let's attempt to set a user with the same code
 	ExpectFalse(t, eatmsg(auth.AddNewUser("root123", u)),
 		"Adding user with code already in use.")
+	u.Codes = []string{hashAuthCode("fresh123"), hashAuthCode("doe123")}
+	ok, msg := auth.AddNewUser("root123", u)
+	ExpectFalse(t, ok, "Second code in use")
+	ExpectTrue(t, strings.Contains(msg, "Code 2 (hint "+codeHint("doe123")+")") &&
+		strings.Contains(msg, "'Jon Doe'") && !strings.Contains(msg, "doe123"),
+		"Which code, hinted, and whose: "+msg)
+	ExpectTrue(t, auth.FindUser("fresh123") == nil, "No code of it added")
 
 	u.Name = "Another,user;[]funny\"characters '" // Stress-test CSV :)
 	u.SetAuthCode("other123")
@@ -143,12 +157,24 @@ func TestAddUser(t *testing.T) {
 		"Attempt to add user by non-member")
 
 	// Ok, now let's see if an new authenticator can make sense of the
-	// file we appended to.
-	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	// file we wrote.
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
 	ExpectTrue(t, auth.FindUser("root123") != nil, "Finding root123")
 	ExpectTrue(t, auth.FindUser("doe123") != nil, "Finding doe123")
 	ExpectTrue(t, auth.FindUser("other123") != nil, "Finding other123")
 	ExpectTrue(t, auth.FindUser("expired123") != nil, "Finding expired123")
+
+	// The file is rewritten as a whole, but keeps its permissions.
+	os.Chmod(authFile.Name(), 0600)
+	u.Name = "Permission Checker"
+	u.UserLevel = LevelUser
+	u.SetAuthCode("perm123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	fileinfo, _ := os.Stat(authFile.Name())
+	ExpectTrue(t, fileinfo.Mode().Perm() == 0600,
+		fmt.Sprintf("Expected permissions to stay, got %v", fileinfo.Mode()))
+	leftover, _ := filepath.Glob(authFile.Name() + ".tmp*")
+	ExpectTrue(t, len(leftover) == 0, "No temp files left behind")
 }
 
 func TestUpdateUser(t *testing.T) {
@@ -201,8 +227,24 @@ func TestUpdateUser(t *testing.T) {
 	// This guy should still be there and found.
 	ExpectTrue(t, auth.FindUser("unchanged123") != nil, "Unchanged User")
 
+	// Failures tell us why.
+	ok, msg := auth.UpdateUser("root123", "nosuch123", func(user *User) bool { return true })
+	ExpectFalse(t, ok, "Updating non-existent user")
+	ExpectTrue(t, strings.Contains(msg, "No user"), "Unexpected message: "+msg)
+
+	// Stealing another user's code is refused and leaves things as-is.
+	ok, msg = auth.UpdateUser("root123", "newdoe123", func(user *User) bool {
+		user.SetAuthCode("unchanged123")
+		return true
+	})
+	ExpectFalse(t, ok, "Updating to code used by another user")
+	ExpectTrue(t, strings.Contains(msg, "already used"), "Unexpected message: "+msg)
+	ExpectTrue(t, auth.FindUser("newdoe123") != nil, "Conflict: newdoe123 still there")
+	ExpectTrue(t, auth.FindUser("unchanged123").Name == "Unchanged User",
+		"Conflict: unchanged123 still owned by Unchanged User")
+
 	// Now let's see if everything is properly persisted
-	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
 	ExpectTrue(t, auth.FindUser("root123") != nil, "Reread: Finding root123")
 	ExpectTrue(t, auth.FindUser("unchanged123") != nil, "Reread: Finding unchanged123")
 	ExpectTrue(t, auth.FindUser("newdoe123") != nil, "Reread: Finding newdoe123")
@@ -237,10 +279,33 @@ func TestDeleteUser(t *testing.T) {
 	// This guy should still be there and found.
 	ExpectTrue(t, auth.FindUser("unchanged123") != nil, "Unchanged User")
 
-	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus())
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
 	ExpectTrue(t, auth.FindUser("root123") != nil, "Reread: Finding root123")
 	ExpectTrue(t, auth.FindUser("unchanged123") != nil, "Reread: Finding unchanged")
 	ExpectFalse(t, auth.FindUser("doe123") != nil, "Reread: Finding doe123")
+
+	ok, msg := auth.DeleteUser("root123", "doe123")
+	ExpectFalse(t, ok, "Deleting already deleted user")
+	ExpectTrue(t, strings.Contains(msg, "No user"), "Unexpected message: "+msg)
+
+	ExpectFalse(t, eatmsg(auth.DeleteUser("unchanged123", "root123")),
+		"Regular user attempted to delete")
+	ExpectTrue(t, auth.FindUser("root123") != nil, "root123 still there")
+
+	// If we can't write the file, the user stays around: make the
+	// atomic rename fail by putting a non-empty directory in its place.
+	os.Remove(authFile.Name())
+	os.MkdirAll(authFile.Name()+"/blocker", 0755)
+	defer os.RemoveAll(authFile.Name())
+	// .. with the same timestamp, so that it isn't considered for reload.
+	stamp := auth.(*FileBasedAuthenticator).fileTimestamp
+	os.Chtimes(authFile.Name(), stamp, stamp)
+	ok, msg = auth.DeleteUser("root123", "unchanged123")
+	ExpectFalse(t, ok, "Delete should fail if file can't be written")
+	ExpectTrue(t, strings.Contains(msg, "Could not write"), "Unexpected message: "+msg)
+	ExpectTrue(t, auth.FindUser("unchanged123") != nil, "Failed delete: unchanged123 still there")
+	leftover, _ := filepath.Glob(authFile.Name() + ".tmp*")
+	ExpectTrue(t, len(leftover) == 0, "Temp file should be cleaned up")
 }
 
 func TestTimeLimits(t *testing.T) {
@@ -419,3 +484,3977 @@ func TestHolidayTimeLimits(t *testing.T) {
 	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
 		AuthOkButOutsideTime, "outside")
 }
+
+func TestDefaultTarget(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "default-target")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	// Without configured default, an empty target is an error.
+	ExpectAuthResult(t, auth, "root123", Target(""), AuthFail, "no default target")
+
+	auth.(*FileBasedAuthenticator).SetDefaultTarget(TargetUpstairs)
+	ExpectAuthResult(t, auth, "root123", Target(""), AuthOk, "")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "nonexist123", Target(""), AuthFail, "No user")
+}
+
+func TestBulkRevokeCodesBefore(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "bulk-revoke")
+	auditFile, _ := ioutil.TempFile("", "bulk-revoke-audit")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(auditFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	logger, _ := NewAuditLogger(auditFile.Name())
+	fileAuth.SetAuditLogger(logger)
+
+	firstBatch, _ := time.Parse("2006-01-02", "2016-03-01")
+	compromiseDate, _ := time.Parse("2006-01-02", "2016-04-01")
+	secondBatch, _ := time.Parse("2006-01-02", "2016-05-01")
+
+	mockClock.now = firstBatch
+	u := User{
+		Name:        "Old Card",
+		ContactInfo: "old@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("oldcard123")
+	auth.AddNewUser("root123", u)
+
+	mockClock.now = secondBatch
+	u = User{
+		Name:        "New Card",
+		ContactInfo: "new@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("newcard123")
+	auth.AddNewUser("root123", u)
+
+	// Only members are allowed to do this.
+	_, err := fileAuth.BulkRevokeCodesBefore("newcard123", compromiseDate)
+	ExpectTrue(t, err != nil, "Non-member bulk revoke")
+
+	revoked, err := fileAuth.BulkRevokeCodesBefore("root123", compromiseDate)
+	ExpectTrue(t, err == nil, "Bulk revoke by member")
+	ExpectTrue(t, revoked == 1, "Expected exactly one revoked code")
+
+	ExpectTrue(t, auth.FindUser("oldcard123") == nil, "Old card revoked")
+	ExpectTrue(t, auth.FindUser("newcard123") != nil, "New card still valid")
+	// root user has been added without issue date: not touched.
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Unknown issue date kept")
+	audit, _ := ioutil.ReadFile(auditFile.Name())
+	ExpectTrue(t, strings.Contains(string(audit), `by="root" what="codes issued before 2016-04-01 00:00" codes=1`),
+		"Audited: "+string(audit))
+
+	// Re-read: the revoked user is still there, but needs a new code.
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	ExpectTrue(t, auth.FindUser("oldcard123") == nil, "Reread: old card revoked")
+	ExpectTrue(t, auth.FindUser("newcard123") != nil, "Reread: new card valid")
+	reissue := 0
+	auth.(*FileBasedAuthenticator).IterateUsers(func(user User) {
+		if user.NeedsCodeReissue() {
+			ExpectTrue(t, user.Name == "Old Card", "Old Card needs reissue")
+			reissue++
+		}
+	})
+	ExpectTrue(t, reissue == 1, "Expected one user needing reissue")
+
+	// Issue dates survived the round-trip: nothing more to revoke.
+	revoked, _ = auth.(*FileBasedAuthenticator).BulkRevokeCodesBefore("root123", compromiseDate)
+	ExpectTrue(t, revoked == 0, "Nothing left to revoke")
+}
+
+func TestBulkRevokeWriteFailure(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "bulk-revoke-fail")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	firstBatch, _ := time.Parse("2006-01-02", "2016-03-01")
+	mockClock.now = firstBatch
+	u := User{Name: "Old Card", ContactInfo: "old@noisebridge.net", UserLevel: LevelUser}
+	u.SetAuthCode("oldcard123")
+	auth.AddNewUser("root123", u)
+
+	// Make the atomic rename fail, with the same timestamp so that the
+	// file isn't considered for reload.
+	os.Remove(authFile.Name())
+	os.MkdirAll(authFile.Name()+"/blocker", 0755)
+	defer os.RemoveAll(authFile.Name())
+	stamp := auth.fileTimestamp
+	os.Chtimes(authFile.Name(), stamp, stamp)
+	revoked, err := auth.BulkRevokeCodesBefore("root123", firstBatch.Add(time.Hour))
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "Could not write"),
+		fmt.Sprintf("Write failure: %v", err))
+	ExpectTrue(t, revoked == 0, "Nothing revoked")
+	ExpectTrue(t, auth.FindUser("oldcard123") != nil, "Old card kept in memory")
+}
+
+// Write a user file with root and "count" regular users and make sure
+// the modification time is different from before, so that it is seen as
+// changed.
+func writeNumberedUserFile(filename string, count int) {
+	users := make([]User, 0, count+1)
+	rootUser := User{
+		Name:        "root",
+		ContactInfo: "root@nb",
+		UserLevel:   LevelMember}
+	rootUser.SetAuthCode("root123")
+	users = append(users, rootUser)
+	for i := 0; i < count; i++ {
+		u := User{
+			Name:        fmt.Sprintf("user%d", i),
+			ContactInfo: fmt.Sprintf("user%d@nb", i),
+			UserLevel:   LevelUser}
+		u.SetAuthCode(fmt.Sprintf("user%d_code", i))
+		users = append(users, u)
+	}
+	writeUserFile(filename, users)
+}
+
+// Write the users to the file, and make sure it looks changed.
+func writeUserFile(filename string, users []User) {
+	f, _ := os.Create(filename)
+	writer := csv.NewWriter(f)
+	for _, u := range users {
+		u.WriteCSV(writer)
+	}
+	writer.Flush()
+	f.Close()
+	fileModCount++
+	modTime := time.Now().Add(time.Duration(fileModCount) * time.Minute)
+	os.Chtimes(filename, modTime, modTime)
+}
+
+var fileModCount = 0
+
+// Return the first event of given type seen on the channel, or nil.
+func findEvent(bus *ApplicationBus, channel AppEventChannel, ev AppEventType) *AppEvent {
+	bus.Flush()
+	for {
+		select {
+		case event := <-channel:
+			if event.Ev == ev {
+				return event
+			}
+		case <-time.After(50 * time.Millisecond):
+			return nil
+		}
+	}
+}
+
+func TestReloadUserCountDropAlert(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "reload-drop")
+	authFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	writeNumberedUserFile(authFile.Name(), 20)
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	auth := NewFileBasedAuthenticator(authFile.Name(), bus, "")
+	auth.SetReloadDropAlert(5, 0)
+
+	// Small change: no alert.
+	writeNumberedUserFile(authFile.Name(), 18)
+	ExpectTrue(t, auth.FindUser("user17_code") != nil, "Reloaded")
+	ExpectTrue(t, findEvent(bus, events, AppUserCountAlert) == nil,
+		"Unexpected alert for small change")
+
+	// Losing a lot of users
+	writeNumberedUserFile(authFile.Name(), 3)
+	ExpectTrue(t, auth.FindUser("user17_code") == nil, "Reloaded")
+	alert := findEvent(bus, events, AppUserCountAlert)
+	ExpectTrue(t, alert != nil && alert.Value == 4, "Expected drop alert")
+
+	// Same with percentages.
+	auth.SetReloadDropAlert(0, 50)
+	writeNumberedUserFile(authFile.Name(), 2) // 4 -> 3 users: 25%
+	auth.FindUser("root123")
+	ExpectTrue(t, findEvent(bus, events, AppUserCountAlert) == nil,
+		"Unexpected alert for 25% drop")
+	writeNumberedUserFile(authFile.Name(), 0) // 3 -> 1 users: 66%
+	auth.FindUser("root123")
+	ExpectTrue(t, findEvent(bus, events, AppUserCountAlert) != nil,
+		"Expected alert for 66% drop")
+}
+
+func TestCustomDenyMessage(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "deny-message")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(-12 * time.Hour)
+	u := User{
+		Name:        "Some User",
+		ContactInfo: "user@noisebridge.net",
+		UserLevel:   LevelUser,
+		DenyMessage: "See Bob about renewing"}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+
+	mockClock.now = someMidnight.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside.*See Bob about renewing")
+
+	// Granted: nothing to see.
+	mockClock.now = someMidnight.Add(13 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "^$")
+
+	// Survives round-trip through the file
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	ExpectTrue(t, auth.FindUser("user123").DenyMessage == "See Bob about renewing",
+		"Reread: deny message")
+	ExpectTrue(t, auth.FindUser("root123").DenyMessage == "", "Reread: root")
+}
+
+func TestFulltimeWeekendSchedule(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "fulltime-weekend")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	saturday, _ := time.Parse("2006-01-02", "2014-10-11")
+	tuesday, _ := time.Parse("2006-01-02", "2014-10-14")
+
+	mockClock.now = saturday.Add(-24 * time.Hour)
+	u := User{
+		Name:        "Some Fulltime User",
+		ContactInfo: "ftuser@noisebridge.net",
+		UserLevel:   LevelFulltimeUser}
+	u.SetAuthCode("fulltimeuser123")
+	auth.AddNewUser("root123", u)
+
+	// Default: same window on all days.
+	mockClock.now = saturday.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 7:00..24:00")
+
+	schedule := EveryDaySchedule(7, 24)
+	schedule[time.Saturday] = HourWindow{0, 24}
+	schedule[time.Sunday] = HourWindow{0, 24}
+	auth.(*FileBasedAuthenticator).SetFulltimeSchedule(schedule)
+
+	mockClock.now = saturday.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
+	mockClock.now = tuesday.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside")
+	mockClock.now = tuesday.Add(8 * time.Hour)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
+}
+
+func TestConfigurableAccessHours(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "access-hours")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(-12 * time.Hour)
+	u := User{
+		Name:        "Some User",
+		ContactInfo: "user@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+	u = User{
+		Name:        "Some Fulltime User",
+		ContactInfo: "ftuser@noisebridge.net",
+		UserLevel:   LevelFulltimeUser}
+	u.SetAuthCode("fulltimeuser123")
+	auth.AddNewUser("root123", u)
+
+	// Defaults
+	mockClock.now = someMidnight.Add(9 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 10:00..23:00")
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
+
+	// Only configure regular users; fulltime stays default.
+	ExpectTrue(t, fileAuth.SetAccessHours(AccessHours{UserStart: 8, UserEnd: 20}) == nil,
+		"Valid hours")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "")
+	mockClock.now = someMidnight.Add(20 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 8:00..20:00")
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
+
+	ExpectTrue(t, fileAuth.SetAccessHours(AccessHours{FulltimeStart: 9, FulltimeEnd: 18}) == nil,
+		"Valid hours")
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 9:00..18:00")
+
+	// Garbage is rejected and doesn't change anything.
+	for _, bad := range []AccessHours{
+		{UserStart: 20, UserEnd: 8},
+		{UserStart: 5, UserEnd: 5},
+		{UserStart: -1, UserEnd: 8},
+		{UserStart: 24, UserEnd: 25},
+		{FulltimeStart: 7, FulltimeEnd: 25},
+	} {
+		ExpectTrue(t, fileAuth.SetAccessHours(bad) != nil,
+			fmt.Sprintf("Expected error for %+v", bad))
+	}
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 9:00..18:00")
+}
+
+func TestPersonalAccessHours(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "personal-hours")
+	authFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock := &MockClock{now: someMidnight.Add(2 * time.Hour)}
+
+	// Older files without the personal hours, one with, one with garbage.
+	content := []string{
+		"root,root@nb,member,,,," + hashAuthCode("root123"),
+		"Day User,day@nb,user,,,," + hashAuthCode("day123"),
+		"Night Owl,owl@nb,user,,,," + hashAuthCode("owl123") + ",,,,,,,0,6",
+		"Broken,broken@nb,user,,,," + hashAuthCode("broken123") + ",,,,,,,6,",
+	}
+	ioutil.WriteFile(authFile.Name(), []byte(strings.Join(content, "\n")+"\n"), 0644)
+	auth := NewFileBasedAuthenticatorWithClock(authFile.Name(), NewApplicationBus(), "", mockClock)
+
+	owl := auth.FindUser("owl123")
+	ExpectTrue(t, owl != nil && owl.Hours != nil && *owl.Hours == HourWindow{0, 6},
+		"Personal hours read")
+	ExpectTrue(t, auth.FindUser("broken123").Hours == nil, "Garbage ignored")
+	ExpectAuthResult(t, auth, "owl123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "day123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 10:00..23:00")
+	ExpectAuthResult(t, auth, "broken123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 10:00..23:00")
+
+	mockClock.now = someMidnight.Add(12 * time.Hour)
+	ExpectAuthResult(t, auth, "owl123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 0:00..6:00")
+	ExpectAuthResult(t, auth, "day123", TargetUpstairs, AuthOk, "")
+	ExpectTrue(t, auth.AccessWindowAt(owl, mockClock.now) == HourWindow{0, 6},
+		"Window shown of the personal hours")
+
+	// Survives rewriting the file; others don't grow empty columns.
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "broken123")), "Deleting")
+	written, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.Contains(string(written), hashAuthCode("owl123")+",,,,,,,0,6\n"),
+		"Personal hours written")
+	ExpectTrue(t, strings.Contains(string(written), hashAuthCode("day123")+"\n"),
+		"No personal hours written")
+	auth = NewFileBasedAuthenticatorWithClock(authFile.Name(), NewApplicationBus(), "", mockClock)
+	ExpectAuthResult(t, auth, "owl123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 0:00..6:00")
+}
+
+func TestDisabledUser(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "disabled-user")
+	authFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	// Older files don't have the field: enabled.
+	content := []string{
+		"root,root@nb,member,,,," + hashAuthCode("root123"),
+		"Other Member,other@nb,member,,,," + hashAuthCode("other123") + ",,,,,,,,,disabled",
+		"Some User,user@nb,user,,,," + hashAuthCode("user123"),
+	}
+	ioutil.WriteFile(authFile.Name(), []byte(strings.Join(content, "\n")+"\n"), 0644)
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+
+	ExpectTrue(t, !auth.FindUser("root123").Disabled, "Enabled by default")
+	result, reason, msg := auth.AuthUserWithReason("other123", TargetUpstairs)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedDisabled &&
+		msg == "account disabled", "Disabled member: "+msg)
+	ExpectFalse(t, eatmsg(auth.DeleteUser("other123", "user123")),
+		"Disabled member can't administer")
+
+	// Suspending keeps level and validity.
+	ExpectTrue(t, eatmsg(auth.UpdateUser("root123", "user123", func(user *User) bool {
+		user.Disabled = true
+		return true
+	})), "Disabling")
+	result, reason, _ = auth.AuthUserWithReason("user123", TargetUpstairs)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedDisabled, "Disabled user")
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	user := auth.FindUser("user123")
+	ExpectTrue(t, user.Disabled && user.UserLevel == LevelUser, "Disabled after rewrite")
+	ExpectTrue(t, eatmsg(auth.UpdateUser("root123", "user123", func(user *User) bool {
+		user.Disabled = false
+		return true
+	})), "Enabling")
+	ExpectTrue(t, !auth.FindUser("user123").Disabled, "Enabled again")
+	written, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.Contains(string(written), hashAuthCode("user123")+"\n"),
+		"No empty columns when enabled")
+}
+
+func TestCoSponsors(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "co-sponsors")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	mockClock.now, _ = time.Parse("2006-01-02", "2014-10-10")
+
+	other := User{Name: "Other Member", ContactInfo: "other@nb", UserLevel: LevelMember}
+	other.Codes = []string{hashAuthCode("other123"), hashAuthCode("otherrfid")}
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", other)), "Adding member")
+	fileAuth.SetCoSponsorAfter(90 * 24 * time.Hour)
+	mockClock.now = mockClock.now.Add(time.Hour)
+
+	// Short-term and anonymous users need only one sponsor.
+	short := User{Name: "Short", ContactInfo: "short@nb", UserLevel: LevelUser,
+		ValidTo: mockClock.now.Add(30 * 24 * time.Hour)}
+	short.SetAuthCode("short123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", short)), "Short-term user")
+	anonymous := User{UserLevel: LevelUser}
+	anonymous.SetAuthCode("anonymous123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", anonymous)), "Anonymous user")
+
+	long := User{Name: "Long", ContactInfo: "long@nb", UserLevel: LevelUser}
+	long.SetAuthCode("long123")
+	ok, msg := auth.AddNewUser("root123", long)
+	ExpectFalse(t, ok, "Unlimited user with one sponsor")
+	ExpectTrue(t, strings.Contains(msg, "second sponsor"), msg)
+	ExpectFalse(t, eatmsg(fileAuth.AddNewUserWithSponsors([]string{"other123", "otherrfid"}, long)),
+		"Same member twice")
+	ExpectFalse(t, eatmsg(fileAuth.AddNewUserWithSponsors([]string{"root123", "short123"}, long)),
+		"Second sponsor not allowed to add")
+	ExpectTrue(t, auth.FindUser("long123") == nil, "Not added")
+
+	ExpectTrue(t, eatmsg(fileAuth.AddNewUserWithSponsors([]string{"root123", "other123"}, long)),
+		"Two sponsors")
+	added := auth.FindUser("long123")
+	ExpectTrue(t, added != nil && len(added.Sponsors) == 2 &&
+		added.Sponsors[0] == hashAuthCode("root123") &&
+		added.Sponsors[1] == hashAuthCode("other123"), "Both sponsors recorded")
+}
+
+func TestValidateNewUser(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "validate-user")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	mockClock.now, _ = time.Parse("2006-01-02", "2014-10-10")
+	before, _ := ioutil.ReadFile(authFile.Name())
+
+	u := User{Name: "Jon Doe", ContactInfo: "doe@nb", UserLevel: LevelUser}
+	u.SetAuthCode("doe123")
+	ExpectTrue(t, eatmsg(fileAuth.ValidateNewUser([]string{"root123"}, u)), "Would succeed")
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Not added")
+	after, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, bytes.Equal(before, after), "File untouched")
+
+	// Same answers as adding.
+	ok, msg := fileAuth.ValidateNewUser([]string{"doe123"}, u)
+	ExpectFalse(t, ok, "Unknown sponsor")
+	_, addMsg := auth.AddNewUser("doe123", u)
+	ExpectTrue(t, msg == addMsg, msg+" vs. "+addMsg)
+	weak := u
+	weak.Codes = []string{"plain"}
+	ExpectFalse(t, eatmsg(fileAuth.ValidateNewUser([]string{"root123"}, weak)), "Unhashed code")
+	taken := u
+	taken.SetAuthCode("root123")
+	ok, msg = fileAuth.ValidateNewUser([]string{"root123"}, taken)
+	ExpectFalse(t, ok, "Duplicate code")
+	ExpectTrue(t, strings.Contains(msg, "'root'"), msg)
+
+	// Validation leaves nothing behind that would stop the real thing.
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding after validating")
+}
+
+func TestImportUsers(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "import-users")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	mockClock.now, _ = time.Parse("2006-01-02", "2014-10-10")
+	newUser := func(name string, codes ...string) User {
+		u := User{Name: name, ContactInfo: name + "@nb", UserLevel: LevelUser}
+		for _, code := range codes {
+			u.Codes = append(u.Codes, hashAuthCode(code))
+		}
+		return u
+	}
+	batch := []User{
+		newUser("one", "one123"),
+		newUser("two", "two123", "one123"), // Same as one.
+		newUser("three", "root123"),        // Same as root.
+		newUser("four", "four123"),
+		{Name: "five", UserLevel: LevelUser, Codes: []string{"plain"}},
+	}
+
+	count, failures := fileAuth.ImportUsers("four123", batch, false)
+	ExpectTrue(t, count == 0 && len(failures) == 1, "Needs a member")
+
+	count, failures = fileAuth.ImportUsers("root123", batch, true)
+	ExpectTrue(t, count == 0 && len(failures) == 3, fmt.Sprintf("Atomic: %v", failures))
+	ExpectTrue(t, auth.FindUser("one123") == nil, "Atomic: none added")
+
+	count, failures = fileAuth.ImportUsers("root123", batch, false)
+	ExpectTrue(t, count == 2 && len(failures) == 3, fmt.Sprintf("Skipping: %v", failures))
+	if len(failures) == 3 {
+		ExpectTrue(t, strings.Contains(failures[0], "'two'") &&
+			strings.Contains(failures[0], "'one'") &&
+			strings.Contains(failures[0], "in this import"), failures[0])
+		ExpectTrue(t, strings.Contains(failures[1], "'three'") &&
+			strings.Contains(failures[1], "'root'"), failures[1])
+		ExpectTrue(t, strings.Contains(failures[2], "'five'"), failures[2])
+	}
+	ExpectTrue(t, auth.FindUser("one123") != nil && auth.FindUser("four123") != nil,
+		"Valid ones added")
+	ExpectTrue(t, auth.FindUser("two123") == nil, "Duplicate within batch skipped")
+
+	// Written to the file.
+	reread := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	found := reread.FindUser("four123")
+	ExpectTrue(t, found != nil && found.Sponsors[0] == hashAuthCode("root123"),
+		"Stored with sponsor")
+}
+
+func TestProbation(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "probation")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	auditFile, _ := ioutil.TempFile("", "probation-audit")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(auditFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	logger, _ := NewAuditLogger(auditFile.Name())
+	fileAuth.SetAuditLogger(logger)
+	ExpectTrue(t, fileAuth.SetProbation(LevelUser, LevelHiatus, time.Hour) != nil,
+		"Not to hiatus")
+	ExpectTrue(t, fileAuth.SetProbation(LevelHiatus, LevelUser, time.Hour) != nil,
+		"Not from hiatus")
+	ExpectTrue(t, fileAuth.SetProbation(LevelUser, LevelFulltimeUser, 30*24*time.Hour) == nil,
+		"Setting probation")
+
+	start, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = start
+	for _, name := range []string{"doe", "roe"} {
+		u := User{Name: name, ContactInfo: name + "@nb", UserLevel: LevelUser}
+		u.SetAuthCode(name + "123")
+		u.Disabled = name == "roe"
+		ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding "+name)
+	}
+
+	mockClock.now = start.Add(29 * 24 * time.Hour)
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.FindUser("doe123").UserLevel == LevelUser, "Still on probation")
+
+	mockClock.now = start.Add(30 * 24 * time.Hour)
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.FindUser("doe123").UserLevel == LevelFulltimeUser, "Promoted")
+	ExpectAuthResult(t, auth, "roe123", TargetDownstairs, AuthFail, "disabled")
+	ExpectTrue(t, auth.FindUser("roe123").UserLevel == LevelUser, "Disabled not promoted")
+
+	reread := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	ExpectTrue(t, reread.FindUser("doe123").UserLevel == LevelFulltimeUser, "Persisted")
+	audit, _ := ioutil.ReadFile(auditFile.Name())
+	ExpectTrue(t, strings.Contains(string(audit), `user-promoted by="" user="doe" level=fulltimeuser`),
+		"Audit logged: "+string(audit))
+}
+
+func TestElevateUser(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "elevate")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	auditFile, _ := ioutil.TempFile("", "elevate-audit")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(auditFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	logger, _ := NewAuditLogger(auditFile.Name())
+	fileAuth.SetAuditLogger(logger)
+
+	evening, _ := time.Parse("2006-01-02 15:04", "2014-10-10 20:00")
+	mockClock.now = evening
+	u := User{Name: "Host", ContactInfo: "host@nb", UserLevel: LevelUser}
+	u.SetAuthCode("host123")
+	auth.AddNewUser("root123", u)
+	other := User{Name: "Other", ContactInfo: "other@nb", UserLevel: LevelUser}
+	other.SetAuthCode("other123")
+	auth.AddNewUser("root123", other)
+	mockClock.now = evening.Add(time.Hour)
+
+	until := evening.Add(6 * time.Hour) // 02:00
+	ExpectFalse(t, eatmsg(fileAuth.ElevateUser("other123", "Host", LevelMember, until)),
+		"Needs a member")
+	ExpectFalse(t, eatmsg(fileAuth.ElevateUser("root123", "Host", LevelMember, evening)),
+		"Needs to end in the future")
+	ExpectFalse(t, eatmsg(fileAuth.ElevateUser("root123", "Nobody", LevelMember, until)),
+		"Unknown user")
+	ExpectTrue(t, eatmsg(fileAuth.ElevateUser("root123", "Host", LevelMember, until)),
+		"Elevating")
+
+	// After regular hours, only the host gets in.
+	mockClock.now = evening.Add(4 * time.Hour) // Midnight.
+	ExpectAuthResult(t, auth, "host123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "other123", TargetUpstairs, AuthOkButOutsideTime, "")
+	ExpectTrue(t, auth.FindUser("host123").UserLevel == LevelUser, "Stored level unchanged")
+	ExpectFalse(t, eatmsg(auth.AddNewUser("host123", other)), "Can't manage users")
+
+	// Back to normal afterwards.
+	mockClock.now = until.Add(time.Minute)
+	ExpectAuthResult(t, auth, "host123", TargetUpstairs, AuthOkButOutsideTime, "")
+	audit, _ := ioutil.ReadFile(auditFile.Name())
+	ExpectTrue(t, strings.Contains(string(audit),
+		`user-elevated by="root" user="Host" level=member until=2014-10-11 02:00`),
+		"Elevation audited: "+string(audit))
+	ExpectTrue(t, strings.Contains(string(audit),
+		`2014-10-11 02:00:00 +0000 elevation-ended by="root" user="Host" level=member`),
+		"End audited at its time: "+string(audit))
+}
+
+func TestWeekdayAccessHours(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "weekday-hours")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+
+	friday, _ := time.Parse("2006-01-02", "2014-10-10")
+	saturday := friday.Add(24 * time.Hour)
+	sunday := saturday.Add(24 * time.Hour)
+
+	mockClock.now = friday.Add(-12 * time.Hour)
+	u := User{
+		Name:        "Some User",
+		ContactInfo: "user@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+	u = User{
+		Name:        "Some Fulltime User",
+		ContactInfo: "ftuser@noisebridge.net",
+		UserLevel:   LevelFulltimeUser}
+	u.SetAuthCode("fulltimeuser123")
+	auth.AddNewUser("root123", u)
+	u = User{
+		Name:        "Some Philanthropist",
+		ContactInfo: "phil@noisebridge.net",
+		UserLevel:   LevelPhilanthropist}
+	u.SetAuthCode("philanthropist123")
+	auth.AddNewUser("root123", u)
+
+	weekdays, err := ParseWeekdayHours("sat=12-23, Sunday=closed")
+	ExpectTrue(t, err == nil, "Parsing weekday hours")
+	ExpectTrue(t, fileAuth.SetAccessHours(AccessHours{
+		UserWeekdays:     weekdays,
+		FulltimeWeekdays: map[time.Weekday]HourWindow{time.Sunday: {0, 24}},
+	}) == nil, "Valid weekday hours")
+
+	// Friday: no entry, global window.
+	mockClock.now = friday.Add(10 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "")
+
+	// Saturday: later.
+	mockClock.now = saturday.Add(10 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 12:00..23:00")
+	mockClock.now = saturday.Add(12 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "")
+	mockClock.now = saturday.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs,
+		AuthOkButOutsideTime, "outside 7:00..24:00")
+
+	// Sunday: closed for regular users, all day for fulltime.
+	mockClock.now = sunday.Add(15 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "closed on Sunday")
+	mockClock.now = sunday.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "philanthropist123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "root123", TargetUpstairs, AuthOk, "")
+
+	// Bad weekday configuration.
+	_, err = ParseWeekdayHours("someday=1-2")
+	ExpectTrue(t, err != nil, "Unknown weekday")
+	ExpectTrue(t, fileAuth.SetAccessHours(AccessHours{
+		UserWeekdays: map[time.Weekday]HourWindow{time.Monday: {20, 25}},
+	}) != nil, "Invalid weekday window")
+	mockClock.now = sunday.Add(15 * time.Hour)
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs,
+		AuthOkButOutsideTime, "closed on Sunday")
+}
+
+func TestSignedReceipts(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "receipts")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	var receipts []AuthReceipt
+	key := []byte("deployment-secret")
+	auth.(*FileBasedAuthenticator).EnableReceipts(key,
+		func(r AuthReceipt) { receipts = append(receipts, r) })
+
+	auth.AuthUser("root123", TargetUpstairs)
+	auth.AuthUser("unknown123", TargetDownstairs)
+	if len(receipts) != 2 {
+		t.Fatalf("Expected 2 receipts, got %d", len(receipts))
+	}
+	ExpectTrue(t, receipts[0].Result == AuthOk, "Granted receipt")
+	ExpectTrue(t, receipts[0].CodeHash == hashAuthCode("root123"), "Hashed code")
+	ExpectTrue(t, receipts[1].Result == AuthFail, "Denied receipt")
+	ExpectTrue(t, VerifyReceipt(key, receipts[0]), "Verify granted")
+	ExpectTrue(t, VerifyReceipt(key, receipts[1]), "Verify denied")
+
+	ExpectFalse(t, VerifyReceipt([]byte("other key"), receipts[0]),
+		"Verify with wrong key")
+	tampered := receipts[1]
+	tampered.Result = AuthOk
+	ExpectFalse(t, VerifyReceipt(key, tampered), "Tampered result")
+	tampered = receipts[0]
+	tampered.Timestamp = tampered.Timestamp.Add(-6 * time.Hour)
+	ExpectFalse(t, VerifyReceipt(key, tampered), "Tampered timestamp")
+}
+
+func TestReloadLevelMinimums(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "reload-minimums")
+	authFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	member := func(name string) User {
+		u := User{Name: name, ContactInfo: name + "@nb", UserLevel: LevelMember}
+		u.SetAuthCode(name + "_code")
+		return u
+	}
+	writeUserFile(authFile.Name(), []User{member("alice"), member("bob")})
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	auth := NewFileBasedAuthenticator(authFile.Name(), bus, "")
+	auth.SetLevelMinimums(map[Level]int{LevelMember: 2}, false)
+
+	// Non-strict: alert, but use the new file.
+	writeUserFile(authFile.Name(), []User{member("alice")})
+	ExpectTrue(t, auth.FindUser("bob_code") == nil, "Non-strict: bob gone")
+	ExpectTrue(t, findEvent(bus, events, AppUserCountAlert) != nil,
+		"Expected alert for too few members")
+
+	writeUserFile(authFile.Name(), []User{member("alice"), member("carol")})
+	ExpectTrue(t, auth.FindUser("carol_code") != nil, "Carol added")
+	ExpectTrue(t, findEvent(bus, events, AppUserCountAlert) == nil,
+		"Enough members again")
+
+	// Strict: keep the previous state.
+	auth.SetLevelMinimums(map[Level]int{LevelMember: 2}, true)
+	writeUserFile(authFile.Name(), []User{member("dave")})
+	ExpectTrue(t, auth.FindUser("dave_code") == nil, "Strict: dave not loaded")
+	ExpectTrue(t, auth.FindUser("carol_code") != nil, "Strict: carol kept")
+	ExpectTrue(t, findEvent(bus, events, AppUserCountAlert) != nil,
+		"Expected alert in strict mode")
+	// .. and we're not re-reading the same bad file over and over again.
+	auth.FindUser("alice_code")
+	ExpectTrue(t, findEvent(bus, events, AppUserCountAlert) == nil,
+		"Bad file only reported once")
+}
+
+func TestBadgeReprint(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "badges")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	u := User{
+		Name:        "Jon Doe",
+		ContactInfo: "jon@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("doe123")
+	auth.AddNewUser("root123", u)
+
+	// Anonymous cards don't get badges.
+	u = User{UserLevel: LevelUser}
+	u.SetAuthCode("anon123")
+	auth.AddNewUser("root123", u)
+
+	needBadge := func() string {
+		users, msg := fileAuth.UsersNeedingBadges("root123")
+		ExpectTrue(t, msg == "", msg)
+		names := ""
+		for _, user := range users {
+			names += user.Name + ";"
+		}
+		return names
+	}
+
+	_, msg := fileAuth.UsersNeedingBadges("doe123")
+	ExpectTrue(t, msg != "", "Only members can ask for badges")
+	ExpectFalse(t, eatmsg(fileAuth.MarkBadgePrinted("doe123", "doe123")),
+		"Only members can mark badges")
+
+	ExpectTrue(t, needBadge() == "root;Jon Doe;", "Never printed: "+needBadge())
+	ExpectTrue(t, eatmsg(fileAuth.MarkBadgePrinted("root123", "doe123")), "Mark")
+	ExpectTrue(t, eatmsg(fileAuth.MarkBadgePrinted("root123", "root123")), "Mark")
+	ExpectTrue(t, needBadge() == "", "All printed: "+needBadge())
+
+	// Changing name or level requires a new badge.
+	auth.UpdateUser("root123", "doe123", func(user *User) bool {
+		user.Name = "Jon Doe-Smith"
+		return true
+	})
+	ExpectTrue(t, needBadge() == "Jon Doe-Smith;", "Name changed: "+needBadge())
+
+	// Everything is persisted.
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	fileAuth = auth.(*FileBasedAuthenticator)
+	ExpectTrue(t, needBadge() == "Jon Doe-Smith;", "Reread: "+needBadge())
+	fileAuth.MarkBadgePrinted("root123", "doe123")
+	ExpectTrue(t, needBadge() == "", "Printed again: "+needBadge())
+}
+
+func TestHoldTargetOpen(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "hold-open")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	fileAuth := auth.(*FileBasedAuthenticator)
+	fileAuth.eventBus = bus
+
+	start, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = start
+	u := User{
+		Name:        "Jon Doe",
+		ContactInfo: "jon@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("doe123")
+	auth.AddNewUser("root123", u)
+
+	ExpectFalse(t, fileAuth.IsTargetHeldOpen(TargetDownstairs), "Initially closed")
+	ExpectFalse(t, eatmsg(fileAuth.HoldTargetOpen("doe123", TargetDownstairs,
+		start.Add(time.Hour), "party")), "Only members can hold open")
+
+	ExpectTrue(t, eatmsg(fileAuth.HoldTargetOpen("root123", TargetDownstairs,
+		start.Add(2*time.Hour), "party")), "Hold open by member")
+	event := findEvent(bus, events, AppHoldOpenRequest)
+	ExpectTrue(t, event != nil && event.Target == TargetDownstairs &&
+		strings.Contains(event.Msg, "root") &&
+		strings.Contains(event.Msg, "party"), "Audited hold-open event")
+
+	mockClock.now = start.Add(time.Hour)
+	ExpectTrue(t, fileAuth.IsTargetHeldOpen(TargetDownstairs), "Held open")
+	ExpectFalse(t, fileAuth.IsTargetHeldOpen(TargetUpstairs), "Other target")
+
+	mockClock.now = start.Add(2 * time.Hour)
+	ExpectFalse(t, fileAuth.IsTargetHeldOpen(TargetDownstairs), "Reverted")
+
+	// Ending early
+	fileAuth.HoldTargetOpen("root123", TargetUpstairs, start.Add(5*time.Hour), "")
+	ExpectTrue(t, fileAuth.IsTargetHeldOpen(TargetUpstairs), "Held open")
+	fileAuth.HoldTargetOpen("root123", TargetUpstairs, time.Time{}, "done")
+	ExpectFalse(t, fileAuth.IsTargetHeldOpen(TargetUpstairs), "Ended early")
+}
+
+func TestReadFileWithBOMAndPadding(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "bom-padding")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	authFile.WriteString("\ufeffroot,root@nb,member,,,," + hashAuthCode("root123") + "\r\n")
+	authFile.WriteString("  Jon  Doe , jon@nb ,  user , , 2014-10-10 12:00 , , " +
+		hashAuthCode("doe123") + " ; " + hashAuthCode("doe456") + " \r\n")
+	authFile.WriteString("\ufeff# comment,with,bom,x,x,x,x\r\n")
+	authFile.Close()
+
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	root := auth.FindUser("root123")
+	ExpectTrue(t, root != nil && root.Name == "root", "First user with BOM")
+	ExpectTrue(t, root != nil && root.UserLevel == LevelMember, "Level of root")
+
+	doe := auth.FindUser("doe123")
+	ExpectTrue(t, doe != nil, "Padded user found")
+	ExpectTrue(t, auth.FindUser("doe456") != nil, "Padded second code")
+	if doe != nil {
+		ExpectTrue(t, doe.Name == "Jon  Doe", "Internal spaces preserved: '"+doe.Name+"'")
+		ExpectTrue(t, doe.ContactInfo == "jon@nb", "Trimmed contact")
+		ExpectTrue(t, doe.UserLevel == LevelUser, "Trimmed level")
+		ExpectFalse(t, doe.ValidFrom.IsZero(), "Trimmed valid-from")
+	}
+}
+
+func TestCSVTimestampFormats(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "csv-times")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	usersFile := dir + "/users.csv"
+	ioutil.WriteFile(usersFile, []byte(
+		"legacy,l@nb,user,,2014-10-10 12:00,2015-01-01 00:00,"+hashAuthCode("legacy123")+"\n"+
+			"rfc,r@nb,user,,2014-10-10T14:00:00+02:00,2015-01-01T00:00:00Z,"+hashAuthCode("rfc123")+"\n"+
+			"date,d@nb,user,,2014-10-10,2015-01-01,"+hashAuthCode("date123")+"\n"), 0644)
+	users, err := NewCSVUserStore(usersFile).Load()
+	ExpectTrue(t, err == nil && len(users) == 3, fmt.Sprintf("Loading: %v", err))
+	from, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	to, _ := time.Parse("2006-01-02", "2015-01-01")
+	for _, user := range users {
+		ExpectTrue(t, user.ValidTo.Equal(to), "ValidTo of "+user.Name)
+	}
+	ExpectTrue(t, users[0].ValidFrom.Equal(from), "Legacy format")
+	ExpectTrue(t, users[1].ValidFrom.Equal(from), "RFC3339, in UTC")
+	ExpectTrue(t, users[2].ValidFrom.Equal(from.Add(-12*time.Hour)), "Date only")
+
+	// Written back in one format.
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	users[1].WriteCSV(writer)
+	writer.Flush()
+	ExpectTrue(t, strings.Contains(buffer.String(), ",2014-10-10 12:00,2015-01-01 00:00,"),
+		"Canonical format: "+buffer.String())
+
+	// A timestamp we don't understand skips the user, not an unlimited user.
+	ioutil.WriteFile(usersFile, []byte(
+		"root,,member,,,,"+hashAuthCode("root123")+"\n"+
+			"# comment,,,,,,\n"+
+			"doe,d@nb,user,,2014-10-10,next year,"+hashAuthCode("doe123")+"\n"), 0644)
+	store := NewCSVUserStore(usersFile)
+	users, err = store.Load()
+	ExpectTrue(t, err == nil && len(users) == 1, fmt.Sprintf("Only root loaded: %v", err))
+	skipped := store.LastLoadReport().Skipped
+	ExpectTrue(t, len(skipped) == 1 && skipped[0].Line == 3 &&
+		strings.Contains(skipped[0].Reason, "ValidTo") &&
+		strings.Contains(skipped[0].Reason, "next year"),
+		fmt.Sprintf("Reported with context: %v", skipped))
+}
+
+func TestWatchUserFile(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "watch-users")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	if err := fileAuth.StartWatching(); err != nil {
+		t.Skip("Can't watch files here: ", err)
+	}
+	defer fileAuth.StopWatching()
+
+	waitForUser := func(code string) bool {
+		for i := 0; i < 100; i++ {
+			if auth.FindUser(code) != nil {
+				return true
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		return false
+	}
+
+	root := *auth.FindUser("root123")
+	doe := User{Name: "Jon Doe", UserLevel: LevelUser}
+	doe.SetAuthCode("doe123")
+
+	// Edit in place, keeping the timestamp as if the filesystem
+	// had coarse mtime. Polling wouldn't notice that.
+	stamp := fileAuth.fileTimestamp
+	writeUserFile(authFile.Name(), []User{root, doe})
+	os.Chtimes(authFile.Name(), stamp, stamp)
+	ExpectTrue(t, waitForUser("doe123"), "In-place edit picked up")
+
+	// Replace file by rename, like editors or writeAllUsers() do.
+	other := User{Name: "Other", UserLevel: LevelUser}
+	other.SetAuthCode("other123")
+	writeUserFile(authFile.Name()+".new", []User{root, doe, other})
+	os.Rename(authFile.Name()+".new", authFile.Name())
+	ExpectTrue(t, waitForUser("other123"), "Replaced file picked up")
+
+	// Back to polling after we stop.
+	fileAuth.StopWatching()
+	writeUserFile(authFile.Name(), []User{root})
+	ExpectFalse(t, auth.FindUser("doe123") != nil, "Polling after StopWatching")
+}
+
+func TestPeriodicReload(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "periodic-reload")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+
+	fileAuth.StartPeriodicReload(time.Hour)
+	scheduler := fileAuth.scheduler
+	fileAuth.StartPeriodicReload(time.Hour) // idempotent
+	ExpectTrue(t, scheduler.Pending() == 1, "One reload pending")
+
+	root := *auth.FindUser("root123")
+	doe := User{Name: "Jon Doe", UserLevel: LevelUser}
+	doe.SetAuthCode("doe123")
+	writeUserFile(authFile.Name(), []User{root, doe})
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "No check on access")
+
+	mockClock.now = mockClock.now.Add(59 * time.Minute)
+	scheduler.RunDue()
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Not yet")
+	mockClock.now = mockClock.now.Add(time.Minute)
+	ExpectTrue(t, scheduler.RunDue() == 1, "Reload due")
+	ExpectTrue(t, auth.FindUser("doe123") != nil, "Reloaded")
+	ExpectTrue(t, scheduler.Pending() == 1, "Next reload pending")
+
+	// Other periodic jobs share the scheduler, and stop with it.
+	schedules, _ := ParseOpenSchedules("gate=mon 10-18")
+	fileAuth.SetOpenSchedules(schedules)
+	fileAuth.SetClockSkewCheck(time.Hour, nil, false)
+	ExpectTrue(t, scheduler.Pending() == 3, "All jobs on one scheduler")
+
+	fileAuth.Close()
+	fileAuth.Close()
+	ExpectTrue(t, scheduler.Pending() == 0, "Nothing pending after Close")
+
+	// Back to checking on access.
+	writeUserFile(authFile.Name(), []User{root})
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Checking after Close")
+}
+
+func TestStatInterval(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "stat-interval")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	fileAuth.SetStatInterval(time.Second)
+	root := *auth.FindUser("root123") // Checked now.
+
+	doe := User{Name: "Jon Doe", UserLevel: LevelUser}
+	doe.SetAuthCode("doe123")
+	writeUserFile(authFile.Name(), []User{root, doe})
+	mockClock.now = mockClock.now.Add(999 * time.Millisecond)
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Not checked yet")
+	mockClock.now = mockClock.now.Add(time.Millisecond)
+	ExpectTrue(t, auth.FindUser("doe123") != nil, "Checked after interval")
+
+	// Clock going backwards doesn't stop us from checking.
+	writeUserFile(authFile.Name(), []User{root})
+	mockClock.now = mockClock.now.Add(-time.Hour)
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Checked after clock change")
+
+	// Lookups while the file is unchanged don't need the lock for themselves.
+	mockClock.now = mockClock.now.Add(time.Hour)
+	fileAuth.fileLock.RLock()
+	found := make(chan bool)
+	go func() { found <- auth.FindUser("root123") != nil }()
+	select {
+	case ok := <-found:
+		ExpectTrue(t, ok, "Found while the lock is shared")
+	case <-time.After(5 * time.Second):
+		t.Errorf("Lookup waits for the exclusive lock")
+	}
+	fileAuth.fileLock.RUnlock()
+}
+
+func TestClockUsedWhileLoading(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "clock-loading")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	authFile.Close()
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02", "2014-12-31")
+	member := User{Name: "Member", ContactInfo: "m@example.com", UserLevel: LevelMember}
+	member.ValidTo, _ = time.Parse("2006-01-02", "2015-01-01")
+	member.SetAuthCode("member123")
+	writeUserFile(authFile.Name(), []User{member})
+
+	auth := NewFileBasedAuthenticatorWithClock(authFile.Name(), NewApplicationBus(), "", mockClock)
+	ExpectTrue(t, auth.loadedLevelCounts[LevelMember] == 1, "Valid at load")
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, AuthOk, "")
+
+	// Reloads count valid users with the same clock.
+	auth.SetLevelMinimums(map[Level]int{LevelMember: 1}, true)
+	writeUserFile(authFile.Name(), []User{member})
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.FailedReloads() == 0, "Valid at reload")
+
+	// Across the year boundary.
+	mockClock.now = mockClock.now.Add(24 * time.Hour)
+	ExpectAuthResult(t, auth, "member123", TargetDownstairs, AuthExpired, "")
+}
+
+func TestAccessHoursAcrossDST(t *testing.T) {
+	location, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Skip("No timezone data: ", err)
+	}
+	authFile, _ := ioutil.TempFile("", "dst")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	auth.SetLocation(location)
+	root := *auth.FindUser("root123")
+	validFrom, _ := time.Parse("2006-01-02", "2014-01-01")
+	user := User{Name: "User", ContactInfo: "u@example.com",
+		UserLevel: LevelUser, ValidFrom: validFrom}
+	user.SetAuthCode("user123")
+	fulltime := User{Name: "Fulltime", ContactInfo: "f@example.com",
+		UserLevel: LevelFulltimeUser, ValidFrom: validFrom}
+	fulltime.SetAuthCode("fulltime123")
+	writeUserFile(authFile.Name(), []User{root, user, fulltime})
+
+	// The clock gives UTC. Users have 10:00..22:59, fulltime users
+	// 7:00..23:59 local time.
+	for _, test := range []struct {
+		utc      string
+		code     string
+		expected AuthResult
+	}{
+		// Spring forward 2014-03-09 2:00 PST -> 3:00 PDT (UTC-7).
+		{"2014-03-09 16:59", "user123", AuthOkButOutsideTime},     // 9:59
+		{"2014-03-09 17:00", "user123", AuthOk},                   // 10:00
+		{"2014-03-10 05:59", "user123", AuthOk},                   // 22:59
+		{"2014-03-10 06:00", "user123", AuthOkButOutsideTime},     // 23:00
+		{"2014-03-09 10:30", "fulltime123", AuthOkButOutsideTime}, // 3:30
+		{"2014-03-09 14:00", "fulltime123", AuthOk},               // 7:00
+
+		// Fall back 2014-11-02 2:00 PDT -> 1:00 PST (UTC-8).
+		{"2014-11-02 17:30", "user123", AuthOkButOutsideTime},     // 9:30
+		{"2014-11-02 18:00", "user123", AuthOk},                   // 10:00
+		{"2014-11-03 06:59", "user123", AuthOk},                   // 22:59
+		{"2014-11-03 07:00", "user123", AuthOkButOutsideTime},     // 23:00
+		{"2014-11-02 08:30", "fulltime123", AuthOkButOutsideTime}, // 1:30 PDT
+		{"2014-11-02 09:30", "fulltime123", AuthOkButOutsideTime}, // 1:30 PST
+		{"2014-11-02 14:59", "fulltime123", AuthOkButOutsideTime}, // 6:59
+		{"2014-11-02 15:00", "fulltime123", AuthOk},               // 7:00
+	} {
+		mockClock.now, _ = time.Parse("2006-01-02 15:04", test.utc)
+		ExpectAuthResult(t, auth, test.code, TargetDownstairs, test.expected, "")
+	}
+
+	// Weekdays are local as well: Sunday evening, Monday in UTC.
+	sunday := map[time.Weekday]HourWindow{time.Sunday: {18, 23}}
+	ExpectTrue(t, auth.SetAccessHours(AccessHours{UserWeekdays: sunday}) == nil, "Hours")
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-11-03 03:00") // Sun 19:00
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, AuthOk, "")
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-11-02 21:00") // Sun 13:00
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, AuthOkButOutsideTime, "")
+}
+
+func TestLockdown(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "lockdown")
+	auth := CreateSimpleFileAuth(authFile, RealClock{}).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	events := make(AppEventChannel, 10)
+	auth.eventBus.Subscribe(events)
+
+	for _, level := range []Level{LevelPhilanthropist, LevelTrustedPhilanthropist} {
+		u := User{Name: string(level), ContactInfo: "x@example.com", UserLevel: level}
+		u.SetAuthCode(string(level) + "123")
+		ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add "+string(level))
+	}
+	ExpectFalse(t, auth.IsLockdown(), "Initially off")
+	ExpectFalse(t, eatmsg(auth.SetLockdown("philanthropist123", true)), "Members only")
+	ExpectFalse(t, auth.IsLockdown(), "Still off")
+
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", true)), "Lockdown")
+	ExpectTrue(t, auth.IsLockdown(), "On")
+	event := findEvent(auth.eventBus, events, AppLockdown)
+	ExpectTrue(t, event != nil && event.Value == 1, "Lockdown event")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	for _, code := range []string{"philanthropist123", "trustedphilanthropist123"} {
+		result, reason, msg := auth.AuthUserWithReason(code, TargetUpstairs)
+		ExpectTrue(t, result == AuthFail && reason == AccessDeniedLockdown &&
+			msg == "space in lockdown.", code+": "+msg)
+	}
+
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", false)), "Lift")
+	ExpectAuthResult(t, auth, "philanthropist123", TargetDownstairs, AuthOk, "")
+}
+
+func TestLockdownEndsHoldOpen(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "lockdown-hold-open")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	events := make(AppEventChannel, 10)
+	auth.eventBus.Subscribe(events)
+
+	start, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = start
+	ExpectTrue(t, eatmsg(auth.HoldTargetOpen("root123", TargetDownstairs,
+		start.Add(4*time.Hour), "party")), "Hold open")
+	ExpectTrue(t, findEvent(auth.eventBus, events, AppHoldOpenRequest) != nil, "Held")
+
+	mockClock.now = start.Add(time.Hour)
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", true)), "Lockdown")
+	ExpectFalse(t, auth.IsTargetHeldOpen(TargetDownstairs), "Not during lockdown")
+	event := findEvent(auth.eventBus, events, AppHoldOpenRequest)
+	ExpectTrue(t, event != nil && event.Target == TargetDownstairs &&
+		event.Timeout.Equal(mockClock.now), "Hold-open ended right away")
+	ExpectFalse(t, eatmsg(auth.HoldTargetOpen("root123", TargetUpstairs,
+		start.Add(4*time.Hour), "party")), "No new hold-open")
+
+	// Ended for good, not just hidden while in lockdown.
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", false)), "Lift")
+	ExpectFalse(t, auth.IsTargetHeldOpen(TargetDownstairs), "Still ended")
+}
+
+func TestDuressCode(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "duress")
+	auth := CreateSimpleFileAuth(authFile, RealClock{}).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	events := make(AppEventChannel, 10)
+	auth.eventBus.Subscribe(events)
+	feed := auth.Events()
+
+	ExpectFalse(t, eatmsg(auth.SetDuressCode("root123", "root123")), "Same as regular")
+	ExpectFalse(t, eatmsg(auth.SetDuressCode("root123", "hlp")), "Too short")
+	auth.SetMinCodeLength(8)
+	ok, msg := auth.SetDuressCode("root123", "help123")
+	ExpectTrue(t, !ok && strings.Contains(msg, "at least 8"), "Configured length: "+msg)
+	auth.SetMinCodeLength(DefaultMinCodeLength)
+	ExpectTrue(t, eatmsg(auth.SetDuressCode("root123", "help123")), "Set duress code")
+
+	// Same as the regular code at the door.
+	result, reason, msg := auth.AuthUserWithReason("root123", TargetDownstairs)
+	<-feed
+	ExpectTrue(t, findEvent(auth.eventBus, events, AppDuressAlarm) == nil, "No alarm")
+	duressResult, duressReason, duressMsg := auth.AuthUserWithReason("help123", TargetDownstairs)
+	ExpectTrue(t, result == duressResult && reason == duressReason && msg == duressMsg,
+		"Indistinguishable")
+	ExpectTrue(t, result == AuthOk, "Granted")
+	event := findEvent(auth.eventBus, events, AppDuressAlarm)
+	ExpectTrue(t, event != nil && event.Target == TargetDownstairs &&
+		strings.Contains(event.Msg, "root"), "Alarm")
+	ExpectTrue(t, (<-feed).Duress, "Flagged in feed")
+
+	// Survives writing and reading the file; both codes belong to root.
+	writeUserFile(authFile.Name(), []User{*auth.FindUser("root123")})
+	ExpectAuthResult(t, auth, "help123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.FindUser("help123").Name == "root", "Same user")
+	u := User{Name: "Copycat", ContactInfo: "c@example.com", UserLevel: LevelUser}
+	u.SetAuthCode("help123")
+	ExpectFalse(t, eatmsg(auth.AddNewUser("root123", u)), "Duress code is taken")
+
+	// Salted along with the regular codes.
+	hasher, _ := NewCodeHasher([]byte("pepper"), 16)
+	auth.SetCodeHasher(hasher, true)
+	ExpectAuthResult(t, auth, "help123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, isSaltedCode(auth.FindUser("root123").DuressCodes[0]), "Salted")
+	ExpectTrue(t, auth.isDuressCode(auth.FindUser("root123"), "help123"), "Still duress")
+	ExpectFalse(t, auth.isDuressCode(auth.FindUser("root123"), "root123"), "Regular")
+}
+
+func TestOpenSpace(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "open-space")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	fileAuth := auth.(*FileBasedAuthenticator)
+	fileAuth.eventBus = bus
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(-12 * time.Hour)
+	u := User{
+		Name:        "Some User",
+		ContactInfo: "user@noisebridge.net",
+		UserLevel:   LevelUser}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+
+	u = User{
+		Name:        "Some Fulltime User",
+		ContactInfo: "ftuser@noisebridge.net",
+		UserLevel:   LevelFulltimeUser}
+	u.SetAuthCode("fulltimeuser123")
+	auth.AddNewUser("root123", u)
+
+	nightTime_3h := someMidnight.Add(3 * time.Hour)
+	mockClock.now = nightTime_3h
+	ExpectFalse(t, fileAuth.IsSpaceOpen(), "Initially closed")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOkButOutsideTime, "outside")
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOkButOutsideTime, "outside")
+
+	ExpectFalse(t, eatmsg(fileAuth.OpenSpace("user123", 0)), "Only members open space")
+	ExpectFalse(t, fileAuth.IsSpaceOpen(), "Still closed")
+
+	ExpectTrue(t, eatmsg(fileAuth.OpenSpace("root123", time.Hour)), "Member opens space")
+	event := findEvent(bus, events, AppSpaceStatus)
+	ExpectTrue(t, event != nil && event.Value == 1 &&
+		strings.Contains(event.Msg, "root"), "Space open event")
+	ExpectTrue(t, fileAuth.IsSpaceOpen(), "Space open")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "fulltimeuser123", TargetUpstairs, AuthOk, "")
+
+	// Closes by itself.
+	mockClock.now = nightTime_3h.Add(time.Hour)
+	ExpectFalse(t, fileAuth.IsSpaceOpen(), "Auto-closed")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOkButOutsideTime, "outside")
+
+	// Default timeout; explicitly closed.
+	fileAuth.SetSpaceOpenTimeout(2 * time.Hour)
+	fileAuth.OpenSpace("root123", 0)
+	mockClock.now = nightTime_3h.Add(2*time.Hour + 59*time.Minute)
+	ExpectTrue(t, fileAuth.IsSpaceOpen(), "Open with default timeout")
+	ExpectTrue(t, eatmsg(fileAuth.CloseSpace("root123")), "Member closes space")
+	ExpectFalse(t, fileAuth.IsSpaceOpen(), "Closed")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOkButOutsideTime, "outside")
+}
+
+// Store keeping users in memory, optionally failing writes.
+type memoryUserStore struct {
+	users     []*User
+	failWrite bool
+}
+
+func (s *memoryUserStore) Load() ([]*User, error) {
+	return s.users, nil
+}
+
+func (s *memoryUserStore) Append(user *User) error {
+	if s.failWrite {
+		return errors.New("write failed")
+	}
+	s.users = append(s.users, user)
+	return nil
+}
+
+func (s *memoryUserStore) ReplaceAll(users []*User) error {
+	if s.failWrite {
+		return errors.New("write failed")
+	}
+	s.users = nil
+	for _, user := range users {
+		if user != nil {
+			s.users = append(s.users, user)
+		}
+	}
+	return nil
+}
+
+func TestNonFileUserStore(t *testing.T) {
+	root := &User{Name: "root", ContactInfo: "root@nb", UserLevel: LevelMember}
+	root.SetAuthCode("root123")
+	store := &memoryUserStore{users: []*User{root}}
+	auth := NewFileBasedAuthenticatorWithStore(store, NewApplicationBus())
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Loaded from store")
+
+	u := User{Name: "Jon Doe", UserLevel: LevelUser}
+	u.SetAuthCode("doe123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding user")
+	ExpectTrue(t, len(store.users) == 2, "Appended to store")
+
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "doe123")), "Deleting user")
+	ExpectTrue(t, len(store.users) == 1 && store.users[0].Name == "root",
+		"Store replaced")
+
+	// Failing store doesn't leave us with users that aren't stored.
+	store.failWrite = true
+	ok, msg := auth.AddNewUser("root123", u)
+	ExpectFalse(t, ok, "Add with failing store")
+	ExpectTrue(t, strings.Contains(msg, "write failed"), "Unexpected message: "+msg)
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Not added")
+
+	// Watching only works on files.
+	ExpectTrue(t, auth.StartWatching() != nil, "Can't watch memory store")
+}
+
+func TestAuthReasons(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "auth-reasons")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(-12 * time.Hour)
+	u := User{Name: "Some User", ContactInfo: "user@nb", UserLevel: LevelUser}
+	u.SetAuthCode("user123")
+	auth.AddNewUser("root123", u)
+	u = User{Name: "Away", ContactInfo: "away@nb", UserLevel: LevelHiatus}
+	u.SetAuthCode("hiatus123")
+	auth.AddNewUser("root123", u)
+	u = User{Name: "Gone", ContactInfo: "gone@nb", UserLevel: LevelUser,
+		ValidTo: someMidnight}
+	u.SetAuthCode("expired123")
+	auth.AddNewUser("root123", u)
+
+	mockClock.now = someMidnight.Add(3 * time.Hour)
+	for _, expect := range []struct {
+		code   string
+		target Target
+		result AuthResult
+		reason AuthReason
+	}{
+		{"root123", TargetUpstairs, AuthOk, AccessGranted},
+		{"user123", TargetUpstairs, AuthOkButOutsideTime, AccessDeniedOutsideHours},
+		{"hiatus123", TargetUpstairs, AuthFail, AccessDeniedHiatus},
+		{"expired123", TargetUpstairs, AuthExpired, AccessDeniedExpired},
+		{"unknown123", TargetUpstairs, AuthFail, AccessDeniedUnknownCode},
+		{"abc", TargetUpstairs, AuthFail, AccessDeniedTooShort},
+		{"root123", "", AuthFail, AccessDeniedNoTarget},
+	} {
+		result, reason, _ := auth.AuthUserWithReason(expect.code, expect.target)
+		ExpectTrue(t, result == expect.result && reason == expect.reason,
+			fmt.Sprintf("%s: expected %d/%s, got %d/%s", expect.code,
+				expect.result, expect.reason, result, reason))
+	}
+}
+
+func TestAuthEventFeed(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "auth-events")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+
+	// Nobody listening; must not block.
+	auth.AuthUser("root123", TargetUpstairs)
+
+	events := fileAuth.Events()
+	auth.AuthUser("root123", TargetUpstairs)
+	auth.AuthUser("unknown123", TargetDownstairs)
+	event := <-events
+	ExpectTrue(t, event.Reason == AccessGranted && event.UserName == "root" &&
+		event.Target == TargetUpstairs, "Granted event")
+	ExpectTrue(t, event.CodeHint != "" && !strings.Contains(event.CodeHint, "root123"),
+		"Code is scrubbed")
+	event = <-events
+	ExpectTrue(t, event.Reason == AccessDeniedUnknownCode && event.UserName == "" &&
+		event.Target == TargetDownstairs, "Unknown code event")
+	ExpectTrue(t, event.CodeHint == hashAuthCode("unknown123")[0:6] &&
+		event.CodeHint != scrubLogValue("unknown123"), "Hint is peppered")
+	SetCodeHints(false)
+	auth.AuthUser("unknown123", TargetDownstairs)
+	SetCodeHints(true)
+	event = <-events
+	ExpectTrue(t, event.CodeHint == "-", "Hints off")
+
+	// A consumer that doesn't keep up doesn't block us.
+	for i := 0; i < authEventBufferSize+10; i++ {
+		auth.AuthUser("root123", TargetUpstairs)
+	}
+	ExpectTrue(t, fileAuth.DroppedAuthEvents() == 10,
+		fmt.Sprintf("Expected 10 dropped, got %d", fileAuth.DroppedAuthEvents()))
+
+	fileAuth.StopEvents(events)
+	auth.AuthUser("root123", TargetUpstairs)
+	ExpectTrue(t, fileAuth.DroppedAuthEvents() == 10, "Not sent after stop")
+}
+
+func TestAuditLog(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "audit-users")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	auditFile, _ := ioutil.TempFile("", "audit-log")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(auditFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	logger, err := NewAuditLogger(auditFile.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileAuth.SetAuditLogger(logger)
+
+	someMidnight, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = someMidnight.Add(-12 * time.Hour)
+	u := User{Name: "Jon Doe", ContactInfo: "jon@nb", UserLevel: LevelUser}
+	u.SetAuthCode("doe123")
+	auth.AddNewUser("root123", u)
+
+	mockClock.now = someMidnight.Add(3 * time.Hour)
+	auth.AuthUser("doe123", TargetDownstairs)
+	auth.AuthUser("secret4567", TargetDownstairs)
+	auth.AuthUser("root123", TargetUpstairs)
+	auth.DeleteUser("root123", "doe123")
+	logger.Close()
+
+	content, _ := ioutil.ReadFile(auditFile.Name())
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	ExpectTrue(t, len(lines) == 5, fmt.Sprintf("Expected 5 lines, got %q", lines))
+	for _, expect := range []string{
+		`^2014-10-09 12:00:00 \+0000 user-added by="root" user="Jon Doe" level=user codes=1$`,
+		`^2014-10-10 03:00:00 \+0000 access target=gate result=denied reason=outside-hours user="Jon Doe" code=[0-9a-f]{6}$`,
+		`^2014-10-10 03:00:00 \+0000 access target=gate result=denied reason=unknown-code user="" code=[0-9a-f]{6}$`,
+		`^2014-10-10 03:00:00 \+0000 access target=upstairs result=granted reason=granted user="root" code=[0-9a-f]{6}$`,
+		`^2014-10-10 03:00:00 \+0000 user-deleted by="root" user="Jon Doe" level=user codes=1$`,
+	} {
+		if len(lines) == 0 {
+			break
+		}
+		ExpectTrue(t, regexp.MustCompile(expect).MatchString(lines[0]),
+			"Unexpected audit line "+lines[0])
+		lines = lines[1:]
+	}
+	ExpectFalse(t, strings.Contains(string(content), "secret4567"), "No plain codes")
+}
+
+func TestFailureLockout(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "lockout")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	start, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = start
+	phil := User{Name: "Phil", ContactInfo: "phil@nb", UserLevel: LevelPhilanthropist}
+	phil.SetAuthCode("phil123")
+	writeUserFile(authFile.Name(), []User{*auth.FindUser("root123"), phil})
+
+	// Off by default.
+	for i := 0; i < 10; i++ {
+		auth.AuthUser(fmt.Sprintf("guess%d", i), TargetDownstairs)
+	}
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+
+	fileAuth.SetFailureLockout(3, time.Minute, 5*time.Minute)
+	auth.AuthUser("guess1", TargetDownstairs)
+	auth.AuthUser("guess2", TargetDownstairs)
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOk, "")
+
+	// Success reset the count, so we need three more.
+	auth.AuthUser("guess3", TargetDownstairs)
+	auth.AuthUser("guess4", TargetDownstairs)
+	mockClock.now = start.Add(30 * time.Second)
+	auth.AuthUser("guess5", TargetDownstairs)
+	_, reason, msg := auth.AuthUserWithReason("phil123", TargetDownstairs)
+	ExpectTrue(t, reason == AccessDeniedLockedOut, "Locked: "+msg)
+	ExpectTrue(t, strings.Contains(msg, "try later"), "Unexpected message: "+msg)
+
+	// Members still get in, without lifting it for the others.
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	_, reason, _ = auth.AuthUserWithReason("phil123", TargetDownstairs)
+	ExpectTrue(t, reason == AccessDeniedLockedOut, "Still locked")
+
+	// Other targets not affected.
+	ExpectAuthResult(t, auth, "phil123", TargetUpstairs, AuthOk, "")
+
+	// Cooldown over.
+	mockClock.now = start.Add(30*time.Second + 5*time.Minute)
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOk, "")
+
+	// Failures spread out beyond the window don't lock.
+	for i := 0; i < 5; i++ {
+		mockClock.now = mockClock.now.Add(2 * time.Minute)
+		auth.AuthUser("guess", TargetDownstairs)
+	}
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+}
+
+func TestFailureTrackerEviction(t *testing.T) {
+	tracker := newFailureTracker()
+	tracker.configure(2, time.Minute, time.Hour)
+	now, _ := time.Parse("2006-01-02", "2014-10-10")
+	tracker.recordFailure("locked", now)
+	tracker.recordFailure("locked", now)
+	for i := 0; i < 3*maxTrackedFailureKeys; i++ {
+		tracker.recordFailure(fmt.Sprintf("key%d", i), now.Add(time.Duration(i)*time.Second))
+	}
+	ExpectTrue(t, len(tracker.entries) <= maxTrackedFailureKeys,
+		fmt.Sprintf("Too many entries: %d", len(tracker.entries)))
+	locked, _ := tracker.lockedUntil("locked", now.Add(time.Minute))
+	ExpectTrue(t, locked, "Locked entries are kept")
+}
+
+func TestSaltedCodes(t *testing.T) {
+	hasher, err := NewCodeHasher([]byte("secret pepper"), 16)
+	ExpectTrue(t, err == nil, "Creating hasher")
+	_, err = NewCodeHasher([]byte("secret pepper"), 1000)
+	ExpectTrue(t, err != nil, "Cost needs to be power of two")
+
+	salted, _ := hasher.Hash("salty123")
+	ExpectTrue(t, hasher.Verify("salty123", salted), "Verify salted code")
+	ExpectFalse(t, hasher.Verify("salty124", salted), "Wrong code")
+	ExpectTrue(t, hasher.Verify("salty123\r\n", salted), "Reader whitespace")
+	other, _ := hasher.Hash("salty123")
+	ExpectTrue(t, other != salted, "Each hash has its own salt")
+
+	authFile, _ := ioutil.TempFile("", "salted-codes")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	salty := User{Name: "salty", UserLevel: LevelUser, Codes: []string{salted}}
+	rootUser := *auth.FindUser("root123")
+	writeUserFile(authFile.Name(), []User{rootUser, salty})
+
+	// Without hasher, salted codes are unknown.
+	ExpectTrue(t, auth.FindUser("salty123") == nil, "Salted needs hasher")
+	ExpectTrue(t, auth.FindUser("root123") != nil, "md5 code")
+
+	fileAuth.SetCodeHasher(hasher, false)
+	found := auth.FindUser("salty123")
+	ExpectTrue(t, found != nil && found.Name == "salty", "Salted code")
+	ExpectTrue(t, auth.FindUser("salty124") == nil, "Wrong salted code")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.FindUser("root123").Codes[0] == hashAuthCode("root123"),
+		"No upgrade unless asked for")
+
+	// Upgrade on use, written with next change.
+	fileAuth.SetCodeHasher(hasher, true)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	root := auth.FindUser("root123")
+	ExpectTrue(t, root != nil && isSaltedCode(root.Codes[0]), "Upgraded code")
+	content, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.Contains(string(content), hashAuthCode("root123")),
+		"Not written yet")
+
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "salty123")), "Delete salty")
+	content, _ = ioutil.ReadFile(authFile.Name())
+	ExpectFalse(t, strings.Contains(string(content), hashAuthCode("root123")),
+		"Upgraded code written")
+	ExpectTrue(t, auth.FindUser("salty123") == nil, "Deleted salted code")
+
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	reloaded.SetCodeHasher(hasher, false)
+	ExpectTrue(t, reloaded.FindUser("root123") != nil, "Salted code persisted")
+}
+
+func TestAuthCodePepper(t *testing.T) {
+	defer SetAuthCodePepper(DefaultAuthCodePepper)
+	// Existing files rely on the default.
+	classic := hashAuthCode("root123")
+	ExpectTrue(t, classic == "98968130855e30d4c21548efd88b27ef", "Default pepper: "+classic)
+
+	ExpectTrue(t, SetAuthCodePepper("") != nil, "Empty pepper")
+	ExpectTrue(t, SetAuthCodePepper("OurVerySpecialPepper") == nil, "Set pepper")
+	ExpectTrue(t, hashAuthCode("root123") != classic, "Pepper changes hash")
+
+	authFile, _ := ioutil.TempFile("", "pepper")
+	auth := CreateSimpleFileAuth(authFile, RealClock{}).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+
+	// The authenticator keeps the pepper it was created with.
+	SetAuthCodePepper(DefaultAuthCodePepper)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.pepper.hint("root123") != codeHint("root123"), "Own hints")
+	ExpectTrue(t, auth.pepper.logName("root") != logName("root"), "Own pseudonyms")
+
+	// Changing the pepper invalidates codes in existing files, without
+	// getting in the way of the authenticator already running.
+	other := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "YetAnotherPepper")
+	ExpectTrue(t, other.FindUser("root123") == nil, "Other pepper, other hash")
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Not re-peppered")
+}
+
+// Concurrent readers, as with several doors. Lookups should not serialize.
+func BenchmarkFindUserParallel(b *testing.B) {
+	authFile, _ := ioutil.TempFile("", "bench-find-user")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	defer syscall.Unlink(authFile.Name())
+	var users []User
+	for i := 0; i < 1000; i++ {
+		u := User{Name: fmt.Sprintf("user%d", i), UserLevel: LevelMember}
+		u.SetAuthCode(fmt.Sprintf("code%d", i))
+		users = append(users, u)
+	}
+	writeUserFile(authFile.Name(), users)
+	fileAuth := auth.(*FileBasedAuthenticator)
+	// Don't measure the timestamp check on each lookup.
+	if err := fileAuth.StartWatching(); err != nil {
+		b.Fatal(err)
+	}
+	defer fileAuth.StopWatching()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			auth.FindUser(fmt.Sprintf("code%d", i%1000))
+			i++
+		}
+	})
+}
+
+func TestNegativeCache(t *testing.T) {
+	cache := newNegativeCache()
+	cache.add("a", 1)
+	ExpectFalse(t, cache.contains("a", 1), "Disabled by default")
+
+	cache.configure(2)
+	cache.add("a", 1)
+	cache.add("b", 1)
+	ExpectTrue(t, cache.contains("a", 1), "Cached")
+	ExpectFalse(t, cache.contains("a", 2), "Other revision")
+	ExpectFalse(t, cache.contains("a", 1), "Stale entry removed")
+	cache.add("a", 1)
+	cache.add("c", 1) // Evicts b, the least recently used.
+	ExpectFalse(t, cache.contains("b", 1), "Evicted")
+	ExpectTrue(t, cache.contains("a", 1) && cache.contains("c", 1), "Kept")
+
+	authFile, _ := ioutil.TempFile("", "negative-cache")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	fileAuth.SetNegativeCacheSize(10)
+	mockClock.now, _ = time.Parse("2006-01-02", "2014-10-10")
+
+	// Code becomes valid after an edit.
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Unknown")
+	u := User{Name: "Jon Doe", UserLevel: LevelMember}
+	u.SetAuthCode("doe123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add user")
+	ExpectTrue(t, auth.FindUser("doe123") != nil, "Known after adding")
+
+	// ... or after a reload.
+	ExpectTrue(t, auth.FindUser("roe123") == nil, "Unknown")
+	rootUser := *auth.FindUser("root123")
+	roe := User{Name: "Richard Roe", UserLevel: LevelMember}
+	roe.SetAuthCode("roe123")
+	writeUserFile(authFile.Name(), []User{rootUser, roe})
+	ExpectTrue(t, auth.FindUser("roe123") != nil, "Known after reload")
+
+	// Cached unknown codes still count towards the lockout.
+	fileAuth.SetFailureLockout(3, time.Minute, time.Minute)
+	for i := 0; i < 3; i++ {
+		ExpectAuthResult(t, auth, "guess1", TargetDownstairs, AuthFail, "")
+	}
+	_, reason, _ := auth.AuthUserWithReason("guess2", TargetDownstairs)
+	ExpectTrue(t, reason == AccessDeniedLockedOut, "Locked out")
+}
+
+func TestListUsers(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "list-users")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	u := User{Name: "Jon Doe", ContactInfo: "jon@doe", UserLevel: LevelMember}
+	u.SetAuthCode("doe123")
+	auth.AddNewUser("root123", u)
+	auth.UpdateUser("root123", "doe123", func(user *User) bool {
+		user.Codes = append(user.Codes, hashAuthCode("doe456"))
+		return true
+	})
+	u = User{Name: "Deleted", UserLevel: LevelMember}
+	u.SetAuthCode("gone123")
+	auth.AddNewUser("root123", u)
+	auth.DeleteUser("root123", "gone123")
+
+	users := fileAuth.ListUsers()
+	ExpectTrue(t, len(users) == 2, fmt.Sprintf("Expected 2 users, got %d", len(users)))
+	ExpectTrue(t, users[0].Name == "root" && users[1].Name == "Jon Doe", "Order")
+	ExpectTrue(t, users[1].ContactInfo == "jon@doe" &&
+		users[1].UserLevel == LevelMember && len(users[1].Sponsors) == 1,
+		"Details")
+	ExpectTrue(t, len(users[1].Codes) == 2, "One entry with both codes")
+
+	// Changing the copies doesn't change our users.
+	users[1].Name = "Mallory"
+	users[1].Codes[0] = hashAuthCode("mallory123")
+	users[1].Sponsors[0] = "nobody"
+	found := auth.FindUser("doe123")
+	ExpectTrue(t, found != nil && found.Name == "Jon Doe", "Unchanged user")
+	ExpectTrue(t, found.Sponsors[0] == hashAuthCode("root123"), "Unchanged sponsor")
+	ExpectTrue(t, auth.FindUser("mallory123") == nil, "Unchanged codes")
+}
+
+func TestFindUsersByName(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "find-by-name")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	for _, name := range []string{"Jon Doe", "Jane Doe", "Richard Roe"} {
+		u := User{Name: name, UserLevel: LevelMember}
+		u.SetAuthCode(name + "123")
+		auth.AddNewUser("root123", u)
+	}
+	auth.UpdateUser("root123", "Jon Doe123", func(user *User) bool {
+		user.Codes = append(user.Codes, hashAuthCode("jon456"))
+		return true
+	})
+
+	found := fileAuth.FindUsersByName("doe")
+	ExpectTrue(t, len(found) == 2, fmt.Sprintf("Expected 2 users, got %d", len(found)))
+	ExpectTrue(t, found[0].Name == "Jon Doe" && found[1].Name == "Jane Doe", "Matches")
+	ExpectTrue(t, len(fileAuth.FindUsersByName("JON")) == 1, "Ignore case")
+	ExpectTrue(t, len(fileAuth.FindUsersByName("nobody")) == 0, "No match")
+
+	jon := found[0]
+	ExpectTrue(t, jon.Codes == nil && jon.Sponsors == nil, "No code material")
+	ExpectTrue(t, len(jon.CodeIssueDates) == 2, "Still see number of codes")
+	ExpectTrue(t, auth.FindUser("jon456") != nil, "Codes untouched")
+}
+
+func TestFindSponsors(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "find-sponsors")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	for _, name := range []string{"Jon Doe", "Jane Doe"} {
+		u := User{Name: name, ContactInfo: name + "@nb", UserLevel: LevelMember}
+		u.SetAuthCode(name + "123")
+		auth.AddNewUser("root123", u)
+	}
+	u := User{Name: "Richard Roe", ContactInfo: "richard@nb", UserLevel: LevelUser}
+	u.SetAuthCode("richard123")
+	fileAuth.AddNewUserWithSponsors([]string{"Jon Doe123", "Jane Doe123"}, u)
+
+	sponsors := fileAuth.FindSponsors("Richard Roe")
+	ExpectTrue(t, len(sponsors) == 2 && sponsors[0].Name == "Jon Doe" &&
+		sponsors[1].Name == "Jane Doe", "Both sponsors found")
+	ExpectTrue(t, sponsors[0].ContactInfo == "Jon Doe@nb" &&
+		sponsors[0].UserLevel == LevelMember, "Sponsor details")
+	ExpectTrue(t, sponsors[0].Codes == nil && sponsors[0].Sponsors == nil,
+		"No code material")
+	ExpectTrue(t, len(fileAuth.FindSponsors("root")) == 0, "Root has no sponsor")
+	ExpectTrue(t, fileAuth.FindSponsors("nobody") == nil, "No such user")
+
+	// Sponsor left.
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "Jon Doe123")), "Deleting")
+	sponsors = fileAuth.FindSponsors("Richard Roe")
+	ExpectTrue(t, len(sponsors) == 2 && sponsors[0].Name == UnknownSponsorName &&
+		sponsors[1].Name == "Jane Doe", "Departed sponsor")
+}
+
+func TestAddRemoveCode(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "add-remove-code")
+	auditFile, _ := ioutil.TempFile("", "add-remove-audit")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(auditFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	logger, _ := NewAuditLogger(auditFile.Name())
+	fileAuth.SetAuditLogger(logger)
+	for i, name := range []string{"Jon Doe", "Jane Doe", "Jane Doe"} {
+		u := User{Name: name, ContactInfo: name + "@nb", UserLevel: LevelUser}
+		u.SetAuthCode(fmt.Sprintf("%s%d23", strings.Fields(name)[0], i+1))
+		auth.AddNewUser("root123", u)
+	}
+
+	ExpectFalse(t, eatmsg(fileAuth.AddCodeToUser("Jon123", "Jon Doe", "card456")),
+		"Only members")
+	ExpectFalse(t, eatmsg(fileAuth.AddCodeToUser("root123", "Jon Doe", "Jane223")),
+		"Code used by someone else")
+	ExpectFalse(t, eatmsg(fileAuth.AddCodeToUser("root123", "Jon Doe", "Jon123")),
+		"Code already used by user")
+	ExpectFalse(t, eatmsg(fileAuth.AddCodeToUser("root123", "Jon Doe", "abc")),
+		"Too short")
+	ExpectFalse(t, eatmsg(fileAuth.AddCodeToUser("root123", "Nobody", "card456")),
+		"No such user")
+	ExpectFalse(t, eatmsg(fileAuth.AddCodeToUser("root123", "Jane Doe", "card456")),
+		"Ambiguous name")
+
+	ExpectTrue(t, eatmsg(fileAuth.AddCodeToUser("root123", "Jon Doe", "card456")),
+		"Adding code")
+	ExpectTrue(t, auth.FindUser("card456").Name == "Jon Doe", "Found with new code")
+	ExpectTrue(t, len(auth.FindUser("Jon123").Codes) == 2, "Both codes")
+
+	ExpectFalse(t, eatmsg(fileAuth.RemoveCodeFromUser("root123", "Jane Doe", "card456")),
+		"Other user's code")
+	ExpectTrue(t, eatmsg(fileAuth.RemoveCodeFromUser("root123", "Jon Doe", "Jon123")),
+		"Removing code")
+	ExpectTrue(t, auth.FindUser("Jon123") == nil, "Code gone")
+	ExpectFalse(t, eatmsg(fileAuth.RemoveCodeFromUser("root123", "Jon Doe", "card456")),
+		"Last code")
+
+	// Persisted.
+	auth = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	user := auth.FindUser("card456")
+	ExpectTrue(t, user != nil && len(user.Codes) == 1 && user.Name == "Jon Doe",
+		"New code stays after reload")
+
+	audit, _ := ioutil.ReadFile(auditFile.Name())
+	ExpectTrue(t, strings.Contains(string(audit), `code-added by="root" user="Jon Doe" level=user codes=2`),
+		"Audit of adding: "+string(audit))
+	ExpectTrue(t, strings.Contains(string(audit), `code-removed by="root" user="Jon Doe" level=user codes=1`),
+		"Audit of removing")
+}
+
+func TestTwoFactor(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "two-factor")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	u := User{Name: "Jon Doe", ContactInfo: "jon@nb", UserLevel: LevelMember}
+	u.Codes = []string{hashAuthCode("cafe1234"), hashAuthCode("jon123"), hashAuthCode("beef5678")}
+	u.CodeTypes = []AuthFactor{FactorCard, FactorPIN, FactorCard}
+	auth.AddNewUser("root123", u)
+	mockClock.now = mockClock.now.Add(time.Minute)
+
+	serverRoom := Target("serverroom")
+	fileAuth.SetTwoFactorTargets([]Target{serverRoom}, 10*time.Second)
+	ExpectTrue(t, fileAuth.NeedsTwoFactor(serverRoom), "Configured")
+	ExpectFalse(t, fileAuth.NeedsTwoFactor(TargetUpstairs), "Other targets")
+	ExpectAuthResult(t, auth, "jon123", TargetUpstairs, AuthOk, "")
+	_, reason, _ := auth.AuthUserWithReason("jon123", serverRoom)
+	ExpectTrue(t, reason == AccessDeniedSecondFactor, "Single code not enough")
+
+	token, msg := fileAuth.BeginAuth("cafe1234", FactorCard, serverRoom)
+	ExpectTrue(t, token != "", "Begin: "+msg)
+	result, _, msg := fileAuth.CompleteAuth(token, "jon123", FactorPIN)
+	ExpectTrue(t, result == AuthOk, "Card and PIN: "+msg)
+	result, _, _ = fileAuth.CompleteAuth(token, "jon123", FactorPIN)
+	ExpectTrue(t, result == AuthFail, "Token used up")
+
+	// Same factor twice.
+	token, _ = fileAuth.BeginAuth("cafe1234", FactorCard, serverRoom)
+	result, _, _ = fileAuth.CompleteAuth(token, "jon123", FactorCard)
+	ExpectTrue(t, result == AuthFail, "Needs both factor types")
+
+	// The same code claimed to be both.
+	token, _ = fileAuth.BeginAuth("cafe1234", FactorCard, serverRoom)
+	result, reason, msg = fileAuth.CompleteAuth(token, "cafe1234", FactorPIN)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedSecondFactor,
+		"Same code twice: "+msg)
+
+	// Codes have to be of the factor claimed; told only after the second.
+	token, msg = fileAuth.BeginAuth("jon123", FactorCard, serverRoom)
+	ExpectTrue(t, token != "" && msg == "", "PIN as card begins: "+msg)
+	result, reason, _ = fileAuth.CompleteAuth(token, "cafe1234", FactorPIN)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedSecondFactor, "PIN as card")
+	token, _ = fileAuth.BeginAuth("cafe1234", FactorCard, serverRoom)
+	result, _, msg = fileAuth.CompleteAuth(token, "beef5678", FactorPIN)
+	ExpectTrue(t, result == AuthFail && msg == "Code is not known as pin.",
+		"Other card as PIN: "+msg)
+	token, msg = fileAuth.BeginAuth("root123", FactorCard, serverRoom)
+	ExpectTrue(t, token != "" && msg == "", "Code of unknown type begins: "+msg)
+	result, _, _ = fileAuth.CompleteAuth(token, "jon123", FactorPIN)
+	ExpectTrue(t, result == AuthFail, "Code of unknown type")
+
+	// Different users.
+	token, _ = fileAuth.BeginAuth("cafe1234", FactorCard, serverRoom)
+	result, reason, otherUserMsg := fileAuth.CompleteAuth(token, "root123", FactorPIN)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedSecondFactor,
+		"Codes of different users")
+
+	// Too slow.
+	token, _ = fileAuth.BeginAuth("jon123", FactorPIN, serverRoom)
+	mockClock.now = mockClock.now.Add(10 * time.Second)
+	result, _, _ = fileAuth.CompleteAuth(token, "cafe1234", FactorCard)
+	ExpectTrue(t, result == AuthFail, "Pending authentication timed out")
+
+	// An unknown first code looks like one of another user.
+	token, msg = fileAuth.BeginAuth("nosuchcode", FactorCard, serverRoom)
+	ExpectTrue(t, token != "" && msg == "", "Unknown first factor begins: "+msg)
+	result, reason, msg = fileAuth.CompleteAuth(token, "root123", FactorPIN)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedSecondFactor &&
+		msg == otherUserMsg, "Unknown first factor: "+msg)
+}
+
+func TestValidityRemaining(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "validity-remaining")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = now
+
+	remaining, ok := auth.ValidityRemaining("root123")
+	ExpectTrue(t, ok && remaining == UnlimitedValidity, "Member does not expire")
+	_, ok = auth.ValidityRemaining("unknown123")
+	ExpectFalse(t, ok, "Unknown code")
+
+	u := User{Name: "Jon Doe", ContactInfo: "jon@doe", UserLevel: LevelUser,
+		ValidTo: now.Add(3 * 24 * time.Hour)}
+	u.SetAuthCode("doe123")
+	auth.AddNewUser("root123", u)
+	remaining, ok = auth.ValidityRemaining("doe123")
+	ExpectTrue(t, ok && remaining == 3*24*time.Hour, "Three days left: "+remaining.String())
+
+	// Anonymous codes expire even without ValidTo.
+	u = User{UserLevel: LevelUser, ValidFrom: now.Add(-24 * time.Hour)}
+	u.SetAuthCode("anon123")
+	auth.AddNewUser("root123", u)
+	remaining, ok = auth.ValidityRemaining("anon123")
+	ExpectTrue(t, ok && remaining == ValidityPeriodAnonymousCards-24*time.Hour,
+		"Anonymous limit: "+remaining.String())
+
+	mockClock.now = now.Add(4 * 24 * time.Hour)
+	remaining, ok = auth.ValidityRemaining("doe123")
+	ExpectTrue(t, ok && remaining == 0, "Expired")
+}
+
+func TestExpiryWarning(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "expiry-warning")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = now
+	u := User{Name: "Jon Doe", ContactInfo: "jon@doe", UserLevel: LevelUser,
+		ValidTo: now.Add(3 * 24 * time.Hour)}
+	u.SetAuthCode("doe123")
+	auth.AddNewUser("root123", u)
+	mockClock.now = now.Add(time.Minute) // Valid from when added.
+
+	// Off by default.
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+	_, msg := auth.AuthUser("doe123", TargetDownstairs)
+	ExpectTrue(t, !strings.Contains(msg, "renew"), "No warning: "+msg)
+
+	fileAuth.SetExpiryWarning(7 * 24 * time.Hour)
+	result, msg := auth.AuthUser("doe123", TargetDownstairs)
+	ExpectTrue(t, result == AuthOk, "Still granted")
+	ExpectTrue(t, msg == "Granted, renew soon: expires 2014-10-13.", "Warning: "+msg)
+	_, msg = auth.AuthUser("root123", TargetDownstairs)
+	ExpectTrue(t, !strings.Contains(msg, "renew"), "Members don't expire: "+msg)
+
+	fileAuth.SetExpiryWarning(24 * time.Hour)
+	_, msg = auth.AuthUser("doe123", TargetDownstairs)
+	ExpectTrue(t, !strings.Contains(msg, "renew"), "Outside warning window: "+msg)
+}
+
+func TestSingleUseCodes(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "single-use")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = now
+	for _, code := range []string{"delivery123", "race123"} {
+		u := User{UserLevel: LevelUser, SingleUse: true}
+		u.SetAuthCode(code)
+		ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding single-use code")
+	}
+	mockClock.now = now.Add(time.Minute)
+
+	ExpectAuthResult(t, auth, "delivery123", TargetDownstairs, AuthOk, "")
+	result, reason, msg := auth.AuthUserWithReason("delivery123", TargetDownstairs)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedUsedUp,
+		"Second use: "+msg)
+	ExpectTrue(t, msg == "Code already used.", "Message: "+msg)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+
+	// Stays used when read again.
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	reloaded.clock = mockClock
+	found := reloaded.FindUser("delivery123")
+	ExpectTrue(t, found != nil && found.SingleUse && found.UsedAt.Equal(now.Add(time.Minute)),
+		"Use recorded in file")
+	ExpectAuthResult(t, reloaded, "delivery123", TargetDownstairs, AuthFail, "")
+
+	// Swiped many times at once, still only works once.
+	var wg sync.WaitGroup
+	var granted int32
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if result, _ := auth.AuthUser("race123", TargetDownstairs); result == AuthOk {
+				atomic.AddInt32(&granted, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	ExpectTrue(t, granted == 1, fmt.Sprintf("Granted %d times", granted))
+}
+
+func TestGuestPass(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "guest-pass")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 03:00")
+	mockClock.now = now
+
+	ExpectFalse(t, eatmsg(fileAuth.AddGuest("guest999", "guest123", "Visitor",
+		3*time.Hour, TargetDownstairs)), "Needs valid member")
+	ExpectFalse(t, eatmsg(fileAuth.AddGuest("root123", "guest123", "Visitor",
+		0, TargetDownstairs)), "Needs validity")
+	ExpectTrue(t, eatmsg(fileAuth.AddGuest("root123", "guest123", "Visitor",
+		3*time.Hour, TargetDownstairs)), "Adding guest")
+	guest := auth.FindUser("guest123")
+	ExpectTrue(t, guest != nil && guest.UserLevel == LevelGuest &&
+		guest.Sponsors[0] == hashAuthCode("root123"), "Guest with sponsor")
+
+	// At any hour, but only where the pass is for.
+	mockClock.now = now.Add(time.Minute)
+	ExpectAuthResult(t, auth, "guest123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "guest123", TargetUpstairs, AuthFail, "not valid for upstairs")
+
+	// Pass survives being written and read back.
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	reloaded.clock = mockClock
+	ExpectAuthResult(t, reloaded, "guest123", TargetDownstairs, AuthOk, "")
+
+	mockClock.now = now.Add(3 * time.Hour)
+	ExpectAuthResult(t, auth, "guest123", TargetDownstairs, AuthExpired, "")
+
+	// Expired guests are dropped from memory on reload.
+	content, _ := ioutil.ReadFile(authFile.Name())
+	ioutil.WriteFile(authFile.Name(), content, 0644)
+	modTime := time.Now().Add(time.Hour)
+	os.Chtimes(authFile.Name(), modTime, modTime)
+	ExpectTrue(t, auth.FindUser("guest123") == nil, "Expired guest dropped")
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Others kept")
+}
+
+func TestAccessRules(t *testing.T) {
+	_, err := ParseAccessMatrix("user:workshop")
+	ExpectTrue(t, err != nil, "Missing rule")
+	_, err = ParseAccessMatrix("nobody:workshop=allow")
+	ExpectTrue(t, err != nil, "Unknown level")
+	_, err = ParseAccessMatrix("user:workshop=20-12")
+	ExpectTrue(t, err != nil, "Invalid hours")
+
+	authFile, _ := ioutil.TempFile("", "access-rules")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	start, _ := time.Parse("2006-01-02 15:04", "2014-10-08 12:00") // Wednesday
+	mockClock.now = start
+	for _, level := range []Level{LevelUser, LevelFulltimeUser} {
+		u := User{Name: string(level), ContactInfo: "x", UserLevel: level}
+		u.SetAuthCode(string(level) + "123")
+		auth.AddNewUser("root123", u)
+	}
+	mockClock.now = start.Add(time.Hour) // 13:00
+	workshop := Target("workshop")
+
+	// Without rules, usual access everywhere.
+	ExpectAuthResult(t, auth, "user123", workshop, AuthOk, "")
+
+	rules, err := ParseAccessMatrix("user:workshop=deny, fulltimeuser:workshop=14-20")
+	ExpectTrue(t, err == nil, "Parsing rules")
+	ExpectTrue(t, fileAuth.SetAccessRules(rules) == nil, "Setting rules")
+	ExpectAuthResult(t, auth, "user123", workshop, AuthFail, "No access to workshop")
+	ExpectAuthResult(t, auth, "user123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "fulltimeuser123", workshop, AuthOkButOutsideTime,
+		"outside 14:00..20:00 at workshop")
+	ExpectAuthResult(t, auth, "root123", workshop, AuthOk, "")
+
+	mockClock.now = start.Add(3 * time.Hour) // 15:00
+	ExpectAuthResult(t, auth, "fulltimeuser123", workshop, AuthOk, "")
+	mockClock.now = start.Add(10 * time.Hour) // 22:00, outside usual hours too.
+	ExpectAuthResult(t, auth, "fulltimeuser123", workshop, AuthOkButOutsideTime, "")
+
+	// Hours of rules only limit: guests still need their targets, users
+	// their usual hours.
+	guest := User{Name: "Guest", ContactInfo: "g", UserLevel: LevelGuest,
+		Targets: []Target{TargetDownstairs}}
+	guest.SetAuthCode("guest123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", guest)), "Adding guest")
+	rules, _ = ParseAccessMatrix("guest:workshop=0-24, user:upstairs=0-24")
+	ExpectTrue(t, fileAuth.SetAccessRules(rules) == nil, "Setting rules")
+	mockClock.now = start.Add(11 * time.Hour) // 23:00
+	ExpectAuthResult(t, auth, "guest123", workshop, AuthFail, "not valid for workshop")
+	ExpectAuthResult(t, auth, "guest123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "user123", TargetUpstairs, AuthOkButOutsideTime, "Regular user outside")
+}
+
+func TestHealthCheck(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "health-check")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	err := fileAuth.HealthCheck()
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "Clock"),
+		"Clock not set")
+	mockClock.now, _ = time.Parse("2006-01-02", "2016-10-10")
+	ExpectTrue(t, fileAuth.HealthCheck() == nil, "Healthy")
+
+	// Failed reload.
+	root := *auth.FindUser("root123")
+	fileAuth.SetLevelMinimums(map[Level]int{LevelMember: 1}, true)
+	writeUserFile(authFile.Name(), []User{})
+	auth.FindUser("root123")
+	ExpectTrue(t, fileAuth.HealthCheck() != nil, "Rejected reload")
+	writeUserFile(authFile.Name(), []User{root})
+	auth.FindUser("root123")
+	ExpectTrue(t, fileAuth.HealthCheck() == nil, "Good reload")
+
+	// Minimums that aren't strict don't stop reloads, but still count.
+	fileAuth.SetLevelMinimums(map[Level]int{LevelMember: 2}, false)
+	err = fileAuth.HealthCheck()
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "1 valid 'member' users"),
+		fmt.Sprintf("Too few members: %v", err))
+
+	// Suspect clock.
+	fileAuth.SetLevelMinimums(nil, false)
+	fileAuth.SetClockSkewCheck(time.Hour, &fixedTimeSource{now: mockClock.now.Add(2 * time.Hour)}, false)
+	err = fileAuth.HealthCheck()
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "Clock suspect"),
+		fmt.Sprintf("Suspect clock: %v", err))
+	fileAuth.SetClockSkewCheck(0, nil, false)
+	fileAuth.CheckClock()
+	ExpectTrue(t, fileAuth.HealthCheck() == nil, "Clock not checked")
+	fileAuth.Close()
+
+	// No users.
+	fileAuth.SetLevelMinimums(nil, false)
+	writeUserFile(authFile.Name(), []User{})
+	auth.FindUser("root123")
+	ExpectTrue(t, fileAuth.HealthCheck() != nil, "No users")
+
+	os.Remove(authFile.Name())
+	ExpectTrue(t, fileAuth.HealthCheck() != nil, "Missing file")
+}
+
+func TestReloadKeepsUsers(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "reload-keeps-users")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	root := *auth.FindUser("root123")
+
+	// File gone for a moment, e.g. while saving.
+	os.Rename(authFile.Name(), authFile.Name()+".tmp")
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Still there")
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Still there")
+	ExpectTrue(t, fileAuth.FailedReloads() == 1, "Told once")
+	os.Rename(authFile.Name()+".tmp", authFile.Name())
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Back")
+	ExpectTrue(t, fileAuth.HealthCheck() == nil, "Unchanged file is current")
+
+	// Truncated. Once it is written completely, we pick it up, even if
+	// the timestamp doesn't change.
+	writeUserFile(authFile.Name(), []User{})
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Empty file ignored")
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Empty file ignored")
+	ExpectTrue(t, fileAuth.FailedReloads() == 2, "Told once")
+	stamp := fileAuth.emptyVersion
+	doe := User{Name: "Jon Doe", UserLevel: LevelUser}
+	doe.SetAuthCode("doe123")
+	writeUserFile(authFile.Name(), []User{root, doe})
+	os.Chtimes(authFile.Name(), stamp, stamp)
+	ExpectTrue(t, auth.FindUser("doe123") != nil, "Complete file read")
+
+	// Unless we explicitly allow it.
+	writeUserFile(authFile.Name(), []User{})
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Empty file ignored")
+	fileAuth.SetAllowEmptyReload(true)
+	ExpectTrue(t, auth.FindUser("root123") == nil, "Empty file allowed")
+}
+
+func TestReloadFailures(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "reload-failures")
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	authFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	root := User{Name: "root", ContactInfo: "root@nb", UserLevel: LevelMember}
+	root.SetAuthCode("root123")
+	writeUserFile(authFile.Name(), []User{root})
+	auth := NewFileBasedAuthenticator(authFile.Name(), bus, "")
+
+	writeBroken := func() {
+		content, _ := ioutil.ReadFile(authFile.Name())
+		content = append(content, []byte("\"doe,,user,,,,abc\n")...)
+		ioutil.WriteFile(authFile.Name(), content, 0644)
+		fileModCount++
+		modTime := time.Now().Add(time.Duration(fileModCount) * time.Minute)
+		os.Chtimes(authFile.Name(), modTime, modTime)
+	}
+	writeBroken()
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Keep previous users")
+	ExpectTrue(t, auth.FailedReloads() == 1, "Counted failure")
+	event := findEvent(bus, events, AppUserReloadFailed)
+	ExpectTrue(t, event != nil && strings.Contains(event.Msg, "line 2"),
+		"Tell where the problem is")
+	err := auth.HealthCheck()
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "rejected"), "Unhealthy")
+
+	// Not re-read until changed again.
+	auth.FindUser("root123")
+	ExpectTrue(t, auth.FailedReloads() == 1, "Only once per change")
+
+	writeBroken()
+	auth.FindUser("root123")
+	writeBroken()
+	auth.FindUser("root123")
+	ExpectTrue(t, auth.FailedReloads() == 3, "Three failures")
+	findEvent(bus, events, AppUserReloadFailed) // second
+	event = findEvent(bus, events, AppUserReloadFailed)
+	ExpectTrue(t, event != nil && strings.HasPrefix(event.Msg, "ALERT") &&
+		event.Value == 3, "Louder after failures in a row")
+
+	writeUserFile(authFile.Name(), []User{root})
+	auth.FindUser("root123")
+	ExpectTrue(t, auth.HealthCheck() == nil, "Good again")
+}
+
+func TestLoadErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "load-errors")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	_, err := LoadFileBasedAuthenticator(NewCSVUserStore(dir+"/missing.csv"), NewApplicationBus(), nil, "")
+	ExpectTrue(t, errors.Is(err, os.ErrNotExist), "Missing file")
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "missing.csv"),
+		"Names the file")
+	ExpectTrue(t, NewFileBasedAuthenticator(dir+"/missing.csv", NewApplicationBus(), "") == nil,
+		"Old constructor still returns nil")
+
+	broken := dir + "/broken.csv"
+	ioutil.WriteFile(broken, []byte("root,,member,,,,abc\n\"broken,,user\n"), 0644)
+	_, err = LoadFileBasedAuthenticator(NewCSVUserStore(broken), NewApplicationBus(), nil, "")
+	ExpectTrue(t, err != nil && !errors.Is(err, os.ErrNotExist), "Broken file")
+	var parseError *csv.ParseError
+	ExpectTrue(t, errors.As(err, &parseError) && parseError.StartLine == 2,
+		fmt.Sprintf("Parse error in line 2: %v", err))
+}
+
+func TestLoadReport(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "load-report")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	usersFile := dir + "/users.csv"
+	ioutil.WriteFile(usersFile, []byte(
+		"root,,member,,,,"+hashAuthCode("root123")+"\n"+
+			"# just a comment\n"+
+			",,,,,,\n"+
+			"doe,d@nb,user,,2014-10-10 12:00\n"+
+			"roe,r@nb,usr,,2014-10-10 12:00,,"+hashAuthCode("roe123")+"\n"+
+			"poe,p@nb,user,,2014-10-10 12:00,,"+hashAuthCode("poe123")+"\n"+
+			"anon,,user,,,,"+hashAuthCode("anon123")+"\n"), 0644)
+	store := NewCSVUserStore(usersFile)
+	logger := &recordingLogger{}
+	auth, err := LoadFileBasedAuthenticator(store, NewApplicationBus(), logger, "")
+	ExpectTrue(t, err == nil, "Malformed records don't fail the load")
+	ExpectTrue(t, auth.FindUser("poe123") != nil, "Users after them still read")
+
+	skipped := store.LastLoadReport().Skipped
+	ExpectTrue(t, len(skipped) == 2, fmt.Sprintf("Comments not reported: %v", skipped))
+	if len(skipped) == 2 {
+		ExpectTrue(t, skipped[0].Line == 4 && strings.Contains(skipped[0].Reason, "fields"),
+			"Short line: "+skipped[0].Error())
+		ExpectTrue(t, skipped[1].Line == 5 && strings.Contains(skipped[1].Reason, "usr"),
+			"Invalid level: "+skipped[1].Error())
+		ExpectTrue(t, strings.Contains(skipped[1].Reason, logName("roe")) &&
+			!strings.Contains(skipped[1].Reason, "roe"), "Pseudonym: "+skipped[1].Error())
+	}
+	log := strings.Join(logger.lines, "\n")
+	ExpectTrue(t, strings.Contains(log, "line 4") && strings.Contains(log, "line 5"),
+		"Skipped records logged: "+log)
+	ExpectTrue(t, strings.Contains(log, "No start-date for temp code of '"+logName("anon")+"'"),
+		"Temp code without start logged: "+log)
+	ExpectTrue(t, len(auth.LastLoadReport().Skipped) == 2, "Report of authenticator")
+}
+
+func TestLoadReportBadTimes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "load-report-times")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	usersFile := dir + "/users.csv"
+	ioutil.WriteFile(usersFile, []byte(
+		"root,,member,,,,"+hashAuthCode("root123")+"\n"+
+			"doe,d@nb,user,,yesterday,,"+hashAuthCode("doe123")+"\n"+
+			"roe,r@nb,user,,,,"+hashAuthCode("roe123")+",,,,,,,,,,,sometimes\n"+
+			"poe,p@nb,user,,2014-10-10 12:00,,"+hashAuthCode("poe123")+"\n"), 0644)
+	store := NewCSVUserStore(usersFile)
+	auth, err := LoadFileBasedAuthenticator(store, NewApplicationBus(), &recordingLogger{}, "")
+	ExpectTrue(t, err == nil, fmt.Sprintf("Bad times don't fail the load: %v", err))
+	if err != nil {
+		return
+	}
+	ExpectTrue(t, auth.FindUser("poe123") != nil, "Users after them still read")
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Bad ValidFrom skipped")
+	ExpectTrue(t, auth.FindUser("roe123") == nil, "Bad schedule skipped")
+
+	skipped := store.LastLoadReport().Skipped
+	ExpectTrue(t, len(skipped) == 2, fmt.Sprintf("Both reported: %v", skipped))
+	if len(skipped) == 2 {
+		ExpectTrue(t, skipped[0].Line == 2 && strings.Contains(skipped[0].Reason, "ValidFrom"),
+			"Bad ValidFrom: "+skipped[0].Error())
+		ExpectTrue(t, skipped[1].Line == 3 && strings.Contains(skipped[1].Reason, "schedule"),
+			"Bad schedule: "+skipped[1].Error())
+		ExpectTrue(t, !strings.Contains(skipped[0].Reason, "doe") &&
+			!strings.Contains(skipped[1].Reason, "roe"), "Pseudonyms")
+	}
+}
+
+func TestLoadReportDuplicateCodes(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "load-duplicates")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	usersFile := dir + "/users.csv"
+	ioutil.WriteFile(usersFile, []byte(
+		"root,,member,,,,"+hashAuthCode("root123")+"\n"+
+			"# comment\n"+
+			"doe,d@nb,user,,2014-10-10 12:00,,"+hashAuthCode("doe123")+"\n"+
+			"roe,r@nb,user,,2014-10-10 12:00,,"+
+			hashAuthCode("roe123")+";"+hashAuthCode("doe123")+"\n"), 0644)
+	auth, err := LoadFileBasedAuthenticator(NewCSVUserStore(usersFile),
+		NewApplicationBus(), &recordingLogger{}, "")
+	ExpectTrue(t, err == nil, "Loaded")
+	ExpectTrue(t, auth.FindUser("roe123") == nil, "None of the codes added")
+	ExpectTrue(t, auth.FindUser("doe123").Name == "doe", "First one keeps it")
+
+	duplicates := auth.LastLoadReport().Duplicates
+	ExpectTrue(t, len(duplicates) == 1, "One duplicate")
+	if len(duplicates) == 1 {
+		ExpectTrue(t, duplicates[0] == DuplicateCode{User: "roe", Line: 4,
+			Owner: "doe", OwnerLine: 3}, duplicates[0].String())
+	}
+
+	// Reloads replace the report.
+	ioutil.WriteFile(usersFile, []byte(
+		"root,,member,,,,"+hashAuthCode("root123")+"\n"), 0644)
+	os.Chtimes(usersFile, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	auth.FindUser("root123")
+	ExpectTrue(t, len(auth.LastLoadReport().Duplicates) == 0, "Reloaded report")
+}
+
+func TestNewUserCodeChecks(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "new-user-codes")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	ExpectTrue(t, checkCodeStrength("abc", DefaultMinCodeLength) != nil, "Too short")
+	ExpectTrue(t, checkCodeStrength("000000", DefaultMinCodeLength) != nil, "All same")
+	ExpectTrue(t, checkCodeStrength("000100", DefaultMinCodeLength) == nil, "Ok")
+
+	u := User{Name: "Jon Doe", UserLevel: LevelMember}
+	ExpectFalse(t, u.SetAuthCode("000000"), "Weak code not set")
+	ok, msg := auth.AddNewUser("root123", u)
+	ExpectTrue(t, !ok && strings.Contains(msg, "no code"), "Rejected: "+msg)
+
+	u.Codes = []string{hashAuthCode("doe123"), "doe456"}
+	ok, msg = auth.AddNewUser("root123", u)
+	ExpectTrue(t, !ok && msg == "Code 2 of new user is not hashed", "Rejected: "+msg)
+	ExpectTrue(t, auth.FindUser("doe123") == nil, "Nothing added")
+
+	u.SetAuthCode("doe123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Good code")
+
+	// Existing weak codes still work.
+	root := *auth.FindUser("root123")
+	root.Codes = []string{hashAuthCode("111111")}
+	writeUserFile(authFile.Name(), []User{root})
+	ExpectAuthResult(t, auth, "111111", TargetDownstairs, AuthOk, "")
+}
+
+func TestMinCodeLength(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "min-code-length")
+	auth := CreateSimpleFileAuth(authFile, RealClock{}).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	ExpectTrue(t, auth.SetMinCodeLength(0) != nil, "Needs to be positive")
+	ExpectTrue(t, auth.MinCodeLength() == DefaultMinCodeLength, "Unchanged")
+
+	// Characters, not bytes: four umlauts are eight bytes.
+	ExpectFalse(t, hasMinimalCodeRequirements("äöüß", 5), "Four characters")
+	ExpectTrue(t, hasMinimalCodeRequirements("äöüßa", 5), "Five characters")
+	ExpectTrue(t, checkCodeStrength("üüüüüü", 5) != nil, "All same multibyte")
+
+	ExpectTrue(t, auth.SetMinCodeLength(8) == nil, "Longer codes")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthFail, "too short")
+	ok, msg := auth.AddGuest("root123", "guest12", "Guest", time.Hour, TargetDownstairs)
+	ExpectTrue(t, !ok && strings.Contains(msg, "at least 8"), "Rejected: "+msg)
+
+	ExpectTrue(t, auth.SetMinCodeLength(4) == nil, "Shorter codes")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, eatmsg(auth.AddGuest("root123", "g123", "Guest", time.Hour, TargetDownstairs)), "Short guest code")
+	ExpectAuthResult(t, auth, "g123", TargetDownstairs, AuthOk, "")
+}
+
+func TestCodeNormalization(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "code-normalization")
+	auth := CreateSimpleFileAuth(authFile, RealClock{})
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	u := User{Name: "Card", UserLevel: LevelMember}
+	u.SetAuthCode("  deadbeef\r\n")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add card")
+
+	ExpectAuthResult(t, auth, "deadbeef", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "deadbeef\r", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "root123\n", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, !hasMinimalCodeRequirements("abcd\r\n", 5), "Measured trimmed")
+
+	// Case is only folded if asked for.
+	ExpectAuthResult(t, auth, "DEADBEEF", TargetDownstairs, AuthFail, "")
+	SetUppercaseHexCodes(true)
+	defer SetUppercaseHexCodes(false)
+	ExpectTrue(t, hashAuthCode("DeadBeef") == hashAuthCode("deadbeef "), "Hex folded")
+	ExpectTrue(t, hashAuthCode("root123") != hashAuthCode("ROOT123"), "Not hex")
+	u.Name = "Another card"
+	u.SetAuthCode("cafe1234")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add card")
+	ExpectAuthResult(t, auth, "CAFE1234\r", TargetDownstairs, AuthOk, "")
+}
+
+func TestRewriteKeepsComments(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "keep-comments")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	line := func(name string, code string) string {
+		var buffer bytes.Buffer
+		writer := csv.NewWriter(&buffer)
+		u := User{Name: name, ContactInfo: "x@example.com", UserLevel: LevelMember}
+		u.SetAuthCode(code)
+		u.WriteCSV(writer)
+		writer.Flush()
+		return buffer.String()
+	}
+	authFile.WriteString("# Header, keep me\n" +
+		line("root", "root123") +
+		"\n# Doe family\n" +
+		line("Jon Doe", "doe123") +
+		line("Jane Doe", "jane123") +
+		"# The Roes\n" +
+		line("Mary Roe", "roe123") +
+		"# End of file")
+	authFile.Close()
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+
+	// Modifying forces a rewrite of the whole file.
+	ExpectTrue(t, eatmsg(auth.UpdateUser("root123", "jane123",
+		func(user *User) bool {
+			user.ContactInfo = "jane@example.com"
+			return true
+		})), "Update Jane")
+	content, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.HasPrefix(string(content), "# Header, keep me\nroot,"), string(content))
+	ExpectTrue(t, strings.Contains(string(content), "\n\n# Doe family\nJon Doe,"), string(content))
+	ExpectTrue(t, strings.Contains(string(content), "\n# The Roes\nMary Roe,"), string(content))
+	ExpectTrue(t, strings.HasSuffix(string(content), "\n# End of file\n"), string(content))
+	ExpectTrue(t, strings.Contains(string(content), "jane@example.com"), "Updated")
+
+	// Comments of a deleted user go to the next one; appended users come
+	// after the trailing comment.
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "doe123")), "Delete Jon")
+	u := User{Name: "New", ContactInfo: "new@example.com", UserLevel: LevelUser}
+	u.SetAuthCode("new123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Add")
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "roe123")), "Delete Mary")
+	content, _ = ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.Contains(string(content), "\n\n# Doe family\nJane Doe,"), string(content))
+	ExpectTrue(t, strings.Contains(string(content), "\n# The Roes\n# End of file\nNew,"), string(content))
+	ExpectTrue(t, auth.FindUser("jane123") != nil, "Jane still there")
+}
+
+func TestCSVDelimiter(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "csv-delimiter")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	store := NewCSVUserStore(dir + "/users.csv")
+	ExpectTrue(t, store.SetDelimiter(';', ';') != nil, "Delimiter same as comment")
+	ExpectTrue(t, store.SetDelimiter('"', '#') != nil, "Quote as delimiter")
+	ExpectTrue(t, store.SetDelimiter(';', 0) == nil, "No comments")
+
+	for _, delimiter := range []rune{',', ';', '\t'} {
+		store := NewCSVUserStore(dir + "/users.csv")
+		ExpectTrue(t, store.SetDelimiter(delimiter, '%') == nil, "Set delimiter")
+		root := &User{Name: "root", UserLevel: LevelMember, Sponsors: []string{""}}
+		root.SetAuthCode("root123")
+		funny := &User{Name: "Doe, Jon; \"JD\"", ContactInfo: "jon@nb; 555, ext 3",
+			UserLevel: LevelUser, Sponsors: []string{hashAuthCode("a"), hashAuthCode("b")},
+			DenyMessage: "Say \"hi\"; then, leave"}
+		funny.Codes = []string{hashAuthCode("doe123"), hashAuthCode("doe456")}
+		funny.CodeIssueDates = []time.Time{{}, {}}
+		funny.ValidFrom, _ = time.Parse("2006-01-02", "2014-10-10")
+		ExpectTrue(t, store.ReplaceAll([]*User{root, funny}) == nil, "Writing")
+
+		content, _ := ioutil.ReadFile(dir + "/users.csv")
+		ioutil.WriteFile(dir+"/users.csv",
+			append([]byte("% Comment; with, delimiters \"\n"), content...), 0644)
+		users, err := store.Load()
+		ExpectTrue(t, err == nil && len(users) == 2,
+			fmt.Sprintf("Loading with %q: %v\n%s", delimiter, err, content))
+		if len(users) == 2 {
+			ExpectTrue(t, reflect.DeepEqual(users[1], funny),
+				fmt.Sprintf("Round trip with %q: %#v", delimiter, users[1]))
+		}
+		ExpectTrue(t, store.ReplaceAll(users) == nil, "Rewriting")
+		content, _ = ioutil.ReadFile(dir + "/users.csv")
+		ExpectTrue(t, strings.HasPrefix(string(content), "% Comment; with, delimiters \"\nroot"+
+			string(delimiter)), "Comment kept: "+string(content))
+	}
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+func TestLogger(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "logger")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	CreateSimpleFileAuth(authFile, RealClock{})
+	logger := &recordingLogger{}
+	auth, err := LoadFileBasedAuthenticator(NewCSVUserStore(authFile.Name()),
+		NewApplicationBus(), logger, "")
+	ExpectTrue(t, err == nil, "Loaded")
+	ExpectTrue(t, len(logger.lines) > 0 &&
+		strings.HasPrefix(logger.lines[0], "Reading "), "Loading logged")
+
+	// Reloads log to the same logger.
+	logger.lines = nil
+	root := *auth.FindUser("root123")
+	writeUserFile(authFile.Name(), []User{root, root})
+	auth.FindUser("root123")
+	ExpectTrue(t, len(logger.lines) > 0 &&
+		strings.Contains(strings.Join(logger.lines, "\n"), "Ignoring multiple used code"),
+		"Reload logged")
+}
+
+func TestLogRedaction(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "redaction")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	authFile.WriteString("root,root@nb,member,,,," + hashAuthCode("root123") + "\n" +
+		"Jon Doe,jon@nb,user,,,," + hashAuthCode("jon12345") + "\n")
+	authFile.Close()
+	logger := &recordingLogger{}
+	auth, _ := LoadFileBasedAuthenticator(NewCSVUserStore(authFile.Name()),
+		NewApplicationBus(), logger, "")
+
+	ExpectTrue(t, logName("Jon Doe") == logName("Jon Doe") &&
+		logName("Jon Doe") != logName("root"), "Stable pseudonyms")
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", true)), "Lockdown")
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "jon12345")), "Deleting")
+	logged := strings.Join(logger.lines, "\n")
+	ExpectTrue(t, !strings.Contains(logged, "'root'") && !strings.Contains(logged, "Jon Doe") &&
+		strings.Contains(logged, logName("Jon Doe")), logged)
+
+	jon := &User{Name: "Jon Doe", ContactInfo: "jon@nb"}
+	msg := logUserMessage("User on hiatus 'Jon Doe <jon@nb>'", jon)
+	ExpectTrue(t, !strings.Contains(msg, "Jon Doe") && !strings.Contains(msg, "jon@nb"), msg)
+
+	SetLogRedaction(false)
+	defer SetLogRedaction(true)
+	ExpectTrue(t, logName("Jon Doe") == "Jon Doe", "Unredacted")
+	ExpectTrue(t, logUserMessage("'Jon Doe <jon@nb>'", jon) == "'Jon Doe <jon@nb>'", "Unredacted")
+}
+
+type recordingMetrics struct {
+	decisions       []string
+	authDurations   []time.Duration
+	reloads         int
+	reloadErrors    int
+	reloadDurations []time.Duration
+	usersLoaded     int
+}
+
+func (m *recordingMetrics) AuthDecision(target Target, result AuthResult, reason AuthReason) {
+	m.decisions = append(m.decisions, fmt.Sprintf("%s:%s", target, reason))
+}
+
+func (m *recordingMetrics) AuthDuration(took time.Duration) {
+	m.authDurations = append(m.authDurations, took)
+}
+
+func (m *recordingMetrics) ReloadDuration(took time.Duration) {
+	m.reloadDurations = append(m.reloadDurations, took)
+}
+
+func (m *recordingMetrics) Reload(err error) {
+	m.reloads++
+	if err != nil {
+		m.reloadErrors++
+	}
+}
+
+func (m *recordingMetrics) UsersLoaded(count int) {
+	m.usersLoaded = count
+}
+
+// A clock that moves on a bit with each reading, so durations measured
+// with it are not zero.
+type steppingClock struct {
+	now  time.Time
+	step time.Duration
+}
+
+func (c *steppingClock) Now() time.Time {
+	c.now = c.now.Add(c.step)
+	return c.now
+}
+
+func TestMetrics(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "metrics")
+	authFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	writeNumberedUserFile(authFile.Name(), 3)
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	auth.clock = &steppingClock{now: time.Now(), step: time.Millisecond}
+	metrics := &recordingMetrics{}
+	auth.SetMetrics(metrics)
+	ExpectTrue(t, metrics.usersLoaded == 4, "Users loaded so far")
+
+	auth.AuthUser("root123", TargetUpstairs)
+	auth.AuthUser("nosuchcode", TargetDownstairs)
+	ExpectTrue(t, strings.Join(metrics.decisions, " ") ==
+		"upstairs:granted gate:unknown-code", strings.Join(metrics.decisions, " "))
+	ExpectTrue(t, len(metrics.authDurations) == 2 && metrics.authDurations[0] > 0,
+		fmt.Sprintf("Auth durations %v", metrics.authDurations))
+
+	writeNumberedUserFile(authFile.Name(), 5)
+	auth.FindUser("root123")
+	ExpectTrue(t, metrics.reloads == 1 && metrics.reloadErrors == 0, "Reload counted")
+	ExpectTrue(t, metrics.usersLoaded == 6, "Users after reload")
+	ExpectTrue(t, len(metrics.reloadDurations) == 1 && metrics.reloadDurations[0] > 0,
+		fmt.Sprintf("Reload durations %v", metrics.reloadDurations))
+
+	ioutil.WriteFile(authFile.Name(), nil, 0644)
+	os.Chtimes(authFile.Name(), time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+	auth.FindUser("root123")
+	ExpectTrue(t, metrics.reloads == 2 && metrics.reloadErrors == 1, "Failed reload counted")
+	ExpectTrue(t, len(metrics.reloadDurations) == 2, "Failed reloads take time too")
+	ExpectTrue(t, metrics.usersLoaded == 6, "Still the users before")
+}
+
+func TestLastSeen(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "last-seen")
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	fileAuth := auth.(*FileBasedAuthenticator)
+	for _, name := range []string{"Jon Doe", "Jane Doe"} {
+		u := User{Name: name, ContactInfo: name + "@nb", UserLevel: LevelMember}
+		u.SetAuthCode(name + "123")
+		auth.AddNewUser("root123", u)
+	}
+	mockClock.now = mockClock.now.Add(time.Hour)
+
+	_, seen := fileAuth.LastSeen("Jon Doe")
+	ExpectFalse(t, seen, "Not seen yet")
+	ExpectTrue(t, len(fileAuth.InactiveSince(24*time.Hour)) == 0,
+		"Not tracking long enough to tell")
+
+	ExpectAuthResult(t, auth, "Jon Doe123", TargetUpstairs, AuthOk, "")
+	jonSeen := mockClock.now
+	when, seen := fileAuth.LastSeen("Jon Doe")
+	ExpectTrue(t, seen && when.Equal(jonSeen), "Seen")
+
+	// Denials don't count.
+	mockClock.now = mockClock.now.Add(48 * time.Hour)
+	fileAuth.SetLockdown("root123", true)
+	ExpectTrue(t, eatmsg(fileAuth.UpdateUser("root123", "Jane Doe123", func(user *User) bool {
+		user.UserLevel = LevelUser
+		return true
+	})), "Making Jane a regular user")
+	auth.AuthUser("Jane Doe123", TargetUpstairs)
+	_, seen = fileAuth.LastSeen("Jane Doe")
+	ExpectFalse(t, seen, "Denied access is not seen")
+	fileAuth.SetLockdown("root123", false)
+	ExpectAuthResult(t, auth, "root123", TargetUpstairs, AuthOk, "")
+
+	inactive := fileAuth.InactiveSince(24 * time.Hour)
+	ExpectTrue(t, len(inactive) == 2 && inactive[0].Name == "Jon Doe" &&
+		inactive[1].Name == "Jane Doe", fmt.Sprintf("Inactive: %v", inactive))
+	ExpectTrue(t, inactive[0].Codes == nil, "No code material")
+	ExpectTrue(t, len(fileAuth.InactiveSince(72*time.Hour)) == 0, "Jon seen within")
+
+	// Survives reloads.
+	writeUserFile(authFile.Name(), fileAuth.ListUsers())
+	when, seen = fileAuth.LastSeen("Jon Doe")
+	ExpectTrue(t, seen && when.Equal(jonSeen), "Seen after reload")
+}
+
+func TestUsageStats(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "usage-stats")
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	bus := NewApplicationBus()
+	events := make(AppEventChannel, 10)
+	bus.Subscribe(events)
+	authFile.Close()
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	writeNumberedUserFile(authFile.Name(), 2)
+	fileAuth := NewFileBasedAuthenticatorWithClock(authFile.Name(), bus, "", mockClock)
+	fileAuth.SetMaxDailyEntries(3)
+
+	for i := 0; i < 3; i++ {
+		fileAuth.AuthUser("user0_code", TargetUpstairs)
+	}
+	fileAuth.AuthUser("user0_code", TargetDownstairs)
+	fileAuth.AuthUser("root123", TargetDownstairs)
+	mockClock.now = mockClock.now.Add(-8 * time.Hour) // Outside user hours.
+	fileAuth.AuthUser("user1_code", TargetDownstairs)
+
+	stats := fileAuth.UsageStats()
+	ExpectTrue(t, len(stats.Users) == 2, fmt.Sprintf("Users with entries: %v", stats.Users))
+	user0 := stats.Users[0]
+	ExpectTrue(t, user0.Name == "user0" && user0.Total == 4 &&
+		user0.Entries[TargetUpstairs] == 3 && user0.Entries[TargetDownstairs] == 1,
+		fmt.Sprintf("Most entries first: %v", user0))
+	ExpectTrue(t, stats.Users[1].Name == "root" && stats.Users[1].Total == 1, "Root")
+
+	alert := findEvent(bus, events, AppUsageAlert)
+	ExpectTrue(t, alert != nil && alert.Value == 4 && alert.Target == TargetDownstairs,
+		"Alert for too many entries")
+	ExpectTrue(t, findEvent(bus, events, AppUsageAlert) == nil, "Only once")
+
+	// New day, new count.
+	mockClock.now = mockClock.now.Add(32 * time.Hour)
+	for i := 0; i < 4; i++ {
+		fileAuth.AuthUser("user0_code", TargetUpstairs)
+	}
+	ExpectTrue(t, findEvent(bus, events, AppUsageAlert) != nil, "Alert next day")
+}
+
+func TestRevokeCodes(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "revoke")
+	denyFile, _ := ioutil.TempFile("", "revoke-deny")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(denyFile.Name())
+	}
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock)
+	fileAuth := auth.(*FileBasedAuthenticator)
+	ExpectTrue(t, fileAuth.SetDenyList(denyFile.Name()) == nil, "Deny-list")
+
+	afternoon, _ := time.Parse("2006-01-02 15:04", "2014-10-10 15:00")
+	mockClock.now = afternoon
+	u := User{Name: "Lost", ContactInfo: "lost@nb", UserLevel: LevelUser}
+	u.SetAuthCode("lost123")
+	u.Codes = append(u.Codes, hashAuthCode("spare123"))
+	auth.AddNewUser("root123", u)
+	other := User{Name: "Other", ContactInfo: "other@nb", UserLevel: LevelUser}
+	other.SetAuthCode("other123")
+	auth.AddNewUser("root123", other)
+	mockClock.now = afternoon.Add(time.Hour)
+
+	ExpectFalse(t, eatmsg(fileAuth.RevokeCode("other123", "lost123")), "Needs a member")
+	ExpectTrue(t, eatmsg(fileAuth.RevokeCode("root123", "lost123")), "Revoking code")
+	ExpectAuthResult(t, auth, "lost123", TargetUpstairs, AuthFail, "revoked")
+	ExpectAuthResult(t, auth, "spare123", TargetUpstairs, AuthOk, "")
+	ExpectTrue(t, auth.FindUser("lost123") != nil, "User still there")
+	denyContent, _ := ioutil.ReadFile(denyFile.Name())
+	ExpectTrue(t, strings.Contains(string(denyContent), codeHint("lost123")) &&
+		!strings.Contains(string(denyContent), scrubLogValue("lost123")),
+		"Deny-list only has the peppered hint")
+
+	ExpectFalse(t, eatmsg(fileAuth.RevokeUserCodes("root123", "Nobody")), "Unknown user")
+	ExpectTrue(t, eatmsg(fileAuth.RevokeUserCodes("root123", "Other")), "Revoking user")
+	ExpectAuthResult(t, auth, "other123", TargetUpstairs, AuthFail, "revoked")
+
+	// Revoked codes stay out after a restart, even with the users unchanged.
+	restarted := NewFileBasedAuthenticatorWithClock(authFile.Name(), NewApplicationBus(), "", mockClock)
+	ExpectTrue(t, restarted.SetDenyList(denyFile.Name()) == nil, "Deny-list after restart")
+	ExpectAuthResult(t, restarted, "lost123", TargetUpstairs, AuthFail, "revoked")
+	ExpectAuthResult(t, restarted, "other123", TargetUpstairs, AuthFail, "revoked")
+	ExpectAuthResult(t, restarted, "spare123", TargetUpstairs, AuthOk, "")
+}
+
+func TestMasterCodes(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "master")
+	masterFile, _ := ioutil.TempFile("", "master-codes")
+	auditFile, _ := ioutil.TempFile("", "master-audit")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(masterFile.Name())
+		defer syscall.Unlink(auditFile.Name())
+	}
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	logger, _ := NewAuditLogger(auditFile.Name())
+	auth.SetAuditLogger(logger)
+	events := make(AppEventChannel, 10)
+	auth.eventBus.Subscribe(events)
+
+	ioutil.WriteFile(masterFile.Name(), []byte("elevator-tech "+hashAuthCode("lift123")+"\n"), 0644)
+	ExpectTrue(t, auth.SetMasterCodes(masterFile.Name()) != nil, "Needs targets")
+	ioutil.WriteFile(masterFile.Name(), []byte("elevator-tech lift123 elevator\n"), 0644)
+	ExpectTrue(t, auth.SetMasterCodes(masterFile.Name()) != nil, "Needs hashed code")
+	ioutil.WriteFile(masterFile.Name(), []byte("# Maintenance\n"+
+		"elevator-tech "+hashAuthCode("lift123")+" elevator,upstairs\n"), 0644)
+	ExpectTrue(t, auth.SetMasterCodes(masterFile.Name()) == nil, "Master codes")
+
+	// At night and in lockdown.
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 03:00")
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", true)), "Lockdown")
+	result, reason, _ := auth.AuthUserWithReason("lift123", TargetElevator)
+	ExpectTrue(t, result == AuthOk && reason == AccessGrantedMaster, "Master override")
+	event := findEvent(auth.eventBus, events, AppMasterOverride)
+	ExpectTrue(t, event != nil && event.Target == TargetElevator &&
+		strings.Contains(event.Msg, "elevator-tech"), "Alarm")
+	ExpectAuthResult(t, auth, "lift123", TargetDownstairs, AuthFail, "")
+	ExpectTrue(t, auth.FindUser("lift123") == nil, "Not a user")
+	audit, _ := ioutil.ReadFile(auditFile.Name())
+	ExpectTrue(t, strings.Contains(string(audit),
+		`target=elevator result=granted reason=master-override user="elevator-tech"`),
+		"Audited: "+string(audit))
+
+	// A locked out target is locked for master codes too.
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", false)), "Lifting lockdown")
+	auth.SetFailureLockout(2, time.Minute, time.Minute)
+	ExpectAuthResult(t, auth, "nosuch123", TargetElevator, AuthFail, "")
+	ExpectAuthResult(t, auth, "nosuch456", TargetElevator, AuthFail, "")
+	ExpectAuthResult(t, auth, "lift123", TargetElevator, AuthFail, "locked")
+	mockClock.now = mockClock.now.Add(2 * time.Minute)
+	auth.SetFailureLockout(0, 0, 0)
+
+	// Revoked master codes are out like any other, even at a door open
+	// to all.
+	ExpectTrue(t, eatmsg(auth.RevokeCode("root123", "lift123")), "Revoking")
+	ExpectAuthResult(t, auth, "lift123", TargetElevator, AuthFail, "revoked")
+	schedules, _ := ParseOpenSchedules("elevator=fri 0-24")
+	auth.SetOpenSchedules(schedules)
+	defer auth.Close()
+	ExpectAuthResult(t, auth, "lift123", TargetElevator, AuthFail, "revoked")
+	ExpectAuthResult(t, auth, "nosuch123", TargetElevator, AuthOk, "")
+}
+
+// Takes its time to tell whether the users changed, like a remote store.
+type slowUserStore struct {
+	*CSVUserStore
+	delay time.Duration
+}
+
+func (s *slowUserStore) Version() (time.Time, error) {
+	time.Sleep(s.delay)
+	return s.CSVUserStore.Version()
+}
+
+func TestAuthUserCtx(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "auth-ctx")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	CreateSimpleFileAuth(authFile, RealClock{})
+	store := &slowUserStore{CSVUserStore: NewCSVUserStore(authFile.Name())}
+	auth, err := LoadFileBasedAuthenticator(store, NewApplicationBus(), &recordingLogger{}, "")
+	ExpectTrue(t, err == nil, "Loading")
+
+	var reason AuthReason
+	result, msg := auth.AuthUserCtx(context.Background(), "root123", TargetDownstairs)
+	ExpectResult(t, result, msg, AuthOk, "", "Background")
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	result, msg = auth.AuthUserCtx(cancelled, "root123", TargetDownstairs)
+	ExpectResult(t, result, msg, AuthFail, "auth timed out", "Cancelled")
+
+	store.delay = 200 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	result, reason, _ = auth.authAndRecord(ctx, "root123", TargetDownstairs, "")
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedTimeout, "Deadline exceeded")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+}
+
+func TestReadOnlyAuthenticator(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "read-only")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = now
+	u := User{Name: "Delivery", UserLevel: LevelUser, SingleUse: true}
+	u.SetAuthCode("delivery123")
+	auth.AddNewUser("root123", u)
+	mockClock.now = now.Add(time.Minute)
+
+	var view Authenticator = auth.ReadOnly()
+	ExpectAuthResult(t, view, "root123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, view, "delivery123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, view, "delivery123", TargetDownstairs, AuthOk, "") // Not used up.
+	ExpectAuthResult(t, view, "unknown123", TargetDownstairs, AuthFail, "")
+
+	other := User{Name: "Other", ContactInfo: "other@nb", UserLevel: LevelUser}
+	other.SetAuthCode("other123")
+	ok, msg := view.AddNewUser("root123", other)
+	ExpectTrue(t, !ok && msg == "read-only", "Can't add: "+msg)
+	ExpectFalse(t, eatmsg(view.DeleteUser("root123", "delivery123")), "Can't delete")
+	ExpectTrue(t, view.FindUser("root123") == nil, "No lookup by code")
+	_, known := view.ValidityRemaining("root123")
+	ExpectFalse(t, known, "No validity by code")
+	found := auth.ReadOnly().FindUsersByName("root")
+	ExpectTrue(t, len(found) == 1 && len(found[0].Codes) == 0, "Found without codes")
+	found[0].Name = "changed"
+	ExpectTrue(t, auth.FindUser("root123").Name == "root", "A copy")
+	_, granted, _ := view.AuthUserDetailed("root123", TargetDownstairs)
+	ExpectTrue(t, granted != nil && len(granted.Codes) == 0, "Granted without codes")
+
+	// Sees changes made with the authenticator itself.
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", other)), "Adding")
+	ExpectTrue(t, len(auth.ReadOnly().FindUsersByName("other")) == 1, "Sees new user")
+	users := auth.ReadOnly().ListUsers()
+	ExpectTrue(t, len(users) == 3 && len(users[0].Codes) == 0, "Lists users without codes")
+
+	// Guessing codes is recorded and locks out like at the door.
+	events := auth.Events()
+	defer auth.StopEvents(events)
+	auth.SetFailureLockout(2, time.Minute, time.Minute)
+	ExpectAuthResult(t, view, "guess123", TargetDownstairs, AuthFail, "")
+	event := <-events
+	ExpectTrue(t, event.Check && event.Reason == AccessDeniedUnknownCode, fmt.Sprintf("%v", event))
+	ExpectAuthResult(t, view, "guess456", TargetDownstairs, AuthFail, "")
+	ExpectAuthResult(t, view, "other123", TargetDownstairs, AuthFail, "locked")
+}
+
+func TestPresence(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "presence")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	auth.SetPresenceTargets([]Target{TargetDownstairs}, []Target{"exit"}, 4*time.Hour)
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = now
+	u := User{Name: "Jon", ContactInfo: "jon@nb", UserLevel: LevelUser}
+	u.SetAuthCode("jon123")
+	auth.AddNewUser("root123", u)
+	mockClock.now = now.Add(time.Minute)
+
+	ExpectTrue(t, len(auth.WhoIsPresent()) == 0, "Nobody yet")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "jon123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "jon123", TargetUpstairs, AuthOk, "") // Neither.
+	present := auth.WhoIsPresent()
+	ExpectTrue(t, len(present) == 2 && len(present[0].Codes) == 0, "Both, no codes")
+	ExpectTrue(t, auth.IsPresent("Jon") && auth.IsPresent("root"), "Present")
+
+	ExpectAuthResult(t, auth, "jon123", "exit", AuthOk, "")
+	ExpectFalse(t, auth.IsPresent("Jon"), "Swiped out")
+	ExpectAuthResult(t, auth, "unknown123", "exit", AuthFail, "")
+	ExpectTrue(t, auth.IsPresent("root"), "Others stay")
+
+	// Didn't swipe out.
+	mockClock.now = now.Add(5 * time.Hour)
+	ExpectFalse(t, auth.IsPresent("root"), "Idle timeout")
+
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	auth.ClearPresence()
+	ExpectTrue(t, len(auth.WhoIsPresent()) == 0, "Cleared")
+}
+
+func TestAutoOpen(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "auto-open")
+	auditFile, _ := ioutil.TempFile("", "auto-open-audit")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(auditFile.Name())
+	}
+	logger, _ := NewAuditLogger(auditFile.Name())
+	auth.SetAuditLogger(logger)
+	auth.SetPresenceTargets([]Target{TargetDownstairs}, []Target{"exit"}, 0)
+	auth.SetAutoOpen(DefaultAutoOpenMembers)
+
+	night, _ := time.Parse("2006-01-02 15:04", "2014-10-10 01:00")
+	mockClock.now = night
+	m := User{Name: "Doe", ContactInfo: "doe@nb", UserLevel: LevelMember}
+	m.SetAuthCode("doe123")
+	auth.AddNewUser("root123", m)
+	u := User{Name: "Jon", ContactInfo: "jon@nb", UserLevel: LevelUser}
+	u.SetAuthCode("jon123")
+	auth.AddNewUser("root123", u)
+	mockClock.now = night.Add(time.Minute)
+
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectFalse(t, auth.IsSpaceOpen(), "One member is not enough")
+	ExpectAuthResult(t, auth, "jon123", TargetDownstairs, AuthOkButOutsideTime, "")
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.IsSpaceOpen(), "Two members open")
+	ExpectAuthResult(t, auth, "jon123", TargetUpstairs, AuthOk, "")
+
+	ExpectAuthResult(t, auth, "root123", "exit", AuthOk, "")
+	ExpectTrue(t, auth.IsSpaceOpen(), "Stays open with a member")
+	ExpectAuthResult(t, auth, "doe123", "exit", AuthOk, "")
+	ExpectFalse(t, auth.IsSpaceOpen(), "Closed when the last member left")
+	ExpectAuthResult(t, auth, "jon123", TargetUpstairs, AuthOkButOutsideTime, "")
+
+	// Closing by hand holds until all members are gone.
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.IsSpaceOpen(), "Open again")
+	ExpectTrue(t, eatmsg(auth.CloseSpace("root123")), "Closing")
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+	ExpectFalse(t, auth.IsSpaceOpen(), "Stays closed")
+	auth.ClearPresence()
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.IsSpaceOpen(), "Opens by itself again")
+
+	audit, _ := ioutil.ReadFile(auditFile.Name())
+	ExpectTrue(t, strings.Contains(string(audit), `space-status open=true by="" msg="Space opened: 2 members present"`) &&
+		strings.Contains(string(audit), `space-status open=false by="" msg="Space closed: last member left"`) &&
+		strings.Contains(string(audit), `space-status open=false by="root"`),
+		"Audited: "+string(audit))
+}
+
+func TestAntiPassback(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "passback")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	auth.SetPresenceTargets([]Target{TargetDownstairs, TargetUpstairs}, []Target{"exit"}, 0)
+	ExpectTrue(t, auth.SetAntiPassback([]Target{TargetDownstairs}, 0) != nil, "Needs window")
+	ExpectTrue(t, auth.SetAntiPassback([]Target{TargetDownstairs}, time.Hour) == nil, "Passback")
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = now
+
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	result, reason, _ := auth.AuthUserWithReason("root123", TargetDownstairs)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedPassback, "Passed back")
+	ExpectAuthResult(t, auth, "root123", TargetUpstairs, AuthOk, "") // Not enforced.
+
+	ExpectAuthResult(t, auth, "root123", "exit", AuthOk, "")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+
+	// Missed the exit: fine again after the window.
+	mockClock.now = now.Add(59 * time.Minute)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthFail, "exit first")
+	mockClock.now = now.Add(time.Hour)
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+}
+
+func TestMaxOccupancy(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "occupancy")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	auth.SetPresenceTargets([]Target{TargetDownstairs}, []Target{"exit"}, 0)
+	auth.SetMaxOccupancy(2)
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = now
+	for _, name := range []string{"jon", "roe", "moe"} {
+		u := User{Name: name, ContactInfo: name + "@nb", UserLevel: LevelUser}
+		u.SetAuthCode(name + "123")
+		auth.AddNewUser("root123", u)
+	}
+	mockClock.now = now.Add(time.Minute)
+
+	ExpectAuthResult(t, auth, "jon123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "roe123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.Occupancy() == 2, "Two in")
+	result, reason, msg := auth.AuthUserWithReason("moe123", TargetDownstairs)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedCapacity && msg == "at capacity",
+		"Full: "+msg)
+	ExpectAuthResult(t, auth, "jon123", TargetDownstairs, AuthOk, "") // Already in.
+	ExpectAuthResult(t, auth, "moe123", TargetUpstairs, AuthOk, "")   // Not an entry.
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.Occupancy() == 3, "Members always get in")
+
+	ExpectAuthResult(t, auth, "jon123", "exit", AuthOk, "")
+	ExpectAuthResult(t, auth, "root123", "exit", AuthOk, "")
+	ExpectTrue(t, auth.Occupancy() == 1, "Exits count")
+	ExpectAuthResult(t, auth, "moe123", TargetDownstairs, AuthOk, "")
+
+	auth.SetMaxOccupancy(0)
+	ExpectAuthResult(t, auth, "jon123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, auth.Occupancy() == 3, "No limit")
+}
+
+func TestCodeTypes(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "code-types")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	authFile.WriteString("root,root@nb,member,,,," + hashAuthCode("root123") + "\n" +
+		"jon,jon@nb,member,,,," + hashAuthCode("cafe1234") + ";" + hashAuthCode("jon123") +
+		",,,,,,,,,,card;pin\n")
+	authFile.Close()
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+
+	user, codeType := auth.FindUserWithCodeType("cafe1234")
+	ExpectTrue(t, user != nil && codeType == FactorCard, "Card")
+	_, codeType = auth.FindUserWithCodeType("jon123")
+	ExpectTrue(t, codeType == FactorPIN, "PIN")
+	user, codeType = auth.FindUserWithCodeType("root123")
+	ExpectTrue(t, user != nil && codeType == FactorUnknown && user.CodeTypes == nil,
+		"Legacy rows are unknown")
+
+	// Adding and removing codes keeps the types of the others.
+	ExpectTrue(t, eatmsg(auth.AddCodeToUser("root123", "jon", "other123")), "Adding code")
+	_, codeType = auth.FindUserWithCodeType("other123")
+	ExpectTrue(t, codeType == FactorUnknown, "New code unknown")
+	ExpectTrue(t, eatmsg(auth.RemoveCodeFromUser("root123", "jon", "cafe1234")), "Removing")
+	_, codeType = auth.FindUserWithCodeType("jon123")
+	ExpectTrue(t, codeType == FactorPIN, "Still PIN")
+	content, _ := ioutil.ReadFile(authFile.Name())
+	ExpectTrue(t, strings.Contains(string(content), ",pin;\n"), "Written: "+string(content))
+
+	// Only known types are accepted.
+	reader := csv.NewReader(strings.NewReader("x,,user,,,,code,,,,,,,,,,finger\n"))
+	reader.FieldsPerRecord = -1
+	_, _, err := NewUserFromCSV(reader)
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "code type"), fmt.Sprintf("%v", err))
+}
+
+func TestHiatusMessage(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "hiatus-message")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	authFile.WriteString("root,root@nb,member,,,," + hashAuthCode("root123") + "\n" +
+		"Away,away@nb,hiatus,,,," + hashAuthCode("away1234") + "\n")
+	authFile.Close()
+	auth := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+
+	// Contact info is not shown by default.
+	result, msg := auth.AuthUser("away1234", TargetUpstairs)
+	ExpectTrue(t, result == AuthFail && strings.Contains(msg, "Away") &&
+		!strings.Contains(msg, "away@nb"), msg)
+
+	ExpectTrue(t, auth.SetHiatusMessage("Welcome back, {{.Name}}! Contact the board.") == nil,
+		"Setting")
+	ExpectAuthResult(t, auth, "away1234", TargetUpstairs, AuthFail,
+		"^Welcome back, Away! Contact the board.$")
+
+	ExpectTrue(t, auth.SetHiatusMessage("{{.Name}} <{{.ContactInfo}}> at {{.Target}}") == nil,
+		"Setting with contact")
+	ExpectAuthResult(t, auth, "away1234", TargetUpstairs, AuthFail,
+		"^Away <away@nb> at upstairs$")
+
+	// Broken templates and fields that aren't there are rejected right away.
+	ExpectTrue(t, auth.SetHiatusMessage("{{.Name") != nil, "Syntax")
+	ExpectTrue(t, auth.SetHiatusMessage("{{.Codes}}") != nil, "No codes")
+	ExpectAuthResult(t, auth, "away1234", TargetUpstairs, AuthFail,
+		"^Away <away@nb> at upstairs$")
+}
+
+func TestJSONExportImport(t *testing.T) {
+	fromFile, _ := ioutil.TempFile("", "export-from")
+	toFile, _ := ioutil.TempFile("", "export-to")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(fromFile.Name())
+		defer syscall.Unlink(toFile.Name())
+	}
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	from := CreateSimpleFileAuth(fromFile, mockClock).(*FileBasedAuthenticator)
+	u := User{Name: "Jon", ContactInfo: "jon@nb", UserLevel: LevelUser,
+		ValidTo: mockClock.now.Add(24 * time.Hour), Hours: &HourWindow{7, 9}}
+	u.SetAuthCode("jon12345")
+	u.DuressCodes = []string{hashAuthCode("jonduress")}
+	ExpectTrue(t, eatmsg(from.AddNewUser("root123", u)), "Adding")
+
+	var snapshot bytes.Buffer
+	ExpectTrue(t, from.ExportJSON(&snapshot) == nil, "Exporting")
+	ExpectTrue(t, strings.Contains(snapshot.String(), `"version": 1`) &&
+		!strings.Contains(snapshot.String(), "jon12345"), snapshot.String())
+
+	// Into an instance with just another member.
+	toFile.WriteString("other,other@nb,member,,,," + hashAuthCode("other123") + "\n")
+	toFile.Close()
+	to := NewFileBasedAuthenticatorWithClock(toFile.Name(), NewApplicationBus(), "", mockClock)
+	ExpectTrue(t, to.ImportJSON("jon12345", bytes.NewReader(snapshot.Bytes())) != nil,
+		"Only members")
+	ExpectTrue(t, to.ImportJSON("other123", bytes.NewReader(snapshot.Bytes())) == nil,
+		"Importing")
+	for _, name := range []string{"root", "Jon"} {
+		var original, imported *User
+		for _, user := range from.ListUsers() {
+			if user.Name == name {
+				original = &user
+			}
+		}
+		for _, user := range to.ListUsers() {
+			if user.Name == name {
+				imported = &user
+			}
+		}
+		ExpectTrue(t, imported != nil && reflect.DeepEqual(original, imported),
+			fmt.Sprintf("Round-trip of %s: %v vs. %v", name, original, imported))
+	}
+
+	// Again, all codes conflict.
+	err := to.ImportJSON("other123", bytes.NewReader(snapshot.Bytes()))
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "nothing imported"), fmt.Sprintf("%v", err))
+	ExpectTrue(t, len(to.ListUsers()) == 3, "Nothing merged")
+
+	// Within a snapshot, too.
+	twice := `{"version": 1, "users": [
+		{"name": "a", "level": "user", "codes": [{"hash": "` + hashAuthCode("same1234") + `"}]},
+		{"name": "b", "level": "user", "codes": [{"hash": "` + hashAuthCode("same1234") + `"}]}]}`
+	err = to.ImportJSON("other123", strings.NewReader(twice))
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "in this snapshot"), fmt.Sprintf("%v", err))
+	ExpectTrue(t, to.ImportJSON("other123", strings.NewReader(`{"version": 2, "users": []}`)) != nil,
+		"Unknown version")
+	ExpectTrue(t, to.ImportJSON("other123", strings.NewReader(
+		`{"version": 1, "users": [{"name": "p", "level": "user", "codes": [{"hash": "plain123"}]}]}`)) != nil,
+		"Plain code")
+	ExpectTrue(t, len(to.ListUsers()) == 3, "Nothing imported")
+}
+
+func TestCSVBackups(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "backups")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	filename := filepath.Join(dir, "users.csv")
+	store := NewCSVUserStore(filename)
+	store.SetBackups(2)
+	root := &User{Name: "root", UserLevel: LevelMember}
+	root.SetAuthCode("root123")
+	ExpectTrue(t, store.ReplaceAll([]*User{root}) == nil, "No file to back up yet")
+	backups, _ := store.listBackups()
+	ExpectTrue(t, len(backups) == 0, "Nothing backed up")
+	original, _ := ioutil.ReadFile(filename)
+
+	ExpectTrue(t, store.backup(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) == nil, "Backup")
+	ioutil.WriteFile(filename, []byte("changed\n"), 0600)
+	os.Chmod(filename, 0600)
+	ExpectTrue(t, store.backup(time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)) == nil,
+		"Same second")
+	backups, _ = store.listBackups()
+	ExpectTrue(t, len(backups) == 1 &&
+		filepath.Base(backups[0]) == "users.csv.20240501-120000.bak", fmt.Sprintf("%v", backups))
+	content, _ := ioutil.ReadFile(backups[0])
+	ExpectTrue(t, bytes.Equal(content, original), "First backup kept")
+
+	ExpectTrue(t, store.backup(time.Date(2024, 5, 2, 12, 0, 0, 0, time.UTC)) == nil, "Backup")
+	ExpectTrue(t, store.ReplaceAll([]*User{root}) == nil, "Rewriting")
+	backups, _ = store.listBackups()
+	ExpectTrue(t, len(backups) == 2 &&
+		filepath.Base(backups[0]) == "users.csv.20240502-120000.bak", fmt.Sprintf("Pruned: %v", backups))
+	content, _ = ioutil.ReadFile(backups[1])
+	ExpectTrue(t, string(content) == "changed\n", "Latest has the content before")
+	if fileinfo, err := os.Stat(backups[1]); err == nil {
+		ExpectTrue(t, fileinfo.Mode().Perm() == 0600, "Permissions of the file")
+	}
+
+	// No backup, no rewrite.
+	os.Chmod(dir, 0500)
+	defer os.Chmod(dir, 0700)
+	if ioutil.WriteFile(filepath.Join(dir, "probe"), nil, 0600) == nil {
+		return // Running as root; can't make the backup fail.
+	}
+	ExpectTrue(t, store.ReplaceAll([]*User{root}) != nil, "Backup failing fails")
+}
+
+func TestCSVVersionHeader(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "version")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	filename := filepath.Join(dir, "users.csv")
+	legacy := "# The roster\n" +
+		"root,root@nb,member,,,," + hashAuthCode("root123") + "\n"
+	ioutil.WriteFile(filename, []byte(legacy), 0644)
+
+	// Without header, as always.
+	store := NewCSVUserStore(filename)
+	users, err := store.Load()
+	ExpectTrue(t, err == nil && len(users) == 1 && store.version == 0, "Version 0")
+
+	ExpectTrue(t, MigrateFile(filename) == nil, "Migrating")
+	content, _ := ioutil.ReadFile(filename)
+	ExpectTrue(t, strings.HasPrefix(string(content),
+		fmt.Sprintf("earl-users-version,%d\n# The roster\nroot,", CSVVersion)), string(content))
+	ExpectTrue(t, MigrateFile(filename) == nil, "Migrating again")
+	again, _ := ioutil.ReadFile(filename)
+	ExpectTrue(t, bytes.Equal(content, again), "Nothing to do")
+	users, err = store.Load()
+	ExpectTrue(t, err == nil && len(users) == 1 && users[0].Name == "root" &&
+		store.version == CSVVersion, "Latest version")
+	loaded := store.LastLoadReport()
+	ExpectTrue(t, loaded.lineOf(users[0]) == 3, "Lines count the header")
+
+	// Rewrites keep the header.
+	ExpectTrue(t, store.ReplaceAll(users) == nil, "Rewriting")
+	again, _ = ioutil.ReadFile(filename)
+	ExpectTrue(t, bytes.Equal(content, again), "Header kept: "+string(again))
+
+	// Records with columns the version doesn't have are not misread.
+	ioutil.WriteFile(filename, append(content,
+		[]byte("jon,,user,,,,"+hashAuthCode("jon12345")+",,,,,,,,,,,,,,extra\n")...), 0644)
+	users, err = store.Load()
+	ExpectTrue(t, err == nil && len(users) == 1, "Newer record skipped")
+	report := store.LastLoadReport()
+	ExpectTrue(t, len(report.Skipped) == 1 && report.Skipped[0].Line == 4 &&
+		strings.Contains(report.Skipped[0].Reason, "version 4 has 20"), fmt.Sprintf("%v", report.Skipped))
+
+	// Files of an older version get the new header with new users.
+	ioutil.WriteFile(filename, []byte("earl-users-version,1\n"+legacy), 0644)
+	store.Load()
+	jon := &User{Name: "jon", UserLevel: LevelUser}
+	jon.SetAuthCode("jon12345")
+	jon.Schedule, _ = ParseRecurringSchedule("tue 18-22")
+	ExpectTrue(t, store.Append(jon) == nil, "Appending")
+	users, err = store.Load()
+	ExpectTrue(t, err == nil && len(users) == 2 && users[1].Schedule != nil &&
+		store.version == CSVVersion, "New field read")
+
+	ioutil.WriteFile(filename, []byte("earl-users-version,7\n"+legacy), 0644)
+	_, err = store.Load()
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "version 7"), fmt.Sprintf("%v", err))
+}
+
+func TestAuthUserDetailed(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "detailed")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 03:00")
+	mockClock.now = now
+	u := User{Name: "Alex", UserLevel: LevelUser}
+	u.SetAuthCode("alex1234")
+	auth.AddNewUser("root123", u)
+	mockClock.now = now.Add(time.Minute)
+
+	result, user, _ := auth.AuthUserDetailed("root123", TargetDownstairs)
+	ExpectTrue(t, result == AuthOk && user != nil && user.Name == "root", "Granted with user")
+	user.Codes[0] = hashAuthCode("changed123")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "") // A copy.
+
+	// Not for denials, also not for those that know the user.
+	result, user, _ = auth.AuthUserDetailed("alex1234", TargetDownstairs)
+	ExpectTrue(t, result == AuthOkButOutsideTime && user == nil, "Outside hours")
+	result, user, _ = auth.AuthUserDetailed("unknown123", TargetDownstairs)
+	ExpectTrue(t, result == AuthFail && user == nil, "Unknown")
+
+	result, user, _ = auth.ReadOnly().AuthUserDetailed("root123", TargetDownstairs)
+	ExpectTrue(t, result == AuthOk && user != nil && user.Name == "root", "Read-only view")
+}
+
+func TestRecurringSchedule(t *testing.T) {
+	schedule, err := ParseRecurringSchedule("fri 22-2; Tuesday 18:30-22")
+	ExpectTrue(t, err == nil && len(schedule) == 2, fmt.Sprintf("%v", err))
+	ExpectTrue(t, schedule.String() == "Fri 22:00-02:00;Tue 18:30-22:00", schedule.String())
+	for _, spec := range []string{"fri", "fri 22", "xyz 1-2", "mon 25-2", "mon 1:5-2", "mon 24-2"} {
+		_, err := ParseRecurringSchedule(spec)
+		ExpectTrue(t, err != nil, "Invalid: "+spec)
+	}
+	at := func(s string) time.Time {
+		result, _ := time.Parse("2006-01-02 15:04", s)
+		return result
+	}
+	// 2014-10-10 is a Friday.
+	ExpectFalse(t, schedule.Contains(at("2014-10-10 21:59")), "Before")
+	ExpectTrue(t, schedule.Contains(at("2014-10-10 22:00")), "Start")
+	ExpectTrue(t, schedule.Contains(at("2014-10-11 01:59")), "After midnight")
+	ExpectFalse(t, schedule.Contains(at("2014-10-11 02:00")), "End")
+	ExpectFalse(t, schedule.Contains(at("2014-10-12 01:00")), "Not after Saturday")
+	ExpectTrue(t, schedule.Contains(at("2014-10-14 18:30")), "Tuesday")
+
+	authFile, _ := ioutil.TempFile("", "recurring")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock := &MockClock{now: at("2014-10-01 12:00")}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	auth.SetLocation(time.FixedZone("PDT", -7*3600))
+	u := User{Name: "Volunteer", ContactInfo: "v@nb", UserLevel: LevelMember,
+		Schedule: schedule}
+	u.SetAuthCode("volunteer123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding")
+
+	// Both the schedule, in local time, and the validity have to pass.
+	mockClock.now = at("2014-10-11 05:00") // Friday 22:00 local.
+	ExpectAuthResult(t, auth, "volunteer123", TargetDownstairs, AuthOk, "")
+	mockClock.now = at("2014-10-10 22:00") // Friday 15:00 local.
+	ExpectAuthResult(t, auth, "volunteer123", TargetDownstairs, AuthOkButOutsideTime, "scheduled")
+	ExpectTrue(t, eatmsg(auth.UpdateUser("root123", "volunteer123", func(user *User) bool {
+		user.ValidTo = at("2014-10-11 00:00")
+		return true
+	})), "Expiring")
+	mockClock.now = at("2014-10-11 05:00")
+	ExpectAuthResult(t, auth, "volunteer123", TargetDownstairs, AuthExpired, "")
+
+	// Round-trips through the file.
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	found := reloaded.FindUser("volunteer123")
+	ExpectTrue(t, found != nil && found.Schedule.String() == schedule.String(), "Read back")
+}
+
+func TestHolidayCalendar(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "holidays")
+	calendarFile, _ := ioutil.TempFile("", "holidays-calendar")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(calendarFile.Name())
+	}
+	at := func(s string) time.Time {
+		result, _ := time.Parse("2006-01-02 15:04", s)
+		return result
+	}
+	mockClock := &MockClock{now: at("2014-12-01 12:00")}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	auth.SetLocation(time.FixedZone("PST", -8*3600))
+	u := User{Name: "Philanthropist", ContactInfo: "p@nb", UserLevel: LevelPhilanthropist}
+	u.SetAuthCode("phil123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding")
+
+	writeCalendar := func(content string, minutes int) {
+		ioutil.WriteFile(calendarFile.Name(), []byte(content), 0644)
+		modTime := time.Now().Add(time.Duration(minutes) * time.Minute)
+		os.Chtimes(calendarFile.Name(), modTime, modTime)
+	}
+	for _, content := range []string{"closed\n", "shut 2014-12-24\n",
+		"closed 2014-12-24 2014-12-20\n", "closed 24.12.2014\n"} {
+		writeCalendar(content, 0)
+		ExpectTrue(t, auth.SetHolidayCalendar(calendarFile.Name()) != nil, "Invalid: "+content)
+	}
+	writeCalendar("# Winter break\nclosed 2014-12-24 2014-12-26\nopen 2014-12-25\n", 1)
+	ExpectTrue(t, auth.SetHolidayCalendar(calendarFile.Name()) == nil, "Calendar")
+
+	// Days are local: 06:00 UTC is still the day before.
+	mockClock.now = at("2014-12-24 06:00")
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOk, "")
+	mockClock.now = at("2014-12-24 12:00")
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOkButOutsideTime,
+		"space closed \\(holiday\\)")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, eatmsg(auth.OpenSpace("root123", 0)), "Opening")
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOkButOutsideTime, "holiday")
+	mockClock.now = at("2014-12-25 12:00")
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOk, "")
+	mockClock.now = at("2014-12-26 23:00")
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOkButOutsideTime, "holiday")
+
+	// Changes are picked up; broken ones keep the days we have.
+	writeCalendar("closed 2014-12-24\n", 2)
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOk, "")
+	writeCalendar("closed 2014-12-26 2014-12-24\n", 3)
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOk, "")
+	mockClock.now = at("2014-12-24 12:00")
+	ExpectAuthResult(t, auth, "phil123", TargetDownstairs, AuthOkButOutsideTime, "holiday")
+}
+
+func TestOpenSchedules(t *testing.T) {
+	for _, spec := range []string{"downstairs", "=mon 10-18", "downstairs=",
+		"downstairs=mon 10-18,downstairs=tue 10-18", "downstairs=xyz 10-18"} {
+		_, err := ParseOpenSchedules(spec)
+		ExpectTrue(t, err != nil, "Invalid: "+spec)
+	}
+	schedules, err := ParseOpenSchedules("gate=fri 10-18;sat 12-20")
+	ExpectTrue(t, err == nil && len(schedules) == 1, fmt.Sprintf("%v", err))
+
+	authFile, _ := ioutil.TempFile("", "open-schedule")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	at := func(s string) time.Time {
+		result, _ := time.Parse("2006-01-02 15:04", s)
+		return result
+	}
+	mockClock := &MockClock{now: at("2014-10-10 09:30")} // A Friday.
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	defer auth.Close()
+	events := make(AppEventChannel, 10)
+	auth.eventBus.Subscribe(events)
+	auth.SetOpenSchedules(schedules)
+	ExpectTrue(t, findEvent(auth.eventBus, events, AppTargetMode) == nil, "Not open yet")
+	ExpectTrue(t, auth.TargetMode(TargetDownstairs) == DoorBadgeRequired, "Badge")
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, AuthFail, "")
+
+	// The scheduler announces the start of the window.
+	mockClock.now = at("2014-10-10 10:00")
+	auth.scheduler.RunDue()
+	event := findEvent(auth.eventBus, events, AppTargetMode)
+	ExpectTrue(t, event != nil && event.Target == TargetDownstairs &&
+		event.Value == int(DoorOpenToAll), "Opened")
+	ExpectTrue(t, auth.TargetMode(TargetDownstairs) == DoorOpenToAll, "Open")
+	ExpectTrue(t, auth.TargetMode(TargetUpstairs) == DoorBadgeRequired, "Other target")
+	result, reason, _ := auth.AuthUserWithReason("nobody123", TargetDownstairs)
+	ExpectTrue(t, result == AuthOk && reason == AccessGrantedOpen, "Anyone gets in")
+	ExpectAuthResult(t, auth, "nobody123", TargetUpstairs, AuthFail, "")
+
+	// Lockdown ends it, lifting it starts it again.
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", true)), "Lockdown")
+	event = findEvent(auth.eventBus, events, AppTargetMode)
+	ExpectTrue(t, event != nil && event.Value == int(DoorBadgeRequired), "Closed by lockdown")
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, AuthFail, "")
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", false)), "Lifting")
+	event = findEvent(auth.eventBus, events, AppTargetMode)
+	ExpectTrue(t, event != nil && event.Value == int(DoorOpenToAll), "Open again")
+
+	// An access notices the end before the scheduler does.
+	mockClock.now = at("2014-10-10 18:00")
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, AuthFail, "")
+	event = findEvent(auth.eventBus, events, AppTargetMode)
+	ExpectTrue(t, event != nil && event.Value == int(DoorBadgeRequired), "Closed")
+	auth.scheduler.RunDue()
+	ExpectTrue(t, findEvent(auth.eventBus, events, AppTargetMode) == nil, "Announced once")
+
+	// Removing the schedule closes the door.
+	mockClock.now = at("2014-10-11 12:00")
+	auth.scheduler.RunDue()
+	ExpectTrue(t, findEvent(auth.eventBus, events, AppTargetMode) != nil, "Saturday")
+	auth.SetOpenSchedules(nil)
+	event = findEvent(auth.eventBus, events, AppTargetMode)
+	ExpectTrue(t, event != nil && event.Value == int(DoorBadgeRequired), "Schedule removed")
+}
+
+func TestSelfTest(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "selftest")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	auth := CreateSimpleFileAuth(authFile, &MockClock{}).(*FileBasedAuthenticator)
+	ExpectTrue(t, auth.SelfTest("canary123", LevelMember) != nil, "No canary yet")
+	ExpectTrue(t, auth.SelfTest("root123", LevelMember) != nil, "Not with a real user")
+
+	canary := User{Name: "Canary", UserLevel: LevelMember, TestOnly: true}
+	canary.SetAuthCode("canary123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", canary)), "Adding")
+	ExpectTrue(t, auth.SelfTest("canary123", LevelMember) == nil, "Self-test")
+	err := auth.SelfTest("canary123", LevelUser)
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "expected user"), fmt.Sprintf("%v", err))
+
+	// Never let in; kept when read back.
+	result, reason, _ := auth.AuthUserWithReason("canary123", TargetDownstairs)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedTestOnly, "Denied")
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	ExpectTrue(t, reloaded.SelfTest("canary123", LevelMember) == nil, "Read back")
+
+	// With another pepper, the stored hash doesn't match any more.
+	reloaded = NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "SomeOtherPepper")
+	err = reloaded.SelfTest("canary123", LevelMember)
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "pepper"), fmt.Sprintf("%v", err))
+}
+
+type fixedTimeSource struct {
+	now time.Time
+}
+
+func (s *fixedTimeSource) Now() (time.Time, error) {
+	return s.now, nil
+}
+
+func TestClockSkew(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "clock-skew")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	defer auth.Close()
+	events := make(AppEventChannel, 10)
+	auth.eventBus.Subscribe(events)
+	// All hours, so that only the clock check decides.
+	u := User{Name: "Jon Doe", ContactInfo: "jon@nb", UserLevel: LevelPhilanthropist}
+	u.SetAuthCode("doe123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding")
+	expired := User{Name: "Old Member", ContactInfo: "old@nb", UserLevel: LevelMember,
+		ValidTo: mockClock.now.Add(-time.Hour)}
+	expired.SetAuthCode("old123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", expired)), "Adding")
+	mockClock.now = mockClock.now.Add(time.Minute)
+	// Hours behind the users file, whenever the test runs.
+	writeUserFile(authFile.Name(), auth.ListUsers())
+	fileTime := mockClock.now.Add(3 * time.Hour)
+	os.Chtimes(authFile.Name(), fileTime, fileTime)
+	auth.FindUser("root123") // Reloads.
+
+	// Only a warning.
+	auth.SetClockSkewCheck(time.Hour, nil, false)
+	ExpectFalse(t, auth.CheckClock(), "Suspect")
+	event := findEvent(auth.eventBus, events, AppClockSkew)
+	ExpectTrue(t, event != nil && event.Value == 1 &&
+		strings.Contains(event.Msg, "users file"), "Event")
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "old123", TargetDownstairs, AuthExpired, "")
+
+	// Fail-safe: members only, whatever the time says.
+	auth.SetClockSkewCheck(time.Hour, nil, true)
+	result, reason, _ := auth.AuthUserWithReason("doe123", TargetDownstairs)
+	ExpectTrue(t, result == AuthFail && reason == AccessDeniedClockSkew, "Members only")
+	ExpectAuthResult(t, auth, "old123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "nobody123", TargetDownstairs, AuthFail, "")
+
+	// The periodic check notices the clock is fixed.
+	mockClock.now = fileTime.Add(2 * time.Hour)
+	auth.scheduler.RunDue()
+	event = findEvent(auth.eventBus, events, AppClockSkew)
+	ExpectTrue(t, event != nil && event.Value == 0, "Right again")
+	ExpectAuthResult(t, auth, "doe123", TargetDownstairs, AuthOk, "")
+
+	// Off a trusted source, in either direction.
+	source := &fixedTimeSource{now: mockClock.now.Add(-90 * time.Minute)}
+	auth.SetClockSkewCheck(time.Hour, source, true)
+	event = findEvent(auth.eventBus, events, AppClockSkew)
+	ExpectTrue(t, event != nil && event.Value == 1 &&
+		strings.Contains(event.Msg, "trusted"), "Ahead of trusted time")
+	source.now = mockClock.now.Add(30 * time.Minute)
+	ExpectTrue(t, auth.CheckClock(), "Within threshold")
+	auth.SetClockSkewCheck(0, source, true)
+	source.now = mockClock.now.Add(24 * time.Hour)
+	ExpectTrue(t, auth.CheckClock(), "Disabled")
+}
+
+func TestGraceSwipe(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "grace")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	at := func(s string) time.Time {
+		result, _ := time.Parse("2006-01-02 15:04", s)
+		return result
+	}
+	mockClock := &MockClock{now: at("2014-10-10 12:00")}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	auth.SetAccessHours(AccessHours{UserStart: 10, UserEnd: 22})
+	auth.SetPresenceTargets([]Target{TargetDownstairs}, []Target{"exit"}, 0)
+	auth.SetGraceSwipe(30 * time.Minute)
+	for _, name := range []string{"Early", "Late"} {
+		u := User{Name: name, ContactInfo: "x@nb", UserLevel: LevelUser}
+		u.SetAuthCode(strings.ToLower(name) + "123")
+		ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding")
+	}
+	names := func(users []User) string {
+		var result []string
+		for _, u := range users {
+			result = append(result, u.Name)
+		}
+		return strings.Join(result, ",")
+	}
+
+	mockClock.now = at("2014-10-10 20:00")
+	ExpectAuthResult(t, auth, "early123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+	mockClock.now = at("2014-10-10 21:55")
+	ExpectAuthResult(t, auth, "late123", TargetDownstairs, AuthOk, "")
+	ExpectTrue(t, len(auth.presentUnauthorized(mockClock.now)) == 0, "All fine before closing")
+
+	// Closing: only the late swipe has grace; members any time.
+	mockClock.now = at("2014-10-10 22:00")
+	report := names(auth.presentUnauthorized(mockClock.now))
+	ExpectTrue(t, report == "Early", report)
+	mockClock.now = at("2014-10-10 22:29")
+	report = names(auth.presentUnauthorized(mockClock.now))
+	ExpectTrue(t, report == "Early", report)
+	mockClock.now = at("2014-10-10 22:30")
+	report = names(auth.presentUnauthorized(mockClock.now))
+	ExpectTrue(t, report == "Early,Late", report)
+
+	// Recurring schedules end windows, too.
+	schedule, _ := ParseRecurringSchedule("fri 18-20:15")
+	end, found := schedule.EndOf(at("2014-10-10 20:00"))
+	ExpectTrue(t, found && end.Equal(at("2014-10-10 20:15")), end.String())
+	_, found = schedule.EndOf(at("2014-10-10 20:15"))
+	ExpectFalse(t, found, "Outside")
+}
+
+func TestUnauthorizedPresent(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "unauthorized-present")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	auth.SetPresenceTargets([]Target{TargetDownstairs}, []Target{"exit"}, 0)
+	u := User{Name: "Jon", ContactInfo: "jon@nb", UserLevel: LevelUser}
+	u.SetAuthCode("jon123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding")
+	mockClock.now = mockClock.now.Add(time.Hour)
+	ExpectAuthResult(t, auth, "jon123", TargetDownstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "root123", TargetDownstairs, AuthOk, "")
+
+	_, msg := auth.UnauthorizedPresent("jon123")
+	ExpectTrue(t, msg != "", "Members only")
+	users, msg := auth.UnauthorizedPresent("root123")
+	ExpectTrue(t, msg == "" && len(users) == 0, "During hours")
+
+	// Past closing, the user should have left; the member may stay.
+	mockClock.now = mockClock.now.Add(11 * time.Hour) // 00:00
+	users, _ = auth.UnauthorizedPresent("root123")
+	ExpectTrue(t, len(users) == 1 && users[0].Name == "Jon" && len(users[0].Codes) == 0,
+		fmt.Sprintf("%v", users))
+	ExpectAuthResult(t, auth, "jon123", "exit", AuthOkButOutsideTime, "")
+	ExpectAuthResult(t, auth, "root123", "exit", AuthOk, "")
+	users, _ = auth.UnauthorizedPresent("root123")
+	ExpectTrue(t, len(users) == 1, "Denied exits don't count")
+}
+
+func TestAccessScheduleFor(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "schedule-summary")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	rules, _ := ParseAccessMatrix("user:upstairs=deny")
+	ExpectTrue(t, auth.SetAccessRules(rules) == nil, "Setting rules")
+
+	u := User{Name: "Jon", ContactInfo: "jon@nb", UserLevel: LevelUser}
+	u.SetAuthCode("jon123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding")
+	// A night owl, in on tuesday evenings until midnight, an hour past the
+	// usual hours of users.
+	tuesday := User{Name: "Tue", ContactInfo: "tue@nb", UserLevel: LevelUser,
+		Hours: &HourWindow{18, 24}}
+	tuesday.Schedule, _ = ParseRecurringSchedule("tue 18-24")
+	tuesday.SetAuthCode("tue123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", tuesday)), "Adding")
+
+	_, msg := auth.AccessScheduleFor("jon123", "tue123")
+	ExpectTrue(t, msg != "", "Members only")
+	_, msg = auth.AccessScheduleFor("root123", "nobody123")
+	ExpectTrue(t, msg == "No such user.", msg)
+
+	summary, msg := auth.AccessScheduleFor("root123", "tue123")
+	ExpectTrue(t, msg == "" && summary.Name == "Tue", msg)
+	ExpectTrue(t, summary.Windows[TargetDownstairs].String() == "Tue 18:00-24:00",
+		summary.Windows[TargetDownstairs].String())
+	_, found := summary.Windows[TargetUpstairs]
+	ExpectFalse(t, found, "Denied by rule")
+
+	summary, _ = auth.AccessScheduleFor("root123", "jon123")
+	windows := summary.Windows[TargetDownstairs]
+	ExpectTrue(t, len(windows) == 7 && windows[2:3].String() == "Tue 10:00-23:00",
+		windows.String())
+
+	summary, _ = auth.AccessScheduleFor("root123", "root123")
+	ExpectTrue(t, summary.Windows[TargetUpstairs][0:1].String() == "Sun 00:00-24:00",
+		summary.Windows[TargetUpstairs].String())
+}
+
+func TestAnonymousUsage(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "anonymous-users")
+	mockClock := &MockClock{}
+	mockClock.now, _ = time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	auditFile, _ := ioutil.TempFile("", "anonymous-audit")
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+		defer syscall.Unlink(auditFile.Name())
+	}
+	logger, _ := NewAuditLogger(auditFile.Name())
+	auth.SetAuditLogger(logger)
+	anna := User{Name: "Anna", ContactInfo: "anna@nb", UserLevel: LevelMember, Anonymous: true}
+	anna.SetAuthCode("anna123")
+	anna.SetDuressCode("anna999")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", anna)), "Adding")
+	jon := User{Name: "Jon", ContactInfo: "jon@nb", UserLevel: LevelMember}
+	jon.SetAuthCode("jon123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", jon)), "Adding")
+	mockClock.now = mockClock.now.Add(time.Minute)
+	events := auth.Events()
+	defer auth.StopEvents(events)
+
+	ExpectAuthResult(t, auth, "anna123", TargetDownstairs, AuthOk, "")
+	event := <-events
+	ExpectTrue(t, event.UserName == "anonymous member" && event.CodeHint == "",
+		fmt.Sprintf("%v", event))
+	ExpectAuthResult(t, auth, "jon123", TargetDownstairs, AuthOk, "")
+	event = <-events
+	ExpectTrue(t, event.UserName == "Jon" && event.CodeHint != "", fmt.Sprintf("%v", event))
+
+	// Security events name everyone.
+	ExpectAuthResult(t, auth, "anna999", TargetDownstairs, AuthOk, "")
+	event = <-events
+	ExpectTrue(t, event.UserName == "Anna" && event.Duress, fmt.Sprintf("%v", event))
+	ExpectTrue(t, eatmsg(auth.SetLockdown("root123", true)), "Lockdown")
+	ExpectAuthResult(t, auth, "anna123", TargetDownstairs, AuthOk, "")
+	event = <-events
+	ExpectTrue(t, event.UserName == "Anna", fmt.Sprintf("%v", event))
+	logger.Close()
+
+	content, _ := ioutil.ReadFile(auditFile.Name())
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	ExpectTrue(t, len(lines) == 6, fmt.Sprintf("Expected 6 lines, got %q", lines))
+	for i, expect := range []string{
+		`user="Anna" level=member`, // Adding is no routine entry.
+		`user="Jon" level=member`,
+		`reason=granted user="anonymous member" code=$`,
+		`reason=granted user="Jon" code=[0-9a-f]{6}$`,
+		`reason=granted user="Anna" code=[0-9a-f]{6} duress$`,
+		`reason=granted user="Anna" code=[0-9a-f]{6}$`,
+	} {
+		if i < len(lines) {
+			ExpectTrue(t, regexp.MustCompile(expect).MatchString(lines[i]),
+				"Unexpected audit line "+lines[i])
+		}
+	}
+
+	// The wish is kept across a reload.
+	reloaded := NewFileBasedAuthenticator(authFile.Name(), NewApplicationBus(), "")
+	found := reloaded.FindUser("anna123")
+	ExpectTrue(t, found != nil && found.Anonymous, "Anonymous in users file")
+}
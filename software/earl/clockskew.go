@@ -0,0 +1,140 @@
+// Sanity check of our clock. Access decisions depend on the time, so a
+// clock that is way off, e.g. without NTP after a power outage, lets users
+// in at the wrong hours or has everyone expired.
+//
+// The clock is suspect if it is more than a threshold behind the last
+// change of the users file, which can't have been changed in the future,
+// or off from an optional trusted time source, e.g. the Date header of a
+// web server. While suspect, a warning is logged with each check, and
+// with fail-safe, only members get in, whatever the time.
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Default for SetClockSkewCheck().
+const DefaultClockSkewThreshold = time.Hour
+
+// How often we compare the clocks.
+const clockSkewInterval = 10 * time.Minute
+
+// A clock we trust more than ours.
+type TimeSource interface {
+	Now() (time.Time, error)
+}
+
+// The time in the Date header of a web server; good to a second, which
+// is plenty for us.
+type HTTPTimeSource struct {
+	url    string
+	client *http.Client
+}
+
+func NewHTTPTimeSource(url string) *HTTPTimeSource {
+	return &HTTPTimeSource{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *HTTPTimeSource) Now() (time.Time, error) {
+	response, err := s.client.Head(s.url)
+	if err != nil {
+		return time.Time{}, err
+	}
+	response.Body.Close()
+	date := response.Header.Get("Date")
+	if date == "" {
+		return time.Time{}, fmt.Errorf("No Date header from %s", s.url)
+	}
+	return http.ParseTime(date)
+}
+
+type clockSkewChecker struct {
+	lock      sync.Mutex
+	threshold time.Duration // 0: not checking.
+	source    TimeSource    // nil: only the users file.
+	failSafe  bool
+	suspect   string // Why, from the last check; empty if not.
+	ticking   bool   // Checked by a job of the scheduler.
+}
+
+func newClockSkewChecker() *clockSkewChecker {
+	return &clockSkewChecker{}
+}
+
+// If only members should get in now.
+func (c *clockSkewChecker) membersOnly() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.suspect != "" && c.failSafe
+}
+
+// Why the clock was suspect at the last check; empty if it wasn't.
+func (c *clockSkewChecker) suspectWhy() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.suspect
+}
+
+// Why the clock reading now is suspect, or empty if it isn't. The source
+// is asked without holding any lock, as that can take a while.
+func (c *clockSkewChecker) check(now time.Time, fileVersion time.Time) string {
+	c.lock.Lock()
+	threshold, source := c.threshold, c.source
+	c.lock.Unlock()
+	if threshold <= 0 {
+		return ""
+	}
+	if !fileVersion.IsZero() && fileVersion.Sub(now) > threshold {
+		return fmt.Sprintf("%s behind the last change of the users file (%s)",
+			fileVersion.Sub(now).Round(time.Second), fileVersion.Format("2006-01-02 15:04:05"))
+	}
+	if source == nil {
+		return ""
+	}
+	trusted, err := source.Now()
+	if err != nil {
+		return "" // Can't tell; the file check is all we have.
+	}
+	skew := trusted.Sub(now)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > threshold {
+		return fmt.Sprintf("%s off the trusted time %s", skew.Round(time.Second),
+			trusted.Format("2006-01-02 15:04:05"))
+	}
+	return ""
+}
+
+// With a suspect clock, times can't decide: members get in even if expired
+// or outside hours by our clock, everyone else that would depend on the
+// time stays out. Other denials stand.
+func clockFailSafe(user *User, result AuthResult, reason AuthReason,
+	msg string) (AuthResult, AuthReason, string) {
+	if result != AuthOk && result != AuthExpired && result != AuthOkButOutsideTime {
+		return result, reason, msg
+	}
+	if user.UserLevel == LevelMember {
+		if result == AuthOk {
+			return result, reason, msg
+		}
+		return AuthOk, AccessGranted, "Clock suspect; not checking times."
+	}
+	return AuthFail, AccessDeniedClockSkew, "Clock suspect: members only."
+}
+
+// Remember the outcome of a check, see check(). Returns if suspicion
+// came or went.
+func (c *clockSkewChecker) setSuspect(why string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	changed := (c.suspect != "") != (why != "")
+	c.suspect = why
+	return changed
+}
@@ -0,0 +1,123 @@
+// CodeAccumulator.
+//
+// PINs are typed on the keypad one key at a time. The CodeAccumulator
+// collects these keys until a terminator key is pressed (or the user stopped
+// typing for a while) and then hands out the complete code, so that
+// terminal handlers don't have to re-implement this.
+package main
+
+import (
+	"time"
+)
+
+type CodeEvent int
+
+const (
+	CodeNone        = CodeEvent(iota) // Nothing to do; still typing.
+	CodeSubmitted                     // A complete code has been entered.
+	CodeEmptySubmit                   // Terminator pressed without code.
+	CodeCleared                       // User pressed the clear key.
+	CodeMalformed                     // Entry discarded, e.g. due to timeout
+)
+
+type CodeAccumulator struct {
+	Terminator byte // Key submitting the code, typically '#'
+	ClearKey   byte // Key resetting the code, typically '*'
+
+	// If the user does not press any key for this time, the entry is
+	// submitted (if SubmitOnTimeout) or discarded as malformed.
+	InterDigitTimeout time.Duration
+	SubmitOnTimeout   bool
+
+	// If non-zero: Entries taking longer than this from the first to the
+	// last key are discarded as malformed.
+	MaxEntryDuration time.Duration
+
+	code         string
+	firstKeyTime time.Time
+	lastKeyTime  time.Time
+}
+
+func NewCodeAccumulator(interDigitTimeout time.Duration) *CodeAccumulator {
+	return &CodeAccumulator{
+		Terminator:        '#',
+		ClearKey:          '*',
+		InterDigitTimeout: interDigitTimeout,
+	}
+}
+
+// Handle a key pressed at time "now". If this completes a code, returns
+// CodeSubmitted and the code.
+func (c *CodeAccumulator) HandleKey(key byte, now time.Time) (CodeEvent, string) {
+	if c.isTimedOut(now) {
+		// The previous entry should've been dealt with in HandleTick()
+		// already, but maybe there was no tick in between.
+		if event, code := c.timeout(); event == CodeSubmitted {
+			if key != c.Terminator && key != c.ClearKey {
+				c.addKey(key, now) // Start of the next code.
+			}
+			return event, code
+		}
+	}
+	switch key {
+	case c.Terminator:
+		if c.code == "" {
+			return CodeEmptySubmit, ""
+		}
+		return c.submit(now)
+	case c.ClearKey:
+		c.reset()
+		return CodeCleared, ""
+	}
+	c.addKey(key, now)
+	return CodeNone, ""
+}
+
+// To be called regularly to deal with entries the user stopped typing.
+func (c *CodeAccumulator) HandleTick(now time.Time) (CodeEvent, string) {
+	if !c.isTimedOut(now) {
+		return CodeNone, ""
+	}
+	return c.timeout()
+}
+
+// Returns true if there is a partial code currently being typed.
+func (c *CodeAccumulator) HasPartialCode() bool {
+	return c.code != ""
+}
+
+func (c *CodeAccumulator) isTimedOut(now time.Time) bool {
+	return c.code != "" && c.InterDigitTimeout > 0 &&
+		now.Sub(c.lastKeyTime) > c.InterDigitTimeout
+}
+
+func (c *CodeAccumulator) timeout() (CodeEvent, string) {
+	if c.SubmitOnTimeout {
+		return c.submit(c.lastKeyTime)
+	}
+	c.reset()
+	return CodeMalformed, ""
+}
+
+func (c *CodeAccumulator) submit(now time.Time) (CodeEvent, string) {
+	code := c.code
+	tooSlow := c.MaxEntryDuration > 0 &&
+		now.Sub(c.firstKeyTime) > c.MaxEntryDuration
+	c.reset()
+	if tooSlow {
+		return CodeMalformed, ""
+	}
+	return CodeSubmitted, code
+}
+
+func (c *CodeAccumulator) addKey(key byte, now time.Time) {
+	if c.code == "" {
+		c.firstKeyTime = now
+	}
+	c.code += string(key)
+	c.lastKeyTime = now
+}
+
+func (c *CodeAccumulator) reset() {
+	c.code = ""
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TypeKeys(c *CodeAccumulator, keys string, now time.Time) (CodeEvent, string) {
+	event, code := CodeNone, ""
+	for _, key := range keys {
+		event, code = c.HandleKey(byte(key), now)
+	}
+	return event, code
+}
+
+func TestCodeAccumulatorTerminator(t *testing.T) {
+	now := time.Now()
+	c := NewCodeAccumulator(5 * time.Second)
+	event, _ := TypeKeys(c, "1234", now)
+	ExpectTrue(t, event == CodeNone, "No code yet")
+	ExpectTrue(t, c.HasPartialCode(), "Partial code")
+	event, code := TypeKeys(c, "5#", now)
+	ExpectTrue(t, event == CodeSubmitted && code == "12345", "Submit on terminator")
+	ExpectFalse(t, c.HasPartialCode(), "Reset after submit")
+
+	event, _ = TypeKeys(c, "#", now)
+	ExpectTrue(t, event == CodeEmptySubmit, "Empty submit")
+}
+
+func TestCodeAccumulatorClear(t *testing.T) {
+	now := time.Now()
+	c := NewCodeAccumulator(5 * time.Second)
+	event, _ := TypeKeys(c, "999*", now)
+	ExpectTrue(t, event == CodeCleared, "Clear key")
+	event, code := TypeKeys(c, "123#", now)
+	ExpectTrue(t, event == CodeSubmitted && code == "123", "Only code after clear")
+}
+
+func TestCodeAccumulatorTimeout(t *testing.T) {
+	now := time.Now()
+	c := NewCodeAccumulator(5 * time.Second)
+
+	// By default, a timeout discards the partial code.
+	TypeKeys(c, "123", now)
+	event, _ := c.HandleTick(now.Add(2 * time.Second))
+	ExpectTrue(t, event == CodeNone, "Not timed out yet")
+	event, _ = c.HandleTick(now.Add(6 * time.Second))
+	ExpectTrue(t, event == CodeMalformed, "Discard on timeout")
+	ExpectFalse(t, c.HasPartialCode(), "Reset after timeout")
+
+	// .. or submits it if configured.
+	c.SubmitOnTimeout = true
+	TypeKeys(c, "456", now)
+	event, code := c.HandleTick(now.Add(6 * time.Second))
+	ExpectTrue(t, event == CodeSubmitted && code == "456", "Submit on timeout")
+
+	// Timeout noticed at next key if there was no tick in between.
+	TypeKeys(c, "789", now)
+	event, code = c.HandleKey('1', now.Add(time.Minute))
+	ExpectTrue(t, event == CodeSubmitted && code == "789", "Submit on late key")
+	event, code = TypeKeys(c, "#", now.Add(time.Minute))
+	ExpectTrue(t, event == CodeSubmitted && code == "1", "New code started")
+}
+
+func TestCodeAccumulatorTooSlow(t *testing.T) {
+	now := time.Now()
+	c := NewCodeAccumulator(5 * time.Second)
+	c.MaxEntryDuration = 10 * time.Second
+
+	// Each key within the inter-digit timeout, but overall too slow.
+	for i := 0; i < 4; i++ {
+		c.HandleKey('1', now.Add(time.Duration(4*i)*time.Second))
+	}
+	event, code := c.HandleKey('#', now.Add(16*time.Second))
+	ExpectTrue(t, event == CodeMalformed && code == "", "Too slow entry")
+
+	event, code = TypeKeys(c, "1234#", now.Add(20*time.Second))
+	ExpectTrue(t, event == CodeSubmitted && code == "1234", "Quick entry")
+}
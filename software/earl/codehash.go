@@ -0,0 +1,109 @@
+// Salted, slow hashing of authentication codes as alternative to the
+// md5 of hashAuthCode().
+//
+// Stored format: scrypt$<tag>$<salt>$<hash>, all hex. Each code gets its own
+// random salt, so we can't look up by hash anymore; the short tag, derived
+// from the code with the secret pepper, narrows down which few stored codes
+// we have to verify. Without the pepper, the tag says nothing about the code.
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	saltedCodePrefix = "scrypt$"
+	saltedCodeSalt   = 16 // bytes
+	saltedCodeKey    = 32 // bytes
+	saltedCodeTag    = 1  // bytes. Enough to not verify all codes.
+
+	// scrypt cost; chosen to be bearable on a Raspberry Pi.
+	DefaultCodeHashCost = 1 << 12
+)
+
+type CodeHasher struct {
+	pepper []byte
+	cost   int // scrypt N, power of two
+}
+
+// Create a hasher with the given secret pepper, which should come from the
+// configuration, not from the code. Cost is the scrypt N parameter; 0 for
+// default.
+func NewCodeHasher(pepper []byte, cost int) (*CodeHasher, error) {
+	if cost == 0 {
+		cost = DefaultCodeHashCost
+	}
+	if cost < 2 || cost&(cost-1) != 0 {
+		return nil, errors.New("Code hash cost needs to be a power of two")
+	}
+	return &CodeHasher{pepper: pepper, cost: cost}, nil
+}
+
+// Hash plain code with a fresh random salt.
+func (h *CodeHasher) Hash(plain string) (string, error) {
+	salt := make([]byte, saltedCodeSalt)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := h.derive(plain, salt)
+	if err != nil {
+		return "", err
+	}
+	return saltedCodePrefix + h.Tag(plain) + "$" + hex.EncodeToString(salt) +
+		"$" + hex.EncodeToString(key), nil
+}
+
+// Tag of the plain code, that is part of its stored form.
+func (h *CodeHasher) Tag(plain string) string {
+	mac := hmac.New(sha256.New, h.pepper)
+	mac.Write([]byte(normalizeAuthCode(plain)))
+	return hex.EncodeToString(mac.Sum(nil)[:saltedCodeTag])
+}
+
+// Check if the plain code matches the stored salted code.
+func (h *CodeHasher) Verify(plain string, stored string) bool {
+	parts := strings.Split(strings.TrimPrefix(stored, saltedCodePrefix), "$")
+	if !isSaltedCode(stored) || len(parts) != 3 || parts[0] != h.Tag(plain) {
+		return false
+	}
+	salt, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+	expected, err := hex.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	key, err := h.derive(plain, salt)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+func (h *CodeHasher) derive(plain string, salt []byte) ([]byte, error) {
+	plain = normalizeAuthCode(plain)
+	return scrypt.Key(append(append([]byte{}, h.pepper...), plain...),
+		salt, h.cost, 8, 1, saltedCodeKey)
+}
+
+func isSaltedCode(stored string) bool {
+	return strings.HasPrefix(stored, saltedCodePrefix)
+}
+
+// Tag of a stored salted code; empty if not salted.
+func saltedCodeTagOf(stored string) string {
+	if !isSaltedCode(stored) {
+		return ""
+	}
+	parts := strings.SplitN(strings.TrimPrefix(stored, saltedCodePrefix), "$", 2)
+	return parts[0]
+}
@@ -0,0 +1,99 @@
+// Codes revoked for good, e.g. of a badge reported stolen. Checked before
+// anything else, so a revoked code stays out even if its user is still in
+// the users file, e.g. restored from a backup or by a reload that raced
+// with removing the user.
+//
+// The file has one hashed code per line, as in the users file; empty lines
+// and lines starting with '#' are ignored. Entries are appended with a
+// single write each, so the file is always complete up to the last one.
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"sync"
+)
+
+type denyList struct {
+	lock     sync.Mutex
+	filename string // Empty: in memory only.
+	hashes   map[string]bool
+}
+
+func newDenyList() *denyList {
+	return &denyList{hashes: make(map[string]bool)}
+}
+
+// Read the hashes in the file, which is created if it doesn't exist yet.
+// Entries added later are appended to it.
+func loadDenyList(filename string) (*denyList, error) {
+	f, err := os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	list := newDenyList()
+	list.filename = filename
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		list.hashes[line] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+func (l *denyList) contains(hash string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.hashes[hash]
+}
+
+// If any of the salted ones of the stored codes is on the list. The others
+// are found with contains(), without denying the user's other codes.
+func (l *denyList) containsSalted(stored []string) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, hash := range stored {
+		if isSaltedCode(hash) && l.hashes[hash] {
+			return true
+		}
+	}
+	return false
+}
+
+// Add the hashes, with a comment line before them. They are denied right
+// away, even if writing them fails: better to keep a code out until the
+// next restart than to let it in.
+func (l *denyList) add(comment string, hashes []string) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var entry strings.Builder
+	entry.WriteString("# " + strings.Replace(comment, "\n", " ", -1) + "\n")
+	for _, hash := range hashes {
+		if !l.hashes[hash] {
+			l.hashes[hash] = true
+			entry.WriteString(hash + "\n")
+		}
+	}
+	if l.filename == "" {
+		return nil
+	}
+	f, err := os.OpenFile(l.filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.WriteString(entry.String()); err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
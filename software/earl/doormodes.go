@@ -0,0 +1,131 @@
+// Doors that are open to all at certain times, e.g. the front door during
+// staffed hours: then the lock is latched open and any code gets in, known
+// or not. Outside these times, the usual rules of the users apply. This is
+// about the door, not about users: lockdown ends it right away.
+//
+// Each change of the mode of a target is posted as AppTargetMode, so that
+// the lock hardware can follow.
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type DoorMode int
+
+const (
+	DoorBadgeRequired = DoorMode(0) // Usual rules of the users.
+	DoorOpenToAll     = DoorMode(1) // Latched open; anyone gets in.
+)
+
+func (m DoorMode) String() string {
+	if m == DoorOpenToAll {
+		return "open-to-all"
+	}
+	return "badge-required"
+}
+
+// How often we check for the start or end of a window.
+const doorModeTick = time.Minute
+
+// Parse schedules such as "gate=mon 10-18;sat 12-20,upstairs=fri 18-22",
+// see ParseRecurringSchedule() for the windows of one target.
+func ParseOpenSchedules(spec string) (map[Target]RecurringSchedule, error) {
+	result := make(map[Target]RecurringSchedule)
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(entry, "=")
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			return nil, fmt.Errorf("Expected <target>=<schedule>, got '%s'", entry)
+		}
+		target := Target(strings.TrimSpace(parts[0]))
+		if _, exists := result[target]; exists {
+			return nil, fmt.Errorf("Two schedules for %s", target)
+		}
+		schedule, err := ParseRecurringSchedule(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", target, err)
+		}
+		if schedule == nil {
+			return nil, fmt.Errorf("%s: empty schedule", target)
+		}
+		result[target] = schedule
+	}
+	return result, nil
+}
+
+type doorModeChange struct {
+	target   Target
+	mode     DoorMode
+	schedule RecurringSchedule
+}
+
+type doorModeTracker struct {
+	lock      sync.Mutex
+	schedules map[Target]RecurringSchedule // Empty: all need a badge.
+	announced map[Target]DoorMode          // Last posted; missing: badge.
+}
+
+func newDoorModeTracker() *doorModeTracker {
+	return &doorModeTracker{
+		schedules: make(map[Target]RecurringSchedule),
+		announced: make(map[Target]DoorMode),
+	}
+}
+
+func (d *doorModeTracker) configure(schedules map[Target]RecurringSchedule) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.schedules = make(map[Target]RecurringSchedule)
+	for target, schedule := range schedules {
+		d.schedules[target] = schedule
+	}
+}
+
+// The mode by schedule at the local time; lockdown isn't considered here.
+func (d *doorModeTracker) mode(target Target, local time.Time) DoorMode {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if schedule := d.schedules[target]; schedule != nil && schedule.Contains(local) {
+		return DoorOpenToAll
+	}
+	return DoorBadgeRequired
+}
+
+// Targets whose mode differs from the one last announced, which is then
+// taken as announced. Sorted by target, so events come in a stable order.
+func (d *doorModeTracker) changes(local time.Time, lockdown bool) []doorModeChange {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	var result []doorModeChange
+	targets := make(map[Target]bool)
+	for target := range d.schedules {
+		targets[target] = true
+	}
+	for target := range d.announced {
+		targets[target] = true // E.g. schedule removed while open.
+	}
+	for target := range targets {
+		mode := DoorBadgeRequired
+		schedule := d.schedules[target]
+		if !lockdown && schedule != nil && schedule.Contains(local) {
+			mode = DoorOpenToAll
+		}
+		if mode == d.announced[target] {
+			continue
+		}
+		if mode == DoorBadgeRequired {
+			delete(d.announced, target)
+		} else {
+			d.announced[target] = mode
+		}
+		result = append(result, doorModeChange{target, mode, schedule})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].target < result[j].target
+	})
+	return result
+}
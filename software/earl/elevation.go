@@ -0,0 +1,57 @@
+// Temporary elevation of a user's level, e.g. a regular user hosting an
+// event who needs member access for the evening. Only the access decision
+// sees the elevated level; managing users still needs the real one. In
+// memory only, so a restart ends all elevations, which is what we want.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type elevation struct {
+	name  string // For logging.
+	level Level
+	until time.Time
+	by    string // Name of the member who elevated.
+}
+
+type elevationTracker struct {
+	lock       sync.Mutex
+	byIdentity map[string]elevation // See User.identity()
+}
+
+func newElevationTracker() *elevationTracker {
+	return &elevationTracker{byIdentity: make(map[string]elevation)}
+}
+
+func (t *elevationTracker) set(identity string, e elevation) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.byIdentity[identity] = e
+}
+
+// Level the user is elevated to, if any at this time.
+func (t *elevationTracker) level(identity string, now time.Time) (Level, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	e, found := t.byIdentity[identity]
+	if !found || !now.Before(e.until) {
+		return "", false
+	}
+	return e.level, true
+}
+
+// Forget the elevations that are over by now, returning them.
+func (t *elevationTracker) expire(now time.Time) []elevation {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	var result []elevation
+	for identity, e := range t.byIdentity {
+		if !now.Before(e.until) {
+			result = append(result, e)
+			delete(t.byIdentity, identity)
+		}
+	}
+	return result
+}
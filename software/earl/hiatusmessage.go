@@ -0,0 +1,56 @@
+// What users on hiatus are told when trying to get in, e.g. whom to
+// contact to become active again. The message goes to the reader as well
+// as the log, so the template only sees fields that are fine to show:
+//
+//	{{.Name}}         name of the user
+//	{{.Level}}        their level, i.e. hiatus
+//	{{.Target}}       where they tried to get in
+//	{{.ContactInfo}}  their contact info; only shown if used explicitly
+//
+// Codes are not available to the template.
+package main
+
+import (
+	"bytes"
+	"text/template"
+)
+
+const DefaultHiatusMessage = "User on hiatus '{{.Name}}'"
+
+type hiatusMessageFields struct {
+	Name        string
+	Level       Level
+	Target      Target
+	ContactInfo string
+}
+
+func parseHiatusMessage(text string) (*template.Template, error) {
+	tmpl, err := template.New("hiatus").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	// Referring to fields that don't exist only fails when executing;
+	// find out now rather than with the first user on hiatus.
+	var discard bytes.Buffer
+	if err := tmpl.Execute(&discard, hiatusMessageFields{}); err != nil {
+		return nil, err
+	}
+	return tmpl, nil
+}
+
+var defaultHiatusMessage = template.Must(parseHiatusMessage(DefaultHiatusMessage))
+
+func hiatusMessage(tmpl *template.Template, user *User, target Target) string {
+	fields := hiatusMessageFields{
+		Name:        user.Name,
+		Level:       user.UserLevel,
+		Target:      target,
+		ContactInfo: user.ContactInfo,
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, fields); err != nil {
+		out.Reset()
+		defaultHiatusMessage.Execute(&out, fields)
+	}
+	return out.String()
+}
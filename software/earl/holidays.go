@@ -0,0 +1,141 @@
+// Days the space is closed, e.g. over the holidays, and days it is open
+// nonetheless, e.g. for a party in the middle of them. On closed days only
+// members get in.
+//
+// One range per line: "closed" or "open", the first and, optionally, the
+// last day, inclusive, e.g.
+//
+//	# Winter break, but we celebrate new year's eve in the space.
+//	closed  2024-12-21  2025-01-05
+//	open    2024-12-31
+//
+// Days are in the local time of the space, see SetLocation(). An "open"
+// day wins over any "closed" range it is in. Empty lines and lines
+// starting with '#' are ignored. The file is read again when it changes.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const holidayDateFormat = "2006-01-02"
+
+type holidayRange struct {
+	first, last time.Time // Midnight UTC of the days.
+	open        bool
+}
+
+type holidayCalendar struct {
+	lock     sync.Mutex
+	filename string
+	modTime  time.Time // Of the file when last read.
+	missing  bool      // The file was gone at the last check.
+	ranges   []holidayRange
+}
+
+func loadHolidayCalendar(filename string) (*holidayCalendar, error) {
+	calendar := &holidayCalendar{filename: filename}
+	if _, err := calendar.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return calendar, nil
+}
+
+func readHolidayRanges(filename string) ([]holidayRange, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var result []holidayRange
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) < 2 || len(fields) > 3 {
+			return nil, fmt.Errorf("%s:%d: expected closed or open and one or two days", filename, line)
+		}
+		var days holidayRange
+		switch fields[0] {
+		case "closed":
+		case "open":
+			days.open = true
+		default:
+			return nil, fmt.Errorf("%s:%d: expected closed or open, got '%s'", filename, line, fields[0])
+		}
+		if days.first, err = time.Parse(holidayDateFormat, fields[1]); err != nil {
+			return nil, fmt.Errorf("%s:%d: day '%s' is not YYYY-MM-DD", filename, line, fields[1])
+		}
+		days.last = days.first
+		if len(fields) == 3 {
+			if days.last, err = time.Parse(holidayDateFormat, fields[2]); err != nil {
+				return nil, fmt.Errorf("%s:%d: day '%s' is not YYYY-MM-DD", filename, line, fields[2])
+			}
+			if days.last.Before(days.first) {
+				return nil, fmt.Errorf("%s:%d: %s is before %s", filename, line, fields[2], fields[1])
+			}
+		}
+		result = append(result, days)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Read the file again if it changed since. If it can't be read, the days
+// read before stay in effect; the error is returned once per change.
+// Returns whether new days were read.
+func (c *holidayCalendar) reloadIfChanged() (bool, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	fileinfo, err := os.Stat(c.filename)
+	if err != nil {
+		if c.missing {
+			return false, nil
+		}
+		c.missing = true
+		return false, err
+	}
+	c.missing = false
+	if fileinfo.ModTime().Equal(c.modTime) {
+		return false, nil
+	}
+	c.modTime = fileinfo.ModTime()
+	ranges, err := readHolidayRanges(c.filename)
+	if err != nil {
+		return false, err
+	}
+	c.ranges = ranges
+	return true, nil
+}
+
+// If the space is closed on the day of t, taken in its location. A nil
+// calendar is never closed.
+func (c *holidayCalendar) closed(t time.Time) bool {
+	if c == nil {
+		return false
+	}
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	closed := false
+	for _, days := range c.ranges {
+		if day.Before(days.first) || day.After(days.last) {
+			continue
+		}
+		if days.open {
+			return false
+		}
+		closed = true
+	}
+	return closed
+}
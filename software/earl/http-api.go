@@ -14,6 +14,15 @@ type ApiServer struct {
 	bus    *ApplicationBus
 	server *http.Server
 
+	// If set, serves /auth requests of remote readers.
+	authHandler http.Handler
+
+	// If set, /healthz reports if this returns an error.
+	healthCheck func() error
+
+	// If set, serves /metrics, e.g. for Prometheus.
+	metricsHandler http.Handler
+
 	// Remember the last event for each type. Already JSON prepared
 	eventChannel   AppEventChannel
 	lastEvents     map[AppEventType]*JsonAppEvent
@@ -57,7 +66,8 @@ func NewApiServer(bus *ApplicationBus, port int) *ApiServer {
 		server: &http.Server{
 			Addr: fmt.Sprintf(":%d", port),
 			// JSON events listeners should be kept open for a while
-			WriteTimeout: 3600 * time.Second,
+			WriteTimeout:      3600 * time.Second,
+			ReadHeaderTimeout: 10 * time.Second,
 		},
 		eventChannel: make(AppEventChannel),
 		lastEvents:   make(map[AppEventType]*JsonAppEvent),
@@ -68,6 +78,31 @@ func NewApiServer(bus *ApplicationBus, port int) *ApiServer {
 	return newObject
 }
 
+// Also answer auth requests of remote readers at /auth.
+func (a *ApiServer) EnableAuth(auth Authenticator) {
+	a.authHandler = NewAuthHttpHandler(auth).WithTimeout()
+}
+
+// Serve /healthz: 200 if check returns nil, 503 with the error otherwise.
+func (a *ApiServer) SetHealthCheck(check func() error) {
+	a.healthCheck = check
+}
+
+// Serve /metrics with the given handler.
+func (a *ApiServer) EnableMetrics(handler http.Handler) {
+	a.metricsHandler = handler
+}
+
+func (a *ApiServer) serveHealth(out http.ResponseWriter) {
+	out.Header().Set("Content-Type", "text/plain")
+	if err := a.healthCheck(); err != nil {
+		out.WriteHeader(http.StatusServiceUnavailable)
+		out.Write([]byte(err.Error() + "\n"))
+		return
+	}
+	out.Write([]byte("ok\n"))
+}
+
 func (a *ApiServer) Run() {
 	a.server.ListenAndServe()
 }
@@ -123,6 +158,18 @@ func (event *JsonAppEvent) writeJSONEvent(out http.ResponseWriter, jsonp_callbac
 }
 
 func (a *ApiServer) ServeHTTP(out http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/auth" && a.authHandler != nil {
+		a.authHandler.ServeHTTP(out, req)
+		return
+	}
+	if req.URL.Path == "/healthz" && a.healthCheck != nil {
+		a.serveHealth(out)
+		return
+	}
+	if req.URL.Path == "/metrics" && a.metricsHandler != nil {
+		a.metricsHandler.ServeHTTP(out, req)
+		return
+	}
 	if req.Method != "GET" && req.Method != "POST" {
 		out.WriteHeader(http.StatusMethodNotAllowed)
 		return
@@ -0,0 +1,74 @@
+// HTTP endpoint for remote readers: POST /auth with {"code": ..., "target": ...}
+// answers whether access is granted. The submitted code is never sent back
+// or logged in plain. Nor is the message of the decision: it can tell whom
+// the code belongs to, e.g. with a personal deny message, so the reader
+// only gets the reason code.
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	authRequestTimeout = 5 * time.Second
+	maxAuthRequestSize = 4096 // bytes
+)
+
+type JsonAuthRequest struct {
+	Code   string `json:"code"`
+	Target Target `json:"target"` // Empty for default target.
+}
+
+type JsonAuthResponse struct {
+	Granted    bool   `json:"granted"`
+	Reason     string `json:"reason"`      // Just "Access granted/denied."
+	ReasonCode string `json:"reason_code"` // As AuthReason.String()
+}
+
+type AuthHttpHandler struct {
+	auth Authenticator
+}
+
+func NewAuthHttpHandler(auth Authenticator) *AuthHttpHandler {
+	return &AuthHttpHandler{auth: auth}
+}
+
+// Serve at /auth of the given mux, with request timeout.
+func (h *AuthHttpHandler) Register(mux *http.ServeMux) {
+	mux.Handle("/auth", h.WithTimeout())
+}
+
+// The handler, but requests taking longer than authRequestTimeout are
+// answered with 503.
+func (h *AuthHttpHandler) WithTimeout() http.Handler {
+	return http.TimeoutHandler(h, authRequestTimeout, "Timeout\n")
+}
+
+func (h *AuthHttpHandler) ServeHTTP(out http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		out.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var request JsonAuthRequest
+	body := http.MaxBytesReader(out, req.Body, maxAuthRequestSize)
+	if err := json.NewDecoder(body).Decode(&request); err != nil {
+		http.Error(out, "Expected JSON with code and target", http.StatusBadRequest)
+		return
+	}
+	result, reason, _ := h.auth.AuthUserWithReason(request.Code, request.Target)
+	log.Printf("HTTP auth from %s for %s: %s (%s)", req.RemoteAddr,
+		request.Target, reason, codeHint(request.Code))
+	response := JsonAuthResponse{
+		Granted:    result == AuthOk,
+		Reason:     "Access denied.",
+		ReasonCode: reason.String(),
+	}
+	if response.Granted {
+		response.Reason = "Access granted."
+	}
+	out.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(out).Encode(response)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postAuth(t *testing.T, mux *http.ServeMux, body string) (*httptest.ResponseRecorder, JsonAuthResponse) {
+	req := httptest.NewRequest("POST", "/auth", strings.NewReader(body))
+	recorder := httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	var response JsonAuthResponse
+	json.Unmarshal(recorder.Body.Bytes(), &response)
+	return recorder, response
+}
+
+func TestHttpAuth(t *testing.T) {
+	auth := NewMockAuthenticator()
+	auth.allow[ACKey{"secret123", TargetDownstairs}] = AuthOk
+	mux := http.NewServeMux()
+	NewAuthHttpHandler(auth).Register(mux)
+
+	recorder, response := postAuth(t, mux, `{"code": "secret123", "target": "gate"}`)
+	ExpectTrue(t, recorder.Code == http.StatusOK, "Status OK")
+	ExpectTrue(t, response.Granted && response.ReasonCode == "granted", "Granted")
+	ExpectFalse(t, strings.Contains(recorder.Body.String(), "secret123"),
+		"Code not echoed")
+
+	_, response = postAuth(t, mux, `{"code": "secret123", "target": "upstairs"}`)
+	ExpectFalse(t, response.Granted, "Other target")
+	_, response = postAuth(t, mux, `{"code": "wrong123", "target": "gate"}`)
+	ExpectTrue(t, !response.Granted && response.ReasonCode == "unknown-code",
+		"Unknown code: "+response.ReasonCode)
+
+	// Messages of decisions can tell too much, e.g. about the user.
+	ExpectTrue(t, response.Reason == "Access denied.", "Generic reason: "+response.Reason)
+	auth.allow[ACKey{"expired123", TargetDownstairs}] = AuthExpired
+	_, response = postAuth(t, mux, `{"code": "expired123", "target": "gate"}`)
+	ExpectTrue(t, response.Reason == "Access denied." && response.ReasonCode == "expired",
+		"Only the reason code: "+response.Reason)
+
+	recorder, _ = postAuth(t, mux, `not json`)
+	ExpectTrue(t, recorder.Code == http.StatusBadRequest, "Bad request")
+	recorder, _ = postAuth(t, mux, `{"code": "`+strings.Repeat("x", 5000)+`"}`)
+	ExpectTrue(t, recorder.Code == http.StatusBadRequest, "Too large request")
+
+	req := httptest.NewRequest("GET", "/auth", nil)
+	recorder = httptest.NewRecorder()
+	mux.ServeHTTP(recorder, req)
+	ExpectTrue(t, recorder.Code == http.StatusMethodNotAllowed, "Only POST")
+}
@@ -0,0 +1,103 @@
+// Throttling of repeated failed codes. The hashed codes don't protect
+// against someone trying many PIN codes at a reader, so after too many
+// unknown codes within a time window, we lock for a cooldown period.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Upper bound of keys we keep track of; beyond that, we evict.
+const maxTrackedFailureKeys = 1000
+
+type failureEntry struct {
+	firstFailure time.Time // Start of current window
+	failures     int
+	lockedUntil  time.Time
+}
+
+type failureTracker struct {
+	lock        sync.Mutex
+	maxFailures int // 0: disabled
+	window      time.Duration
+	cooldown    time.Duration
+	entries     map[string]*failureEntry
+}
+
+func newFailureTracker() *failureTracker {
+	return &failureTracker{entries: make(map[string]*failureEntry)}
+}
+
+func (t *failureTracker) configure(maxFailures int, window time.Duration, cooldown time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.maxFailures = maxFailures
+	t.window = window
+	t.cooldown = cooldown
+	t.entries = make(map[string]*failureEntry)
+}
+
+// Returns if the key is locked at the given time and until when.
+func (t *failureTracker) lockedUntil(key string, now time.Time) (bool, time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	entry := t.entries[key]
+	if entry == nil || !now.Before(entry.lockedUntil) {
+		return false, time.Time{}
+	}
+	return true, entry.lockedUntil
+}
+
+// Record a failure. Returns true if this failure started a lockout.
+func (t *failureTracker) recordFailure(key string, now time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.maxFailures <= 0 {
+		return false
+	}
+	entry := t.entries[key]
+	if entry == nil {
+		if len(t.entries) >= maxTrackedFailureKeys {
+			t.evictRequiresLock(now)
+		}
+		entry = &failureEntry{}
+		t.entries[key] = entry
+	}
+	if now.Sub(entry.firstFailure) > t.window {
+		entry.firstFailure = now
+		entry.failures = 0
+	}
+	entry.failures++
+	if entry.failures < t.maxFailures {
+		return false
+	}
+	entry.lockedUntil = now.Add(t.cooldown)
+	entry.failures = 0
+	entry.firstFailure = time.Time{}
+	return true
+}
+
+func (t *failureTracker) recordSuccess(key string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.entries, key)
+}
+
+// Forget entries that neither are locked nor have recent failures. If
+// that doesn't help, forget all that are not locked.
+func (t *failureTracker) evictRequiresLock(now time.Time) {
+	for key, entry := range t.entries {
+		if !now.Before(entry.lockedUntil) && now.Sub(entry.firstFailure) > t.window {
+			delete(t.entries, key)
+		}
+	}
+	if len(t.entries) < maxTrackedFailureKeys {
+		return
+	}
+	for key, entry := range t.entries {
+		if !now.Before(entry.lockedUntil) {
+			delete(t.entries, key)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log"
+	"strings"
+)
+
+// Where to log to, so that e.g. the authenticator's lines can be routed
+// separately. A *log.Logger implements it.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// The standard logger of the log package, as set up in main().
+type StdLogger struct{}
+
+func (l StdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+// If set, the general log shows pseudonyms instead of names and leaves out
+// contact info, as it tends to end up where not everyone should see who
+// came and went. The audit log, which is access controlled, always has the
+// real values.
+var redactLogs = true
+
+func SetLogRedaction(on bool) {
+	redactLogs = on
+}
+
+// The name as to show in the general log. Redacted, it is a pseudonym that
+// stays the same for the same name, so that lines of one user still go
+// together. Keyed with the pepper of the codes, so that it is not enough
+// to hash the names of the members to tell who it was. With the
+// process-wide pepper; authenticators use their own.
+func logName(name string) string {
+	return authCodePepper.logName(name)
+}
+
+func (p codePepper) logName(name string) string {
+	if !redactLogs || name == "" {
+		return name
+	}
+	hashgen := sha256.New()
+	io.WriteString(hashgen, string(p)+"\x00"+name)
+	return "user-" + hex.EncodeToString(hashgen.Sum(nil))[0:8]
+}
+
+// Message meant for the user that is logged as well, with their name and
+// contact info redacted.
+func logUserMessage(msg string, user *User) string {
+	return authCodePepper.logUserMessage(msg, user)
+}
+
+func (p codePepper) logUserMessage(msg string, user *User) string {
+	if !redactLogs || user == nil {
+		return msg
+	}
+	if user.ContactInfo != "" {
+		msg = strings.Replace(msg, user.ContactInfo, "[contact]", -1)
+	}
+	if user.Name != "" {
+		msg = strings.Replace(msg, user.Name, p.logName(user.Name), -1)
+	}
+	return msg
+}
@@ -1,12 +1,18 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -47,11 +53,39 @@ func parseArg(arg string) (devicepath string, baudrate int) {
 	return
 }
 
+// Parse a list of level=count pairs, such as "member=3,user=10"
+func parseLevelMinimums(spec string) (map[Level]int, error) {
+	result := make(map[Level]int)
+	for _, pair := range strings.Split(spec, ",") {
+		split := strings.Split(pair, "=")
+		if len(split) != 2 || !isValidLevel(split[0]) {
+			return nil, fmt.Errorf("Expected <level>=<count>, got '%s'", pair)
+		}
+		count, err := strconv.Atoi(split[1])
+		if err != nil {
+			return nil, err
+		}
+		result[Level(split[0])] = count
+	}
+	return result, nil
+}
+
 type Backends struct {
 	authenticator Authenticator
 	appEventBus   *ApplicationBus
 }
 
+// Targets of a comma separated list, e.g. "upstairs, downstairs".
+func splitTargets(list string) []Target {
+	var result []Target
+	for _, target := range strings.Split(list, ",") {
+		if target = strings.TrimSpace(target); target != "" {
+			result = append(result, Target(target))
+		}
+	}
+	return result
+}
+
 func printVersionInfo() {
 	fmt.Printf("Version: %s", VERSION)
 }
@@ -72,8 +106,8 @@ func printUserList(auth *FileBasedAuthenticator) {
 		fmt.Printf("%*s %*s %-14s ",
 			-longest_name, user.Name,
 			-longest_contact, user.ContactInfo, user.UserLevel)
-		timeFrom, timeTo := user.AccessHours()
-		fmt.Printf("\u231a %02d:00..%02d:00 ", timeFrom, timeTo)
+		window := auth.AccessWindowAt(&user, time.Now())
+		fmt.Printf("\u231a %02d:00..%02d:00 ", window.From, window.To)
 
 		exp := user.ExpiryDate(time.Now())
 		validityPeriod := user.InValidityPeriod(time.Now())
@@ -86,6 +120,9 @@ func printUserList(auth *FileBasedAuthenticator) {
 			fmt.Print(exp.Format("2006-01-02 15:04"))
 			fmt.Printf("\033[0m")
 		}
+		if user.Disabled {
+			fmt.Printf(" \033[1;31mDisabled\033[0m")
+		}
 		fmt.Println()
 	})
 }
@@ -151,12 +188,133 @@ func handleSerialDevice(devicepath string, baud int, backends *Backends) {
 	}
 }
 
+func openUserDatabase(filename string) (UserStore, error) {
+	if openSQLiteUserStore == nil {
+		return nil, errors.New("No SQLite support; build with -tags sqlite")
+	}
+	return openSQLiteUserStore(filename)
+}
+
+// The CSV stores, of one or several files.
+type userFileStore interface {
+	UserStore
+	SetDelimiter(comma rune, comment rune) error
+	SetBackups(keep int)
+	Migrate() error
+}
+
+// User file with the given delimiter and comment character; an empty
+// comment for none. Several comma separated files or globs are read as
+// one, with new users added to newUserFile or else the last file, and level
+// conflicts between the files resolved by the conflicts policy, see
+// ParseConflictPolicy(). Before rewrites, the latest backups of the files
+// are kept, see SetBackups().
+func openUserFile(filename string, delimiter string, comment string,
+	newUserFile string, conflicts string, backups int) (userFileStore, error) {
+	var store userFileStore
+	if strings.ContainsAny(filename, ",*?[") {
+		multi := NewMultiFileUserStore(strings.Split(filename, ",")...)
+		multi.SetNewUserFile(newUserFile)
+		policy, err := ParseConflictPolicy(conflicts)
+		if err != nil {
+			return nil, err
+		}
+		multi.SetConflictPolicy(policy)
+		store = multi
+	} else {
+		store = NewCSVUserStore(filename)
+	}
+	store.SetBackups(backups)
+	comma := []rune(delimiter)
+	commentRunes := []rune(comment)
+	if len(comma) != 1 || len(commentRunes) > 1 {
+		return nil, fmt.Errorf("Expected single characters as delimiter and comment, got '%s' and '%s'",
+			delimiter, comment)
+	}
+	var commentRune rune
+	if len(commentRunes) == 1 {
+		commentRune = commentRunes[0]
+	}
+	return store, store.SetDelimiter(comma[0], commentRune)
+}
+
 func main() {
 	userFileName := flag.String("users", "", "User Authentication file.")
+	userDatabase := flag.String("users-db", "", "SQLite user database to use instead of -users file. Needs binary built with -tags sqlite")
+	userFileBackups := flag.Int("users-backups", 10, "Keep this many timestamped backups of the -users file from before rewrites (0: none)")
+	userFileDelimiter := flag.String("users-delimiter", ",", "Field delimiter in the -users file, e.g. ';'")
+	userFileComment := flag.String("users-comment", "#", "Lines in the -users file starting with this are comments; empty for none")
+	newUserFile := flag.String("users-new-file", "", "With several -users files, e.g. 'members.csv,guests.csv' or 'users.d/*.csv', the one new users are added to (default: the last one)")
+	userFileConflicts := flag.String("users-conflicts", "first-file-wins", "With several -users files, what to do about a code of users of different levels: first-file-wins, highest-level-wins or reject")
+	migrateUsers := flag.Bool("migrate-users", false, "Rewrite the -users file in the latest layout, with a version header, and exit")
+	importUsers := flag.Bool("import-users", false, "Import users from -users file into empty -users-db and exit")
 	logFileName := flag.String("logfile", "", "The log file, default = stdout")
+	authLogFileName := flag.String("auth-logfile", "", "Separate log file for the authenticator, default = -logfile")
 	doorbellDir := flag.String("belldir", "", "Directory that contains upstairs.wav, gate.wav etc. Wav needs to be named like")
 	httpPort := flag.Int("httpport", -1, "Port to listen HTTP requests on")
+	httpAuth := flag.Bool("http-auth", false, "Answer auth requests of remote readers with POST /auth on -httpport. Only use in a trusted network.")
+	metrics := flag.Bool("metrics", false, "Serve Prometheus metrics at /metrics on -httpport. Needs binary built with -tags prometheus")
 	tcpPort := flag.Int("tcpport", -1, "Port to listen for TCP requests on")
+	defaultTarget := flag.String("default-target", "", "Target to use for auth requests that don't specify one (default: none)")
+	reloadDropAlert := flag.Int("reload-drop-alert", 0, "Alert if a user file reload loses more than this many users (0: off)")
+	reloadDropAlertPct := flag.Int("reload-drop-alert-percent", 0, "Alert if a user file reload loses more than this percentage of users (0: off)")
+	timezone := flag.String("timezone", "", "Timezone of the space for access hours, e.g. 'America/Los_Angeles' (default: local time)")
+	userHours := flag.String("user-hours", "", "Hours regular users have access, e.g. '10-23' for 10:00..22:59 (default: 10-23)")
+	fulltimeHours := flag.String("fulltime-hours", "", "Hours fulltime users have access, e.g. '7-24' (default: 7-24)")
+	userWeekdayHours := flag.String("user-weekday-hours", "", "Per-weekday hours for regular users, e.g. 'sat=12-23,sun=closed' (default: -user-hours)")
+	fulltimeWeekdayHours := flag.String("fulltime-weekday-hours", "", "Per-weekday hours for fulltime users, e.g. 'sun=0-24' (default: -fulltime-hours)")
+	fulltimeWeekendHours := flag.String("fulltime-weekend-hours", "", "Hours fulltime users have access on Sat/Sun, e.g. '0-24' (default: same as weekdays)")
+	accessRules := flag.String("access-rules", "", "Access of levels at particular targets, limiting their usual access, e.g. 'user:workshop=deny,fulltimeuser:workshop=12-20,member:workshop=allow'")
+	openSchedules := flag.String("open-schedule", "", "Targets open to all, without badge, in weekly windows, e.g. 'gate=mon 10-18;sat 12-20,upstairs=fri 18-22'; in -timezone")
+	twoFactorTargets := flag.String("two-factor-targets", "", "Comma separated targets that need card and PIN, e.g. 'serverroom'")
+	presenceEntry := flag.String("presence-entry", "", "Comma separated targets at the way in; access there marks users present, see -presence-exit")
+	presenceExit := flag.String("presence-exit", "", "Comma separated targets at the way out; access there marks users absent")
+	passbackTargets := flag.String("anti-passback-targets", "", "Comma separated entry targets where users present can't enter again until they exit, see -presence-entry")
+	passbackWindow := flag.Duration("anti-passback-window", 30*time.Minute, "How long after entering -anti-passback-targets deny another entry without exit")
+	maxOccupancy := flag.Int("max-occupancy", 0, "Let only members in at -presence-entry targets while this many users are present (0: no limit)")
+	autoOpen := flag.Bool("auto-open", false, "Open the space while -auto-open-members members are present, see -presence-entry")
+	autoOpenMembers := flag.Int("auto-open-members", DefaultAutoOpenMembers, "Members present at the same time to open the space with -auto-open")
+	graceSwipe := flag.Duration("grace-swipe", 0, "Users entering less than this before their hours end count as allowed to be present until this after, e.g. 15m (0: off)")
+	presenceTimeout := flag.Duration("presence-timeout", 12*time.Hour, "Users count as present for this long after entering if they don't swipe out (0: until they do)")
+	twoFactorTimeout := flag.Duration("two-factor-timeout", DefaultTwoFactorTimeout, "Time to present the second factor at -two-factor-targets")
+	receiptKeyFile := flag.String("receipt-key", "", "File with key to sign access decision receipts. Enables receipts.")
+	receiptLog := flag.String("receipt-log", "", "File to append signed access decision receipts to.")
+	pepperFile := flag.String("pepper-file", "", "File with the pepper for hashing codes; alternatively set in $EARL_PEPPER. Changing it invalidates all codes in an existing user file (default: built-in pepper)")
+	redactLogs := flag.Bool("redact-logs", true, "Show pseudonyms instead of names and leave out contact info in the log; the audit log keeps them")
+	codeHints := flag.Bool("code-hints", true, "Log access decisions with a short, peppered hint of the code to recognize the same card across readers")
+	uppercaseHex := flag.Bool("uppercase-hex-codes", false, "Uppercase codes that consist of hex digits only, for readers reporting card IDs in varying case")
+	hashCodes := flag.Bool("hash-codes", false, "Read plain codes from stdin, one per line, print their hashes with the configured pepper and exit")
+	saltedCodes := flag.Bool("salted-codes", false, "Accept codes with salted hashes, keyed with the pepper of -pepper-file or $EARL_PEPPER")
+	codeHashCost := flag.Int("code-hash-cost", DefaultCodeHashCost, "Cost (scrypt N, power of two) of salted code hashes")
+	upgradeCodes := flag.Bool("upgrade-codes", false, "Replace md5-hashed codes with salted ones when used; needs -salted-codes")
+	auditLog := flag.String("audit-log", "", "File to append all access decisions and user changes to. Re-opened on SIGHUP, e.g. after log rotation.")
+	notifyWebhook := flag.String("notify-webhook", "", "URL to post JSON notifications to, e.g. a Slack incoming webhook: users added and notable access decisions")
+	masterCodesFile := flag.String("master-codes", "", "File of hashed maintenance codes and the targets they always open; each use raises an alarm")
+	clockSkewThreshold := flag.Duration("clock-skew-threshold", DefaultClockSkewThreshold, "Warn if the clock is more than that behind the last change of the users file or off -trusted-time-url; 0 disables")
+	trustedTimeURL := flag.String("trusted-time-url", "", "URL of a web server whose Date header the clock is compared with, e.g. on the local network")
+	clockSkewFailSafe := flag.Bool("clock-skew-fail-safe", false, "While the clock is suspect, only let members in, regardless of times")
+	canaryCode := flag.String("canary-code", "", "Plain code of a test-only user to look up at startup; refuse to start if it isn't found, e.g. with a changed pepper")
+	canaryLevel := flag.String("canary-level", string(LevelMember), "Level the -canary-code user is expected to have")
+	holidayFile := flag.String("holidays", "", "File of days the space is closed to all but members, and days it is open nonetheless; re-read when changed")
+	denyListFile := flag.String("deny-list", "", "File of revoked code hashes, checked before the users; revoked codes are appended to it")
+	levelMinimums := flag.String("level-minimums", "", "Minimum number of valid users per level expected after reload, e.g. 'member=3,user=10'")
+	allowEmptyReload := flag.Bool("allow-empty-reload", false, "Accept user file reloads without any users instead of keeping the previous ones")
+	strictLevelMinimums := flag.Bool("strict-level-minimums", false, "Reject user file reloads that violate -level-minimums")
+	lockoutFailures := flag.Int("lockout-failures", 0, "Lock a reader after this many unknown codes within -lockout-window (0: off)")
+	lockoutWindow := flag.Duration("lockout-window", time.Minute, "Time window in which unknown codes count towards -lockout-failures")
+	lockoutCooldown := flag.Duration("lockout-cooldown", 5*time.Minute, "How long a reader stays locked after too many unknown codes")
+	hiatusMessage := flag.String("hiatus-message", DefaultHiatusMessage, "Template of what users on hiatus are told, with {{.Name}}, {{.Level}}, {{.Target}} and {{.ContactInfo}}")
+	minCodeLength := flag.Int("min-code-length", DefaultMinCodeLength, "Minimum number of characters of PINs and RFID codes")
+	expiryWarning := flag.Duration("expiry-warning", 0, "Tell users to renew when they get access within this time before they expire, e.g. 168h (0: off)")
+	maxDailyEntries := flag.Int("max-daily-entries", 0, "Alert if a user gets in more often than this on a day, e.g. a shared card (0: off)")
+	promoteAfter := flag.Duration("promote-after", 0, "Promote users of -promote-levels valid for longer than this with their next access, e.g. 720h (0: off)")
+	promoteLevels := flag.String("promote-levels", "user=fulltimeuser", "Levels -promote-after promotes from and to")
+	coSponsorAfter := flag.Duration("co-sponsor-after", 0, "New users valid longer than this, or without limit, need two sponsoring members, e.g. 2160h (0: off)")
+	negativeCacheSize := flag.Int("negative-cache-size", 0, "Remember this many recently seen unknown codes to cheaply reject repeated guesses (0: off)")
+	spaceOpenTimeout := flag.Duration("space-open-timeout", defaultSpaceOpenTimeout, "Time after which a space opened by a member closes automatically")
+	statInterval := flag.Duration("stat-interval", DefaultStatInterval, "Check user file for changes at most this often on access (0: on each access)")
+	reloadInterval := flag.Duration("reload-interval", 0, "Check user file for changes in this interval instead of on each access, e.g. on network mounts where -watch-users doesn't work (0: off)")
+	watchUsers := flag.Bool("watch-users", false, "Watch user file for changes instead of checking its timestamp on each access")
 	list_users := flag.Bool("list-users", false, "List users and exit")
 	show_version := flag.Bool("version", false, "Print version info")
 
@@ -178,6 +336,80 @@ func main() {
 
 	log.Printf("Starting... version: %s\n", VERSION)
 
+	// Empty, if not configured: the built-in one for the hashes of codes,
+	// none for salted codes.
+	pepper := strings.TrimSpace(os.Getenv("EARL_PEPPER"))
+	if *pepperFile != "" {
+		content, err := ioutil.ReadFile(*pepperFile)
+		if err != nil {
+			log.Fatal("Can't read pepper: ", err)
+		}
+		pepper = strings.TrimSpace(string(content))
+		if pepper == "" {
+			log.Fatal("Empty pepper in ", *pepperFile)
+		}
+	}
+
+	// Process-wide as well, before anything runs: codes of users added in
+	// the UI and code hints of the readers need the same pepper as the
+	// authenticator.
+	if pepper != "" {
+		if err := SetAuthCodePepper(pepper); err != nil {
+			log.Fatal("Can't set pepper: ", err)
+		}
+	}
+	SetUppercaseHexCodes(*uppercaseHex)
+	SetLogRedaction(*redactLogs)
+	SetCodeHints(*codeHints)
+
+	if *hashCodes {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			code := strings.TrimSpace(scanner.Text())
+			if code != "" {
+				fmt.Println(hashAuthCode(code))
+			}
+		}
+		return
+	}
+
+	if *migrateUsers {
+		if *userFileName == "" {
+			log.Fatal("-migrate-users needs -users")
+		}
+		userFile, err := openUserFile(*userFileName, *userFileDelimiter, *userFileComment,
+			*newUserFile, *userFileConflicts, *userFileBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := userFile.Migrate(); err != nil {
+			log.Fatal("Migration failed: ", err)
+		}
+		log.Printf("Migrated %s to version %d", *userFileName, CSVVersion)
+		return
+	}
+	if *importUsers {
+		if *userFileName == "" || *userDatabase == "" {
+			log.Fatal("-import-users needs -users and -users-db")
+		}
+		database, err := openUserDatabase(*userDatabase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		userFile, err := openUserFile(*userFileName, *userFileDelimiter, *userFileComment,
+			*newUserFile, *userFileConflicts, 0)
+		if err != nil {
+			log.Fatal(err)
+		}
+		count, err := ImportUsers(userFile, database)
+		if err != nil {
+			log.Fatal("Import failed: ", err)
+		}
+		log.Printf("Imported %d users from %s into %s", count,
+			*userFileName, *userDatabase)
+		return
+	}
+
 	if len(flag.Args()) < 1 && !*list_users {
 		fmt.Fprintf(os.Stderr,
 			"Expected list of serial ports."+
@@ -188,15 +420,245 @@ func main() {
 	}
 
 	appEventBus := NewApplicationBus()
-	authenticator := NewFileBasedAuthenticator(*userFileName,
-		appEventBus)
+	var store UserStore
+	if *userDatabase != "" {
+		database, err := openUserDatabase(*userDatabase)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = database
+	} else {
+		userFile, err := openUserFile(*userFileName, *userFileDelimiter, *userFileComment,
+			*newUserFile, *userFileConflicts, *userFileBackups)
+		if err != nil {
+			log.Fatal(err)
+		}
+		store = userFile
+	}
+	var authLogger Logger // default: standard logger
+	if *authLogFileName != "" {
+		authLogFile, err := os.OpenFile(*authLogFileName, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+		if err != nil {
+			log.Fatal("Error opening authenticator log file", err)
+		}
+		defer authLogFile.Close()
+		authLogger = log.New(authLogFile, "", log.LstdFlags)
+	}
+	authenticator, err := LoadFileBasedAuthenticator(store, appEventBus, authLogger, pepper)
+	if err != nil {
+		log.Fatal("Can't continue without authenticator: ", err)
+	}
 	backends := &Backends{
 		authenticator: authenticator,
 		appEventBus:   appEventBus,
 	}
 
-	if authenticator == nil {
-		log.Fatal("Can't continue without authenticator.")
+	authenticator.SetDefaultTarget(Target(*defaultTarget))
+	authenticator.SetReloadDropAlert(*reloadDropAlert, *reloadDropAlertPct)
+	authenticator.SetSpaceOpenTimeout(*spaceOpenTimeout)
+	authenticator.SetExpiryWarning(*expiryWarning)
+	authenticator.SetCoSponsorAfter(*coSponsorAfter)
+	authenticator.SetMaxDailyEntries(*maxDailyEntries)
+	if *promoteAfter > 0 {
+		levels := strings.Split(*promoteLevels, "=")
+		if len(levels) != 2 {
+			log.Fatalf("-promote-levels: expected <from>=<to>, got '%s'", *promoteLevels)
+		}
+		err := authenticator.SetProbation(Level(levels[0]), Level(levels[1]), *promoteAfter)
+		if err != nil {
+			log.Fatal("-promote-levels: ", err)
+		}
+	}
+	if err := authenticator.SetMinCodeLength(*minCodeLength); err != nil {
+		log.Fatal("-min-code-length: ", err)
+	}
+	if err := authenticator.SetHiatusMessage(*hiatusMessage); err != nil {
+		log.Fatal("-hiatus-message: ", err)
+	}
+	if *accessRules != "" {
+		rules, err := ParseAccessMatrix(*accessRules)
+		if err == nil {
+			err = authenticator.SetAccessRules(rules)
+		}
+		if err != nil {
+			log.Fatal("-access-rules: ", err)
+		}
+	}
+	if *twoFactorTargets != "" {
+		authenticator.SetTwoFactorTargets(splitTargets(*twoFactorTargets), *twoFactorTimeout)
+	}
+	if *presenceEntry != "" {
+		authenticator.SetPresenceTargets(splitTargets(*presenceEntry),
+			splitTargets(*presenceExit), *presenceTimeout)
+		authenticator.SetGraceSwipe(*graceSwipe)
+	}
+	if *passbackTargets != "" {
+		if *presenceEntry == "" {
+			log.Fatal("-anti-passback-targets requires -presence-entry")
+		}
+		if err := authenticator.SetAntiPassback(splitTargets(*passbackTargets), *passbackWindow); err != nil {
+			log.Fatal("-anti-passback-window: ", err)
+		}
+	}
+	if *maxOccupancy > 0 {
+		if *presenceEntry == "" {
+			log.Fatal("-max-occupancy requires -presence-entry")
+		}
+		authenticator.SetMaxOccupancy(*maxOccupancy)
+	}
+	if *autoOpen {
+		if *presenceEntry == "" {
+			log.Fatal("-auto-open requires -presence-entry")
+		}
+		authenticator.SetAutoOpen(*autoOpenMembers)
+	}
+	authenticator.SetFailureLockout(*lockoutFailures, *lockoutWindow, *lockoutCooldown)
+	authenticator.SetNegativeCacheSize(*negativeCacheSize)
+	if *timezone != "" {
+		location, err := time.LoadLocation(*timezone)
+		if err != nil {
+			log.Fatal("-timezone: ", err)
+		}
+		authenticator.SetLocation(location)
+	}
+	if *openSchedules != "" { // After the location, as it's local time.
+		schedules, err := ParseOpenSchedules(*openSchedules)
+		if err != nil {
+			log.Fatal("-open-schedule: ", err)
+		}
+		authenticator.SetOpenSchedules(schedules)
+	}
+	var hours AccessHours
+	if *userHours != "" {
+		window, err := ParseHourWindow(*userHours)
+		if err != nil {
+			log.Fatal("-user-hours: ", err)
+		}
+		hours.UserStart, hours.UserEnd = window.From, window.To
+	}
+	if *fulltimeHours != "" {
+		window, err := ParseHourWindow(*fulltimeHours)
+		if err != nil {
+			log.Fatal("-fulltime-hours: ", err)
+		}
+		hours.FulltimeStart, hours.FulltimeEnd = window.From, window.To
+	}
+	if *userWeekdayHours != "" {
+		weekdays, err := ParseWeekdayHours(*userWeekdayHours)
+		if err != nil {
+			log.Fatal("-user-weekday-hours: ", err)
+		}
+		hours.UserWeekdays = weekdays
+	}
+	hours.FulltimeWeekdays = make(map[time.Weekday]HourWindow)
+	if *fulltimeWeekendHours != "" {
+		weekend, err := ParseHourWindow(*fulltimeWeekendHours)
+		if err != nil {
+			log.Fatal("-fulltime-weekend-hours: ", err)
+		}
+		hours.FulltimeWeekdays[time.Saturday] = weekend
+		hours.FulltimeWeekdays[time.Sunday] = weekend
+	}
+	if *fulltimeWeekdayHours != "" {
+		weekdays, err := ParseWeekdayHours(*fulltimeWeekdayHours)
+		if err != nil {
+			log.Fatal("-fulltime-weekday-hours: ", err)
+		}
+		for day, window := range weekdays {
+			hours.FulltimeWeekdays[day] = window
+		}
+	}
+	if err := authenticator.SetAccessHours(hours); err != nil {
+		log.Fatal("Access hours: ", err)
+	}
+	if *levelMinimums != "" {
+		minimums, err := parseLevelMinimums(*levelMinimums)
+		if err != nil {
+			log.Fatal("-level-minimums: ", err)
+		}
+		authenticator.SetLevelMinimums(minimums, *strictLevelMinimums)
+	}
+	authenticator.SetAllowEmptyReload(*allowEmptyReload)
+	if *receiptKeyFile != "" {
+		key, err := ioutil.ReadFile(*receiptKeyFile)
+		if err != nil || len(key) == 0 {
+			log.Fatal("Can't read receipt key: ", err)
+		}
+		if *receiptLog == "" {
+			log.Fatal("-receipt-key requires -receipt-log")
+		}
+		sink, err := NewReceiptFileSink(*receiptLog)
+		if err != nil {
+			log.Fatal("Can't open receipt log: ", err)
+		}
+		authenticator.EnableReceipts(key, sink)
+	}
+	if *saltedCodes {
+		if pepper == "" {
+			// The built-in one is no secret.
+			log.Fatal("-salted-codes requires -pepper-file or $EARL_PEPPER")
+		}
+		hasher, err := NewCodeHasher([]byte(pepper), *codeHashCost)
+		if err != nil {
+			log.Fatal("-code-hash-cost: ", err)
+		}
+		authenticator.SetCodeHasher(hasher, *upgradeCodes)
+	} else if *upgradeCodes {
+		log.Fatal("-upgrade-codes requires -salted-codes")
+	}
+	if *notifyWebhook != "" {
+		authenticator.SetNotifier(NewWebhookNotifier(*notifyWebhook))
+	}
+	if *masterCodesFile != "" {
+		if err := authenticator.SetMasterCodes(*masterCodesFile); err != nil {
+			log.Fatal("-master-codes: ", err)
+		}
+	}
+	if *holidayFile != "" {
+		if err := authenticator.SetHolidayCalendar(*holidayFile); err != nil {
+			log.Fatal("-holidays: ", err)
+		}
+	}
+	if *denyListFile != "" {
+		if err := authenticator.SetDenyList(*denyListFile); err != nil {
+			log.Fatal("-deny-list: ", err)
+		}
+	}
+	var timeSource TimeSource
+	if *trustedTimeURL != "" {
+		timeSource = NewHTTPTimeSource(*trustedTimeURL)
+	}
+	authenticator.SetClockSkewCheck(*clockSkewThreshold, timeSource, *clockSkewFailSafe)
+	if *canaryCode != "" {
+		if err := authenticator.SelfTest(*canaryCode, Level(*canaryLevel)); err != nil {
+			log.Fatal("Self-test failed: ", err)
+		}
+	}
+	if *auditLog != "" {
+		auditLogger, err := NewAuditLogger(*auditLog)
+		if err != nil {
+			log.Fatal("Can't open audit log: ", err)
+		}
+		authenticator.SetAuditLogger(auditLogger)
+		hangup := make(chan os.Signal, 1)
+		signal.Notify(hangup, syscall.SIGHUP)
+		go func() {
+			for range hangup {
+				if err := auditLogger.Reopen(); err != nil {
+					log.Printf("Can't re-open audit log: %v", err)
+				}
+			}
+		}()
+	}
+	if *watchUsers {
+		if err := authenticator.StartWatching(); err != nil {
+			log.Printf("Can't watch %v (%v); checking timestamp instead.",
+				store, err)
+		}
+	}
+	authenticator.SetStatInterval(*statInterval)
+	if *reloadInterval > 0 {
+		authenticator.StartPeriodicReload(*reloadInterval)
 	}
 
 	// If we just requested to list users, do this and exit.
@@ -215,8 +677,28 @@ func main() {
 		go handleSerialDevice(devicepath, baudrate, backends)
 	}
 
+	var metricsHandler http.Handler
+	if *metrics {
+		if newPrometheusMetrics == nil {
+			log.Fatal("-metrics: No Prometheus support; build with -tags prometheus")
+		}
+		m, handler, err := newPrometheusMetrics()
+		if err != nil {
+			log.Fatal("-metrics: ", err)
+		}
+		authenticator.SetMetrics(m)
+		metricsHandler = handler
+	}
+
 	if *httpPort > 0 && *httpPort <= 65535 {
 		apiServer := NewApiServer(appEventBus, *httpPort)
+		if metricsHandler != nil {
+			apiServer.EnableMetrics(metricsHandler)
+		}
+		if *httpAuth {
+			apiServer.EnableAuth(authenticator)
+		}
+		apiServer.SetHealthCheck(authenticator.HealthCheck)
 		go apiServer.Run()
 	}
 
@@ -0,0 +1,74 @@
+// Master codes for maintenance, e.g. of the elevator technician: they open
+// their targets regardless of hours, lockdown or the space being closed.
+// Kept in a file of their own, so that they don't get lost with edits of
+// the users, and each use is an alarm rather than a regular entry.
+//
+// One code per line: a name for the logs, the hashed code as in the users
+// file and the comma separated targets, separated by whitespace, e.g.
+//
+//	elevator-tech  5f4dcc3b5aa765d61d8327deb882cf99  elevator,upstairs
+//
+// Empty lines and lines starting with '#' are ignored.
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type masterCode struct {
+	name    string
+	targets map[Target]bool
+}
+
+// By hashed code.
+type masterCodes map[string]masterCode
+
+func loadMasterCodes(filename string) (masterCodes, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	result := make(masterCodes)
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("%s:%d: expected name, hashed code and targets", filename, line)
+		}
+		if !isHashedCode(fields[1]) || isSaltedCode(fields[1]) {
+			// Salted codes would be too slow to check with each code.
+			return nil, fmt.Errorf("%s:%d: code of '%s' needs to be hashed as with -hash-codes", filename, line, fields[0])
+		}
+		if _, exists := result[fields[1]]; exists {
+			return nil, fmt.Errorf("%s:%d: duplicate code of '%s'", filename, line, fields[0])
+		}
+		master := masterCode{name: fields[0], targets: make(map[Target]bool)}
+		for _, target := range strings.Split(fields[2], ",") {
+			if target != "" {
+				master.targets[Target(target)] = true
+			}
+		}
+		result[fields[1]] = master
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// Name of the master code for the target, or empty if it isn't one.
+func (m masterCodes) find(pepper codePepper, plain_code string, target Target) string {
+	master, found := m[pepper.hash(plain_code)]
+	if !found || !master.targets[target] {
+		return ""
+	}
+	return master.name
+}
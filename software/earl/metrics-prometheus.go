@@ -0,0 +1,107 @@
+//go:build prometheus
+
+// Metrics for Prometheus. Needs the Prometheus client library, so it is only
+// built with "go build -tags prometheus".
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+type PrometheusMetrics struct {
+	granted        *prometheus.CounterVec // by target
+	denied         *prometheus.CounterVec // by reason and target
+	authDuration   prometheus.Histogram
+	reloads        prometheus.Counter
+	reloadErrors   prometheus.Counter
+	reloadDuration prometheus.Histogram
+	usersLoaded    prometheus.Gauge
+}
+
+func init() {
+	newPrometheusMetrics = func() (Metrics, http.Handler, error) {
+		registry := prometheus.NewRegistry()
+		metrics, err := NewPrometheusMetrics(registry)
+		if err != nil {
+			return nil, nil, err
+		}
+		return metrics, promhttp.HandlerFor(registry, promhttp.HandlerOpts{}), nil
+	}
+}
+
+// Create the metrics and register them with the registerer, e.g.
+// prometheus.DefaultRegisterer or, in tests, a new registry.
+func NewPrometheusMetrics(registerer prometheus.Registerer) (*PrometheusMetrics, error) {
+	m := &PrometheusMetrics{
+		granted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_granted_total",
+			Help: "Number of times access was granted.",
+		}, []string{"target"}),
+		denied: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "auth_denied_total",
+			Help: "Number of times access was denied.",
+		}, []string{"reason", "target"}),
+		authDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name: "auth_duration_seconds",
+			Help: "Time to decide on access.",
+			// Usually well below a millisecond with the users in memory.
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+		reloads: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reload_total",
+			Help: "Number of reloads of the users, successful or not.",
+		}),
+		reloadErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "reload_errors_total",
+			Help: "Number of rejected reloads of the users.",
+		}),
+		reloadDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "reload_duration_seconds",
+			Help:    "Time to read the users for a reload.",
+			Buckets: prometheus.DefBuckets,
+		}),
+		usersLoaded: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "users_loaded",
+			Help: "Number of users read in the last successful load.",
+		}),
+	}
+	for _, collector := range []prometheus.Collector{
+		m.granted, m.denied, m.authDuration, m.reloads, m.reloadErrors,
+		m.reloadDuration, m.usersLoaded} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func (m *PrometheusMetrics) AuthDecision(target Target, result AuthResult, reason AuthReason) {
+	if result == AuthOk {
+		m.granted.WithLabelValues(string(target)).Inc()
+	} else {
+		m.denied.WithLabelValues(reason.String(), string(target)).Inc()
+	}
+}
+
+func (m *PrometheusMetrics) AuthDuration(took time.Duration) {
+	m.authDuration.Observe(took.Seconds())
+}
+
+func (m *PrometheusMetrics) Reload(err error) {
+	m.reloads.Inc()
+	if err != nil {
+		m.reloadErrors.Inc()
+	}
+}
+
+func (m *PrometheusMetrics) ReloadDuration(took time.Duration) {
+	m.reloadDuration.Observe(took.Seconds())
+}
+
+func (m *PrometheusMetrics) UsersLoaded(count int) {
+	m.usersLoaded.Set(float64(count))
+}
@@ -0,0 +1,51 @@
+//go:build prometheus
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func sampleCount(histogram prometheus.Histogram) uint64 {
+	var metric dto.Metric
+	histogram.Write(&metric)
+	return metric.GetHistogram().GetSampleCount()
+}
+
+func TestPrometheusMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	metrics, err := NewPrometheusMetrics(registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewPrometheusMetrics(registry)
+	ExpectTrue(t, err != nil, "Registering twice")
+
+	metrics.AuthDecision(TargetUpstairs, AuthOk, AccessGranted)
+	metrics.AuthDecision(TargetUpstairs, AuthOk, AccessGranted)
+	metrics.AuthDecision(TargetDownstairs, AuthFail, AccessDeniedUnknownCode)
+	metrics.AuthDecision(TargetDownstairs, AuthOkButOutsideTime, AccessDeniedOutsideHours)
+	ExpectTrue(t, testutil.ToFloat64(metrics.granted.WithLabelValues("upstairs")) == 2,
+		"Granted")
+	ExpectTrue(t, testutil.ToFloat64(metrics.denied.WithLabelValues("unknown-code", "gate")) == 1,
+		"Denied by reason")
+	ExpectTrue(t, testutil.ToFloat64(metrics.denied.WithLabelValues("outside-hours", "gate")) == 1,
+		"Outside hours is a denial")
+	metrics.AuthDuration(2 * time.Millisecond)
+	ExpectTrue(t, sampleCount(metrics.authDuration) == 1, "Auth duration")
+
+	metrics.Reload(nil)
+	metrics.Reload(errors.New("broken"))
+	metrics.ReloadDuration(300 * time.Millisecond)
+	metrics.UsersLoaded(42)
+	ExpectTrue(t, testutil.ToFloat64(metrics.reloads) == 2, "Reloads")
+	ExpectTrue(t, testutil.ToFloat64(metrics.reloadErrors) == 1, "Reload errors")
+	ExpectTrue(t, testutil.ToFloat64(metrics.usersLoaded) == 42, "Users loaded")
+	ExpectTrue(t, sampleCount(metrics.reloadDuration) == 1, "Reload duration")
+}
@@ -0,0 +1,32 @@
+// Counting what the authenticator does, e.g. to graph access decisions and
+// reloads in a monitoring system. metrics-prometheus.go has an
+// implementation for Prometheus.
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// Told about access decisions and loads of the users. Must not block.
+type Metrics interface {
+	// An AuthUser() decision.
+	AuthDecision(target Target, result AuthResult, reason AuthReason)
+
+	// How long an AuthUser() decision took, by the clock of the
+	// authenticator.
+	AuthDuration(took time.Duration)
+
+	// A reload of the users; err is nil if it worked.
+	Reload(err error)
+
+	// How long reading the users for a reload took, successful or not.
+	ReloadDuration(took time.Duration)
+
+	// Number of users after a successful load.
+	UsersLoaded(count int)
+}
+
+// Create Prometheus metrics with their own registry, and a handler serving
+// them. Only available if built with -tags prometheus, nil otherwise.
+var newPrometheusMetrics func() (Metrics, http.Handler, error)
@@ -0,0 +1,84 @@
+// Cache of recently seen unknown codes. Someone trying codes at a reader
+// tends to replay a handful of guesses; these we can reject without looking
+// through the users again, which is costly with salted codes.
+//
+// Entries are only valid for the user revision they were seen in, so any
+// change of the users, including a reload, invalidates them: a code that
+// was unknown might be valid now.
+package main
+
+import (
+	"container/list"
+	"sync"
+)
+
+type negativeCacheEntry struct {
+	key      string // Hashed code.
+	revision int
+}
+
+// Least recently used are evicted first.
+type negativeCache struct {
+	lock    sync.Mutex
+	size    int        // 0: disabled
+	order   *list.List // Most recently used first.
+	entries map[string]*list.Element
+}
+
+func newNegativeCache() *negativeCache {
+	return &negativeCache{order: list.New(), entries: make(map[string]*list.Element)}
+}
+
+func (c *negativeCache) configure(size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.size = size
+	c.clearRequiresLock()
+}
+
+func (c *negativeCache) clear() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.clearRequiresLock()
+}
+
+func (c *negativeCache) clearRequiresLock() {
+	c.order.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// Returns true if the key is known to be unknown in the given revision.
+func (c *negativeCache) contains(key string, revision int) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	element := c.entries[key]
+	if element == nil {
+		return false
+	}
+	if element.Value.(*negativeCacheEntry).revision != revision {
+		c.order.Remove(element)
+		delete(c.entries, key)
+		return false
+	}
+	c.order.MoveToFront(element)
+	return true
+}
+
+func (c *negativeCache) add(key string, revision int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.size <= 0 {
+		return
+	}
+	if element := c.entries[key]; element != nil {
+		element.Value.(*negativeCacheEntry).revision = revision
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[key] = c.order.PushFront(&negativeCacheEntry{key, revision})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*negativeCacheEntry).key)
+	}
+}
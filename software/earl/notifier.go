@@ -0,0 +1,193 @@
+// Notifications of things people want to hear about, e.g. in a chat
+// channel: users and guests added, and notable access decisions such as
+// users on hiatus trying to get in or master codes used.
+//
+// Notifying happens in the background; a slow or failing notifier never
+// holds up or fails the decision or change it is about. If notifications
+// pile up, the excess is dropped and logged.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type NotifyKind string
+
+const (
+	NotifyUserAdded  = NotifyKind("user-added")
+	NotifyGuestAdded = NotifyKind("guest-added")
+	NotifyAccess     = NotifyKind("access") // See Reason
+)
+
+type NotifyEvent struct {
+	Timestamp time.Time  `json:"timestamp"`
+	Kind      NotifyKind `json:"kind"`
+	Target    Target     `json:"target,omitempty"`
+	Reason    string     `json:"reason,omitempty"` // AuthReason of access.
+	UserName  string     `json:"user,omitempty"`
+	By        string     `json:"by,omitempty"` // Member who added the user.
+	Msg       string     `json:"msg"`          // For humans.
+}
+
+type Notifier interface {
+	Notify(event NotifyEvent) error
+}
+
+// Doesn't notify anyone.
+type NopNotifier struct{}
+
+func (NopNotifier) Notify(event NotifyEvent) error {
+	return nil
+}
+
+// Posts each event as JSON to a URL. The message is in "text" as well, so
+// that Slack and compatible incoming webhooks show it. Events carry names,
+// never codes, so neither does the payload.
+//
+// Failed posts are retried a few times, with the backoff doubling after
+// each attempt. Rejected requests (4xx) are not retried, except for "too
+// many requests". Each attempt times out, so a dead endpoint only delays
+// the notifications after it.
+type WebhookNotifier struct {
+	url      string
+	client   *http.Client
+	attempts int
+	backoff  time.Duration
+}
+
+const (
+	DefaultWebhookAttempts = 3
+	DefaultWebhookBackoff  = time.Second
+)
+
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{
+		url:      url,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		attempts: DefaultWebhookAttempts,
+		backoff:  DefaultWebhookBackoff,
+	}
+}
+
+// Try each event that many times, waiting backoff after the first failure.
+func (n *WebhookNotifier) SetRetries(attempts int, backoff time.Duration) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	n.attempts = attempts
+	n.backoff = backoff
+}
+
+func (n *WebhookNotifier) Notify(event NotifyEvent) error {
+	body, err := json.Marshal(struct {
+		Text string `json:"text"`
+		NotifyEvent
+	}{event.Msg, event})
+	if err != nil {
+		return err
+	}
+	backoff := n.backoff
+	for attempt := 1; ; attempt++ {
+		retry, err := n.post(body)
+		if err == nil || !retry || attempt >= n.attempts {
+			return err
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// Returns if it is worth trying again on error.
+func (n *WebhookNotifier) post(body []byte) (bool, error) {
+	response, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return true, err
+	}
+	response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		retry := response.StatusCode/100 == 5 ||
+			response.StatusCode == http.StatusTooManyRequests
+		return retry, fmt.Errorf("Webhook responded with %s", response.Status)
+	}
+	return false, nil
+}
+
+const notifyQueueSize = 32
+
+// Hands events to the notifier from a goroutine of its own.
+type notifyQueue struct {
+	notifier Notifier
+	logger   Logger
+	events   chan NotifyEvent
+	done     chan bool
+
+	lock    sync.Mutex
+	closed  bool
+	dropped int
+}
+
+func newNotifyQueue(notifier Notifier, logger Logger) *notifyQueue {
+	q := &notifyQueue{
+		notifier: notifier,
+		logger:   logger,
+		events:   make(chan NotifyEvent, notifyQueueSize),
+		done:     make(chan bool),
+	}
+	go q.run()
+	return q
+}
+
+func (q *notifyQueue) run() {
+	defer close(q.done)
+	for event := range q.events {
+		if err := q.notifier.Notify(event); err != nil {
+			q.logger.Printf("Could not notify %s: %v", event.Kind, err)
+		}
+	}
+}
+
+// Never blocks. Fine to call on a nil queue, which doesn't notify.
+func (q *notifyQueue) send(event NotifyEvent) {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.closed {
+		return
+	}
+	select {
+	case q.events <- event:
+	default:
+		q.dropped++
+		q.logger.Printf("Notifications piling up; dropped %d so far.", q.dropped)
+	}
+}
+
+func (q *notifyQueue) droppedCount() int {
+	if q == nil {
+		return 0
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.dropped
+}
+
+// Stop after the events queued so far have been handed to the notifier.
+func (q *notifyQueue) close() {
+	if q == nil {
+		return
+	}
+	q.lock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.events)
+	}
+	q.lock.Unlock()
+	<-q.done
+}
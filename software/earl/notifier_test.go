@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+	"time"
+)
+
+type channelNotifier struct {
+	events chan NotifyEvent
+	err    error
+}
+
+func (n *channelNotifier) Notify(event NotifyEvent) error {
+	n.events <- event
+	return n.err
+}
+
+func nextNotification(events chan NotifyEvent) *NotifyEvent {
+	select {
+	case event := <-events:
+		return &event
+	case <-time.After(time.Second):
+		return nil
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	authFile, _ := ioutil.TempFile("", "notify")
+	mockClock := &MockClock{}
+	auth := CreateSimpleFileAuth(authFile, mockClock).(*FileBasedAuthenticator)
+	if !keepGeneratedFiles {
+		defer syscall.Unlink(authFile.Name())
+	}
+	defer auth.Close()
+	// Failing doesn't fail anything.
+	notifier := &channelNotifier{events: make(chan NotifyEvent, 10), err: errors.New("down")}
+	auth.SetNotifier(notifier)
+	now, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	mockClock.now = now
+
+	ExpectTrue(t, eatmsg(auth.AddGuest("root123", "guest123", "Visitor", time.Hour, TargetUpstairs)),
+		"Adding guest")
+	event := nextNotification(notifier.events)
+	ExpectTrue(t, event != nil && event.Kind == NotifyGuestAdded &&
+		event.UserName == "Visitor" && event.By == "root", "Guest added")
+
+	u := User{Name: "Away", ContactInfo: "away@nb", UserLevel: LevelHiatus}
+	u.SetAuthCode("away123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding")
+	event = nextNotification(notifier.events)
+	ExpectTrue(t, event != nil && event.Kind == NotifyUserAdded && event.UserName == "Away",
+		"User added")
+
+	mockClock.now = now.Add(time.Minute)
+	ExpectAuthResult(t, auth, "root123", TargetUpstairs, AuthOk, "")
+	ExpectAuthResult(t, auth, "away123", TargetUpstairs, AuthFail, "")
+	event = nextNotification(notifier.events)
+	ExpectTrue(t, event != nil && event.Kind == NotifyAccess &&
+		event.Reason == "hiatus" && event.Target == TargetUpstairs, "Hiatus denial")
+}
+
+func TestNotifyNeverBlocks(t *testing.T) {
+	stuck := &channelNotifier{events: make(chan NotifyEvent)} // Nobody reads.
+	logger := &recordingLogger{}
+	q := newNotifyQueue(stuck, logger)
+	for i := 0; i < 2*notifyQueueSize; i++ {
+		q.send(NotifyEvent{Kind: NotifyAccess})
+	}
+	ExpectTrue(t, len(logger.lines) > 0 && q.droppedCount() >= notifyQueueSize,
+		"Dropping counted")
+	go func() {
+		for range stuck.events {
+		}
+	}()
+	q.close()
+	q.send(NotifyEvent{Kind: NotifyAccess}) // Ignored once closed.
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	received := make(chan map[string]interface{}, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&body)
+		received <- body
+	}))
+	defer server.Close()
+
+	err := NewWebhookNotifier(server.URL).Notify(NotifyEvent{
+		Kind: NotifyUserAdded, UserName: "Jon", Msg: "'root' added 'Jon' as user."})
+	ExpectTrue(t, err == nil, "Posted")
+	body := <-received
+	ExpectTrue(t, body["text"] == "'root' added 'Jon' as user." &&
+		body["kind"] == "user-added" && body["user"] == "Jon", "Body")
+	for key := range body {
+		ExpectTrue(t, key != "code" && key != "codes", "No codes in payload")
+	}
+
+	// Server errors are retried, with a backoff; rejections are not.
+	var attempts []time.Time
+	status := http.StatusServiceUnavailable
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempts = append(attempts, time.Now())
+		if len(attempts) < 3 {
+			http.Error(w, "busy", status)
+		}
+	}))
+	defer flaky.Close()
+	notifier := NewWebhookNotifier(flaky.URL)
+	notifier.SetRetries(3, 20*time.Millisecond)
+	ExpectTrue(t, notifier.Notify(NotifyEvent{}) == nil, "Third attempt succeeds")
+	ExpectTrue(t, len(attempts) == 3, "Retried")
+	if len(attempts) == 3 {
+		ExpectTrue(t, attempts[2].Sub(attempts[1]) >= 40*time.Millisecond,
+			"Backoff doubles")
+	}
+
+	attempts = nil
+	notifier.SetRetries(2, time.Millisecond)
+	ExpectTrue(t, notifier.Notify(NotifyEvent{}) != nil, "Gives up")
+	ExpectTrue(t, len(attempts) == 2, "Bounded")
+
+	attempts, status = nil, http.StatusBadRequest
+	ExpectTrue(t, notifier.Notify(NotifyEvent{}) != nil, "Rejected")
+	ExpectTrue(t, len(attempts) == 1, "Not retried")
+}
@@ -0,0 +1,181 @@
+// Who is in the space, with readers at the way in and the way out: access
+// at an entry target marks a user present, at an exit target absent.
+// People don't always swipe out, e.g. when following someone else through
+// the door, so presence also ends after an idle timeout without another
+// entry. In memory only, so a restart starts with nobody present.
+//
+// With anti-passback at a target, users that are present can't enter
+// there again, e.g. by handing their card to someone outside. That only
+// holds for a window after their entry, so that a missed exit can't keep
+// anyone out for long.
+//
+// Users that got in shortly before their hours end, e.g. at 21:55 with
+// closing at 22:00, may stay a grace after, to pack up: they count as
+// allowed to be present until then rather than from the end. Nobody is
+// sent out either way; it is just how they are reported.
+//
+// With a maximum occupancy, entry targets let nobody else in while that
+// many users are present. Members are not held back; that is up to the
+// caller.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type presenceTracker struct {
+	lock        sync.Mutex
+	entry       map[Target]bool
+	exit        map[Target]bool
+	idleTimeout time.Duration       // 0: until exit.
+	present     map[string]presence // By User.identity()
+
+	passback       map[Target]bool
+	passbackWindow time.Duration
+
+	maxOccupancy int // 0: no limit.
+}
+
+type presence struct {
+	since      time.Time // Entry.
+	member     bool
+	target     Target    // Where they entered.
+	graceUntil time.Time // Allowed to be present until then; zero: no grace.
+}
+
+func newPresenceTracker() *presenceTracker {
+	return &presenceTracker{present: make(map[string]presence)}
+}
+
+func (t *presenceTracker) configure(entry []Target, exit []Target, idleTimeout time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.entry = make(map[Target]bool)
+	for _, target := range entry {
+		t.entry[target] = true
+	}
+	t.exit = make(map[Target]bool)
+	for _, target := range exit {
+		t.exit[target] = true
+	}
+	t.idleTimeout = idleTimeout
+}
+
+// Record granted access of the user at the target. graceUntil is when a
+// late entry stops counting as allowed, see above.
+func (t *presenceTracker) record(identity string, member bool, target Target,
+	now time.Time, graceUntil time.Time) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch {
+	case t.entry[target]:
+		t.present[identity] = presence{since: now, member: member,
+			target: target, graceUntil: graceUntil}
+	case t.exit[target]:
+		delete(t.present, identity)
+	}
+}
+
+// Identities of the users present at this time.
+func (t *presenceTracker) presentAt(now time.Time) map[string]bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.expireRequiresLock(now)
+	result := make(map[string]bool)
+	for identity := range t.present {
+		result[identity] = true
+	}
+	return result
+}
+
+// The users present at this time with their entry, by identity.
+func (t *presenceTracker) entriesAt(now time.Time) map[string]presence {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.expireRequiresLock(now)
+	result := make(map[string]presence)
+	for identity, p := range t.present {
+		result[identity] = p
+	}
+	return result
+}
+
+func (t *presenceTracker) membersAt(now time.Time) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.expireRequiresLock(now)
+	members := 0
+	for _, p := range t.present {
+		if p.member {
+			members++
+		}
+	}
+	return members
+}
+
+func (t *presenceTracker) expireRequiresLock(now time.Time) {
+	if t.idleTimeout <= 0 {
+		return
+	}
+	for identity, p := range t.present {
+		if now.Sub(p.since) >= t.idleTimeout {
+			delete(t.present, identity)
+		}
+	}
+}
+
+func (t *presenceTracker) configurePassback(targets []Target, window time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.passback = make(map[Target]bool)
+	for _, target := range targets {
+		t.passback[target] = true
+	}
+	t.passbackWindow = window
+}
+
+// Returns true if the user is present, and entered too recently to enter
+// at the target again.
+func (t *presenceTracker) passbackDenied(identity string, target Target, now time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if !t.passback[target] {
+		return false
+	}
+	t.expireRequiresLock(now)
+	p, present := t.present[identity]
+	return present && now.Sub(p.since) < t.passbackWindow
+}
+
+func (t *presenceTracker) setMaxOccupancy(max int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.maxOccupancy = max
+}
+
+func (t *presenceTracker) occupancy(now time.Time) int {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.expireRequiresLock(now)
+	return len(t.present)
+}
+
+// Returns true if entering at the target would exceed the maximum. Users
+// that count as present already don't add to it.
+func (t *presenceTracker) atCapacity(identity string, target Target, now time.Time) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.maxOccupancy <= 0 || !t.entry[target] {
+		return false
+	}
+	t.expireRequiresLock(now)
+	_, present := t.present[identity]
+	return !present && len(t.present) >= t.maxOccupancy
+}
+
+func (t *presenceTracker) clear() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.present = make(map[string]presence)
+}
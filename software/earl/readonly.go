@@ -0,0 +1,90 @@
+// A view of the authenticator for less trusted components in the same
+// process, e.g. a dashboard: it tells whether codes would get in and lists
+// the users, but can't change anything. It works on the users of the
+// authenticator itself, so it sees reloads and changes right away. Users
+// come without their codes and are only found by name, and checking codes
+// is recorded like any access decision, so the view can't be used to
+// collect or guess codes.
+package main
+
+import (
+	"context"
+	"time"
+)
+
+type ReadOnlyAuthenticator struct {
+	auth *FileBasedAuthenticator
+}
+
+const readOnlyMessage = "read-only"
+
+func (a *FileBasedAuthenticator) ReadOnly() *ReadOnlyAuthenticator {
+	return &ReadOnlyAuthenticator{auth: a}
+}
+
+// The view doesn't look up users by code: unlike checking a code, that
+// wouldn't be recorded, so it could be used to guess codes. Always nil; see
+// FindUsersByName().
+func (r *ReadOnlyAuthenticator) FindUser(plain_code string) *User {
+	return nil
+}
+
+// Users whose name contains the query, without their codes.
+func (r *ReadOnlyAuthenticator) FindUsersByName(query string) []User {
+	return r.auth.FindUsersByName(query)
+}
+
+// Without their codes.
+func (r *ReadOnlyAuthenticator) ListUsers() []User {
+	users := r.auth.ListUsers()
+	for i := range users {
+		users[i].stripCodes()
+	}
+	return users
+}
+
+// Would the code get in at the target? The check goes to the audit log
+// and the feed of decisions like any, and unknown codes count towards the
+// lockout, but nobody enters, e.g. single-use codes stay unused.
+func (r *ReadOnlyAuthenticator) AuthUser(code string, target Target) (AuthResult, string) {
+	result, _, msg := r.AuthUserWithReason(code, target)
+	return result, msg
+}
+
+func (r *ReadOnlyAuthenticator) AuthUserWithReason(code string, target Target) (AuthResult, AuthReason, string) {
+	_, result, reason, msg := r.auth.authAndRecordUser(context.Background(), code, target, "", true)
+	return result, reason, msg
+}
+
+// The user granted comes without codes.
+func (r *ReadOnlyAuthenticator) AuthUserDetailed(code string, target Target) (AuthResult, *User, string) {
+	user, result, _, msg := r.auth.authAndRecordUser(context.Background(), code, target, "", true)
+	if result != AuthOk || user == nil {
+		return result, nil, msg
+	}
+	granted := user.deepCopy()
+	granted.stripCodes()
+	return result, &granted, msg
+}
+
+func (r *ReadOnlyAuthenticator) MinCodeLength() int {
+	return r.auth.MinCodeLength()
+}
+
+// Not by code either, see FindUser().
+func (r *ReadOnlyAuthenticator) ValidityRemaining(code string) (time.Duration, bool) {
+	return 0, false
+}
+
+func (r *ReadOnlyAuthenticator) AddNewUser(authentication_code string, user User) (bool, string) {
+	return false, readOnlyMessage
+}
+
+func (r *ReadOnlyAuthenticator) UpdateUser(authentication_code string,
+	user_code string, updater_fun ModifyFun) (bool, string) {
+	return false, readOnlyMessage
+}
+
+func (r *ReadOnlyAuthenticator) DeleteUser(authentication_code string, user_code string) (bool, string) {
+	return false, readOnlyMessage
+}
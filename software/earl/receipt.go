@@ -0,0 +1,79 @@
+// Signed receipts of access decisions.
+//
+// If enabled, each AuthUser() decision produces a receipt that is signed
+// with a deployment key (HMAC-SHA256). The receipts can be stored somewhere
+// and in case of a dispute ("the system let someone in at 3am") verified
+// to be genuine with VerifyReceipt().
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+type AuthReceipt struct {
+	Timestamp time.Time
+	Target    Target
+	CodeHash  string // As stored, see hashAuthCode(); never the plain code.
+	Result    AuthResult
+	Signature string // hex encoded HMAC over all of the above.
+}
+
+// Called with each new receipt.
+type ReceiptSink func(receipt AuthReceipt)
+
+func (r *AuthReceipt) signedPayload() string {
+	return fmt.Sprintf("%s|%s|%s|%d", r.Timestamp.UTC().Format(time.RFC3339Nano),
+		r.Target, r.CodeHash, r.Result)
+}
+
+func (r *AuthReceipt) computeSignature(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(r.signedPayload()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Create a receipt for a decision and sign it.
+func NewSignedReceipt(key []byte, timestamp time.Time, target Target,
+	code_hash string, result AuthResult) AuthReceipt {
+	receipt := AuthReceipt{
+		Timestamp: timestamp,
+		Target:    target,
+		CodeHash:  code_hash,
+		Result:    result,
+	}
+	receipt.Signature = receipt.computeSignature(key)
+	return receipt
+}
+
+// Returns true if the receipt has been signed with the given key and
+// was not modified since.
+func VerifyReceipt(key []byte, receipt AuthReceipt) bool {
+	expected := receipt.computeSignature(key)
+	return hmac.Equal([]byte(expected), []byte(receipt.Signature))
+}
+
+// Create a sink that appends receipts as JSON, one per line, to the given
+// file.
+func NewReceiptFileSink(filename string) (ReceiptSink, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var lock sync.Mutex
+	return func(receipt AuthReceipt) {
+		line, err := json.Marshal(receipt)
+		if err != nil {
+			return
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		f.Write(append(line, '\n'))
+	}, nil
+}
@@ -0,0 +1,179 @@
+// When a user can get in, for handing them at onboarding: the weekly
+// windows at each target, with the hours of their level or their personal
+// hours, their recurring schedule and the access rules combined, just as
+// an access decision combines them. What isn't weekly, like the validity
+// period or holidays, is in the notes.
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// Weekly windows per target, each day on its own, so a window across
+// midnight shows as two. Targets the user never gets in are left out.
+type ScheduleSummary struct {
+	Name    string
+	Level   Level
+	Windows map[Target]RecurringSchedule
+	Notes   []string
+}
+
+// The doors, and the targets of access rules and guest passes.
+func (a *FileBasedAuthenticator) summaryTargets(user *User) []Target {
+	seen := map[Target]bool{TargetDownstairs: true, TargetUpstairs: true, TargetElevator: true}
+	for _, targets := range a.accessRules {
+		for target := range targets {
+			seen[target] = true
+		}
+	}
+	for _, target := range user.Targets {
+		seen[target] = true
+	}
+	var result []Target
+	for target := range seen {
+		result = append(result, target)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+	return result
+}
+
+// The effective weekly windows the user with the given code gets in at
+// each target. Only members can ask; returns why not otherwise.
+func (a *FileBasedAuthenticator) AccessScheduleFor(memberCode, targetCode string) (ScheduleSummary, string) {
+	if auth_ok, auth_msg := a.verifyOpAllowed(memberCode, CanLevelAdminister); !auth_ok {
+		return ScheduleSummary{}, auth_msg
+	}
+	user := a.findUserSynchronized(targetCode, nil)
+	if user == nil {
+		return ScheduleSummary{}, "No such user."
+	}
+	summary := ScheduleSummary{
+		Name:    user.Name,
+		Level:   user.UserLevel,
+		Windows: make(map[Target]RecurringSchedule),
+	}
+	switch {
+	case user.TestOnly:
+		summary.Notes = append(summary.Notes, "Test-only: never gets in.")
+		return summary, ""
+	case user.Disabled:
+		summary.Notes = append(summary.Notes, "Account disabled.")
+		return summary, ""
+	case user.UserLevel == LevelHiatus:
+		summary.Notes = append(summary.Notes, "On hiatus.")
+		return summary, ""
+	}
+	now := a.clock.Now()
+	if !user.ValidFrom.IsZero() && !user.ValidFrom.Before(now) {
+		summary.Notes = append(summary.Notes,
+			"Valid from "+user.ValidFrom.Format("2006-01-02 15:04")+".")
+	}
+	if expires := user.ExpiryDate(now); !expires.IsZero() {
+		if expires.After(now) {
+			summary.Notes = append(summary.Notes,
+				"Valid until "+expires.Format("2006-01-02 15:04")+".")
+		} else {
+			summary.Notes = append(summary.Notes, "Expired.")
+		}
+	}
+	if user.SingleUse {
+		summary.Notes = append(summary.Notes, "Gets in once.")
+	}
+	if user.UserLevel != LevelMember && a.holidays != nil {
+		summary.Notes = append(summary.Notes, "Not on days the space is closed for holidays.")
+	}
+	if hasPersonalHours(user.UserLevel) {
+		summary.Notes = append(summary.Notes,
+			"Hours of the level don't apply while a member has opened the space.")
+	}
+	for _, target := range a.summaryTargets(user) {
+		if windows := a.weeklyWindows(user, target); len(windows) > 0 {
+			summary.Windows[target] = windows
+		}
+	}
+	return summary, ""
+}
+
+// Part of a day, as time since midnight.
+type daySpan struct {
+	start, end time.Duration
+}
+
+// The windows the user gets in at the target, day by day.
+func (a *FileBasedAuthenticator) weeklyWindows(user *User, target Target) RecurringSchedule {
+	rule, has_rule := a.accessRules.Rule(user.UserLevel, target)
+	if has_rule && !rule.Allowed {
+		return nil
+	}
+	if user.UserLevel == LevelGuest && !user.HasTarget(target) {
+		return nil
+	}
+	var result RecurringSchedule
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		spans := []daySpan{{0, 24 * time.Hour}}
+		if user.Schedule != nil {
+			spans = scheduleSpansOn(user.Schedule, day)
+		}
+		if hasPersonalHours(user.UserLevel) {
+			spans = clipSpans(spans, a.accessWindowOn(user, day))
+		}
+		if has_rule && rule.Hours != nil {
+			spans = clipSpans(spans, *rule.Hours)
+		}
+		for _, span := range spans {
+			result = append(result, RecurringWindow{day, span.start, span.end})
+		}
+	}
+	return result
+}
+
+// The parts of the day the schedule covers, merged and in order, including
+// those of windows from the day before that go past midnight.
+func scheduleSpansOn(s RecurringSchedule, day time.Weekday) []daySpan {
+	yesterday := (day + 6) % 7
+	var spans []daySpan
+	for _, window := range s {
+		if window.Day == day {
+			end := window.End
+			if end > 24*time.Hour {
+				end = 24 * time.Hour
+			}
+			spans = append(spans, daySpan{window.Start, end})
+		}
+		if window.Day == yesterday && window.End > 24*time.Hour {
+			spans = append(spans, daySpan{0, window.End - 24*time.Hour})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].start < spans[j].start })
+	var result []daySpan
+	for _, span := range spans {
+		if last := len(result) - 1; last >= 0 && span.start <= result[last].end {
+			if span.end > result[last].end {
+				result[last].end = span.end
+			}
+			continue
+		}
+		result = append(result, span)
+	}
+	return result
+}
+
+// The spans cut to the hours of the window.
+func clipSpans(spans []daySpan, window HourWindow) []daySpan {
+	from := time.Duration(window.From) * time.Hour
+	to := time.Duration(window.To) * time.Hour
+	var result []daySpan
+	for _, span := range spans {
+		if span.start < from {
+			span.start = from
+		}
+		if span.end > to {
+			span.end = to
+		}
+		if span.start < span.end {
+			result = append(result, span)
+		}
+	}
+	return result
+}
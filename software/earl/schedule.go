@@ -0,0 +1,358 @@
+// Access schedules: hour windows in which someone may open doors, possibly
+// different per day of the week.
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval in hours in which access is allowed. Includes From, excludes
+// To [From...To). So (7, 22) means >= 7:00 && < 22; (0, 24) all day and
+// (0, 0) not at all.
+type HourWindow struct {
+	From int
+	To   int
+}
+
+// Per-weekday windows, indexed by time.Weekday
+type WeeklySchedule [7]HourWindow
+
+// Schedule with the same window every day of the week.
+func EveryDaySchedule(from int, to int) WeeklySchedule {
+	var result WeeklySchedule
+	for day := range result {
+		result[day] = HourWindow{from, to}
+	}
+	return result
+}
+
+func (w HourWindow) Contains(hour int) bool {
+	return hour >= w.From && hour < w.To
+}
+
+// True if this doesn't allow access at any hour.
+func (w HourWindow) IsClosed() bool {
+	return w.From >= w.To
+}
+
+func (w HourWindow) String() string {
+	if w.IsClosed() {
+		return "closed"
+	}
+	return fmt.Sprintf("%d:00..%d:00", w.From, w.To)
+}
+
+// Window that applies at the given time.
+func (s WeeklySchedule) WindowAt(t time.Time) HourWindow {
+	return s[t.Weekday()]
+}
+
+func (s WeeklySchedule) Allows(t time.Time) bool {
+	return s.WindowAt(t).Contains(t.Hour())
+}
+
+// Parse something like "7-24" into a HourWindow.
+func ParseHourWindow(spec string) (HourWindow, error) {
+	parts := strings.Split(spec, "-")
+	if len(parts) != 2 {
+		return HourWindow{}, fmt.Errorf("Expected <from>-<to> hours, got '%s'", spec)
+	}
+	from, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return HourWindow{}, err
+	}
+	to, err := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err != nil {
+		return HourWindow{}, err
+	}
+	if from < 0 || to > 24 || from > to {
+		return HourWindow{}, fmt.Errorf("Invalid hour range '%s'", spec)
+	}
+	return HourWindow{from, to}, nil
+}
+
+// Daytime windows for the levels that don't have all-hours access. Start is
+// the first hour with access, End the first hour without, e.g. 10, 23 for
+// 10:00 .. 22:59. Windows left at zero get the defaults.
+type AccessHours struct {
+	UserStart     int
+	UserEnd       int
+	FulltimeStart int
+	FulltimeEnd   int
+
+	// Optional windows for particular days of the week; days without
+	// entry use the windows above. HourWindow{0, 0} closes the day,
+	// HourWindow{0, 24} opens it all day.
+	UserWeekdays     map[time.Weekday]HourWindow
+	FulltimeWeekdays map[time.Weekday]HourWindow
+}
+
+// The hours we always had.
+func DefaultAccessHours() AccessHours {
+	userFrom, userTo := (&User{UserLevel: LevelUser}).AccessHours()
+	fulltimeFrom, fulltimeTo := (&User{UserLevel: LevelFulltimeUser}).AccessHours()
+	return AccessHours{
+		UserStart:     userFrom,
+		UserEnd:       userTo,
+		FulltimeStart: fulltimeFrom,
+		FulltimeEnd:   fulltimeTo,
+	}
+}
+
+// Fill in defaults for unset windows and check that the hours make sense.
+func (h AccessHours) withDefaults() (AccessHours, error) {
+	defaults := DefaultAccessHours()
+	if h.UserStart == 0 && h.UserEnd == 0 {
+		h.UserStart, h.UserEnd = defaults.UserStart, defaults.UserEnd
+	}
+	if h.FulltimeStart == 0 && h.FulltimeEnd == 0 {
+		h.FulltimeStart, h.FulltimeEnd = defaults.FulltimeStart, defaults.FulltimeEnd
+	}
+	if err := validateHours("user", h.UserStart, h.UserEnd); err != nil {
+		return h, err
+	}
+	if err := validateHours("fulltime user", h.FulltimeStart, h.FulltimeEnd); err != nil {
+		return h, err
+	}
+	for day, window := range h.UserWeekdays {
+		if err := validateDayWindow("user on "+day.String(), window); err != nil {
+			return h, err
+		}
+	}
+	for day, window := range h.FulltimeWeekdays {
+		if err := validateDayWindow("fulltime user on "+day.String(), window); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// Per-weekday schedule for regular users.
+func (h AccessHours) UserSchedule() WeeklySchedule {
+	return weekdaySchedule(h.UserWindow(), h.UserWeekdays)
+}
+
+// Per-weekday schedule for fulltime users.
+func (h AccessHours) FulltimeSchedule() WeeklySchedule {
+	return weekdaySchedule(h.FulltimeWindow(), h.FulltimeWeekdays)
+}
+
+func weekdaySchedule(window HourWindow, weekdays map[time.Weekday]HourWindow) WeeklySchedule {
+	result := EveryDaySchedule(window.From, window.To)
+	for day, window := range weekdays {
+		result[day] = window
+	}
+	return result
+}
+
+func (h AccessHours) UserWindow() HourWindow {
+	return HourWindow{h.UserStart, h.UserEnd}
+}
+
+func (h AccessHours) FulltimeWindow() HourWindow {
+	return HourWindow{h.FulltimeStart, h.FulltimeEnd}
+}
+
+func validateHours(what string, start int, end int) error {
+	if start < 0 || start > 23 {
+		return fmt.Errorf("Start hour for %s must be 0..23, got %d", what, start)
+	}
+	if end <= start || end > 24 {
+		return fmt.Errorf("End hour for %s must be %d..24, got %d", what, start+1, end)
+	}
+	return nil
+}
+
+// Like validateHours(), but a day can also be closed.
+func validateDayWindow(what string, window HourWindow) error {
+	if window.IsClosed() {
+		return nil
+	}
+	return validateHours(what, window.From, window.To)
+}
+
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// Parse per-weekday hours such as "sat=12-23,sun=closed".
+func ParseWeekdayHours(spec string) (map[time.Weekday]HourWindow, error) {
+	result := make(map[time.Weekday]HourWindow)
+	for _, entry := range strings.Split(spec, ",") {
+		parts := strings.Split(entry, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Expected <day>=<from>-<to>, got '%s'", entry)
+		}
+		name := strings.ToLower(strings.TrimSpace(parts[0]))
+		if len(name) > 3 {
+			name = name[:3]
+		}
+		day, found := weekdayNames[name]
+		if !found {
+			return nil, fmt.Errorf("Unknown weekday '%s'", parts[0])
+		}
+		hours := strings.TrimSpace(parts[1])
+		if hours == "closed" {
+			result[day] = HourWindow{}
+			continue
+		}
+		window, err := ParseHourWindow(hours)
+		if err != nil {
+			return nil, err
+		}
+		result[day] = window
+	}
+	return result, nil
+}
+
+// A window that comes back every week, e.g. a volunteer's shift. Start and
+// End are the time since midnight of Day; End is beyond 24h for windows
+// that cross midnight, e.g. Friday 22:00..02:00.
+type RecurringWindow struct {
+	Day   time.Weekday
+	Start time.Duration
+	End   time.Duration
+}
+
+// Recurring windows of a user, in addition to their validity period.
+// Times are in the configured location, see SetLocation().
+type RecurringSchedule []RecurringWindow
+
+// Parse windows such as "tue 18:00-22:00;fri 22-2", separated by ';'. A
+// window ending at or before its start ends the next day.
+func ParseRecurringSchedule(spec string) (RecurringSchedule, error) {
+	var result RecurringSchedule
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Expected <day> <from>-<to>, got '%s'", entry)
+		}
+		name := strings.ToLower(fields[0])
+		if len(name) > 3 {
+			name = name[:3]
+		}
+		day, found := weekdayNames[name]
+		if !found {
+			return nil, fmt.Errorf("Unknown weekday '%s'", fields[0])
+		}
+		times := strings.Split(fields[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("Expected <from>-<to> times, got '%s'", fields[1])
+		}
+		start, err := parseTimeOfDay(times[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseTimeOfDay(times[1])
+		if err != nil {
+			return nil, err
+		}
+		if start == 24*time.Hour {
+			return nil, fmt.Errorf("Window can't start at 24:00 in '%s'", entry)
+		}
+		if end <= start {
+			end += 24 * time.Hour // Until the next day.
+		}
+		result = append(result, RecurringWindow{day, start, end})
+	}
+	return result, nil
+}
+
+// "18", "18:30" or "24" as time since midnight.
+func parseTimeOfDay(spec string) (time.Duration, error) {
+	parts := strings.Split(strings.TrimSpace(spec), ":")
+	if len(parts) > 2 {
+		return 0, fmt.Errorf("Invalid time '%s'", spec)
+	}
+	hour, err := strconv.Atoi(parts[0])
+	if err != nil || hour < 0 || hour > 24 {
+		return 0, fmt.Errorf("Invalid time '%s'", spec)
+	}
+	minute := 0
+	if len(parts) == 2 {
+		minute, err = strconv.Atoi(parts[1])
+		if err != nil || len(parts[1]) != 2 || minute < 0 || minute > 59 ||
+			(hour == 24 && minute > 0) {
+			return 0, fmt.Errorf("Invalid time '%s'", spec)
+		}
+	}
+	return time.Duration(hour)*time.Hour + time.Duration(minute)*time.Minute, nil
+}
+
+// Whether the time, in the location the schedule is meant for, is in one
+// of the windows. Uses the wall clock time, so windows keep their hours
+// across daylight saving changes.
+func (s RecurringSchedule) Contains(t time.Time) bool {
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	yesterday := (t.Weekday() + 6) % 7
+	for _, window := range s {
+		if window.Day == t.Weekday() && sinceMidnight >= window.Start && sinceMidnight < window.End {
+			return true
+		}
+		// The part after midnight of windows starting the day before.
+		if window.Day == yesterday && sinceMidnight+24*time.Hour < window.End {
+			return true
+		}
+	}
+	return false
+}
+
+// The end of the window that contains t, in the location of t. If windows
+// overlap, the one that ends last.
+func (s RecurringSchedule) EndOf(t time.Time) (time.Time, bool) {
+	if !s.Contains(t) {
+		return time.Time{}, false
+	}
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second
+	yesterday := (t.Weekday() + 6) % 7
+	var result time.Time
+	for _, window := range s {
+		var end time.Time
+		switch {
+		case window.Day == t.Weekday() && sinceMidnight >= window.Start && sinceMidnight < window.End:
+			end = midnight.Add(window.End)
+		case window.Day == yesterday && sinceMidnight+24*time.Hour < window.End:
+			end = midnight.Add(window.End - 24*time.Hour)
+		default:
+			continue
+		}
+		if end.After(result) {
+			result = end
+		}
+	}
+	return result, true
+}
+
+// As ParseRecurringSchedule() reads it.
+func (s RecurringSchedule) String() string {
+	entries := make([]string, len(s))
+	for i, window := range s {
+		end := window.End
+		if end > 24*time.Hour {
+			end -= 24 * time.Hour
+		}
+		entries[i] = fmt.Sprintf("%s %s-%s", window.Day.String()[:3],
+			formatTimeOfDay(window.Start), formatTimeOfDay(end))
+	}
+	return strings.Join(entries, ";")
+}
+
+func formatTimeOfDay(d time.Duration) string {
+	return fmt.Sprintf("%02d:%02d", int(d/time.Hour), int(d%time.Hour/time.Minute))
+}
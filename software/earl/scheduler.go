@@ -0,0 +1,147 @@
+// Simple scheduler to run callbacks at a given time.
+//
+// Time based features (expiring lockouts, temporary grants, ...) register
+// their callbacks here instead of each running their own timer goroutine.
+// The time is taken from a Clock, so tests can use a MockClock, move
+// the time forward and call RunDue() to deterministically fire callbacks
+// without sleeping.
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type ScheduledTaskId int
+
+type scheduledTask struct {
+	id       ScheduledTaskId
+	when     time.Time
+	callback func()
+}
+
+type Scheduler struct {
+	clock Clock
+
+	lock      sync.Mutex
+	tasks     []*scheduledTask // Sorted by time; same time: insertion order
+	nextId    ScheduledTaskId
+	isRunning bool      // background loop is running
+	isClosed  bool      // Close() has been called.
+	done      chan bool // Stop background loop
+}
+
+func NewScheduler(clock Clock) *Scheduler {
+	return &Scheduler{
+		clock: clock,
+		done:  make(chan bool),
+	}
+}
+
+// Schedule callback to be called at the given time. Returns an id that can
+// be used to Cancel() it again.
+// The callback is called from RunDue(), so it should return quickly.
+func (s *Scheduler) At(when time.Time, callback func()) ScheduledTaskId {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextId++
+	if s.isClosed {
+		return s.nextId // Shut down. Never called.
+	}
+	task := &scheduledTask{id: s.nextId, when: when, callback: callback}
+	pos := len(s.tasks)
+	for pos > 0 && s.tasks[pos-1].when.After(when) {
+		pos--
+	}
+	s.tasks = append(s.tasks, nil)
+	copy(s.tasks[pos+1:], s.tasks[pos:])
+	s.tasks[pos] = task
+	return task.id
+}
+
+// Schedule callback to be called after the given duration from now.
+func (s *Scheduler) After(d time.Duration, callback func()) ScheduledTaskId {
+	return s.At(s.clock.Now().Add(d), callback)
+}
+
+// Cancel a scheduled task. Returns true if it was still pending.
+func (s *Scheduler) Cancel(id ScheduledTaskId) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for i, task := range s.tasks {
+		if task.id == id {
+			s.tasks = append(s.tasks[:i], s.tasks[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Number of tasks still waiting to be run.
+func (s *Scheduler) Pending() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.tasks)
+}
+
+// Run all callbacks that are due by now, in the order of their scheduled
+// time. Returns the number of callbacks run.
+func (s *Scheduler) RunDue() int {
+	count := 0
+	for {
+		task := s.popDueTask(s.clock.Now())
+		if task == nil {
+			return count
+		}
+		task.callback() // Outside lock: callback might schedule again.
+		count++
+	}
+}
+
+func (s *Scheduler) popDueTask(now time.Time) *scheduledTask {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(s.tasks) == 0 || s.tasks[0].when.After(now) {
+		return nil
+	}
+	task := s.tasks[0]
+	s.tasks = s.tasks[1:]
+	return task
+}
+
+// Start a background goroutine that calls RunDue() every "tick". Calling
+// it multiple times has no effect.
+func (s *Scheduler) Start(tick time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isRunning || s.isClosed {
+		return
+	}
+	s.isRunning = true
+	go func() {
+		for {
+			select {
+			case <-s.done:
+				return
+			case <-time.After(tick):
+				s.RunDue()
+			}
+		}
+	}()
+}
+
+// Stop the background goroutine (if started) and discard all pending
+// tasks. Safe to call multiple times.
+func (s *Scheduler) Close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.isClosed {
+		return
+	}
+	s.isClosed = true
+	s.tasks = nil
+	if s.isRunning {
+		s.isRunning = false
+		close(s.done)
+	}
+}
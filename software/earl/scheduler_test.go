@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedulerRunsInOrder(t *testing.T) {
+	mockClock := &MockClock{}
+	start, _ := time.Parse("2006-01-02", "2014-10-10")
+	mockClock.now = start
+	scheduler := NewScheduler(mockClock)
+
+	fired := ""
+	scheduler.At(start.Add(3*time.Hour), func() { fired += "c" })
+	scheduler.At(start.Add(1*time.Hour), func() { fired += "a" })
+	scheduler.At(start.Add(2*time.Hour), func() { fired += "b" })
+	scheduler.At(start.Add(2*time.Hour), func() { fired += "B" }) // Same time: insertion order
+	cancelled := scheduler.At(start.Add(1*time.Hour), func() { fired += "X" })
+	ExpectTrue(t, scheduler.Cancel(cancelled), "Cancel pending task")
+	ExpectFalse(t, scheduler.Cancel(cancelled), "Cancel twice")
+
+	ExpectTrue(t, scheduler.RunDue() == 0, "Nothing due yet")
+
+	mockClock.now = start.Add(2 * time.Hour)
+	ExpectTrue(t, scheduler.RunDue() == 3, "Three tasks due")
+	ExpectTrue(t, fired == "abB", "Expected abB, got "+fired)
+
+	// Callbacks can schedule new things. This one runs before "c".
+	scheduler.After(30*time.Minute, func() {
+		fired += "d"
+		scheduler.After(time.Hour, func() { fired += "e" })
+	})
+	mockClock.now = start.Add(5 * time.Hour)
+	scheduler.RunDue()
+	ExpectTrue(t, fired == "abBdc", "Expected abBdc, got "+fired)
+	ExpectTrue(t, scheduler.Pending() == 1, "Newly scheduled e pending")
+	mockClock.now = start.Add(6 * time.Hour)
+	scheduler.RunDue()
+	ExpectTrue(t, fired == "abBdce", "Expected abBdce, got "+fired)
+}
+
+func TestSchedulerClose(t *testing.T) {
+	scheduler := NewScheduler(RealClock{})
+	scheduler.Close() // Never started: fine.
+
+	scheduler = NewScheduler(RealClock{})
+	fired := make(chan bool, 1)
+	scheduler.Start(time.Millisecond)
+	scheduler.Start(time.Millisecond) // idempotent
+	scheduler.After(0, func() { fired <- true })
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Errorf("Background scheduler did not fire")
+	}
+
+	scheduler.After(time.Hour, func() {})
+	scheduler.Close()
+	scheduler.Close()
+	ExpectTrue(t, scheduler.Pending() == 0, "Close discards pending tasks")
+	scheduler.After(0, func() { t.Errorf("Should never be called") })
+	ExpectTrue(t, scheduler.RunDue() == 0, "Nothing runs after close")
+}
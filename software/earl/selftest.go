@@ -0,0 +1,49 @@
+// Self-test at startup with a canary: a test-only user in the users file
+// whose plain code we know. If the pepper changed or the file got damaged,
+// the canary is not found any more, and we rather refuse to start than
+// find out when everyone is locked out.
+//
+// The canary is a user like any other, with "test-only" in field 18 of
+// its line in the users file (or test_only set in the database). It is
+// denied everywhere, so knowing its code gets nobody in.
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// Check that the canary code is found, by its hash, as a test-only user of
+// the given level, and that it is denied as test-only. Returns why not.
+func (a *FileBasedAuthenticator) SelfTest(canary_code string, level Level) error {
+	if !hasMinimalCodeRequirements(canary_code, a.minCodeLength) {
+		return fmt.Errorf("Canary code shorter than the %d characters codes need",
+			a.minCodeLength)
+	}
+	user := a.findUserSynchronized(canary_code, nil)
+	if user == nil {
+		return fmt.Errorf("Canary code not found in %v with hash %s...: "+
+			"changed pepper or damaged file?", a.store, a.pepper.hash(canary_code)[0:6])
+	}
+	if !user.TestOnly {
+		// Its code would be around in the configuration for anyone to use.
+		return fmt.Errorf("Canary code is of '%s', who is not test-only", a.pepper.logName(user.Name))
+	}
+	if user.UserLevel != level {
+		return fmt.Errorf("Canary '%s' is %s, expected %s", a.pepper.logName(user.Name),
+			user.UserLevel, level)
+	}
+	target := a.defaultTarget
+	if target == "" {
+		target = TargetDownstairs
+	}
+	// Through all the checks, without recording anything.
+	_, result, reason, msg := a.authUser(context.Background(), canary_code,
+		target, "", true)
+	if result != AuthFail || reason != AccessDeniedTestOnly {
+		return fmt.Errorf("Canary '%s' expected to be denied as %s, got %s: %s",
+			a.pepper.logName(user.Name), AccessDeniedTestOnly, reason, msg)
+	}
+	a.logger.Printf("Self-test passed with canary '%s'", a.pepper.logName(user.Name))
+	return nil
+}
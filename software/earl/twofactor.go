@@ -0,0 +1,134 @@
+// Two-factor authentication for sensitive targets: there, a user needs to
+// present both their card and their PIN within a short time. The first code
+// starts a pending authentication identified by a token, the second one
+// completes it.
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// What kind of code was presented; the terminal knows.
+type AuthFactor string
+
+const (
+	FactorCard    = AuthFactor("card")    // RFID
+	FactorPIN     = AuthFactor("pin")     // Typed on the keypad
+	FactorUnknown = AuthFactor("unknown") // Code of a user not known to be either
+)
+
+// Default time between first and second factor.
+const DefaultTwoFactorTimeout = 30 * time.Second
+
+// Upper bound of pending authentications we keep track of.
+const maxPendingAuths = 1000
+
+// Implemented by authenticators that support two factors. Terminals check
+// for it, so that simpler authenticators don't need to.
+type TwoFactorAuthenticator interface {
+	// Returns true if access to the target needs two factors.
+	NeedsTwoFactor(target Target) bool
+
+	// Start authentication with the first code. Returns a token to
+	// complete with CompleteAuth(), or an empty token and why not.
+	BeginAuth(code string, factor AuthFactor, target Target) (string, string)
+
+	// Complete a pending authentication with the second code, which
+	// has to be of the other factor and of the same user.
+	CompleteAuth(token string, code string, factor AuthFactor) (AuthResult, AuthReason, string)
+}
+
+// Identity of pending authentications with a first code that is unknown or
+// not of its factor. Matches no user, so they never complete.
+const unknownIdentity = "-"
+
+type pendingAuth struct {
+	identity string // See User.identity(); or unknownIdentity
+	code     string // As stored, so that it can't be the second factor too. Empty if unknown.
+	factor   AuthFactor
+	target   Target
+	expires  time.Time
+}
+
+type twoFactorTracker struct {
+	lock    sync.Mutex
+	targets map[Target]bool // Empty: no target needs two factors.
+	timeout time.Duration
+	pending map[string]*pendingAuth
+}
+
+func newTwoFactorTracker() *twoFactorTracker {
+	return &twoFactorTracker{
+		targets: make(map[Target]bool),
+		timeout: DefaultTwoFactorTimeout,
+		pending: make(map[string]*pendingAuth),
+	}
+}
+
+func (t *twoFactorTracker) configure(targets []Target, timeout time.Duration) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.targets = make(map[Target]bool)
+	for _, target := range targets {
+		t.targets[target] = true
+	}
+	t.timeout = timeout
+	t.pending = make(map[string]*pendingAuth)
+}
+
+func (t *twoFactorTracker) required(target Target) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.targets[target]
+}
+
+// Start a pending authentication. Returns an empty token if there are too
+// many already.
+func (t *twoFactorTracker) begin(identity string, code string, factor AuthFactor,
+	target Target, now time.Time) string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return ""
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if len(t.pending) >= maxPendingAuths {
+		t.evictRequiresLock(now)
+		if len(t.pending) >= maxPendingAuths {
+			return ""
+		}
+	}
+	key := hex.EncodeToString(token)
+	t.pending[key] = &pendingAuth{
+		identity: identity,
+		code:     code,
+		factor:   factor,
+		target:   target,
+		expires:  now.Add(t.timeout),
+	}
+	return key
+}
+
+// Returns the pending authentication for the token, or nil if there is none
+// or it expired. Either way, the token can't be used again.
+func (t *twoFactorTracker) take(token string, now time.Time) *pendingAuth {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	pending := t.pending[token]
+	delete(t.pending, token)
+	if pending == nil || !now.Before(pending.expires) {
+		return nil
+	}
+	return pending
+}
+
+func (t *twoFactorTracker) evictRequiresLock(now time.Time) {
+	for token, pending := range t.pending {
+		if !now.Before(pending.expires) {
+			delete(t.pending, token)
+		}
+	}
+}
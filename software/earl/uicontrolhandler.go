@@ -205,8 +205,9 @@ func (u *UIControlHandler) HandleRFID(rfid string) {
 		newUser := User{
 			Name:      userName,
 			UserLevel: LevelUser}
-		newUser.SetAuthCode(rfid)
-		if ok, msg := u.auth.AddNewUser(u.authUserCode, newUser); ok {
+		if err := newUser.setAuthCode(rfid, u.auth.MinCodeLength(), authCodePepper); err != nil {
+			u.t.WriteLCD(0, "Trouble: code "+err.Error())
+		} else if ok, msg := u.auth.AddNewUser(u.authUserCode, newUser); ok {
 			u.t.WriteLCD(0,
 				fmt.Sprintf("Success! += %s", userName))
 		} else {
@@ -0,0 +1,112 @@
+// What users do: when they last got access and how often, through which
+// target. For membership reviews, capacity planning and to notice a code
+// that is used suspiciously often. In memory only, so a restart starts over.
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Entries of a user since UsageStats.Since.
+type UserUsage struct {
+	Name      string
+	UserLevel Level
+	Entries   map[Target]int
+	Total     int
+	LastSeen  time.Time
+}
+
+type UsageStats struct {
+	Since time.Time   // When we started counting.
+	Users []UserUsage // Users that got access since, most entries first.
+}
+
+type userActivity struct {
+	lastSeen   time.Time
+	entries    map[Target]int
+	day        time.Time // Start of the day dayEntries are counted for.
+	dayEntries int
+}
+
+type activityTracker struct {
+	lock            sync.Mutex
+	since           time.Time
+	users           map[string]*userActivity // by User.identity()
+	maxDailyEntries int                      // 0: no alerts
+}
+
+func newActivityTracker(since time.Time) *activityTracker {
+	return &activityTracker{since: since, users: make(map[string]*userActivity)}
+}
+
+func (t *activityTracker) setMaxDailyEntries(max int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.maxDailyEntries = max
+}
+
+// Record an entry at the given time of the space. Returns the number of
+// entries of that user on that day, and true just when that got more than
+// the configured maximum.
+func (t *activityTracker) record(identity string, target Target, now time.Time) (int, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	activity := t.users[identity]
+	if activity == nil {
+		activity = &userActivity{entries: make(map[Target]int)}
+		t.users[identity] = activity
+	}
+	activity.lastSeen = now
+	activity.entries[target]++
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	if !day.Equal(activity.day) {
+		activity.day = day
+		activity.dayEntries = 0
+	}
+	activity.dayEntries++
+	return activity.dayEntries,
+		t.maxDailyEntries > 0 && activity.dayEntries == t.maxDailyEntries+1
+}
+
+func (t *activityTracker) lastSeen(identity string) (time.Time, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	activity := t.users[identity]
+	if activity == nil {
+		return time.Time{}, false
+	}
+	return activity.lastSeen, true
+}
+
+// Usage of the given users; those without entries are left out.
+func (t *activityTracker) stats(users []User) UsageStats {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	result := UsageStats{Since: t.since}
+	for _, user := range users {
+		if len(user.indexedCodes()) == 0 {
+			continue
+		}
+		activity := t.users[user.identity()]
+		if activity == nil {
+			continue
+		}
+		usage := UserUsage{
+			Name:      user.Name,
+			UserLevel: user.UserLevel,
+			Entries:   make(map[Target]int),
+			LastSeen:  activity.lastSeen,
+		}
+		for target, count := range activity.entries {
+			usage.Entries[target] = count
+			usage.Total += count
+		}
+		result.Users = append(result.Users, usage)
+	}
+	sort.SliceStable(result.Users, func(i, j int) bool {
+		return result.Users[i].Total > result.Users[j].Total
+	})
+	return result
+}
@@ -8,8 +8,14 @@
 package main
 
 import (
+	"crypto/md5"
 	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -42,6 +48,10 @@ const (
 	LevelPhilanthropist = Level("philanthropist")
 	// A philanthropist that has been granted the ability to add tokens by a member.
 	LevelTrustedPhilanthropist = Level("trustedphilanthropist")
+
+	// A visitor with a time-boxed pass, see AddGuest(). Only has access to
+	// the Targets of the pass.
+	LevelGuest = Level("guest")
 )
 
 const (
@@ -71,46 +81,351 @@ type User struct {
 	ValidFrom   time.Time // E.g. for temporary classes pin
 	ValidTo     time.Time // for anonymous tokens, day visitors or temp PIN
 	Codes       []string  // List of (hashed) codes associated with user
+
+	// When each of the Codes was issued; same order as Codes. Can be
+	// nil or have zero entries for codes issued before we tracked this.
+	CodeIssueDates []time.Time
+
+	// Whether each of the Codes is a card or a PIN, for rules such as
+	// cards at any time, PINs only during staffed hours. Same order as
+	// Codes; nil or missing entries for codes we don't know it of.
+	CodeTypes []AuthFactor
+
+	// Optional personal message added when this user is denied access,
+	// e.g. "See Bob about renewing your membership".
+	DenyMessage string
+
+	// When a badge for this user was last printed, and a fingerprint of
+	// the information printed on it. Zero/empty if never printed.
+	BadgePrinted     time.Time
+	BadgeFingerprint string
+
+	// Single-use codes, e.g. for deliveries, work only once. UsedAt is
+	// when that happened; zero if not used yet.
+	SingleUse bool
+	UsedAt    time.Time
+
+	// Targets guests have access to. Not used for other levels.
+	Targets []Target
+
+	// Codes that grant access just like the Codes, but raise a silent
+	// alarm, for someone forced to open the door. Hashed like Codes.
+	DuressCodes []string
+
+	// Personal access hours of regular and fulltime users, replacing
+	// those of their level, e.g. for a night-owl the members trust.
+	// nil to use the level's.
+	Hours *HourWindow
+
+	// Suspended by an operator: no access whatever the level and
+	// validity, which are kept for when the user is enabled again.
+	Disabled bool
+
+	// Recurring windows the user has access in, e.g. a volunteer's
+	// weekly shift, checked in addition to the validity period and the
+	// level's hours. nil for no such restriction.
+	Schedule RecurringSchedule
+
+	// A canary for SelfTest(): looked up like any user, but never let
+	// in anywhere.
+	TestOnly bool
+
+	// Rather not have their routine entries attributed: the audit log and
+	// the feed of access decisions name only their level. Security events,
+	// e.g. a duress code, still name them.
+	Anonymous bool
+}
+
+// Format of the timestamps we write. When reading, RFC3339 and plain dates
+// are accepted as well; see parseCSVTime().
+const csvTimeFormat = "2006-01-02 15:04"
+
+// Accepted when reading, tried in this order.
+var csvTimeLayouts = []string{csvTimeFormat, time.RFC3339, "2006-01-02"}
+
+// Number of fields every user line in the CSV has. Newer, optional fields
+// follow after these; older files without them are still read fine.
+const minCSVFields = 7
+
+// Files can start with a line telling the version of their layout, e.g.
+//
+//	earl-users-version,1
+//
+// so that a file with columns we don't know is rejected rather than
+// silently misread. Files without are version 0, the layout from before
+// versions, read leniently as always. The header is not a comment: older
+// programs skip it as a malformed user instead of missing it.
+const csvVersionHeader = "earl-users-version"
+
+// The version MigrateFile() writes.
+const CSVVersion = 4
+
+// Fields of the user records in each version; records with more are
+// from a newer layout. 0: no limit.
+var csvVersionFields = map[int]int{
+	0: 0,
+	1: 17,
+	2: 18, // Schedule
+	3: 19, // Test-only
+	4: 20, // Anonymous
+}
+
+// The version if the record is a version header. Errors for versions we
+// can't read.
+func parseCSVVersionHeader(record []string) (int, bool, error) {
+	if len(record) == 0 ||
+		strings.TrimSpace(strings.TrimPrefix(record[0], "\ufeff")) != csvVersionHeader {
+		return 0, false, nil
+	}
+	if len(record) < 2 {
+		return 0, true, fmt.Errorf("Version header without version")
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(record[1]))
+	if err != nil {
+		return 0, true, fmt.Errorf("Invalid version '%s' in header", record[1])
+	}
+	if _, known := csvVersionFields[version]; !known {
+		return 0, true, fmt.Errorf("User file is version %d; this program reads up to %d",
+			version, CSVVersion)
+	}
+	return version, true, nil
 }
 
 // User CSV
 // Fields are stored in the sequence as they appear in the struct, with arrays
 // being represented as semicolon separated lists.
-// Create a new user read from a CSV reader
-func NewUserFromCSV(reader *csv.Reader) (user *User, done bool) {
+// Create a new user read from a CSV reader. Returns an error for records
+// that are not even valid CSV.
+// Records that are meant to be users but can't be one, e.g. with too few
+// fields, return a *MalformedRecordError; reading can go on after these.
+// So do timestamps or schedules we can't make sense of: silently reading
+// those as unset could give access nobody intended.
+// Comments and blank lines return neither a user nor an error.
+// Reads the version 0 layout, see NewUserFromCSVVersion().
+func NewUserFromCSV(reader *csv.Reader) (user *User, done bool, err error) {
+	return NewUserFromCSVVersion(reader, 0)
+}
+
+// As NewUserFromCSV(), for files with the given version header.
+func NewUserFromCSVVersion(reader *csv.Reader, version int) (user *User, done bool, err error) {
+	maxFields, known := csvVersionFields[version]
+	if !known {
+		return nil, true, fmt.Errorf("Unknown user file version %d", version)
+	}
 	line, err := reader.Read()
+	if err == io.EOF {
+		return nil, true, nil
+	}
 	if err != nil {
-		return nil, true
+		return nil, true, err
+	}
+	// Files edited elsewhere might have a UTF-8 byte order mark in the
+	// beginning (which then is part of the first field) or whitespace
+	// padding around fields.
+	line[0] = strings.TrimPrefix(line[0], "\ufeff")
+	blank := true
+	for i := range line {
+		line[i] = strings.TrimSpace(line[i])
+		blank = blank && line[i] == ""
 	}
-	if len(line) != 7 {
-		return nil, false
+	// Comments are skipped by the reader, but not those after a byte
+	// order mark or padding.
+	firstElement := line[0]
+	if blank || (reader.Comment != 0 &&
+		strings.HasPrefix(firstElement, string(reader.Comment))) {
+		return nil, false, nil
 	}
-	// comment
-	firstElement := strings.TrimSpace(line[0])
-	if len(firstElement) > 0 && firstElement[0] == '#' {
-		return nil, false
+	malformed := func(reason string) error {
+		lineNo, _ := reader.FieldPos(0)
+		return &MalformedRecordError{Line: lineNo, Reason: reason}
+	}
+	if len(line) < minCSVFields {
+		return nil, false, malformed(fmt.Sprintf("only %d of %d fields",
+			len(line), minCSVFields))
+	}
+	if maxFields > 0 && len(line) > maxFields {
+		return nil, false, malformed(fmt.Sprintf("%d fields, but version %d has %d",
+			len(line), version, maxFields))
 	}
 	level := line[2]
-	ValidFrom, _ := time.Parse("2006-01-02 15:04", line[4])
-	ValidTo, _ := time.Parse("2006-01-02 15:04", line[5])
 	if !isValidLevel(level) {
-		log.Printf("Got invalid level '%s'", level)
-		return nil, false
+		return nil, false, malformed(fmt.Sprintf("invalid level '%s' of user '%s'",
+			level, logName(line[0])))
+	}
+	// Skip the record, like any malformed one, rather than fail the
+	// whole file; with the position of the field, for whoever fixes it.
+	timeError := func(field int, what string, err error) error {
+		lineNo, _ := reader.FieldPos(field)
+		return &MalformedRecordError{Line: lineNo,
+			Reason: fmt.Sprintf("%s of user '%s': %v", what, logName(line[0]), err)}
+	}
+	ValidFrom, err := parseCSVTime(line[4])
+	if err != nil {
+		return nil, false, timeError(4, "ValidFrom", err)
+	}
+	ValidTo, err := parseCSVTime(line[5])
+	if err != nil {
+		return nil, false, timeError(5, "ValidTo", err)
+	}
+	result := &User{
+		Name:        line[0],
+		ContactInfo: line[1],
+		UserLevel:   Level(level),
+		Sponsors:    splitTrimmed(line[3], ";"),
+		ValidFrom:   ValidFrom, // field 4
+		ValidTo:     ValidTo,   // field 5
+	}
+
+	// Codes in field 6, their (optional) issue dates in field 7 and
+	// types in field 16.
+	var issueDates, codeTypes []string
+	if len(line) > 7 && line[7] != "" {
+		issueDates = strings.Split(line[7], ";")
+	}
+	if len(line) > 16 && line[16] != "" {
+		codeTypes = strings.Split(line[16], ";")
 	}
-	return &User{
-			Name:        line[0],
-			ContactInfo: line[1],
-			UserLevel:   Level(level),
-			Sponsors:    strings.Split(line[3], ";"),
-			ValidFrom:   ValidFrom, // field 4
-			ValidTo:     ValidTo,   // field 5
-			Codes:       strings.Split(line[6], ";")},
-		false
+	for i, code := range strings.Split(line[6], ";") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			continue // e.g. user whose codes all have been revoked.
+		}
+		result.Codes = append(result.Codes, code)
+		var issued time.Time
+		if i < len(issueDates) {
+			issued, err = parseCSVTime(strings.TrimSpace(issueDates[i]))
+			if err != nil {
+				return nil, false, timeError(7, "code issue date", err)
+			}
+		}
+		result.CodeIssueDates = append(result.CodeIssueDates, issued)
+		if codeTypes != nil {
+			codeType := FactorUnknown
+			if i < len(codeTypes) {
+				codeType, err = parseCodeType(strings.TrimSpace(codeTypes[i]))
+				if err != nil {
+					return nil, false, timeError(16, "code type", err)
+				}
+			}
+			result.CodeTypes = append(result.CodeTypes, codeType)
+		}
+	}
+	if len(line) > 8 {
+		result.DenyMessage = line[8]
+	}
+	if len(line) > 9 && line[9] != "" {
+		// "<print date>;<fingerprint>"
+		badge := strings.SplitN(line[9], ";", 2)
+		result.BadgePrinted, err = parseCSVTime(strings.TrimSpace(badge[0]))
+		if err != nil {
+			return nil, false, timeError(9, "badge print date", err)
+		}
+		if len(badge) > 1 {
+			result.BadgeFingerprint = badge[1]
+		}
+	}
+	if len(line) > 10 {
+		if err = result.parseSingleUseField(line[10]); err != nil {
+			return nil, false, timeError(10, "single-use date", err)
+		}
+	}
+	if len(line) > 11 {
+		result.parseTargetsField(line[11])
+	}
+	if len(line) > 12 {
+		result.DuressCodes = parseCodeList(line[12])
+	}
+	if len(line) > 13 {
+		var to string
+		if len(line) > 14 {
+			to = line[14]
+		}
+		result.parseHoursFields(line[13], to)
+	}
+	if len(line) > 15 {
+		result.Disabled = line[15] == "disabled"
+	}
+	if len(line) > 17 && line[17] != "" {
+		// Not to be read as unset, which would give access at any time.
+		result.Schedule, err = ParseRecurringSchedule(line[17])
+		if err != nil {
+			return nil, false, timeError(17, "schedule", err)
+		}
+	}
+	if len(line) > 18 {
+		result.TestOnly = line[18] == "test-only"
+	}
+	if len(line) > 19 {
+		result.Anonymous = line[19] == "anonymous"
+	}
+	return result, false, nil
+}
+
+// A record in the CSV that is skipped as it is not a valid user.
+type MalformedRecordError struct {
+	File   string // Only set by stores with several files.
+	Line   int    // 1-based, in the file.
+	Reason string
+}
+
+func (e *MalformedRecordError) Error() string {
+	if e.File != "" {
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Reason)
+	}
+	return fmt.Sprintf("line %d: %s", e.Line, e.Reason)
+}
+
+// Parse a timestamp in any of the csvTimeLayouts; empty is the zero time.
+// Times with a zone are converted to UTC, which is what the legacy format
+// without zone is read as, and to the precision of csvTimeFormat, so that
+// writing them back doesn't change them.
+func parseCSVTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	for _, layout := range csvTimeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.UTC().Truncate(time.Minute), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("can't parse time '%s'; expected e.g. "+
+		"'2014-10-10 12:00', '2014-10-10T12:00:00+02:00' or '2014-10-10'", value)
+}
+
+// "card", "pin", or empty or "unknown" if not known.
+func parseCodeType(value string) (AuthFactor, error) {
+	switch AuthFactor(value) {
+	case FactorCard, FactorPIN:
+		return AuthFactor(value), nil
+	case "", FactorUnknown:
+		return FactorUnknown, nil
+	}
+	return FactorUnknown, fmt.Errorf("invalid '%s'; expected card or pin", value)
+}
+
+// Like strings.Split(), but with whitespace around each element removed.
+func splitTrimmed(s string, sep string) []string {
+	result := strings.Split(s, sep)
+	for i := range result {
+		result[i] = strings.TrimSpace(result[i])
+	}
+	return result
+}
+
+// Semicolon separated codes; nil if there are none.
+func parseCodeList(field string) []string {
+	var result []string
+	for _, code := range splitTrimmed(field, ";") {
+		if code != "" {
+			result = append(result, code)
+		}
+	}
+	return result
 }
 
 func isValidLevel(input string) bool {
 	switch input {
-	case "member", "user", "fulltimeuser", "hiatus", "philanthropist", "trustedphilanthropist":
+	case "member", "user", "fulltimeuser", "hiatus", "philanthropist", "trustedphilanthropist", "guest":
 		return true
 	default:
 		return false
@@ -125,15 +440,270 @@ func (user *User) WriteCSV(writer *csv.Writer) {
 	fields[2] = string(user.UserLevel)
 	fields[3] = strings.Join(user.Sponsors, ";")
 	if !user.ValidFrom.IsZero() {
-		fields[4] = user.ValidFrom.Format("2006-01-02 15:04")
+		fields[4] = user.ValidFrom.Format(csvTimeFormat)
 	}
 	if !user.ValidTo.IsZero() {
-		fields[5] = user.ValidTo.Format("2006-01-02 15:04")
+		fields[5] = user.ValidTo.Format(csvTimeFormat)
 	}
 	fields[6] = strings.Join(user.Codes, ";")
+
+	// Optional fields. Only emitted if there is something to say, so that
+	// files stay readable by older versions as long as possible.
+	issueDates := make([]string, len(user.Codes))
+	haveIssueDates := false
+	for i := range user.Codes {
+		if issued := user.CodeIssueDate(i); !issued.IsZero() {
+			issueDates[i] = issued.Format(csvTimeFormat)
+			haveIssueDates = true
+		}
+	}
+	if haveIssueDates {
+		fields = append(fields, strings.Join(issueDates, ";")) // field 7
+	} else {
+		fields = append(fields, "")
+	}
+	fields = append(fields, user.DenyMessage) // field 8
+	if !user.BadgePrinted.IsZero() {
+		fields = append(fields, user.BadgePrinted.Format(csvTimeFormat)+
+			";"+user.BadgeFingerprint) // field 9
+	} else {
+		fields = append(fields, "")
+	}
+	fields = append(fields, user.singleUseField())               // field 10
+	fields = append(fields, user.targetsField())                 // field 11
+	fields = append(fields, strings.Join(user.DuressCodes, ";")) // field 12
+	if user.Hours != nil {
+		fields = append(fields, strconv.Itoa(user.Hours.From), // field 13
+			strconv.Itoa(user.Hours.To)) // field 14
+	} else {
+		fields = append(fields, "", "")
+	}
+	if user.Disabled {
+		fields = append(fields, "disabled") // field 15
+	} else {
+		fields = append(fields, "")
+	}
+	fields = append(fields, user.codeTypesField())  // field 16
+	fields = append(fields, user.Schedule.String()) // field 17
+	if user.TestOnly {
+		fields = append(fields, "test-only") // field 18
+	} else {
+		fields = append(fields, "")
+	}
+	if user.Anonymous {
+		fields = append(fields, "anonymous") // field 19
+	} else {
+		fields = append(fields, "")
+	}
+
+	// Trim empty optional fields at the end.
+	for len(fields) > minCSVFields && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
 	writer.Write(fields)
 }
 
+// "once" for single-use codes, "once;<used date>" if used. Empty otherwise.
+func (user *User) singleUseField() string {
+	if !user.SingleUse {
+		return ""
+	}
+	if user.UsedAt.IsZero() {
+		return "once"
+	}
+	return "once;" + user.UsedAt.Format(csvTimeFormat)
+}
+
+func (user *User) parseSingleUseField(field string) (err error) {
+	parts := strings.SplitN(field, ";", 2)
+	user.SingleUse = strings.TrimSpace(parts[0]) == "once"
+	if user.SingleUse && len(parts) > 1 {
+		user.UsedAt, err = parseCSVTime(strings.TrimSpace(parts[1]))
+	}
+	return err
+}
+
+// Personal access hours: first hour with access and first hour without.
+// Both empty to use the level's; anything else that is not a valid window
+// is ignored, so the user keeps the hours of their level.
+func (user *User) parseHoursFields(from string, to string) {
+	user.Hours = nil
+	if from == "" && to == "" {
+		return
+	}
+	start, err := strconv.Atoi(from)
+	if err == nil {
+		var end int
+		if end, err = strconv.Atoi(to); err == nil {
+			err = validateHours("user "+user.Name, start, end)
+			if err == nil {
+				user.Hours = &HourWindow{start, end}
+				return
+			}
+		}
+	}
+	log.Printf("Ignoring personal hours '%s'-'%s' of '%s': %v",
+		from, to, logName(user.Name), err)
+}
+
+// Targets, semicolon separated.
+func (user *User) targetsField() string {
+	targets := make([]string, len(user.Targets))
+	for i, target := range user.Targets {
+		targets[i] = string(target)
+	}
+	return strings.Join(targets, ";")
+}
+
+func (user *User) parseTargetsField(field string) {
+	user.Targets = nil
+	for _, target := range splitTrimmed(field, ";") {
+		if target != "" {
+			user.Targets = append(user.Targets, Target(target))
+		}
+	}
+}
+
+func (user *User) HasTarget(target Target) bool {
+	for _, t := range user.Targets {
+		if t == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Return the issue date of the code at the given index in Codes. Zero time
+// if not known.
+func (user *User) CodeIssueDate(index int) time.Time {
+	if index < 0 || index >= len(user.CodeIssueDates) {
+		return time.Time{}
+	}
+	return user.CodeIssueDates[index]
+}
+
+// Type of the code at the given index in Codes; FactorUnknown if not known.
+func (user *User) CodeType(index int) AuthFactor {
+	if index < 0 || index >= len(user.CodeTypes) || user.CodeTypes[index] == "" {
+		return FactorUnknown
+	}
+	return user.CodeTypes[index]
+}
+
+// Semicolon separated types of the codes, empty if none is known.
+func (user *User) codeTypesField() string {
+	types := make([]string, len(user.Codes))
+	known := false
+	for i := range user.Codes {
+		if codeType := user.CodeType(i); codeType != FactorUnknown {
+			types[i] = string(codeType)
+			known = true
+		}
+	}
+	if !known {
+		return ""
+	}
+	return strings.Join(types, ";")
+}
+
+// Update CodeIssueDates to match the current Codes. Codes that already
+// existed in the "previous" version of the user (can be nil) keep their date,
+// all others are regarded as issued "now". CodeTypes that don't match the
+// Codes anymore, e.g. after adding a code, get the types of the previous
+// version by code as well; new codes are of unknown type.
+func (user *User) stampCodeIssueDates(previous *User, now time.Time) {
+	knownDates := make(map[string]time.Time)
+	if previous != nil {
+		for i, code := range previous.Codes {
+			knownDates[code] = previous.CodeIssueDate(i)
+		}
+	}
+	dates := make([]time.Time, len(user.Codes))
+	for i, code := range user.Codes {
+		if issued, found := knownDates[code]; found {
+			dates[i] = issued
+		} else {
+			dates[i] = now
+		}
+	}
+	user.CodeIssueDates = dates
+
+	if len(user.CodeTypes) == len(user.Codes) || previous == nil {
+		return
+	}
+	knownTypes := make(map[string]AuthFactor)
+	for i, code := range previous.Codes {
+		knownTypes[code] = previous.CodeType(i)
+	}
+	var types []AuthFactor
+	for i, code := range user.Codes {
+		if codeType, found := knownTypes[code]; found && codeType != FactorUnknown {
+			if types == nil {
+				types = make([]AuthFactor, len(user.Codes))
+				for j := range types {
+					types[j] = FactorUnknown
+				}
+			}
+			types[i] = codeType
+		}
+	}
+	user.CodeTypes = types
+}
+
+// Short fingerprint of the information we print on a badge.
+func (user *User) badgeFingerprint() string {
+	hashgen := md5.New()
+	io.WriteString(hashgen, user.Name+"\n"+string(user.UserLevel))
+	return hex.EncodeToString(hashgen.Sum(nil))[0:8]
+}
+
+// Copy of the user that shares no slices with the original.
+func (user *User) deepCopy() User {
+	result := *user
+	result.Sponsors = append([]string(nil), user.Sponsors...)
+	result.Codes = append([]string(nil), user.Codes...)
+	result.CodeIssueDates = append([]time.Time(nil), user.CodeIssueDates...)
+	result.CodeTypes = append([]AuthFactor(nil), user.CodeTypes...)
+	result.Targets = append([]Target(nil), user.Targets...)
+	result.DuressCodes = append([]string(nil), user.DuressCodes...)
+	if user.Hours != nil {
+		hours := *user.Hours
+		result.Hours = &hours
+	}
+	result.Schedule = append(RecurringSchedule(nil), user.Schedule...)
+	return result
+}
+
+// Remove all code material: codes and sponsors, which are hashed codes as
+// well. The issue dates still tell how many codes the user has.
+func (user *User) stripCodes() {
+	if len(user.CodeIssueDates) < len(user.Codes) {
+		user.CodeIssueDates = append(user.CodeIssueDates,
+			make([]time.Time, len(user.Codes)-len(user.CodeIssueDates))...)
+	}
+	user.Codes = nil
+	user.DuressCodes = nil
+	user.Sponsors = nil
+}
+
+// Returns true if the user never had a badge printed or the information on
+// it is outdated.
+func (user *User) NeedsBadgePrint() bool {
+	return user.BadgePrinted.IsZero() ||
+		user.BadgeFingerprint != user.badgeFingerprint()
+}
+
+func (user *User) MarkBadgePrinted(now time.Time) {
+	user.BadgePrinted = now
+	user.BadgeFingerprint = user.badgeFingerprint()
+}
+
+// A user that doesn't have any codes (anymore), e.g. because they have
+// been revoked, needs new codes to be issued to be able to get in.
+func (user *User) NeedsCodeReissue() bool {
+	return len(user.Codes) == 0
+}
+
 // We regard a user to be able to contact if they have a name and contact data
 func (user *User) HasContactInfo() bool {
 	// Names that start with '<' are auto-generated by
@@ -151,12 +721,12 @@ func (user *User) InValidityPeriod(now time.Time) bool {
 
 // Return when code expires. If the returned date IsZero(), there is no limit.
 // Even if there is no explicit user.ValidTo
-// limited when there is no contact info 30 days after creation
+// limited when there is no contact info 30 days after creation; without a
+// start date, that is in the past (logged when loading).
 func (user *User) ExpiryDate(now time.Time) time.Time {
 	result := user.ValidTo
 	if !user.HasContactInfo() {
 		if user.ValidFrom.IsZero() {
-			log.Println("No start-date for temp code.")
 			return now.Add(-24 * time.Hour) // in the past
 		}
 		anonLimit := user.ValidFrom.Add(ValidityPeriodAnonymousCards)
@@ -169,32 +739,86 @@ func (user *User) ExpiryDate(now time.Time) time.Time {
 
 // Returns the interval in hours this user may open doors. Includes from,
 // excludes to [from...to). So (7, 22) means >= 7:00 && < 22
+// Regular and fulltime users might have personal Hours instead.
 func (user *User) AccessHours() (from int, to int) {
+	if user.Hours != nil && hasPersonalHours(user.UserLevel) {
+		return user.Hours.From, user.Hours.To
+	}
 	switch user.UserLevel {
 	case LevelMember:
 		return 0, 24 // all access
 	case LevelPhilanthropist, LevelTrustedPhilanthropist:
 		return 0, 24 // all access
+	case LevelGuest:
+		return 0, 24 // limited by validity of the pass instead.
 	case LevelFulltimeUser:
 		return 7, 24 // 7:00 .. 23:59
 	case LevelUser:
 		return 10, 23 // 10:00 .. 22:59
 	}
-	// TODO: for time-restricted users such as users for classes,
-	// we can have custom hours here that don't depend on the UserLevel
-
 	return 0, 0 // no access.
 }
 
+// Levels whose access hours can be set per user. The others have access
+// all day, or not at all.
+func hasPersonalHours(l Level) bool {
+	return l == LevelUser || l == LevelFulltimeUser
+}
+
 // Set the auth code to some value (should probably be add-auth-code)
-// Returns true if code is long enough to meet criteria.
+// Returns true if code is long enough to meet criteria, see
+// checkCodeStrength(), with the DefaultMinCodeLength.
 // (todo: right now we only set one code, but we need something like add)
 func (user *User) SetAuthCode(code string) bool {
-	if !hasMinimalCodeRequirements(code) {
-		return false
+	return user.setAuthCode(code, DefaultMinCodeLength, authCodePepper) == nil
+}
+
+// Like SetAuthCode(), but with the minimum length and pepper of the
+// authenticator. Tells why the code is not good enough.
+func (user *User) setAuthCode(code string, minLength int, pepper codePepper) error {
+	if err := checkCodeStrength(code, minLength); err != nil {
+		return err
+	}
+	user.Codes = []string{pepper.hash(code)}
+	user.CodeIssueDates = nil // Will be stamped when stored.
+	user.CodeTypes = nil
+	return nil
+}
+
+// Set the duress code, which has to be different from the regular code.
+// Returns true if it is good enough, see SetAuthCode().
+func (user *User) SetDuressCode(code string) bool {
+	return user.setDuressCode(code, DefaultMinCodeLength, authCodePepper) == nil
+}
+
+// Like SetDuressCode(), but with the minimum length and pepper of the
+// authenticator. Tells why the code is not good enough.
+func (user *User) setDuressCode(code string, minLength int, pepper codePepper) error {
+	if err := checkCodeStrength(code, minLength); err != nil {
+		return err
+	}
+	hashed := pepper.hash(code)
+	for _, existing := range user.Codes {
+		if existing == hashed {
+			return errors.New("same as the regular code")
+		}
 	}
-	user.Codes = []string{hashAuthCode(code)}
-	return true
+	user.DuressCodes = []string{hashed}
+	return nil
+}
+
+// Identifies the user across copies and reloads. Codes are unique, so
+// the first one does. Only for users that have codes.
+func (user *User) identity() string {
+	return user.indexedCodes()[0]
+}
+
+// All codes that identify this user, regular and duress.
+func (user *User) indexedCodes() []string {
+	if len(user.DuressCodes) == 0 {
+		return user.Codes
+	}
+	return append(append([]string(nil), user.Codes...), user.DuressCodes...)
 }
 
 func CanLevelModify(l Level) bool {
@@ -206,6 +830,11 @@ func CanLevelModify(l Level) bool {
 	return false
 }
 
+// Operations affecting many users at once are reserved for members.
+func CanLevelAdminister(l Level) bool {
+	return l == LevelMember
+}
+
 func CanLevelAddDelete(l Level) bool {
 	switch l {
 	case LevelMember, LevelTrustedPhilanthropist:
@@ -0,0 +1,259 @@
+// A JSON snapshot of all users, for backups and moving users between
+// instances with tools other than a CSV editor. Unlike the CSV, fields are
+// named and times are RFC 3339, e.g.
+//
+//	{
+//	  "version": 1,
+//	  "exported": "2024-05-01T12:00:00Z",
+//	  "users": [
+//	    {
+//	      "name": "Jon",
+//	      "contact_info": "jon@example.com",
+//	      "level": "member",
+//	      "sponsors": ["9af1..."],
+//	      "valid_from": "2024-01-01T00:00:00Z",
+//	      "codes": [{"hash": "5f4d...", "issued": "2024-01-01T00:00:00Z", "type": "card"}]
+//	    }
+//	  ]
+//	}
+//
+// Codes are hashed as in the store; the snapshot has no plain codes, but
+// is as sensitive as the users file. Fields that are not set are left out.
+// Readers should reject versions they don't know; new fields that older
+// readers can ignore don't change the version.
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const UserExportVersion = 1
+
+type userExport struct {
+	Version  int        `json:"version"`
+	Exported time.Time  `json:"exported"`
+	Users    []jsonUser `json:"users"`
+}
+
+type jsonUser struct {
+	Name             string      `json:"name,omitempty"`
+	ContactInfo      string      `json:"contact_info,omitempty"`
+	Level            Level       `json:"level"`
+	Sponsors         []string    `json:"sponsors,omitempty"`
+	ValidFrom        *time.Time  `json:"valid_from,omitempty"`
+	ValidTo          *time.Time  `json:"valid_to,omitempty"`
+	Codes            []jsonCode  `json:"codes"`
+	DuressCodes      []string    `json:"duress_codes,omitempty"`
+	DenyMessage      string      `json:"deny_message,omitempty"`
+	BadgePrinted     *time.Time  `json:"badge_printed,omitempty"`
+	BadgeFingerprint string      `json:"badge_fingerprint,omitempty"`
+	SingleUse        bool        `json:"single_use,omitempty"`
+	UsedAt           *time.Time  `json:"used_at,omitempty"`
+	Targets          []Target    `json:"targets,omitempty"`
+	Hours            *HourWindow `json:"hours,omitempty"`
+	Disabled         bool        `json:"disabled,omitempty"`
+	Schedule         string      `json:"schedule,omitempty"` // e.g. "Tue 18:00-22:00"
+	TestOnly         bool        `json:"test_only,omitempty"`
+	Anonymous        bool        `json:"anonymous,omitempty"`
+}
+
+type jsonCode struct {
+	Hash   string     `json:"hash"`
+	Issued *time.Time `json:"issued,omitempty"`
+	Type   AuthFactor `json:"type,omitempty"`
+}
+
+// nil for the zero time, so that it is left out.
+func jsonTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	t = t.UTC()
+	return &t
+}
+
+func fromJSONTime(t *time.Time) time.Time {
+	if t == nil {
+		return time.Time{}
+	}
+	return *t
+}
+
+func newJSONUser(user *User) jsonUser {
+	result := jsonUser{
+		Name:             user.Name,
+		ContactInfo:      user.ContactInfo,
+		Level:            user.UserLevel,
+		Sponsors:         user.Sponsors,
+		ValidFrom:        jsonTime(user.ValidFrom),
+		ValidTo:          jsonTime(user.ValidTo),
+		Codes:            make([]jsonCode, len(user.Codes)),
+		DuressCodes:      user.DuressCodes,
+		DenyMessage:      user.DenyMessage,
+		BadgePrinted:     jsonTime(user.BadgePrinted),
+		BadgeFingerprint: user.BadgeFingerprint,
+		SingleUse:        user.SingleUse,
+		UsedAt:           jsonTime(user.UsedAt),
+		Targets:          user.Targets,
+		Hours:            user.Hours,
+		Disabled:         user.Disabled,
+		Schedule:         user.Schedule.String(),
+		TestOnly:         user.TestOnly,
+		Anonymous:        user.Anonymous,
+	}
+	for i, code := range user.Codes {
+		result.Codes[i] = jsonCode{Hash: code, Issued: jsonTime(user.CodeIssueDate(i))}
+		if codeType := user.CodeType(i); codeType != FactorUnknown {
+			result.Codes[i].Type = codeType
+		}
+	}
+	return result
+}
+
+func (u *jsonUser) user() (User, error) {
+	if !isValidLevel(string(u.Level)) {
+		return User{}, fmt.Errorf("invalid level '%s'", u.Level)
+	}
+	result := User{
+		Name:             u.Name,
+		ContactInfo:      u.ContactInfo,
+		UserLevel:        u.Level,
+		Sponsors:         u.Sponsors,
+		ValidFrom:        fromJSONTime(u.ValidFrom),
+		ValidTo:          fromJSONTime(u.ValidTo),
+		DuressCodes:      u.DuressCodes,
+		DenyMessage:      u.DenyMessage,
+		BadgePrinted:     fromJSONTime(u.BadgePrinted),
+		BadgeFingerprint: u.BadgeFingerprint,
+		SingleUse:        u.SingleUse,
+		UsedAt:           fromJSONTime(u.UsedAt),
+		Targets:          u.Targets,
+		Hours:            u.Hours,
+		Disabled:         u.Disabled,
+		TestOnly:         u.TestOnly,
+		Anonymous:        u.Anonymous,
+	}
+	schedule, err := ParseRecurringSchedule(u.Schedule)
+	if err != nil {
+		return User{}, err
+	}
+	result.Schedule = schedule
+	typed := false
+	codeTypes := make([]AuthFactor, len(u.Codes))
+	for i, code := range u.Codes {
+		switch code.Type {
+		case "", FactorUnknown:
+			codeTypes[i] = FactorUnknown
+		case FactorCard, FactorPIN:
+			codeTypes[i], typed = code.Type, true
+		default:
+			return User{}, fmt.Errorf("invalid code type '%s'", code.Type)
+		}
+		result.Codes = append(result.Codes, code.Hash)
+		result.CodeIssueDates = append(result.CodeIssueDates, fromJSONTime(code.Issued))
+	}
+	if typed {
+		result.CodeTypes = codeTypes
+	}
+	if len(result.Codes) == 0 {
+		return User{}, fmt.Errorf("no code")
+	}
+	for i, code := range result.indexedCodes() {
+		if !isHashedCode(code) {
+			return User{}, fmt.Errorf("code %d is not hashed", i+1)
+		}
+	}
+	return result, nil
+}
+
+// Write all users as a JSON snapshot, see above.
+func (a *FileBasedAuthenticator) ExportJSON(w io.Writer) error {
+	users := a.ListUsers()
+	export := userExport{
+		Version:  UserExportVersion,
+		Exported: a.clock.Now().UTC(),
+		Users:    make([]jsonUser, len(users)),
+	}
+	for i := range users {
+		export.Users[i] = newJSONUser(&users[i])
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(export)
+}
+
+// Add the users of a snapshot written by ExportJSON(), e.g. to restore a
+// backup into an empty instance. Unlike ImportUsers(), users are taken as
+// they are, with their sponsors, validity and issue dates. Only members
+// can do that. If a code of the snapshot is already someone's, or in the
+// snapshot twice, nothing is imported: merging would need someone to
+// decide who keeps the code.
+func (a *FileBasedAuthenticator) ImportJSON(authentication_code string, r io.Reader) error {
+	if auth_ok, auth_msg := a.verifyOpAllowed(authentication_code, CanLevelAdminister); !auth_ok {
+		return fmt.Errorf("%s", auth_msg)
+	}
+	var export userExport
+	if err := json.NewDecoder(r).Decode(&export); err != nil {
+		return fmt.Errorf("Reading snapshot: %v", err)
+	}
+	if export.Version < 1 || export.Version > UserExportVersion {
+		return fmt.Errorf("Snapshot version %d not supported; expected up to %d",
+			export.Version, UserExportVersion)
+	}
+	var conflicts []string
+	var batch []*User
+	batchCodes := make(map[string]*User)
+	for i := range export.Users {
+		user, err := export.Users[i].user()
+		if err != nil {
+			return fmt.Errorf("User %d '%s': %v", i+1, export.Users[i].Name, err)
+		}
+		if code, owner := a.codeOwnerSynchronized(&user); owner != nil {
+			conflicts = append(conflicts, duplicateCodeMessage(&user, code, owner))
+			continue
+		}
+		for _, code := range user.indexedCodes() {
+			if owner := batchCodes[code]; owner != nil {
+				conflicts = append(conflicts,
+					duplicateCodeMessage(&user, code, owner)+" (in this snapshot)")
+				break
+			}
+			batchCodes[code] = &user
+		}
+		batch = append(batch, &user)
+	}
+	if len(conflicts) > 0 {
+		return fmt.Errorf("Conflicting codes, nothing imported: %s",
+			strings.Join(conflicts, " "))
+	}
+
+	// Someone might have added codes since we checked.
+	var added []*User
+	rollback := func() {
+		for _, user := range added {
+			a.removeUserSynchronized(user)
+		}
+	}
+	for _, user := range batch {
+		if code, owner := a.addUserSynchronized(user); owner != nil {
+			rollback()
+			return fmt.Errorf("Conflicting codes, nothing imported: %s",
+				duplicateCodeMessage(user, code, owner))
+		}
+		added = append(added, user)
+	}
+	if ok, msg := a.writeAllUsers(); !ok {
+		rollback()
+		return fmt.Errorf("Could not write imported users: %s", msg)
+	}
+	for _, user := range added {
+		a.auditUserChange(AppUserAdded, authentication_code, user)
+		a.postUserEvent(AppUserAdded, user)
+	}
+	a.logger.Printf("Imported %d users from JSON snapshot", len(added))
+	return nil
+}
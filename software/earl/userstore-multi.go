@@ -0,0 +1,415 @@
+// Users split across several CSV files, e.g. one per team, or one for
+// the permanent members and one for guests. Each file is a CSVUserStore of
+// its own, so comments survive rewrites as usual; users are written back
+// to the file they came from.
+//
+// A code in two files can belong to users of different levels, e.g. a
+// member in the board's file who is still a guest in a stale guest file.
+// What to do about that is up to the ConflictPolicy.
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What to do about users of different levels in different files with a
+// code in common.
+type ConflictPolicy int
+
+const (
+	// The user of the first file keeps the code; the other one is skipped
+	// as a duplicate code, just like in a single file.
+	ConflictFirstFileWins ConflictPolicy = iota
+
+	// The user of the higher level is kept, see levelRank.
+	ConflictHighestLevelWins
+
+	// Don't load: the users we have stay, and the failed reload alerts.
+	ConflictReject
+)
+
+var conflictPolicyNames = map[ConflictPolicy]string{
+	ConflictFirstFileWins:    "first-file-wins",
+	ConflictHighestLevelWins: "highest-level-wins",
+	ConflictReject:           "reject",
+}
+
+func (p ConflictPolicy) String() string {
+	return conflictPolicyNames[p]
+}
+
+func ParseConflictPolicy(name string) (ConflictPolicy, error) {
+	for policy, policyName := range conflictPolicyNames {
+		if name == policyName {
+			return policy, nil
+		}
+	}
+	return ConflictFirstFileWins, fmt.Errorf(
+		"Expected first-file-wins, highest-level-wins or reject, got '%s'", name)
+}
+
+// Order of levels for ConflictHighestLevelWins. Hiatus ranks above all, so
+// that a stale file doesn't undo a block.
+var levelRank = map[Level]int{
+	LevelGuest:                 1,
+	LevelUser:                  2,
+	LevelFulltimeUser:          3,
+	LevelPhilanthropist:        4,
+	LevelTrustedPhilanthropist: 5,
+	LevelMember:                6,
+	LevelHiatus:                7,
+}
+
+type MultiFileUserStore struct {
+	patterns  []string // Filenames or globs such as "users.d/*.csv".
+	comma     rune
+	comment   rune
+	backups   int
+	newUsers  string // File new users are added to; empty for the last one.
+	conflicts ConflictPolicy
+
+	stores map[string]*CSVUserStore // By filename.
+	files  []string                 // As of the last Load(), in order.
+	origin map[string]string        // Filename by user name and by code.
+	report LoadReport
+}
+
+// Users in the given files. Patterns with glob characters are expanded on
+// each load, so files added to a directory are picked up on reload.
+func NewMultiFileUserStore(patterns ...string) *MultiFileUserStore {
+	return &MultiFileUserStore{
+		patterns: patterns,
+		comma:    ',',
+		comment:  '#',
+		stores:   make(map[string]*CSVUserStore),
+		origin:   make(map[string]string),
+	}
+}
+
+func (s *MultiFileUserStore) String() string {
+	return strings.Join(s.patterns, ",")
+}
+
+// Same as CSVUserStore.SetDelimiter(), for all files.
+func (s *MultiFileUserStore) SetDelimiter(comma rune, comment rune) error {
+	if err := validateCSVDelimiter(comma, comment); err != nil {
+		return err
+	}
+	s.comma = comma
+	s.comment = comment
+	for _, store := range s.stores {
+		store.SetDelimiter(comma, comment)
+	}
+	return nil
+}
+
+// Same as CSVUserStore.SetBackups(), for each of the files.
+func (s *MultiFileUserStore) SetBackups(keep int) {
+	s.backups = keep
+	for _, store := range s.stores {
+		store.SetBackups(keep)
+	}
+}
+
+// Same as CSVUserStore.Migrate(), for each of the files.
+func (s *MultiFileUserStore) Migrate() error {
+	files, err := s.filenames()
+	if err != nil {
+		return err
+	}
+	for _, filename := range files {
+		if err := s.storeFor(filename).Migrate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// File that users added with Append() or ReplaceAll() go to, e.g. the one
+// for guests. By default, it is the last of the files.
+func (s *MultiFileUserStore) SetNewUserFile(filename string) {
+	s.newUsers = filename
+}
+
+// How to resolve level conflicts between the files; first-file-wins by
+// default.
+func (s *MultiFileUserStore) SetConflictPolicy(policy ConflictPolicy) {
+	s.conflicts = policy
+}
+
+// The files matching the patterns, in order, each only once.
+func (s *MultiFileUserStore) filenames() ([]string, error) {
+	var result []string
+	seen := make(map[string]bool)
+	for _, pattern := range s.patterns {
+		matches := []string{pattern}
+		if strings.ContainsAny(pattern, "*?[") {
+			var err error
+			if matches, err = filepath.Glob(pattern); err != nil {
+				return nil, err
+			}
+		}
+		for _, filename := range matches {
+			if !seen[filename] {
+				seen[filename] = true
+				result = append(result, filename)
+			}
+		}
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("No user files match %v", s)
+	}
+	return result, nil
+}
+
+func (s *MultiFileUserStore) storeFor(filename string) *CSVUserStore {
+	store := s.stores[filename]
+	if store == nil {
+		store = NewCSVUserStore(filename)
+		store.SetDelimiter(s.comma, s.comment)
+		store.SetBackups(s.backups)
+		s.stores[filename] = store
+	}
+	return store
+}
+
+// Load the users of all files. Fails if any of the files fails, as we'd
+// rather keep the users we have than lose a whole team.
+func (s *MultiFileUserStore) Load() ([]*User, error) {
+	files, err := s.filenames()
+	if err != nil {
+		return nil, err
+	}
+	var result []*User
+	origin := make(map[string]string)
+	report := LoadReport{lines: make(map[*User]int), files: make(map[*User]string)}
+	for _, filename := range files {
+		store := s.storeFor(filename)
+		users, err := store.Load()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		fileReport := store.LastLoadReport()
+		for _, skipped := range fileReport.Skipped {
+			skipped.File = filename
+			report.Skipped = append(report.Skipped, skipped)
+		}
+		for _, user := range users {
+			report.lines[user] = fileReport.lineOf(user)
+			report.files[user] = filename
+		}
+		result = append(result, users...)
+	}
+	result, err = s.resolveConflicts(result, &report)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range result {
+		addOrigin(origin, user, report.fileOf(user))
+	}
+	s.files = files
+	s.origin = origin
+	s.report = report
+	return result, nil
+}
+
+// Apply the conflict policy to the users, in file order, noting each
+// resolution in the report. Users of the same level or file are left to
+// the duplicate check of the authenticator.
+func (s *MultiFileUserStore) resolveConflicts(users []*User, report *LoadReport) ([]*User, error) {
+	if s.conflicts == ConflictFirstFileWins {
+		return users, nil
+	}
+	owners := make(map[string]*User) // By code, of the users kept so far.
+	dropped := make(map[*User]bool)
+	position := func(user *User) string {
+		return filePosition(report.fileOf(user), report.lineOf(user))
+	}
+	for _, user := range users {
+		var rivals []*User
+		for _, code := range user.Codes {
+			rival := owners[code]
+			if rival == nil || dropped[rival] || rival.UserLevel == user.UserLevel ||
+				report.fileOf(rival) == report.fileOf(user) {
+				continue
+			}
+			if s.conflicts == ConflictReject {
+				return nil, fmt.Errorf("%s '%s' (%s) and %s '%s' (%s) have a code in common",
+					rival.UserLevel, logName(rival.Name), position(rival),
+					user.UserLevel, logName(user.Name), position(user))
+			}
+			rivals = append(rivals, rival)
+		}
+		// The first file wins among equals.
+		var winner *User
+		for _, rival := range rivals {
+			if levelRank[rival.UserLevel] >= levelRank[user.UserLevel] {
+				winner = rival
+				break
+			}
+		}
+		if winner != nil {
+			dropped[user] = true
+			report.Conflicts = append(report.Conflicts, newLevelConflict(winner, user, report))
+			continue
+		}
+		for _, rival := range rivals {
+			if !dropped[rival] {
+				dropped[rival] = true
+				report.Conflicts = append(report.Conflicts, newLevelConflict(user, rival, report))
+			}
+		}
+		for _, code := range user.Codes {
+			if owner := owners[code]; owner == nil || dropped[owner] {
+				owners[code] = user
+			}
+		}
+	}
+	var result []*User
+	for _, user := range users {
+		if !dropped[user] {
+			result = append(result, user)
+		}
+	}
+	return result, nil
+}
+
+func newLevelConflict(kept *User, dropped *User, report *LoadReport) LevelConflict {
+	return LevelConflict{
+		Kept: kept.Name, KeptLevel: kept.UserLevel,
+		KeptFile: report.fileOf(kept), KeptLine: report.lineOf(kept),
+		Dropped: dropped.Name, DroppedLevel: dropped.UserLevel,
+		DroppedFile: report.fileOf(dropped), DroppedLine: report.lineOf(dropped),
+	}
+}
+
+func (s *MultiFileUserStore) LastLoadReport() LoadReport {
+	return s.report
+}
+
+// Latest change of any of the files or the directories globbed, so that
+// files added or removed there count as a change.
+func (s *MultiFileUserStore) Version() (time.Time, error) {
+	files, err := s.filenames()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var latest time.Time
+	dirs := make(map[string]bool)
+	for _, pattern := range s.patterns {
+		if strings.ContainsAny(pattern, "*?[") {
+			dirs[filepath.Dir(pattern)] = true
+		}
+	}
+	for _, filename := range files {
+		fileinfo, err := os.Stat(filename)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fileinfo.ModTime().After(latest) {
+			latest = fileinfo.ModTime()
+		}
+	}
+	for dir := range dirs {
+		if fileinfo, err := os.Stat(dir); err == nil && fileinfo.ModTime().After(latest) {
+			latest = fileinfo.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (s *MultiFileUserStore) newUserFile() (string, error) {
+	if s.newUsers != "" {
+		return s.newUsers, nil
+	}
+	files := s.files
+	if len(files) == 0 {
+		var err error
+		if files, err = s.filenames(); err != nil {
+			return "", err
+		}
+	}
+	return files[len(files)-1], nil
+}
+
+// Append the user to the file of new users.
+func (s *MultiFileUserStore) Append(user *User) error {
+	filename, err := s.newUserFile()
+	if err != nil {
+		return err
+	}
+	if err = s.storeFor(filename).Append(user); err != nil {
+		return err
+	}
+	addOrigin(s.origin, user, filename)
+	return nil
+}
+
+// Write each user back to the file it was loaded from, new ones to the
+// file of new users. Files are written one after the other; if one fails,
+// we stop there, but those before it have been written already.
+func (s *MultiFileUserStore) ReplaceAll(users []*User) error {
+	newUsers, err := s.newUserFile()
+	if err != nil {
+		return err
+	}
+	byFile := make(map[string][]*User)
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		filename := s.fileOf(user, newUsers)
+		byFile[filename] = append(byFile[filename], user)
+	}
+	files := s.files
+	if _, listed := byFile[newUsers]; listed && !containsString(files, newUsers) {
+		files = append(files, newUsers)
+	}
+	for _, filename := range files {
+		// Also the files whose users are all gone.
+		if err := s.storeFor(filename).ReplaceAll(byFile[filename]); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	for _, user := range byFile[newUsers] {
+		addOrigin(s.origin, user, newUsers)
+	}
+	return nil
+}
+
+// Where the user was loaded from, recognized by name or, if renamed, by
+// code. Unknown users go to newUsers.
+func (s *MultiFileUserStore) fileOf(user *User, newUsers string) string {
+	if filename, known := s.origin[user.Name]; known {
+		return filename
+	}
+	for _, code := range user.Codes {
+		if filename, known := s.origin[code]; known {
+			return filename
+		}
+	}
+	return newUsers
+}
+
+// Remember where the user is, unless known already; the first file with
+// a name or code wins, like with duplicate codes.
+func addOrigin(origin map[string]string, user *User, filename string) {
+	for _, key := range append([]string{user.Name}, user.Codes...) {
+		if _, seen := origin[key]; !seen {
+			origin[key] = filename
+		}
+	}
+}
+
+func containsString(list []string, element string) bool {
+	for _, candidate := range list {
+		if candidate == element {
+			return true
+		}
+	}
+	return false
+}
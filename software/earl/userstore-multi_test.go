@@ -0,0 +1,146 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMultiFileUserStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "multi-users")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	os.Mkdir(dir+"/users.d", 0755)
+	ioutil.WriteFile(dir+"/users.d/1-members.csv", []byte(
+		"# Members\n"+
+			"root,root@nb,member,,,,"+hashAuthCode("root123")+"\n"+
+			"doe,doe@nb,member,,,,"+hashAuthCode("doe123")+"\n"), 0644)
+	ioutil.WriteFile(dir+"/users.d/2-guests.csv", []byte(
+		"# Guests\n"+
+			"roe,roe@nb,user,,,,"+hashAuthCode("doe123")+"\n"), 0644)
+	store := NewMultiFileUserStore(dir + "/users.d/*.csv")
+	auth, err := LoadFileBasedAuthenticator(store, NewApplicationBus(), &recordingLogger{}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ExpectTrue(t, auth.FindUser("root123") != nil, "Users of first file")
+
+	// Duplicates across files are reported like those in one.
+	duplicates := auth.LastLoadReport().Duplicates
+	ExpectTrue(t, len(duplicates) == 1, "Duplicate across files")
+	if len(duplicates) == 1 {
+		ExpectTrue(t, duplicates[0] == DuplicateCode{
+			User: "roe", File: dir + "/users.d/2-guests.csv", Line: 2,
+			Owner: "doe", OwnerFile: dir + "/users.d/1-members.csv", OwnerLine: 3},
+			duplicates[0].String())
+	}
+
+	// New users go to the last file, changed ones stay where they were.
+	guest := User{Name: "guest", ContactInfo: "guest@nb", UserLevel: LevelUser}
+	guest.SetAuthCode("guest123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", guest)), "Adding")
+	ExpectTrue(t, eatmsg(auth.UpdateUser("root123", "doe123", func(user *User) bool {
+		user.Name = "Jon Doe"
+		return true
+	})), "Renaming")
+	members, _ := ioutil.ReadFile(dir + "/users.d/1-members.csv")
+	guests, _ := ioutil.ReadFile(dir + "/users.d/2-guests.csv")
+	ExpectTrue(t, strings.HasPrefix(string(members), "# Members\nroot,") &&
+		strings.Contains(string(members), "\nJon Doe,"), "Renamed stays: "+string(members))
+	ExpectTrue(t, strings.HasPrefix(string(guests), "# Guests\n") &&
+		strings.Contains(string(guests), "\nguest,"), "New in last file: "+string(guests))
+
+	// Files added to the directory are picked up.
+	ioutil.WriteFile(dir+"/users.d/3-more.csv", []byte(
+		"moe,moe@nb,member,,,,"+hashAuthCode("moe123")+"\n"), 0644)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(dir+"/users.d", later, later)
+	ExpectTrue(t, auth.FindUser("moe123") != nil, "New file read")
+	ExpectTrue(t, auth.FindUser("guest123") != nil, "Others still there")
+
+	// A designated file for new users.
+	store.SetNewUserFile(dir + "/users.d/2-guests.csv")
+	other := User{Name: "other", ContactInfo: "other@nb", UserLevel: LevelUser}
+	other.SetAuthCode("other123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", other)), "Adding other")
+	guests, _ = ioutil.ReadFile(dir + "/users.d/2-guests.csv")
+	ExpectTrue(t, strings.Contains(string(guests), "\nother,"), "In designated file")
+}
+
+func TestMultiFileUserStoreErrors(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "multi-errors")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	_, err := NewMultiFileUserStore(dir + "/*.csv").Load()
+	ExpectTrue(t, err != nil, "No files")
+
+	ioutil.WriteFile(dir+"/a.csv", []byte(
+		"root,,member,,,,"+hashAuthCode("root123")+"\n"), 0644)
+	ioutil.WriteFile(dir+"/b.csv", []byte("doe,,user\n\"broken\n"), 0644)
+	store := NewMultiFileUserStore(dir+"/a.csv", dir+"/b.csv")
+	_, err = store.Load()
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "b.csv"),
+		"Broken file fails all")
+
+	ioutil.WriteFile(dir+"/b.csv", []byte("doe,,user\n"), 0644)
+	users, err := store.Load()
+	ExpectTrue(t, err == nil && len(users) == 1, "Malformed record skipped")
+	skipped := store.LastLoadReport().Skipped
+	ExpectTrue(t, len(skipped) == 1 && skipped[0].File == dir+"/b.csv" &&
+		skipped[0].Line == 1, "Skipped record with file")
+}
+
+func TestMultiFileConflictPolicy(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "multi-conflicts")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	// A stale guest pass of someone who became a member since.
+	guests, board := dir+"/1-guests.csv", dir+"/2-board.csv"
+	ioutil.WriteFile(guests, []byte(
+		"doe,doe@nb,guest,,,,"+hashAuthCode("doe123")+"\n"), 0644)
+	ioutil.WriteFile(board, []byte(
+		"root,root@nb,member,,,,"+hashAuthCode("root123")+"\n"+
+			"Jon Doe,doe@nb,member,,,,"+hashAuthCode("doe123")+"\n"), 0644)
+
+	_, err := ParseConflictPolicy("last-file-wins")
+	ExpectTrue(t, err != nil, "Unknown policy")
+
+	// As in a single file, the first one gets the code.
+	store := NewMultiFileUserStore(guests, board)
+	auth, err := LoadFileBasedAuthenticator(store, NewApplicationBus(), &recordingLogger{}, "")
+	ExpectTrue(t, err == nil && auth.FindUser("doe123").UserLevel == LevelGuest,
+		"First file wins")
+	report := auth.LastLoadReport()
+	ExpectTrue(t, len(report.Duplicates) == 1 && len(report.Conflicts) == 0,
+		"Reported as duplicate")
+
+	store = NewMultiFileUserStore(guests, board)
+	policy, _ := ParseConflictPolicy("highest-level-wins")
+	store.SetConflictPolicy(policy)
+	logger := &recordingLogger{}
+	auth, err = LoadFileBasedAuthenticator(store, NewApplicationBus(), logger, "")
+	ExpectTrue(t, err == nil && auth.FindUser("doe123").Name == "Jon Doe",
+		"Highest level wins")
+	report = auth.LastLoadReport()
+	ExpectTrue(t, len(report.Duplicates) == 0 && len(report.Conflicts) == 1, "Conflict reported")
+	if len(report.Conflicts) == 1 {
+		ExpectTrue(t, report.Conflicts[0] == LevelConflict{
+			Kept: "Jon Doe", KeptLevel: LevelMember, KeptFile: board, KeptLine: 2,
+			Dropped: "doe", DroppedLevel: LevelGuest, DroppedFile: guests, DroppedLine: 1},
+			report.Conflicts[0].String())
+	}
+	ExpectTrue(t, strings.Contains(strings.Join(logger.lines, "\n"), "Level conflict in"),
+		"Resolution logged")
+
+	store = NewMultiFileUserStore(guests, board)
+	policy, _ = ParseConflictPolicy("reject")
+	store.SetConflictPolicy(policy)
+	_, err = store.Load()
+	ExpectTrue(t, err != nil && strings.Contains(err.Error(), "have a code in common"),
+		"Rejected")
+}
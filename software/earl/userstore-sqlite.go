@@ -0,0 +1,333 @@
+//go:build sqlite
+
+// Users stored in a SQLite database. Needs cgo, so it is only built with
+// "go build -tags sqlite".
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const sqliteTimeFormat = "2006-01-02 15:04" // Same as in the CSV file.
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+	id                INTEGER PRIMARY KEY,
+	name              TEXT NOT NULL,
+	level             TEXT NOT NULL,
+	contact           TEXT NOT NULL DEFAULT '',
+	valid_from        TEXT NOT NULL DEFAULT '',
+	valid_to          TEXT NOT NULL DEFAULT '',
+	sponsors          TEXT NOT NULL DEFAULT '',
+	deny_message      TEXT NOT NULL DEFAULT '',
+	badge_printed     TEXT NOT NULL DEFAULT '',
+	badge_fingerprint TEXT NOT NULL DEFAULT '',
+	single_use        TEXT NOT NULL DEFAULT '', -- as in the CSV file
+	targets           TEXT NOT NULL DEFAULT '', -- of guests, ';' separated
+	duress_codes      TEXT NOT NULL DEFAULT '', -- hashed, ';' separated
+	hours             TEXT NOT NULL DEFAULT '', -- personal, "<from>-<to>"
+	disabled          INTEGER NOT NULL DEFAULT 0,
+	schedule          TEXT NOT NULL DEFAULT '', -- recurring, as in the CSV file
+	test_only         INTEGER NOT NULL DEFAULT 0,
+	anonymous         INTEGER NOT NULL DEFAULT 0
+);
+CREATE TABLE IF NOT EXISTS codes (
+	code     TEXT PRIMARY KEY,  -- hashed, see hashAuthCode()
+	user_id  INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+	position INTEGER NOT NULL,
+	issued   TEXT NOT NULL DEFAULT '',
+	type     TEXT NOT NULL DEFAULT '' -- card or pin; empty if unknown
+);
+CREATE INDEX IF NOT EXISTS codes_by_user ON codes(user_id);
+`
+
+// Users including their codes in a SQLite database. All changes are done in
+// a transaction, so the database is never left half-written.
+type SQLiteUserStore struct {
+	filename string
+	db       *sql.DB
+}
+
+func init() {
+	openSQLiteUserStore = func(filename string) (UserStore, error) {
+		return NewSQLiteUserStore(filename)
+	}
+}
+
+// Open the database, creating the schema if needed.
+func NewSQLiteUserStore(filename string) (*SQLiteUserStore, error) {
+	db, err := sql.Open("sqlite3", filename+"?_foreign_keys=on")
+	if err != nil {
+		return nil, err
+	}
+	if _, err = db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	for _, column := range []string{"single_use", "targets", "duress_codes", "hours"} {
+		err = addSQLiteColumn(db, "users", column, "TEXT NOT NULL DEFAULT ''")
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	err = addSQLiteColumn(db, "users", "disabled", "INTEGER NOT NULL DEFAULT 0")
+	if err == nil {
+		err = addSQLiteColumn(db, "codes", "type", "TEXT NOT NULL DEFAULT ''")
+	}
+	if err == nil {
+		err = addSQLiteColumn(db, "users", "schedule", "TEXT NOT NULL DEFAULT ''")
+	}
+	if err == nil {
+		err = addSQLiteColumn(db, "users", "test_only", "INTEGER NOT NULL DEFAULT 0")
+	}
+	if err == nil {
+		err = addSQLiteColumn(db, "users", "anonymous", "INTEGER NOT NULL DEFAULT 0")
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &SQLiteUserStore{filename: filename, db: db}, nil
+}
+
+func (s *SQLiteUserStore) String() string {
+	return s.filename
+}
+
+func (s *SQLiteUserStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *SQLiteUserStore) Load() ([]*User, error) {
+	rows, err := s.db.Query(`SELECT id, name, level, contact, valid_from,
+		valid_to, sponsors, deny_message, badge_printed, badge_fingerprint,
+		single_use, targets, duress_codes, hours, disabled, schedule,
+		test_only, anonymous FROM users ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []*User
+	byId := make(map[int64]*User)
+	for rows.Next() {
+		var id int64
+		user, err := scanSQLiteUser(rows, &id)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, user)
+		byId[id] = user
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	codes, err := s.db.Query(`SELECT user_id, code, issued, type FROM codes
+		ORDER BY user_id, position`)
+	if err != nil {
+		return nil, err
+	}
+	defer codes.Close()
+	for codes.Next() {
+		var id int64
+		var code, issued, codeType string
+		if err = codes.Scan(&id, &code, &issued, &codeType); err != nil {
+			return nil, err
+		}
+		if user := byId[id]; user != nil {
+			addSQLiteCode(user, code, issued, codeType)
+		}
+	}
+	return result, codes.Err()
+}
+
+// Look up the user with the given hashed code with an indexed query,
+// without loading all users. Returns nil if there is no such user.
+func (s *SQLiteUserStore) FindByCode(hashed_code string) (*User, error) {
+	var id int64
+	user, err := scanSQLiteUser(s.db.QueryRow(`SELECT u.id, u.name, u.level,
+		u.contact, u.valid_from, u.valid_to, u.sponsors, u.deny_message,
+		u.badge_printed, u.badge_fingerprint, u.single_use, u.targets,
+		u.duress_codes, u.hours, u.disabled, u.schedule, u.test_only,
+		u.anonymous
+		FROM codes c JOIN users u ON u.id = c.user_id
+		WHERE c.code = ?`, hashed_code), &id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	codes, err := s.db.Query(`SELECT code, issued, type FROM codes
+		WHERE user_id = ? ORDER BY position`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer codes.Close()
+	for codes.Next() {
+		var code, issued, codeType string
+		if err = codes.Scan(&code, &issued, &codeType); err != nil {
+			return nil, err
+		}
+		addSQLiteCode(user, code, issued, codeType)
+	}
+	return user, codes.Err()
+}
+
+func (s *SQLiteUserStore) Append(user *User) error {
+	return s.inTransaction(func(tx *sql.Tx) error {
+		return insertSQLiteUser(tx, user)
+	})
+}
+
+func (s *SQLiteUserStore) ReplaceAll(users []*User) error {
+	return s.inTransaction(func(tx *sql.Tx) error {
+		if _, err := tx.Exec("DELETE FROM codes"); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM users"); err != nil {
+			return err
+		}
+		for _, user := range users {
+			if user == nil {
+				continue
+			}
+			if err := insertSQLiteUser(tx, user); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *SQLiteUserStore) inTransaction(work func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	if err = work(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func insertSQLiteUser(tx *sql.Tx, user *User) error {
+	result, err := tx.Exec(`INSERT INTO users (name, level, contact,
+		valid_from, valid_to, sponsors, deny_message, badge_printed,
+		badge_fingerprint, single_use, targets, duress_codes, hours,
+		disabled, schedule, test_only, anonymous)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		user.Name, string(user.UserLevel), user.ContactInfo,
+		formatSQLiteTime(user.ValidFrom), formatSQLiteTime(user.ValidTo),
+		strings.Join(user.Sponsors, ";"), user.DenyMessage,
+		formatSQLiteTime(user.BadgePrinted), user.BadgeFingerprint,
+		user.singleUseField(), user.targetsField(),
+		strings.Join(user.DuressCodes, ";"), formatSQLiteHours(user.Hours),
+		user.Disabled, user.Schedule.String(), user.TestOnly, user.Anonymous)
+	if err != nil {
+		return err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	for i, code := range user.Codes {
+		codeType := ""
+		if user.CodeType(i) != FactorUnknown {
+			codeType = string(user.CodeType(i))
+		}
+		_, err = tx.Exec(`INSERT INTO codes (code, user_id, position, issued, type)
+			VALUES (?, ?, ?, ?, ?)`,
+			code, id, i, formatSQLiteTime(user.CodeIssueDate(i)), codeType)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Something we can get a user row from; sql.Row or sql.Rows.
+type sqliteScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSQLiteUser(row sqliteScanner, id *int64) (*User, error) {
+	var user User
+	var level, valid_from, valid_to, sponsors, badge_printed string
+	var single_use, targets, duress_codes, hours, schedule string
+	err := row.Scan(id, &user.Name, &level, &user.ContactInfo,
+		&valid_from, &valid_to, &sponsors, &user.DenyMessage,
+		&badge_printed, &user.BadgeFingerprint, &single_use, &targets,
+		&duress_codes, &hours, &user.Disabled, &schedule, &user.TestOnly,
+		&user.Anonymous)
+	if err != nil {
+		return nil, err
+	}
+	if user.Schedule, err = ParseRecurringSchedule(schedule); err != nil {
+		return nil, fmt.Errorf("Schedule of user '%s': %v", logName(user.Name), err)
+	}
+	user.UserLevel = Level(level)
+	user.ValidFrom = parseSQLiteTime(valid_from)
+	user.ValidTo = parseSQLiteTime(valid_to)
+	user.Sponsors = splitTrimmed(sponsors, ";")
+	user.BadgePrinted = parseSQLiteTime(badge_printed)
+	user.parseSingleUseField(single_use)
+	user.parseTargetsField(targets)
+	user.DuressCodes = parseCodeList(duress_codes)
+	if window, err := ParseHourWindow(hours); err == nil {
+		user.Hours = &window
+	}
+	return &user, nil
+}
+
+// Add a column that databases created by older versions don't have yet.
+func addSQLiteColumn(db *sql.DB, table string, column string, definition string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?",
+		table, column).Scan(&count)
+	if err != nil || count > 0 {
+		return err
+	}
+	_, err = db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition)
+	return err
+}
+
+// Types are only kept if any is known, like in the CSV file.
+func addSQLiteCode(user *User, code string, issued string, codeType string) {
+	user.Codes = append(user.Codes, code)
+	user.CodeIssueDates = append(user.CodeIssueDates, parseSQLiteTime(issued))
+	if codeType == "" && user.CodeTypes == nil {
+		return
+	}
+	for len(user.CodeTypes) < len(user.Codes)-1 {
+		user.CodeTypes = append(user.CodeTypes, FactorUnknown)
+	}
+	parsed, _ := parseCodeType(codeType)
+	user.CodeTypes = append(user.CodeTypes, parsed)
+}
+
+func formatSQLiteHours(hours *HourWindow) string {
+	if hours == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d-%d", hours.From, hours.To)
+}
+
+func formatSQLiteTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(sqliteTimeFormat)
+}
+
+func parseSQLiteTime(value string) time.Time {
+	t, _ := time.Parse(sqliteTimeFormat, value)
+	return t
+}
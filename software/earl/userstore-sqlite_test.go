@@ -0,0 +1,116 @@
+//go:build sqlite
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSQLiteUserStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sqlite-users")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+
+	// Some users in the old CSV.
+	csvFile := dir + "/users.csv"
+	issued, _ := time.Parse("2006-01-02 15:04", "2014-10-10 12:00")
+	root := User{Name: "root", ContactInfo: "root@nb", UserLevel: LevelMember,
+		Sponsors: []string{""}}
+	root.SetAuthCode("root123")
+	root.SetDuressCode("help123")
+	doe := User{Name: "Jon Doe", ContactInfo: "jon@nb", UserLevel: LevelUser,
+		Sponsors: []string{hashAuthCode("root123")}, ValidFrom: issued,
+		DenyMessage: "Talk to root", Hours: &HourWindow{18, 24}}
+	doe.Codes = []string{hashAuthCode("doe123"), hashAuthCode("doe456")}
+	doe.CodeIssueDates = []time.Time{issued, {}}
+	delivery := User{UserLevel: LevelUser, ValidFrom: issued,
+		SingleUse: true, UsedAt: issued, Disabled: true, TestOnly: true,
+		Anonymous: true}
+	delivery.SetAuthCode("delivery123")
+	delivery.Schedule, _ = ParseRecurringSchedule("fri 22-2")
+	writeUserFile(csvFile, []User{root, doe, delivery})
+
+	store, err := NewSQLiteUserStore(dir + "/users.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	count, err := ImportUsers(NewCSVUserStore(csvFile), store)
+	ExpectTrue(t, err == nil && count == 3, "Importing CSV")
+	_, err = ImportUsers(NewCSVUserStore(csvFile), store)
+	ExpectTrue(t, err != nil, "Import only into empty store")
+
+	// Same users as in the CSV file.
+	fromCSV, _ := NewCSVUserStore(csvFile).Load()
+	fromDB, err := store.Load()
+	ExpectTrue(t, err == nil, "Loading")
+	ExpectTrue(t, reflect.DeepEqual(fromCSV, fromDB), "Same users as CSV")
+
+	found, err := store.FindByCode(hashAuthCode("doe456"))
+	ExpectTrue(t, err == nil && found != nil && found.Name == "Jon Doe",
+		"Find by code")
+	ExpectTrue(t, reflect.DeepEqual(found, fromDB[1]), "Found complete user")
+	found, err = store.FindByCode(hashAuthCode("nosuch"))
+	ExpectTrue(t, err == nil && found == nil, "Unknown code")
+
+	// A failing change doesn't leave anything behind.
+	other := User{Name: "Other", UserLevel: LevelUser}
+	other.Codes = []string{hashAuthCode("doe123")}
+	ExpectTrue(t, store.ReplaceAll([]*User{&root, &doe, &other}) != nil,
+		"Duplicate code")
+	fromDB, _ = store.Load()
+	ExpectTrue(t, len(fromDB) == 3, "Unchanged after failed replace")
+
+	// Used by the authenticator.
+	auth := NewFileBasedAuthenticatorWithStore(store, NewApplicationBus())
+	ExpectTrue(t, auth.FindUser("doe123") != nil, "Auth finds user")
+	u := User{Name: "New User", UserLevel: LevelUser}
+	u.SetAuthCode("new123")
+	ExpectTrue(t, eatmsg(auth.AddNewUser("root123", u)), "Adding")
+	ExpectTrue(t, eatmsg(auth.DeleteUser("root123", "doe123")), "Deleting")
+	found, _ = store.FindByCode(hashAuthCode("new123"))
+	ExpectTrue(t, found != nil, "Added user stored")
+	found, _ = store.FindByCode(hashAuthCode("doe456"))
+	ExpectTrue(t, found == nil, "Deleted user's codes gone")
+}
+
+func TestSQLiteUserStoreAddsNewColumns(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "sqlite-upgrade")
+	if !keepGeneratedFiles {
+		defer os.RemoveAll(dir)
+	}
+	// Users table as created by versions before single-use codes.
+	db, _ := sql.Open("sqlite3", dir+"/users.db")
+	_, err := db.Exec(`CREATE TABLE users (
+		id INTEGER PRIMARY KEY, name TEXT NOT NULL, level TEXT NOT NULL,
+		contact TEXT NOT NULL DEFAULT '', valid_from TEXT NOT NULL DEFAULT '',
+		valid_to TEXT NOT NULL DEFAULT '', sponsors TEXT NOT NULL DEFAULT '',
+		deny_message TEXT NOT NULL DEFAULT '',
+		badge_printed TEXT NOT NULL DEFAULT '',
+		badge_fingerprint TEXT NOT NULL DEFAULT '');
+		INSERT INTO users (name, level) VALUES ('root', 'member');`)
+	db.Close()
+	ExpectTrue(t, err == nil, "Creating old database")
+
+	store, err := NewSQLiteUserStore(dir + "/users.db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	users, err := store.Load()
+	ExpectTrue(t, err == nil && len(users) == 1, "Old users still there")
+	once := User{Name: "once", UserLevel: LevelGuest, SingleUse: true,
+		Targets: []Target{TargetDownstairs}}
+	once.SetAuthCode("once123")
+	ExpectTrue(t, store.Append(&once) == nil, "Storing single-use user")
+	found, _ := store.FindByCode(hashAuthCode("once123"))
+	ExpectTrue(t, found != nil && found.SingleUse, "Single-use stored")
+	ExpectTrue(t, found.HasTarget(TargetDownstairs), "Guest targets stored")
+}
@@ -0,0 +1,577 @@
+// Storage of users. The authenticator keeps all users in memory and only
+// needs to load them or write them back; a UserStore does the actual work.
+// The CSVUserStore is the classic user file.
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+type UserStore interface {
+	// Load all users.
+	Load() ([]*User, error)
+
+	// Add a single user to the stored ones.
+	Append(user *User) error
+
+	// Replace all stored users with the given ones.
+	ReplaceAll(users []*User) error
+}
+
+// Stores that can be changed behind our back, e.g. by editing the user file,
+// implement this, so that we know when to reload.
+type VersionedUserStore interface {
+	UserStore
+
+	// Returns something that changes whenever the content changes.
+	Version() (time.Time, error)
+}
+
+// Users stored in a CSV file, one user per line. See User.WriteCSV() for
+// the format. Writes are atomic: we write a temp file and rename it.
+// Comments survive rewrites, see csvLayout.
+type CSVUserStore struct {
+	filename string
+	comma    rune       // Field delimiter.
+	comment  rune       // Lines starting with it are comments; 0 for none.
+	layout   csvLayout  // As of the last Load() or write.
+	report   LoadReport // Of the last Load().
+	backups  int        // Kept by ReplaceAll(); 0: none.
+	version  int        // Of the layout, see CSVVersion.
+}
+
+// Stores that can tell what they left out when loading implement this.
+type ReportingUserStore interface {
+	UserStore
+
+	// Report of the last successful Load().
+	LastLoadReport() LoadReport
+}
+
+// What Load() left out of the file, so that whoever edited it learns about
+// a typo before the users it dropped find out at the door.
+type LoadReport struct {
+	Skipped    []MalformedRecordError // In file order.
+	Duplicates []DuplicateCode        // Filled in by the authenticator.
+	Conflicts  []LevelConflict        // Resolved by the store.
+
+	lines map[*User]int    // Where the users were, if the store knows.
+	files map[*User]string // Only for stores with several files.
+}
+
+// A user not loaded as one of their codes is already someone else's. Lines
+// are 0 for stores without lines, files empty for stores with just one.
+type DuplicateCode struct {
+	User      string
+	File      string
+	Line      int
+	Owner     string // Who got the code first.
+	OwnerFile string
+	OwnerLine int
+}
+
+func (d DuplicateCode) String() string {
+	return fmt.Sprintf("user '%s' (%s) has a code of '%s' (%s)",
+		d.User, filePosition(d.File, d.Line),
+		d.Owner, filePosition(d.OwnerFile, d.OwnerLine))
+}
+
+// Users in two files with a code in common, but of different levels, of
+// which the store kept one, see ConflictPolicy.
+type LevelConflict struct {
+	Kept         string
+	KeptLevel    Level
+	KeptFile     string
+	KeptLine     int
+	Dropped      string
+	DroppedLevel Level
+	DroppedFile  string
+	DroppedLine  int
+}
+
+func (c LevelConflict) String() string {
+	return fmt.Sprintf("kept %s '%s' (%s) over %s '%s' (%s) with a code in common",
+		c.KeptLevel, c.Kept, filePosition(c.KeptFile, c.KeptLine),
+		c.DroppedLevel, c.Dropped, filePosition(c.DroppedFile, c.DroppedLine))
+}
+
+// "line 3" or "users.csv:3".
+func filePosition(file string, line int) string {
+	if file == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", file, line)
+}
+
+// Line in the file the user was read from; 0 if unknown.
+func (r *LoadReport) lineOf(user *User) int {
+	return r.lines[user]
+}
+
+// File the user was read from; empty if unknown or there is just one.
+func (r *LoadReport) fileOf(user *User) string {
+	return r.files[user]
+}
+
+// Operators curate the user file by hand, so we keep what is not a user -
+// comments, blank lines, lines we don't understand - verbatim, each block
+// attached to the user that followed it in the file. On rewrite, a block is
+// emitted before that user again, or, if that user is gone or renamed,
+// before the next one still there.
+type csvLayout struct {
+	names    []string // Users in file order.
+	before   [][]byte // Lines before names[i].
+	trailing []byte   // Lines after the last user.
+}
+
+func NewCSVUserStore(filename string) *CSVUserStore {
+	return &CSVUserStore{filename: filename, comma: ',', comment: '#'}
+}
+
+// Use another field delimiter and comment character than ',' and '#', e.g.
+// for files exported with a locale that separates by ';'. A comment of 0
+// means there are no comments. Lists within fields stay ';' separated; the
+// writer quotes those fields if ';' is the delimiter.
+func (s *CSVUserStore) SetDelimiter(comma rune, comment rune) error {
+	if err := validateCSVDelimiter(comma, comment); err != nil {
+		return err
+	}
+	s.comma = comma
+	s.comment = comment
+	return nil
+}
+
+func validateCSVDelimiter(comma rune, comment rune) error {
+	if !validCSVRune(comma) || (comment != 0 && !validCSVRune(comment)) {
+		return fmt.Errorf("Invalid CSV delimiter %q or comment %q", comma, comment)
+	}
+	if comma == comment {
+		return errors.New("CSV delimiter and comment need to differ")
+	}
+	return nil
+}
+
+// Same restrictions as encoding/csv has.
+func validCSVRune(r rune) bool {
+	return r != 0 && r != '"' && r != '\r' && r != '\n' &&
+		utf8.ValidRune(r) && r != utf8.RuneError
+}
+
+// Before each rewrite of the whole file, copy it to a backup next to it,
+// <filename>.YYYYMMDD-HHMMSS.bak, and keep the given number of the latest
+// of these. Restoring is renaming a backup back. Rewrites fail if the
+// backup fails. Appending users doesn't replace any, so it is not
+// backed up. 0, the default, disables.
+func (s *CSVUserStore) SetBackups(keep int) {
+	s.backups = keep
+}
+
+func (s *CSVUserStore) newReader(content []byte) *csv.Reader {
+	reader := csv.NewReader(bytes.NewReader(content))
+	reader.FieldsPerRecord = -1 //variable length fields
+	reader.Comma = s.comma
+	reader.Comment = s.comment
+	return reader
+}
+
+func (s *CSVUserStore) newWriter(out io.Writer) *csv.Writer {
+	writer := csv.NewWriter(out)
+	writer.Comma = s.comma
+	return writer
+}
+
+func (s *CSVUserStore) String() string {
+	return s.filename
+}
+
+func (s *CSVUserStore) Filename() string {
+	return s.filename
+}
+
+func (s *CSVUserStore) Load() ([]*User, error) {
+	if s.filename == "" {
+		return nil, errors.New("RFID-user file not provided")
+	}
+	content, err := ioutil.ReadFile(s.filename)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := s.newReader(content)
+	var result []*User
+	var layout csvLayout
+	var pending []byte // Non-user lines since the last user.
+	var offset int64
+	offsetLine := 1 // Line at offset.
+	report := LoadReport{lines: make(map[*User]int)}
+	version, err := s.readVersionHeader(content)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", s.filename, err)
+	}
+	if version > 0 {
+		reader.Read() // Written again with rewrites.
+		offset = reader.InputOffset()
+		offsetLine = 2
+	}
+	for {
+		user, done, err := NewUserFromCSVVersion(reader, version)
+		var malformed *MalformedRecordError
+		if errors.As(err, &malformed) {
+			report.Skipped = append(report.Skipped, *malformed)
+		} else if err != nil {
+			return nil, err // Rather nothing than half of the users.
+		}
+		if done {
+			layout.trailing = append(pending, content[offset:]...)
+			if n := len(layout.trailing); n > 0 && layout.trailing[n-1] != '\n' {
+				layout.trailing = append(layout.trailing, '\n')
+			}
+			break
+		}
+		raw := content[offset:reader.InputOffset()]
+		offset = reader.InputOffset()
+		rawLine := offsetLine
+		offsetLine += bytes.Count(raw, []byte{'\n'})
+		if user == nil {
+			// Comment or malformed; kept verbatim either way.
+			pending = append(pending, raw...)
+			continue
+		}
+		// Blank lines and comments the reader skipped before the user
+		// are ours.
+		line, _ := reader.FieldPos(0)
+		skipped := lineStart(raw, rawLine, line)
+		layout.names = append(layout.names, user.Name)
+		layout.before = append(layout.before, append(pending, raw[:skipped]...))
+		pending = nil
+		report.lines[user] = line
+		result = append(result, user)
+	}
+	s.layout = layout
+	s.report = report
+	s.version = version
+	return result, nil
+}
+
+// Version of the layout according to the header on the first line; 0
+// without.
+func (s *CSVUserStore) readVersionHeader(content []byte) (int, error) {
+	if end := bytes.IndexByte(content, '\n'); end >= 0 {
+		content = content[:end+1]
+	}
+	record, err := s.newReader(content).Read()
+	if err != nil {
+		return 0, nil // Not a header, whatever it is.
+	}
+	version, _, err := parseCSVVersionHeader(record)
+	return version, err
+}
+
+func (s *CSVUserStore) versionHeader(version int) []byte {
+	var buffer bytes.Buffer
+	writer := s.newWriter(&buffer)
+	writer.Write([]string{csvVersionHeader, strconv.Itoa(version)})
+	writer.Flush()
+	return buffer.Bytes()
+}
+
+// Rewrite the file in the latest layout, keeping comments and malformed
+// lines as usual. Nothing to do if it already is.
+func (s *CSVUserStore) Migrate() error {
+	users, err := s.Load()
+	if err != nil {
+		return err
+	}
+	if s.version == CSVVersion {
+		return nil
+	}
+	s.version = CSVVersion
+	return s.ReplaceAll(users)
+}
+
+// Migrate the file with the usual delimiters to the latest layout.
+func MigrateFile(filename string) error {
+	return NewCSVUserStore(filename).Migrate()
+}
+
+func (s *CSVUserStore) LastLoadReport() LoadReport {
+	return s.report
+}
+
+// Offset of the given line in raw, which starts with line first.
+func lineStart(raw []byte, first int, line int) int {
+	start := 0
+	for ; first < line; first++ {
+		next := bytes.IndexByte(raw[start:], '\n')
+		if next < 0 {
+			return len(raw)
+		}
+		start += next + 1
+	}
+	return start
+}
+
+// Timestamp of the file.
+func (s *CSVUserStore) Version() (time.Time, error) {
+	fileinfo, err := os.Stat(s.filename)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fileinfo.ModTime(), nil
+}
+
+// Append the user. The existing content is kept as-is, including comments,
+// but still written atomically, so that a crash can't leave a truncated
+// last record. The version header of an older layout is updated, as the
+// user might have fields it doesn't.
+func (s *CSVUserStore) Append(user *User) error {
+	content, err := ioutil.ReadFile(s.filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if version, err := s.readVersionHeader(content); err != nil {
+		return err
+	} else if version > 0 && version < CSVVersion {
+		end := bytes.IndexByte(content, '\n')
+		if end < 0 {
+			end = len(content) - 1
+		}
+		content = append(s.versionHeader(CSVVersion), content[end+1:]...)
+	}
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		content = append(content, '\n')
+	}
+	buffer := bytes.NewBuffer(content)
+	writer := s.newWriter(buffer)
+	user.WriteCSV(writer)
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	if err := s.replaceContent(buffer.Bytes()); err != nil {
+		return err
+	}
+	if s.version > 0 {
+		s.version = CSVVersion
+	}
+	// The trailing lines now come before the new user.
+	s.layout.names = append(s.layout.names, user.Name)
+	s.layout.before = append(s.layout.before, s.layout.trailing)
+	s.layout.trailing = nil
+	return nil
+}
+
+func (s *CSVUserStore) ReplaceAll(users []*User) error {
+	present := make(map[string]bool)
+	for _, user := range users {
+		if user != nil {
+			present[user.Name] = true
+		}
+	}
+	// Move lines of users that are gone to the next one that is not.
+	placed := make(map[string][]byte)
+	var carry []byte
+	for i, name := range s.layout.names {
+		carry = append(carry, s.layout.before[i]...)
+		if present[name] && placed[name] == nil && len(carry) > 0 {
+			placed[name] = carry
+			carry = nil
+		}
+	}
+	carry = append(carry, s.layout.trailing...)
+
+	var layout csvLayout
+	var buffer bytes.Buffer
+	writer := s.newWriter(&buffer)
+	version := s.version
+	if version > 0 {
+		// Layouts only add fields, so all users fit the latest.
+		version = CSVVersion
+		buffer.Write(s.versionHeader(version))
+	}
+	for _, user := range users {
+		if user == nil {
+			continue
+		}
+		lines := placed[user.Name]
+		delete(placed, user.Name)
+		writer.Flush()
+		buffer.Write(lines)
+		user.WriteCSV(writer)
+		layout.names = append(layout.names, user.Name)
+		layout.before = append(layout.before, lines)
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	buffer.Write(carry)
+	layout.trailing = carry
+	if err := s.backup(time.Now()); err != nil {
+		return fmt.Errorf("Not writing %s without backup: %v", s.filename, err)
+	}
+	if err := s.replaceContent(buffer.Bytes()); err != nil {
+		return err
+	}
+	s.layout = layout
+	s.version = version
+	return nil
+}
+
+const csvBackupSuffix = ".bak"
+
+// Copy the file to a backup and prune the old ones. Nothing to do if there
+// is no file yet. Within the same second, the first backup is kept: it has
+// what was there before.
+func (s *CSVUserStore) backup(now time.Time) error {
+	if s.backups <= 0 {
+		return nil
+	}
+	content, err := ioutil.ReadFile(s.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	backup := s.filename + "." + now.Format("20060102-150405") + csvBackupSuffix
+	if _, err := os.Stat(backup); os.IsNotExist(err) {
+		if err := writeFileSynced(backup, content, s.filename); err != nil {
+			return err
+		}
+	}
+	backups, err := s.listBackups()
+	if err != nil {
+		return err
+	}
+	for len(backups) > s.backups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// Backups of the file, oldest first.
+func (s *CSVUserStore) listBackups() ([]string, error) {
+	dir := filepath.Dir(s.filename)
+	prefix := filepath.Base(s.filename) + "."
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, csvBackupSuffix) {
+			continue
+		}
+		stamp := strings.TrimSuffix(strings.TrimPrefix(name, prefix), csvBackupSuffix)
+		if _, err := time.Parse("20060102-150405", stamp); err == nil {
+			result = append(result, filepath.Join(dir, name))
+		}
+	}
+	sort.Strings(result) // Timestamps sort by time.
+	return result, nil
+}
+
+// Write the file with the permissions of like, as it has the same content.
+func writeFileSynced(filename string, content []byte, like string) error {
+	var perm os.FileMode = 0644
+	if fileinfo, err := os.Stat(like); err == nil {
+		perm = fileinfo.Mode().Perm()
+	}
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(filename)
+		return err
+	}
+	return f.Close()
+}
+
+// Write content to a temp file in the same directory, with the permissions
+// of the existing file, then atomically rename it over the user file. On any
+// error, the original file is left untouched.
+func (s *CSVUserStore) replaceContent(content []byte) (err error) {
+	var perm os.FileMode = 0644
+	if fileinfo, err := os.Stat(s.filename); err == nil {
+		perm = fileinfo.Mode().Perm()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(s.filename),
+		filepath.Base(s.filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpFilename := f.Name()
+	defer func() {
+		if err != nil {
+			os.Remove(tmpFilename)
+		}
+	}()
+
+	if _, err = f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Chmod(tmpFilename, perm); err != nil {
+		return err
+	}
+
+	// Alright, good. Atomic rename.
+	return os.Rename(tmpFilename, s.filename)
+}
+
+// Open a SQLite user store. Only available if built with -tags sqlite,
+// nil otherwise.
+var openSQLiteUserStore func(filename string) (UserStore, error)
+
+// One-time migration, e.g. of a CSV user file into a database. Refuses to
+// overwrite a store that already has users. Returns the number of users
+// imported.
+func ImportUsers(from UserStore, to UserStore) (int, error) {
+	existing, err := to.Load()
+	if err != nil {
+		return 0, err
+	}
+	if len(existing) > 0 {
+		return 0, fmt.Errorf("%v already has %d users", to, len(existing))
+	}
+	users, err := from.Load()
+	if err != nil {
+		return 0, err
+	}
+	if err = to.ReplaceAll(users); err != nil {
+		return 0, err
+	}
+	return len(users), nil
+}